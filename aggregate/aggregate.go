@@ -0,0 +1,162 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+// Package aggregate defines the aggregation tasks, which combine several models into a new one
+// (e.g. federated averaging over the models trained by several data owners).
+//
+// An aggregation task runs the "aggregate" entrypoint of either the algo or the problem workflow
+// container over the untarred input models, and the resulting model records its lineage.
+package aggregate
+
+import (
+	"fmt"
+
+	"github.com/satori/go.uuid"
+)
+
+// Topic is the broker topic of normal priority aggregation tasks (see priority.Topic)
+const Topic = "aggregate"
+
+// Containers providing the aggregate entrypoint
+const (
+	EntrypointAlgo    = "algo"
+	EntrypointProblem = "problem"
+)
+
+// LineageFile is the file of the aggregated model folder holding its Lineage
+const LineageFile = "lineage.json"
+
+// Aggregateuplet is an aggregation task: Models are combined into ModelEnd (by the algo's
+// container unless Entrypoint says otherwise), each with its weight if Weights are given
+type Aggregateuplet struct {
+	Key        string      `json:"key"`
+	Problem    uuid.UUID   `json:"problem"`
+	Algo       uuid.UUID   `json:"algo"`
+	Models     []uuid.UUID `json:"models"`
+	Weights    []float64   `json:"weights,omitempty"`
+	ModelEnd   uuid.UUID   `json:"model_end"`
+	Rank       int         `json:"rank"`
+	Entrypoint string      `json:"entrypoint,omitempty"`
+}
+
+// Check validates an aggregation task
+func (a *Aggregateuplet) Check() error {
+	switch {
+	case a.Key == "":
+		return fmt.Errorf("key is required")
+	case uuid.Equal(a.Problem, uuid.Nil):
+		return fmt.Errorf("problem is required")
+	case uuid.Equal(a.Algo, uuid.Nil):
+		return fmt.Errorf("algo is required")
+	case uuid.Equal(a.ModelEnd, uuid.Nil):
+		return fmt.Errorf("model_end is required")
+	case len(a.Models) < 2:
+		return fmt.Errorf("at least 2 models are required, got %d", len(a.Models))
+	case len(a.Weights) > 0 && len(a.Weights) != len(a.Models):
+		return fmt.Errorf("%d weights given for %d models", len(a.Weights), len(a.Models))
+	case a.Rank < 0:
+		return fmt.Errorf("rank can't be negative")
+	}
+	if a.Entrypoint != "" && a.Entrypoint != EntrypointAlgo && a.Entrypoint != EntrypointProblem {
+		return fmt.Errorf("invalid entrypoint %q, expected %q or %q", a.Entrypoint, EntrypointAlgo, EntrypointProblem)
+	}
+
+	seen := make(map[string]bool, len(a.Models))
+	for _, model := range a.Models {
+		switch {
+		case uuid.Equal(model, uuid.Nil):
+			return fmt.Errorf("models can't be Nil uuids")
+		case uuid.Equal(model, a.ModelEnd):
+			return fmt.Errorf("model_end %s is one of the models", model)
+		case seen[model.String()]:
+			return fmt.Errorf("model %s is given twice", model)
+		}
+		seen[model.String()] = true
+	}
+	for _, weight := range a.Weights {
+		if weight < 0 {
+			return fmt.Errorf("weights can't be negative")
+		}
+	}
+	return nil
+}
+
+// Input is an input model of an aggregation, as described to the aggregate entrypoint
+type Input struct {
+	Model  uuid.UUID `json:"model"`
+	Weight float64   `json:"weight"`
+}
+
+// Inputs returns the input models along with their weight (equal weights summing to 1 if no
+// weights are given, weights normalized to sum to 1 otherwise)
+func (a *Aggregateuplet) Inputs() []Input {
+	total := 0.0
+	for _, weight := range a.Weights {
+		total += weight
+	}
+	inputs := make([]Input, 0, len(a.Models))
+	for i, model := range a.Models {
+		weight := 1 / float64(len(a.Models))
+		if len(a.Weights) > 0 && total > 0 {
+			weight = a.Weights[i] / total
+		}
+		inputs = append(inputs, Input{Model: model, Weight: weight})
+	}
+	return inputs
+}
+
+// Lineage records the models an aggregated model was produced from
+type Lineage struct {
+	Key        string    `json:"key"`
+	Model      uuid.UUID `json:"model"`
+	Rank       int       `json:"rank"`
+	Entrypoint string    `json:"entrypoint"`
+	Inputs     []Input   `json:"inputs"`
+}
+
+// Lineage returns the lineage of the model produced by an aggregation task
+func (a *Aggregateuplet) Lineage() Lineage {
+	entrypoint := a.Entrypoint
+	if entrypoint == "" {
+		entrypoint = EntrypointAlgo
+	}
+	return Lineage{
+		Key:        a.Key,
+		Model:      a.ModelEnd,
+		Rank:       a.Rank,
+		Entrypoint: entrypoint,
+		Inputs:     a.Inputs(),
+	}
+}
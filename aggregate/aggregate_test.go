@@ -0,0 +1,64 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package aggregate
+
+import (
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInputs(t *testing.T) {
+	models := []uuid.UUID{uuid.NewV4(), uuid.NewV4()}
+	even := Aggregateuplet{Models: models}
+	inputs := even.Inputs()
+	assert.Equal(t, models[0], inputs[0].Model)
+	assert.Equal(t, 0.5, inputs[0].Weight)
+
+	weighted := Aggregateuplet{Models: models, Weights: []float64{300, 100}}
+	inputs = weighted.Inputs()
+	assert.Equal(t, 0.75, inputs[0].Weight)
+	assert.Equal(t, 0.25, inputs[1].Weight)
+}
+
+func TestLineage(t *testing.T) {
+	a := Aggregateuplet{Models: []uuid.UUID{uuid.NewV4(), uuid.NewV4()}, ModelEnd: uuid.NewV4()}
+	lineage := a.Lineage()
+	assert.Equal(t, EntrypointAlgo, lineage.Entrypoint)
+	assert.Equal(t, a.ModelEnd, lineage.Model)
+	assert.Len(t, lineage.Inputs, 2)
+}
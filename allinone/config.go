@@ -0,0 +1,274 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/api/server"
+	"github.com/MorpheoOrg/morpheo-compute/broker"
+	"github.com/MorpheoOrg/morpheo-compute/priority"
+	"github.com/MorpheoOrg/morpheo-compute/worker/compute"
+)
+
+// Storage, peer and container runtime backends
+const (
+	StorageMock = "mock"
+	StorageFS   = "fs"
+	StorageAPI  = "api"
+
+	PeerMock   = "mock"
+	PeerFS     = "fs"
+	PeerFabric = "fabric"
+
+	RuntimeDocker = "docker"
+	RuntimeMock   = "mock"
+)
+
+// AllInOneConfig holds the configuration of the API and of the worker, as well as the backends
+// they share
+type AllInOneConfig struct {
+	API    *server.ProducerConfig
+	Worker *compute.ConsumerConfig
+
+	// Root folder of the embedded broker, scheduled tasks, retraining schedules, task data and
+	// filesystem storage & peer
+	Folder string
+
+	Storage          string
+	Peer             string
+	PeerConfigFile   string
+	ContainerRuntime string
+}
+
+// NewAllInOneConfig parses CLI flags and generates the shared configuration
+func NewAllInOneConfig() *AllInOneConfig {
+	var (
+		hostname             string
+		port                 int
+		folder               string
+		brokerType           string
+		brokerRequeueDelay   time.Duration
+		brokerMaxAttempts    int
+		storage              string
+		storageHost          string
+		storagePort          int
+		storageUser          string
+		storagePassword      string
+		peer                 string
+		peerConfigFile       string
+		containerRuntime     string
+		dockerTimeout        time.Duration
+		learnParallelism     int
+		predictParallelism   int
+		aggregateParallelism int
+		evaluateParallelism  int
+		learnTimeout         time.Duration
+		predictTimeout       time.Duration
+		aggregateTimeout     time.Duration
+		evaluateTimeout      time.Duration
+		priorityWeights      common.MultiStringFlag
+		journalMaxAge        time.Duration
+		startModelWait       time.Duration
+		checkpointInterval   time.Duration
+		defaultPriority      string
+		problemPriorities    common.MultiStringFlag
+		readyTimeout         time.Duration
+		servingConcurrency   int
+		servingMaxModels     int
+		servingIdleTimeout   time.Duration
+		servingStartTimeout  time.Duration
+		servingReqTimeout    time.Duration
+		servingHealthInterv  time.Duration
+		traceExporter        string
+		traceFile            string
+		traceEndpoint        string
+	)
+
+	// CLI Flags
+	flag.StringVar(&hostname, "host", "0.0.0.0", "The hostname our server will be listening on")
+	flag.IntVar(&port, "port", 8000, "The port our compute API will be listening on")
+	flag.StringVar(&folder, "dir", "/tmp/compute", "Root folder of the embedded broker, scheduled tasks, retraining schedules, task data and filesystem storage & peer")
+	flag.StringVar(&brokerType, "broker", broker.BrokerMemory, "Broker type to use ('memory' or 'embedded', to keep tasks across restarts)")
+	flag.DurationVar(&brokerRequeueDelay, "broker-requeue-delay", 10*time.Second, "Delay before failed tasks are retried, multiplied by the number of attempts")
+	flag.IntVar(&brokerMaxAttempts, "broker-max-attempts", 5, "Number of attempts after which a task is given up on (0 for no limit)")
+	flag.StringVar(&storage, "storage", StorageMock, "Storage to use ('mock', 'fs' to read and write blobs in <dir>/storage or 'api')")
+	flag.StringVar(&storageHost, "storage-host", "storage", "Hostname of the storage API (-storage api only)")
+	flag.IntVar(&storagePort, "storage-port", 80, "TCP port to contact storage on (-storage api only)")
+	flag.StringVar(&storageUser, "storage-user", "u", "Basic Authentication username of the storage API")
+	flag.StringVar(&storagePassword, "storage-password", "p", "Basic Authentication password of the storage API")
+	flag.StringVar(&peer, "peer", PeerMock, "Peer to use ('mock', 'fs' to read and write uplets in <dir>/peer or 'fabric')")
+	flag.StringVar(&peerConfigFile, "peer-config", "secrets/config.yaml", "Configuration file of the peer client (-peer fabric only)")
+	flag.StringVar(&containerRuntime, "container-runtime", RuntimeDocker, "Container runtime to use ('docker' or 'mock')")
+	flag.DurationVar(&dockerTimeout, "docker-timeout", 15*time.Minute, "Docker commands timeout (concerns builds, runs, pulls, etc...)")
+	flag.IntVar(&learnParallelism, "learn-parallelism", 1, "Number of learning task that this worker can execute in parallel.")
+	flag.IntVar(&predictParallelism, "predict-parallelism", 1, "Number of prediction task that this worker can execute in parallel.")
+	flag.DurationVar(&learnTimeout, "learn-timeout", 20*time.Minute, "After this delay, learning tasks are timed out")
+	flag.DurationVar(&predictTimeout, "predict-timeout", 20*time.Minute, "After this delay, prediction tasks are timed out")
+	flag.IntVar(&aggregateParallelism, "aggregate-parallelism", 1, "Number of aggregation task that this worker can execute in parallel.")
+	flag.DurationVar(&aggregateTimeout, "aggregate-timeout", 20*time.Minute, "After this delay, aggregation tasks are timed out")
+	flag.IntVar(&evaluateParallelism, "evaluate-parallelism", 1, "Number of evaluation task that this worker can execute in parallel.")
+	flag.DurationVar(&evaluateTimeout, "evaluate-timeout", 20*time.Minute, "After this delay, evaluation tasks are timed out")
+	flag.DurationVar(&journalMaxAge, "journal-max-age", 24*time.Hour, "How long failed learning tasks keep their workspace and journal, for their next attempt to resume at the stage that failed (0 disables journaling)")
+	flag.DurationVar(&startModelWait, "start-model-wait", 48*time.Hour, "Maximum time a chained learnuplet (rank > 0) waits for its start model since its submission, before being reported failed (0 for as long as the broker retries it)")
+	flag.DurationVar(&checkpointInterval, "checkpoint-interval", 10*time.Minute, "How often the checkpoint folder of training containers is uploaded to storage, for a redelivered learning task to resume from its latest checkpoint on any worker (0 disables checkpoints)")
+	flag.Var(&priorityWeights, "priority-weight", "Weight of a task priority when picking the next task to run, as <priority>=<weight> (0 to not consume it, defaults: high=6, normal=3, low=1)")
+	flag.StringVar(&defaultPriority, "default-priority", priority.Normal, "Priority of the tasks submitted without any, unless set for their problem ('high', 'normal' or 'low')")
+	flag.Var(&problemPriorities, "problem-priority", "Priority of the tasks of a problem submitted without any, as <problem UUID>=<priority>")
+	flag.DurationVar(&readyTimeout, "ready-timeout", 5*time.Second, "Timeout of each dependency check ran by the readiness probe")
+	flag.IntVar(&servingConcurrency, "serving-concurrency", 4, "Number of online prediction requests a served model handles at once (others get a 429)")
+	flag.IntVar(&servingMaxModels, "serving-max-models", 4, "Number of models loaded at once for online predictions, the least recently used idle one being unloaded to load another")
+	flag.DurationVar(&servingIdleTimeout, "serving-idle-timeout", 15*time.Minute, "Served models receiving no online prediction request for this long are unloaded")
+	flag.DurationVar(&servingStartTimeout, "serving-start-timeout", 2*time.Minute, "Served models whose container isn't healthy after this delay fail to load")
+	flag.DurationVar(&servingReqTimeout, "serving-request-timeout", 30*time.Second, "After this delay, online prediction requests to a served model are timed out")
+	flag.DurationVar(&servingHealthInterv, "serving-health-interval", 30*time.Second, "Interval between two health checks of the served models")
+	flag.StringVar(&traceExporter, "trace-exporter", "none", "Trace exporter to use ('none', 'stdout', 'file' or 'otlp')")
+	flag.StringVar(&traceFile, "trace-file", "traces.json", "File the 'file' trace exporter appends spans to")
+	flag.StringVar(&traceEndpoint, "trace-endpoint", "http://otel-collector:4318", "OTLP/HTTP collector the 'otlp' trace exporter posts spans to")
+	flag.Parse()
+
+	brokerFolder := filepath.Join(folder, "broker")
+
+	weights, err := priority.ParseWeights(priorityWeights)
+	if err != nil {
+		log.Panicf("Error parsing -priority-weight flags: %s", err)
+	}
+	problemPriority, err := server.ParseProblemPriorities(defaultPriority, problemPriorities)
+	if err != nil {
+		log.Panicf("Error parsing -problem-priority flags: %s", err)
+	}
+	if servingConcurrency < 1 {
+		log.Panicf("Error: -serving-concurrency must be at least 1, got %d", servingConcurrency)
+	}
+	if servingMaxModels < 1 {
+		log.Panicf("Error: -serving-max-models must be at least 1, got %d", servingMaxModels)
+	}
+
+	// Only the storage API can be reached over HTTP (the filesystem storage is plugged in directly)
+	var storageEndpoints []string
+	if storage == StorageAPI {
+		storageEndpoints = append(storageEndpoints, fmt.Sprintf("http://%s:%d", storageHost, storagePort))
+	}
+
+	return &AllInOneConfig{
+		// The API pushes tasks directly to the broker (which shares its process), without outbox
+		API: &server.ProducerConfig{
+			Hostname:            hostname,
+			Port:                port,
+			Broker:              brokerType,
+			BrokerFolder:        brokerFolder,
+			ReadyTimeout:        readyTimeout,
+			ScheduledFolder:     filepath.Join(folder, "scheduled"),
+			ScheduledInterval:   time.Second,
+			SchedulesFolder:     filepath.Join(folder, "schedules"),
+			SchedulesInterval:   10 * time.Second,
+			StorageEndpoints:    storageEndpoints,
+			ChainMaxWait:        24 * time.Hour,
+			BatchesFolder:       filepath.Join(folder, "batches"),
+			BatchMaxItems:       1000,
+			BatchConfirmTimeout: time.Hour,
+			SweepsFolder:        filepath.Join(folder, "sweeps"),
+			SweepMaxTrials:      500,
+			WorkersFolder:       filepath.Join(folder, "workers"),
+			WorkersInterval:     10 * time.Second,
+			WorkersRetention:    24 * time.Hour,
+			StorageUser:         storageUser,
+			StoragePassword:     storagePassword,
+			DefaultPriority:     defaultPriority,
+			ProblemPriorities:   problemPriority,
+			TraceExporter:       traceExporter,
+			TraceFile:           traceFile,
+			TraceEndpoint:       traceEndpoint,
+		},
+		Worker: &compute.ConsumerConfig{
+			Broker:               brokerType,
+			BrokerFolder:         brokerFolder,
+			BrokerRequeueDelay:   brokerRequeueDelay,
+			BrokerMaxAttempts:    brokerMaxAttempts,
+			LearnParallelism:     learnParallelism,
+			PredictParallelism:   predictParallelism,
+			AggregateParallelism: aggregateParallelism,
+			EvaluateParallelism:  evaluateParallelism,
+			LearnTimeout:         learnTimeout,
+			PredictTimeout:       predictTimeout,
+			AggregateTimeout:     aggregateTimeout,
+			EvaluateTimeout:      evaluateTimeout,
+			PriorityWeights:      weights,
+			JournalMaxAge:        journalMaxAge,
+			StartModelWait:       startModelWait,
+			CheckpointInterval:   checkpointInterval,
+
+			StorageHost:     storageHost,
+			StoragePort:     storagePort,
+			StorageUser:     storageUser,
+			StoragePassword: storagePassword,
+
+			DockerTimeout: dockerTimeout,
+
+			// The API answers online predictions with the worker's model server directly
+			Serving: compute.ServingConfig{
+				Concurrency:    servingConcurrency,
+				MaxModels:      servingMaxModels,
+				IdleTimeout:    servingIdleTimeout,
+				StartTimeout:   servingStartTimeout,
+				RequestTimeout: servingReqTimeout,
+				HealthInterval: servingHealthInterv,
+			},
+
+			// The worker sends its heartbeats to the API directly
+			Heartbeat: compute.HeartbeatConfig{
+				Interval: 10 * time.Second,
+				Lease:    time.Minute,
+			},
+
+			TraceExporter: traceExporter,
+			TraceFile:     traceFile,
+			TraceEndpoint: traceEndpoint,
+		},
+
+		Folder:           folder,
+		Storage:          storage,
+		Peer:             peer,
+		PeerConfigFile:   peerConfigFile,
+		ContainerRuntime: containerRuntime,
+	}
+}
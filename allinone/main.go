@@ -0,0 +1,206 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/client"
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/api/server"
+	"github.com/MorpheoOrg/morpheo-compute/broker"
+	"github.com/MorpheoOrg/morpheo-compute/registry"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+	"github.com/MorpheoOrg/morpheo-compute/worker/compute"
+)
+
+func main() {
+	conf := NewAllInOneConfig()
+
+	storage, err := newStorage(conf)
+	if err != nil {
+		log.Panicln(err)
+	}
+	peer, err := newPeer(conf)
+	if err != nil {
+		log.Panicln(err)
+	}
+	containerRuntime, err := newContainerRuntime(conf)
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	// The API and the worker share the same broker
+	producer, consumer, addHandlers, err := newBroker(conf)
+	if err != nil {
+		log.Panicln(err)
+	}
+	defer producer.Stop()
+
+	api, err := server.NewServer(conf.API, producer, peer)
+	if err != nil {
+		log.Panicln(err)
+	}
+	// Retraining schedules select data among the blobs of the filesystem storage, and chained
+	// learnuplets wait for their start model to be written there
+	if selector, ok := storage.(server.DataSelector); ok {
+		api.SetDataSelector(selector)
+	}
+	if checker, ok := storage.(server.ModelChecker); ok {
+		api.SetModelChecker(checker)
+	}
+
+	exporter, err := tracing.NewExporter(conf.Worker.TraceExporter, conf.Worker.TraceFile, conf.Worker.TraceEndpoint)
+	if err != nil {
+		log.Panicf("Error creating trace exporter: %s", err)
+	}
+	worker := compute.NewWorker(
+		filepath.Join(conf.Folder, "data"),
+		"train", "test", "untargeted_test", "pred", "perf", "model",
+		"problem", "algo",
+		containerRuntime, storage, peer,
+	)
+	worker.SetTracer(tracing.NewTracer("compute-worker", exporter))
+	worker.SetJournalMaxAge(conf.Worker.JournalMaxAge)
+	worker.SetStartModelWait(conf.Worker.StartModelWait)
+	worker.SetCheckpointInterval(conf.Worker.CheckpointInterval)
+	worker.RegisterHandlers(addHandlers, conf.Worker)
+
+	// Online predictions are answered by the worker's model server, in the same process
+	models := worker.NewModelServer(conf.Worker.Serving)
+	api.SetPredictor(models)
+
+	// The worker's heartbeats are recorded by the API's worker registry, in the same process (the
+	// tasks of the worker of a previous run are recovered once its lease expires)
+	go worker.SendHeartbeats(func(heartbeat registry.Heartbeat) error {
+		_, err := api.RecordHeartbeat(heartbeat)
+		return err
+	}, conf.Worker.Heartbeat)
+
+	// Worker metrics are registered in the same process, hence served by the API's /metrics route
+	go api.RelayNewLearnuplet()
+	go func() {
+		if err := api.ListenAndServe(); err != nil {
+			log.Panicln(err)
+		}
+	}()
+
+	log.Printf("[INFO] All-in-one compute started (broker: %s, storage: %s, peer: %s, runtime: %s, folder: %s)", conf.Worker.Broker, conf.Storage, conf.Peer, conf.ContainerRuntime, conf.Folder)
+	consumer.ConsumeUntilKilled()
+	models.Stop()
+
+	log.Println("[INFO] Consumer has been gracefully stopped... Bye bye!")
+}
+
+// newBroker creates the producer the API pushes tasks with and the consumer the worker pulls them
+// from
+func newBroker(conf *AllInOneConfig) (common.Producer, compute.TaskConsumer, compute.AddHandlersFunc, error) {
+	switch conf.Worker.Broker {
+	case broker.BrokerMemory:
+		memoryBroker := broker.NewMemoryBroker(conf.Worker.BrokerRequeueDelay, conf.Worker.BrokerMaxAttempts)
+		return memoryBroker, memoryBroker, memoryBroker.AddWeightedHandlers, nil
+	case broker.BrokerEmbedded:
+		producer, err := server.NewProducer(conf.API)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		consumer, addHandlers, err := compute.NewConsumer(conf.Worker)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return producer, consumer, addHandlers, nil
+	default:
+		return nil, nil, nil, fmt.Errorf("Unsupported broker (%s). Available brokers: 'memory', 'embedded'", conf.Worker.Broker)
+	}
+}
+
+func newStorage(conf *AllInOneConfig) (client.Storage, error) {
+	switch conf.Storage {
+	case StorageMock:
+		return client.NewStorageAPIMock()
+	case StorageFS:
+		return newFileStorage(filepath.Join(conf.Folder, "storage"))
+	case StorageAPI:
+		return &client.StorageAPI{
+			Hostname: conf.Worker.StorageHost,
+			Port:     conf.Worker.StoragePort,
+			User:     conf.Worker.StorageUser,
+			Password: conf.Worker.StoragePassword,
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported storage (%s). Available storages: 'mock', 'fs', 'api'", conf.Storage)
+	}
+}
+
+func newPeer(conf *AllInOneConfig) (client.Peer, error) {
+	switch conf.Peer {
+	case PeerMock:
+		return &client.PeerMock{}, nil
+	case PeerFS:
+		return newFilePeer(filepath.Join(conf.Folder, "peer"))
+	case PeerFabric:
+		peer, err := client.NewPeerAPI(
+			conf.PeerConfigFile,
+			"Aphp",
+			"mychannel",
+			"mycc",
+		)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating peer client: %s", err)
+		}
+		return peer, nil
+	default:
+		return nil, fmt.Errorf("Unsupported peer (%s). Available peers: 'mock', 'fs', 'fabric'", conf.Peer)
+	}
+}
+
+func newContainerRuntime(conf *AllInOneConfig) (common.ContainerRuntime, error) {
+	switch conf.ContainerRuntime {
+	case RuntimeDocker:
+		containerRuntime, err := common.NewDockerRuntime(conf.Worker.DockerTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("Impossible to connect to Docker container backend: %s", err)
+		}
+		return containerRuntime, nil
+	case RuntimeMock:
+		return common.NewMockRuntime(), nil
+	default:
+		return nil, fmt.Errorf("Unsupported container runtime (%s). Available runtimes: 'docker', 'mock'", conf.ContainerRuntime)
+	}
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/MorpheoOrg/morpheo-compute/api/server"
+	"github.com/MorpheoOrg/morpheo-compute/broker"
+	"github.com/MorpheoOrg/morpheo-compute/priority"
+	"github.com/MorpheoOrg/morpheo-compute/worker/compute"
+)
+
+// sweepRuntime runs the containers of a sweep: the algo's train step predicts its "lr"
+// hyperparameter, which the problem's perf step reports as the perf
+type sweepRuntime struct{}
+
+func (sweepRuntime) ImageBuild(name string, imageContext io.Reader) (io.ReadCloser, error) {
+	io.Copy(ioutil.Discard, imageContext)
+	return ioutil.NopCloser(&bytes.Buffer{}), nil
+}
+
+func (sweepRuntime) ImageLoad(name string, image io.Reader) error { return nil }
+
+func (sweepRuntime) ImageUnload(name string) error { return nil }
+
+func (sweepRuntime) RunImageInUntrustedContainer(image string, args []string, mounts map[string]string, autoRemove bool) (string, error) {
+	folders := make(map[string]string, len(mounts))
+	for host, container := range mounts {
+		folders[container] = host
+	}
+	switch args[len(args)-1] {
+	case "train":
+		var params map[string]float64
+		paramsBytes, err := ioutil.ReadFile(filepath.Join(folders["/data/params"], "params.json"))
+		if err == nil {
+			err = json.Unmarshal(paramsBytes, &params)
+		}
+		if err != nil {
+			return "", err
+		}
+		lr := []byte(fmt.Sprintf("%f", params["lr"]))
+		if err = ioutil.WriteFile(filepath.Join(folders["/data/model"], "model"), lr, 0644); err != nil {
+			return "", err
+		}
+		return "", ioutil.WriteFile(filepath.Join(folders["/data/test"], "pred"), lr, 0644)
+	}
+	if args[1] == "perf" {
+		pred, err := ioutil.ReadFile(filepath.Join(folders["/submission_data/test"], "pred"))
+		if err != nil {
+			return "", err
+		}
+		perf := fmt.Sprintf(`{"perf": %s, "train_perf": {}, "test_perf": {}}`, pred)
+		return "", ioutil.WriteFile(filepath.Join(folders["/hidden_data/perf"], "performance.json"), []byte(perf), 0644)
+	}
+	return "", nil
+}
+
+// writeBlob writes a blob to the filesystem storage, tar-gzipped unless it's a data blob
+func writeBlob(t *testing.T, storage *fileStorage, kind string, id uuid.UUID) {
+	var blob bytes.Buffer
+	if kind == blobData {
+		blob.WriteString("data")
+	} else {
+		zipWriter := gzip.NewWriter(&blob)
+		tarWriter := tar.NewWriter(zipWriter)
+		require.Nil(t, tarWriter.WriteHeader(&tar.Header{Name: "Dockerfile", Mode: 0644, Size: 4}))
+		_, err := tarWriter.Write([]byte("FROM"))
+		require.Nil(t, err)
+		require.Nil(t, tarWriter.Close())
+		require.Nil(t, zipWriter.Close())
+	}
+	require.Nil(t, storage.write(kind, id, &blob))
+}
+
+func TestSweep(t *testing.T) {
+	folder, err := ioutil.TempDir("", "allinone")
+	require.Nil(t, err)
+	defer os.RemoveAll(folder)
+
+	storage, err := newFileStorage(filepath.Join(folder, "storage"))
+	require.Nil(t, err)
+	peer, err := newFilePeer(filepath.Join(folder, "peer"))
+	require.Nil(t, err)
+	problem, algo, train, test := uuid.NewV4(), uuid.NewV4(), uuid.NewV4(), uuid.NewV4()
+	writeBlob(t, storage, blobProblem, problem)
+	writeBlob(t, storage, blobAlgo, algo)
+	writeBlob(t, storage, blobData, train)
+	writeBlob(t, storage, blobData, test)
+
+	memoryBroker := broker.NewMemoryBroker(10*time.Millisecond, 3)
+	api, err := server.NewServer(&server.ProducerConfig{
+		SweepsFolder:   filepath.Join(folder, "sweeps"),
+		SweepMaxTrials: 10,
+	}, memoryBroker, peer)
+	require.Nil(t, err)
+	worker := compute.NewWorker(
+		filepath.Join(folder, "data"),
+		"train", "test", "untargeted_test", "pred", "perf", "model",
+		"problem", "algo",
+		sweepRuntime{}, storage, peer,
+	)
+	worker.RegisterHandlers(memoryBroker.AddWeightedHandlers, &compute.ConsumerConfig{
+		LearnParallelism: 2,
+		LearnTimeout:     time.Minute,
+		PriorityWeights:  priority.DefaultWeights,
+	})
+	memoryBroker.Start()
+	defer memoryBroker.Stop()
+
+	app := api.SetIrisApp()
+	app.Boot()
+	ts := httptest.NewServer(app.Router)
+	defer ts.Close()
+
+	sweep := fmt.Sprintf(`{
+		"name": "lr",
+		"learnuplet": {"problem": "%s", "algo": "%s", "train_data": ["%s"], "test_data": ["%s"], "model_start": "%s", "rank": 0},
+		"grid": {"lr": [0.2, 0.5, 0.3]}
+	}`, problem, algo, train, test, uuid.Nil)
+	resp, err := http.Post(ts.URL+server.SweepsRoute, "application/json", bytes.NewBufferString(sweep))
+	require.Nil(t, err)
+	var submitted struct {
+		SweepID string `json:"sweep_id"`
+	}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&submitted))
+	resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	// The trials are trained and reported to the peer, which ranks them on the leaderboard
+	var status struct {
+		Status      string `json:"status"`
+		Leaderboard []struct {
+			Status string   `json:"status"`
+			Perf   *float64 `json:"perf"`
+		} `json:"leaderboard"`
+		Best *struct {
+			Params   map[string]float64 `json:"params"`
+			ModelEnd string             `json:"model_end"`
+			Perf     *float64           `json:"perf"`
+		} `json:"best"`
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for status.Status != server.BatchDone && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		resp, err = http.Get(ts.URL + "/sweeps/" + submitted.SweepID)
+		require.Nil(t, err)
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&status))
+		resp.Body.Close()
+	}
+	require.Equal(t, server.BatchDone, status.Status)
+	require.Len(t, status.Leaderboard, 3)
+	for _, trial := range status.Leaderboard {
+		assert.Equal(t, "done", trial.Status)
+		assert.NotNil(t, trial.Perf)
+	}
+	require.NotNil(t, status.Best)
+	assert.Equal(t, 0.5, status.Best.Params["lr"])
+	assert.InDelta(t, 0.5, *status.Best.Perf, 1e-9)
+
+	// Its model was posted to storage
+	exists, err := storage.ModelExists(uuid.FromStringOrNil(status.Best.ModelEnd))
+	assert.Nil(t, err)
+	assert.True(t, exists)
+}
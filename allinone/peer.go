@@ -0,0 +1,217 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/client"
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/predict"
+)
+
+// filePeer stores learnuplets in a local folder, as one <key>.json file per learnuplet (in the
+// chaincode format, which is opaque to the filePeer: only the "status" field is read). Queries and
+// invocations it doesn't implement are served by the Peer Mock.
+type filePeer struct {
+	*client.PeerMock
+
+	folder string
+	lock   sync.Mutex
+}
+
+// newFilePeer creates a filePeer reading learnuplets from folder (created if need be)
+func newFilePeer(folder string) (*filePeer, error) {
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return nil, fmt.Errorf("Error creating filesystem peer folder: %s", err)
+	}
+	return &filePeer{
+		PeerMock: &client.PeerMock{},
+		folder:   folder,
+	}, nil
+}
+
+// QueryStatusLearnuplet returns the JSON array of the learnuplets with the given status
+func (p *filePeer) QueryStatusLearnuplet(status string) ([]byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	files, err := ioutil.ReadDir(p.folder)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing learnuplets: %s", err)
+	}
+	learnuplets := []map[string]interface{}{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		learnuplet, err := p.read(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if learnuplet["status"] == status {
+			learnuplets = append(learnuplets, learnuplet)
+		}
+	}
+	return json.Marshal(learnuplets)
+}
+
+// SetUpletWorker assigns a learnuplet to a worker and sets its status to pending
+func (p *filePeer) SetUpletWorker(key string, worker string) (string, []byte, error) {
+	return p.update(key, func(learnuplet map[string]interface{}) {
+		learnuplet["worker"] = worker
+		learnuplet["status"] = common.TaskStatusPending
+	})
+}
+
+// RegisterLearnuplet creates a learnuplet (the trials of a sweep), stored in the compute format
+func (p *filePeer) RegisterLearnuplet(learnuplet common.Learnuplet) (string, []byte, error) {
+	learnupletBytes, err := json.Marshal(learnuplet)
+	if err != nil {
+		return "", nil, fmt.Errorf("Error marshaling learnuplet %s: %s", learnuplet.Key, err)
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal(learnupletBytes, &fields); err != nil {
+		return "", nil, fmt.Errorf("Error un-marshaling learnuplet %s: %s", learnuplet.Key, err)
+	}
+	return p.write(learnuplet.Key, false, func(stored map[string]interface{}) {
+		for field, value := range fields {
+			stored[field] = value
+		}
+	})
+}
+
+// ResetUplet hands a learnuplet pending on a (dead) worker back: its status is set to todo, unless
+// it was assigned to another worker in the meantime
+func (p *filePeer) ResetUplet(key string, worker string) (string, []byte, error) {
+	return p.update(key, func(learnuplet map[string]interface{}) {
+		if learnuplet["worker"] != worker || learnuplet["status"] != common.TaskStatusPending {
+			return
+		}
+		delete(learnuplet, "worker")
+		learnuplet["status"] = common.TaskStatusTodo
+	})
+}
+
+// ReportLearn sets the status and performances of a learnuplet
+func (p *filePeer) ReportLearn(key string, status string, perf float64, trainPerf, testPerf map[string]float64) (string, []byte, error) {
+	return p.update(key, func(learnuplet map[string]interface{}) {
+		learnuplet["status"] = status
+		learnuplet["perf"] = perf
+		learnuplet["train_perf"] = trainPerf
+		learnuplet["test_perf"] = testPerf
+	})
+}
+
+// ReportEvaluation stores the result of an evaluation as <key>.json, next to the learnuplets
+// (evaluations are never relayed: they're only written with a done or failed status)
+func (p *filePeer) ReportEvaluation(key string, model uuid.UUID, status string, perf float64, testPerf map[string]float64) (string, []byte, error) {
+	return p.write(key, false, func(evaluation map[string]interface{}) {
+		evaluation["key"] = key
+		evaluation["model"] = model
+		evaluation["status"] = status
+		evaluation["perf"] = perf
+		evaluation["test_perf"] = testPerf
+	})
+}
+
+// ReportPred stores the result of a prediction task, along with the status of each of its data
+// blobs, as <key>.json (like evaluations, preduplets are never relayed)
+func (p *filePeer) ReportPred(key string, status string, items []predict.Item) (string, []byte, error) {
+	return p.write(key, false, func(preduplet map[string]interface{}) {
+		preduplet["key"] = key
+		preduplet["status"] = status
+		preduplet["items"] = items
+	})
+}
+
+func (p *filePeer) update(key string, change func(map[string]interface{})) (string, []byte, error) {
+	return p.write(key, true, change)
+}
+
+// write changes the <key>.json file, which must exist if mustExist is set
+func (p *filePeer) write(key string, mustExist bool, change func(map[string]interface{})) (string, []byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// Evaluations and preduplets reported for the first time don't have a file yet
+	learnuplet := map[string]interface{}{}
+	if _, err := os.Stat(p.path(key)); mustExist || !os.IsNotExist(err) {
+		if learnuplet, err = p.read(key); err != nil {
+			return "", nil, err
+		}
+	}
+	change(learnuplet)
+	learnupletBytes, err := json.Marshal(learnuplet)
+	if err != nil {
+		return "", nil, fmt.Errorf("Error marshaling learnuplet %s: %s", key, err)
+	}
+
+	tmp := p.path(key) + ".tmp"
+	if err = ioutil.WriteFile(tmp, learnupletBytes, 0600); err != nil {
+		return "", nil, fmt.Errorf("Error writing learnuplet %s: %s", key, err)
+	}
+	if err = os.Rename(tmp, p.path(key)); err != nil {
+		return "", nil, fmt.Errorf("Error storing learnuplet %s: %s", key, err)
+	}
+	return key, learnupletBytes, nil
+}
+
+func (p *filePeer) read(key string) (map[string]interface{}, error) {
+	learnupletBytes, err := ioutil.ReadFile(p.path(key))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading learnuplet %s: %s", key, err)
+	}
+	var learnuplet map[string]interface{}
+	if err = json.Unmarshal(learnupletBytes, &learnuplet); err != nil {
+		return nil, fmt.Errorf("Error un-marshaling learnuplet %s: %s", key, err)
+	}
+	return learnuplet, nil
+}
+
+// path returns the file of a learnuplet (keys can't point outside of the peer folder)
+func (p *filePeer) path(key string) string {
+	return filepath.Join(p.folder, filepath.Base(key)+".json")
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/client"
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// Blob kinds, which are also the subfolders of the filesystem storage
+const (
+	blobProblem    = "problem"
+	blobAlgo       = "algo"
+	blobModel      = "model"
+	blobData       = "data"
+	blobPrediction = "prediction"
+)
+
+// fileStorage reads blobs from (and writes them to) a local folder, as <folder>/<kind>/<uuid>
+// (tar-gzipped like on the Storage API). Metadata are still served by the Storage API Mock.
+type fileStorage struct {
+	*client.StorageAPIMock
+
+	folder string
+}
+
+// newFileStorage creates a fileStorage storing blobs in folder (created if need be)
+func newFileStorage(folder string) (*fileStorage, error) {
+	for _, kind := range []string{blobProblem, blobAlgo, blobModel, blobData, blobPrediction} {
+		if err := os.MkdirAll(filepath.Join(folder, kind), 0700); err != nil {
+			return nil, fmt.Errorf("Error creating filesystem storage folder: %s", err)
+		}
+	}
+	mock, err := client.NewStorageAPIMock()
+	if err != nil {
+		return nil, fmt.Errorf("Error loading Storage Mock: %s", err)
+	}
+	return &fileStorage{
+		StorageAPIMock: mock,
+		folder:         folder,
+	}, nil
+}
+
+// GetProblemWorkflowBlob opens the problem workflow blob
+func (s *fileStorage) GetProblemWorkflowBlob(id uuid.UUID) (io.ReadCloser, error) {
+	return s.open(blobProblem, id)
+}
+
+// GetAlgoBlob opens the algo blob
+func (s *fileStorage) GetAlgoBlob(id uuid.UUID) (io.ReadCloser, error) {
+	return s.open(blobAlgo, id)
+}
+
+// GetModelBlob opens the model blob
+func (s *fileStorage) GetModelBlob(id uuid.UUID) (io.ReadCloser, error) {
+	return s.open(blobModel, id)
+}
+
+// GetDataBlob opens the data blob
+func (s *fileStorage) GetDataBlob(id uuid.UUID) (io.ReadCloser, error) {
+	return s.open(blobData, id)
+}
+
+// PostModel stores a model blob
+func (s *fileStorage) PostModel(model *common.Model, blobReader io.Reader, size int64) error {
+	return s.write(blobModel, model.ID, blobReader)
+}
+
+// PostPrediction stores a prediction blob
+func (s *fileStorage) PostPrediction(prediction *common.Prediction, blobReader io.Reader, size int64) error {
+	return s.write(blobPrediction, prediction.ID, blobReader)
+}
+
+// ModelExists checks whether a model blob has been written
+func (s *fileStorage) ModelExists(id uuid.UUID) (bool, error) {
+	_, err := os.Stat(filepath.Join(s.folder, blobModel, id.String()))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Error checking model %s: %s", id, err)
+	}
+	return true, nil
+}
+
+// DeleteModel deletes a model blob (the checkpoints of the learnuplets once trained)
+func (s *fileStorage) DeleteModel(id uuid.UUID) error {
+	err := os.Remove(filepath.Join(s.folder, blobModel, id.String()))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error deleting model %s: %s", id, err)
+	}
+	return nil
+}
+
+// SelectData selects the data blobs of the retraining schedules. Queries are URL query strings
+// with optional "uuid" (data UUIDs to select, repeated) and "since" (RFC 3339 date the blobs must
+// have been written after) parameters, e.g. "since={{last_run}}".
+func (s *fileStorage) SelectData(query string) ([]uuid.UUID, error) {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid data selection query %q: %s", query, err)
+	}
+	var since time.Time
+	if values.Get("since") != "" {
+		if since, err = time.Parse(time.RFC3339, values.Get("since")); err != nil {
+			return nil, fmt.Errorf("Invalid since date in data selection query %q: %s", query, err)
+		}
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(s.folder, blobData))
+	if err != nil {
+		return nil, fmt.Errorf("Error listing data: %s", err)
+	}
+	var ids []uuid.UUID
+	for _, file := range files {
+		id, err := uuid.FromString(file.Name())
+		if err != nil || file.IsDir() || !file.ModTime().After(since) {
+			continue
+		}
+		if len(values["uuid"]) > 0 && !stringInSlice(id.String(), values["uuid"]) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func stringInSlice(a string, list []string) bool {
+	for _, b := range list {
+		if b == a {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *fileStorage) open(kind string, id uuid.UUID) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.folder, kind, id.String()))
+	if err != nil {
+		return nil, fmt.Errorf("Error opening %s %s: %s", kind, id, err)
+	}
+	return f, nil
+}
+
+// write stores a blob atomically, so that it's never read partially written
+func (s *fileStorage) write(kind string, id uuid.UUID, blobReader io.Reader) error {
+	tmp, err := ioutil.TempFile(filepath.Join(s.folder, kind), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("Error creating %s %s: %s", kind, id, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, blobReader)
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return fmt.Errorf("Error writing %s %s: %s", kind, id, err)
+	}
+	if err = os.Rename(tmp.Name(), filepath.Join(s.folder, kind, id.String())); err != nil {
+		return fmt.Errorf("Error storing %s %s: %s", kind, id, err)
+	}
+	return nil
+}
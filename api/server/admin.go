@@ -0,0 +1,133 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// Debug routes, only registered in debug mode
+const (
+	QueryRoute  = "/query"
+	InvokeRoute = "/invoke"
+)
+
+// AdminTokenIdentity is the identity of administrators authenticated with the admin token
+const AdminTokenIdentity = "admin-token"
+
+// newAuditLogger creates the logger audit records are written to: the given file, or the
+// standard logger output if path is blank
+func newAuditLogger(path string) (*log.Logger, error) {
+	if path == "" {
+		return log.New(os.Stderr, "[AUDIT] ", log.LstdFlags), nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening audit log %s: %s", path, err)
+	}
+	return log.New(f, "[AUDIT] ", log.LstdFlags|log.LUTC), nil
+}
+
+// auditf writes an audit record
+func (s *Server) auditf(format string, args ...interface{}) {
+	if s.audit == nil {
+		log.Printf("[AUDIT] "+format, args...)
+		return
+	}
+	s.audit.Printf(format, args...)
+}
+
+// configureDebugRoutes registers the routes letting administrators query and invoke chaincode
+// functions through the API's peer identity
+func (s *Server) configureDebugRoutes(app *iris.Framework) {
+	app.Get(QueryRoute, s.adminOnly(s.query))
+	app.Get(InvokeRoute, s.adminOnly(s.invoke))
+}
+
+// adminOnly restricts a handler to administrators, authenticated either with a client
+// certificate whose subject is in the admin list (if mutual TLS is enabled) or with the admin
+// bearer token
+func (s *Server) adminOnly(handler iris.HandlerFunc) iris.HandlerFunc {
+	return func(c *iris.Context) {
+		admin, ok := s.authenticateAdmin(c)
+		if !ok {
+			s.auditf("Rejected %s %s from %s: not an administrator", c.Method(), c.Path(), c.Request.RemoteAddr)
+			c.JSON(iris.StatusUnauthorized, common.NewAPIError("Administrator authentication required"))
+			return
+		}
+		c.Set(identityKey, admin)
+		handler(c)
+	}
+}
+
+func (s *Server) authenticateAdmin(c *iris.Context) (identity string, ok bool) {
+	s.conf.Lock()
+	mutualTLS := s.conf.MutualTLSOn()
+	adminSubjects := s.conf.AdminSubjects
+	adminToken := s.conf.AdminToken
+	s.conf.Unlock()
+
+	if mutualTLS && c.Request.TLS != nil && len(c.Request.TLS.PeerCertificates) > 0 {
+		subject := c.Request.TLS.PeerCertificates[0].Subject
+		if stringInSlice(subject.String(), adminSubjects) || stringInSlice(subject.CommonName, adminSubjects) {
+			return subject.String(), true
+		}
+	}
+
+	authorization := c.Request.Header.Get("Authorization")
+	if adminToken != "" && c.Request.TLS != nil && strings.HasPrefix(authorization, "Bearer ") {
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			return AdminTokenIdentity, true
+		}
+	}
+	return "", false
+}
+
+// chaincodeFunctionAllowed checks a chaincode function against the debug routes allowlist
+func (s *Server) chaincodeFunctionAllowed(fcn string) bool {
+	s.conf.Lock()
+	defer s.conf.Unlock()
+	return stringInSlice(fcn, s.conf.ChaincodeFunctions)
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/aggregate"
+	"github.com/MorpheoOrg/morpheo-compute/envelope"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// AggregateRoute accepts aggregation tasks
+const AggregateRoute = "/aggregate"
+
+// aggregateSubmission is an aggregation task posted to the API, along with its submission options
+type aggregateSubmission struct {
+	aggregate.Aggregateuplet
+	submitOptions
+}
+
+func (s *Server) submitAggregateuplet(c *iris.Context) {
+	var submission aggregateSubmission
+
+	// Let's continue the submitter's trace, if any
+	span := s.tracer.StartFromTraceparent("api.submitAggregateuplet", c.Request.Header.Get(tracing.TraceparentHeader))
+	var err error
+	defer func() { span.End(err) }()
+
+	if err = json.NewDecoder(c.Request.Body).Decode(&submission); err != nil {
+		upletsRejected.WithLabelValues(UpletAggregate, RejectMalformed).Inc()
+		msg := fmt.Sprintf("Error decoding body to JSON: %s", err)
+		log.Printf("[INFO] %s", msg)
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+		return
+	}
+
+	d, err := s.dispatchOf(submission.submitOptions, submission.Problem, identityOf(c))
+	if err == nil && d.CVFolds > 0 {
+		err = fmt.Errorf("cv_folds only applies to learnuplets")
+	}
+	if err == nil {
+		err = submission.Aggregateuplet.Check()
+	}
+	if err != nil {
+		upletsRejected.WithLabelValues(UpletAggregate, RejectInvalid).Inc()
+		msg := fmt.Sprintf("Invalid aggregate-uplet: %s", err)
+		log.Printf("[INFO] %s", msg)
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+		return
+	}
+
+	scheduled, err := s.postAggregateuplet(submission.Aggregateuplet, d, span)
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(err.Error()))
+		return
+	}
+	c.JSON(iris.StatusAccepted, accepted("Aggregate-uplet ingested", d, scheduled))
+}
+
+// postAggregateuplet pushes an aggregation task to the broker, or holds it until it's due and its
+// input models are all on storage (in which case the scheduled task is returned)
+func (s *Server) postAggregateuplet(uplet aggregate.Aggregateuplet, d dispatch, parent *tracing.Span) (scheduled *scheduledTask, err error) {
+	span := parent.Child("api.postAggregateuplet")
+	span.SetAttribute("uplet.key", uplet.Key)
+	span.SetAttribute("uplet.priority", d.Priority)
+	defer func() { span.End(err) }()
+
+	// Input models typically are the ModelEnd of learnuplets that may not be done yet
+	d.WaitForModels = uplet.Models
+
+	scheduled, err = s.enqueue(envelope.TypeAggregate, aggregate.Topic, uplet.Key, uplet, d, span)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to push aggregate-uplet into broker: %s", err)
+	}
+	countAccepted(UpletAggregate, d)
+	return scheduled, nil
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// identityKey is the iris context key under which the authenticated identity is stored
+const identityKey = "identity"
+
+// AllSubjectsRoute is the allowlist entry route applying to every route
+const AllSubjectsRoute = "*"
+
+// publicRoutes can be reached without a client certificate (liveness/readiness probes and
+// metrics scraping)
+var publicRoutes = []string{RootRoute, HealthRoute, ReadyRoute, MetricsRoute}
+
+// parseSubjectAllowlist parses "<route>=<subject>" entries into a per-route list of allowed
+// certificate subjects
+func parseSubjectAllowlist(entries []string) (map[string][]string, error) {
+	allowlist := make(map[string][]string)
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid allowlist entry %q, expected <route>=<subject>", entry)
+		}
+		allowlist[parts[0]] = append(allowlist[parts[0]], parts[1])
+	}
+	return allowlist, nil
+}
+
+// newMutualTLSListener creates a TLS listener verifying client certificates against the
+// configured CA bundle. Certificates are verified if given, and required by authMiddleware on
+// non-public routes, so that probes can still reach the API without one.
+func newMutualTLSListener(conf *ProducerConfig) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading TLS key pair: %s", err)
+	}
+
+	caBundle, err := ioutil.ReadFile(conf.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading client CA bundle %s: %s", conf.ClientCAFile, err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caBundle) {
+		return nil, fmt.Errorf("No PEM certificate found in client CA bundle %s", conf.ClientCAFile)
+	}
+
+	return tls.Listen("tcp", net.JoinHostPort(conf.Hostname, strconv.Itoa(conf.Port)), &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	})
+}
+
+// authMiddleware authenticates clients using their (already verified) TLS certificate and checks
+// their subject against the route allowlist. The authenticated identity is stored in the iris
+// context, see identityOf. It is a no-op when client authentication isn't enabled.
+func (s *Server) authMiddleware(c *iris.Context) {
+	s.conf.Lock()
+	enabled := s.conf.MutualTLSOn()
+	allowlist := s.conf.AllowedSubjects
+	s.conf.Unlock()
+
+	if !enabled || stringInSlice(c.Path(), publicRoutes) {
+		c.Next()
+		return
+	}
+
+	if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+		s.auditf("Rejected %s %s from %s: no client certificate", c.Method(), c.Path(), c.Request.RemoteAddr)
+		c.JSON(iris.StatusUnauthorized, common.NewAPIError("A client certificate is required"))
+		c.StopExecution()
+		return
+	}
+
+	cert := c.Request.TLS.PeerCertificates[0]
+	if !subjectAllowed(cert, routeOf(c.Path()), allowlist) {
+		s.auditf("Rejected %s %s from %s: subject %q not allowed", c.Method(), c.Path(), c.Request.RemoteAddr, cert.Subject.String())
+		c.JSON(iris.StatusForbidden, common.NewAPIError(fmt.Sprintf("Subject %s isn't allowed on this route", cert.Subject.String())))
+		c.StopExecution()
+		return
+	}
+
+	c.Set(identityKey, cert.Subject.String())
+	s.auditf("%s %s by %q", c.Method(), c.Path(), cert.Subject.String())
+	c.Next()
+}
+
+// subjectAllowed checks a certificate subject against the allowlist entries of a route and of
+// AllSubjectsRoute. Entries match either the full subject DN or its common name. Routes without
+// any entry accept any certificate issued by the client CA.
+func subjectAllowed(cert *x509.Certificate, route string, allowlist map[string][]string) bool {
+	var allowed []string
+	allowed = append(allowed, allowlist[route]...)
+	allowed = append(allowed, allowlist[AllSubjectsRoute]...)
+	if len(allowed) == 0 {
+		return true
+	}
+	return stringInSlice(cert.Subject.String(), allowed) || stringInSlice(cert.Subject.CommonName, allowed)
+}
+
+// identityOf returns the authenticated identity of the client that sent the request, or its
+// remote address if client authentication isn't enabled
+func identityOf(c *iris.Context) string {
+	if identity := c.GetString(identityKey); identity != "" {
+		return identity
+	}
+	return c.Request.RemoteAddr
+}
@@ -0,0 +1,472 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/envelope"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// BatchRoute accepts a batch of uplets, BatchStatusRoute reports the aggregate status of a batch
+const (
+	BatchRoute       = "/batch"
+	BatchStatusRoute = "/batch/:id"
+)
+
+// Statuses of the items of a batch, on submission. Once accepted, learnuplets take the status of
+// their learnuplet on the peer (todo, pending, done or failed), or are unknown if the peer still
+// doesn't know of them after the batch confirmation timeout.
+const (
+	BatchItemAccepted  = "accepted"
+	BatchItemScheduled = "scheduled"
+	BatchItemRejected  = "rejected"
+	BatchItemFailed    = "failed"
+	BatchItemUnknown   = "unknown"
+)
+
+// Aggregate statuses of a batch
+const (
+	BatchRunning = "running"
+	BatchDone    = "done"
+	BatchFailed  = "failed"
+)
+
+var errBatchNotFound = errors.New("Batch not found")
+
+// batchItemType is the type of an item of a batch ("learn", "pred", "aggregate" or "evaluate"),
+// posted along with the fields of the uplet and its submission options, as they're posted to
+// /learn, /pred, /aggregate or /evaluate
+type batchItemType struct {
+	Type string `json:"type"`
+}
+
+// batchItem is the result of the submission of an item of a batch
+type batchItem struct {
+	Index       int    `json:"index"`
+	Type        string `json:"type"`
+	Key         string `json:"key,omitempty"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	ScheduledID string `json:"scheduled_id,omitempty"`
+	// PushBy is the date a scheduled item is pushed by at the latest (its not_before date, or its
+	// wait deadline if it's held until its input models are on storage)
+	PushBy *time.Time `json:"push_by,omitempty"`
+}
+
+// batchRecord is a submitted batch, as stored on disk
+type batchRecord struct {
+	ID        string      `json:"id"`
+	Submitter string      `json:"submitter"`
+	CreatedAt time.Time   `json:"created_at"`
+	Items     []batchItem `json:"items"`
+}
+
+// batchStatus is the aggregate status of a batch: the current status of its items and their
+// count by status
+type batchStatus struct {
+	batchRecord
+	Status string         `json:"status"`
+	Counts map[string]int `json:"counts"`
+}
+
+// batchItemLabels are the metric labels of the types of batch items
+var batchItemLabels = map[string]string{
+	envelope.TypeLearn:     UpletLearn,
+	envelope.TypePred:      UpletPred,
+	envelope.TypeAggregate: UpletAggregate,
+	envelope.TypeEvaluate:  UpletEvaluate,
+}
+
+// batchMessage is a message of a batch waiting to be pushed, along with the item it comes from
+type batchMessage struct {
+	item    int
+	message outboxEntry
+}
+
+// submitBatch accepts an array of learnuplets, preduplets, aggregate-uplets and/or evaluate-uplets. Each item is validated on its
+// own and the valid ones that are due right away are pushed at once through the outbox (either
+// all of them or none), others are handed over to the scheduler. The response reports the result
+// of each item, and the ID the aggregate status of the batch can be queried with.
+func (s *Server) submitBatch(c *iris.Context) {
+	span := s.tracer.StartFromTraceparent("api.submitBatch", c.Request.Header.Get(tracing.TraceparentHeader))
+	var err error
+	defer func() { span.End(err) }()
+
+	var rawItems []json.RawMessage
+	if err = json.NewDecoder(c.Request.Body).Decode(&rawItems); err != nil {
+		msg := fmt.Sprintf("Error decoding body to a JSON array: %s", err)
+		log.Printf("[INFO] %s", msg)
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+		return
+	}
+	msg := ""
+	switch {
+	case len(rawItems) == 0:
+		msg = "Empty batch"
+	case s.conf.BatchMaxItems > 0 && len(rawItems) > s.conf.BatchMaxItems:
+		msg = fmt.Sprintf("Batches hold at most %d items, got %d", s.conf.BatchMaxItems, len(rawItems))
+	}
+	if msg != "" {
+		log.Printf("[INFO] %s", msg)
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+		return
+	}
+
+	batch := &batchRecord{
+		ID:        uuid.NewV4().String(),
+		Submitter: identityOf(c),
+		CreatedAt: time.Now().UTC(),
+		Items:     make([]batchItem, len(rawItems)),
+	}
+	span.SetAttribute("batch.id", batch.ID)
+
+	// Let's validate each item and collect the messages to push
+	var messages []batchMessage
+	for i, raw := range rawItems {
+		item := &batch.Items[i]
+		item.Index = i
+		collect := func(topic string, message []byte) error {
+			messages = append(messages, batchMessage{item: i, message: outboxEntry{Topic: topic, Body: message}})
+			return nil
+		}
+		scheduled, failure, err := s.submitBatchItem(raw, item, batch.Submitter, collect, span)
+		switch {
+		case err != nil:
+			item.Status = failure
+			item.Error = err.Error()
+		case scheduled != nil:
+			item.Status = BatchItemScheduled
+			item.ScheduledID = scheduled.ID
+			pushBy := scheduled.NotBefore
+			if scheduled.WaitDeadline != nil {
+				pushBy = *scheduled.WaitDeadline
+			}
+			item.PushBy = &pushBy
+		default:
+			item.Status = BatchItemAccepted
+		}
+	}
+
+	// ...and push them at once
+	if err = s.pushBatch(batch, messages); err != nil {
+		log.Printf("[ERROR] Batch %s: %s", batch.ID, err)
+	}
+
+	accepted := 0
+	for _, item := range batch.Items {
+		if item.Status == BatchItemAccepted || item.Status == BatchItemScheduled {
+			upletsAccepted.WithLabelValues(batchItemLabels[item.Type]).Inc()
+			accepted++
+		}
+	}
+	response := map[string]interface{}{
+		"message":  fmt.Sprintf("%d/%d item(s) of the batch ingested", accepted, len(batch.Items)),
+		"batch_id": batch.ID,
+		"items":    batch.Items,
+	}
+	if s.batches != nil {
+		if err2 := s.batches.Put(batch.ID, batch); err2 != nil {
+			log.Printf("[ERROR] %s", err2)
+			delete(response, "batch_id")
+		}
+	} else {
+		delete(response, "batch_id")
+	}
+
+	if accepted == 0 {
+		c.JSON(iris.StatusBadRequest, response)
+		return
+	}
+	c.JSON(iris.StatusAccepted, response)
+}
+
+// submitBatchItem validates an item of a batch and enqueues it, pushing it with push. The item
+// status to report on failure (rejected or failed) is returned along with the error.
+func (s *Server) submitBatchItem(raw json.RawMessage, item *batchItem, submitter string, push func(topic string, message []byte) error, span *tracing.Span) (*scheduledTask, string, error) {
+	var itemType batchItemType
+	if err := json.Unmarshal(raw, &itemType); err != nil {
+		upletsRejected.WithLabelValues(UpletLearn, RejectMalformed).Inc()
+		return nil, BatchItemRejected, fmt.Errorf("Error decoding item: %s", err)
+	}
+	item.Type = itemType.Type
+
+	var (
+		submitOpts submitOptions
+		problem    uuid.UUID
+		upletLabel string
+		check      func() error
+	)
+	var learn learnSubmission
+	var pred predSubmission
+	var agg aggregateSubmission
+	var eval evaluateSubmission
+	switch itemType.Type {
+	case envelope.TypeLearn:
+		upletLabel = UpletLearn
+		if err := json.Unmarshal(raw, &learn); err != nil {
+			upletsRejected.WithLabelValues(upletLabel, RejectMalformed).Inc()
+			return nil, BatchItemRejected, fmt.Errorf("Error decoding learnuplet: %s", err)
+		}
+		item.Key, submitOpts, problem = learn.Key, learn.submitOptions, learn.Problem
+		check = func() error {
+			if err := learn.Learnuplet.Check(); err != nil {
+				return err
+			}
+			return checkCVFolds(learn.CVFolds, learn.Learnuplet)
+		}
+	case envelope.TypePred:
+		upletLabel = UpletPred
+		if err := json.Unmarshal(raw, &pred); err != nil {
+			upletsRejected.WithLabelValues(upletLabel, RejectMalformed).Inc()
+			return nil, BatchItemRejected, fmt.Errorf("Error decoding preduplet: %s", err)
+		}
+		item.Key, submitOpts, problem, check = pred.Key, pred.submitOptions, pred.Problem, pred.Preduplet.Check
+	case envelope.TypeAggregate:
+		upletLabel = UpletAggregate
+		if err := json.Unmarshal(raw, &agg); err != nil {
+			upletsRejected.WithLabelValues(upletLabel, RejectMalformed).Inc()
+			return nil, BatchItemRejected, fmt.Errorf("Error decoding aggregate-uplet: %s", err)
+		}
+		item.Key, submitOpts, problem = agg.Key, agg.submitOptions, agg.Problem
+		check = func() error {
+			if agg.CVFolds > 0 {
+				return fmt.Errorf("cv_folds only applies to learnuplets")
+			}
+			return agg.Aggregateuplet.Check()
+		}
+	case envelope.TypeEvaluate:
+		upletLabel = UpletEvaluate
+		if err := json.Unmarshal(raw, &eval); err != nil {
+			upletsRejected.WithLabelValues(upletLabel, RejectMalformed).Inc()
+			return nil, BatchItemRejected, fmt.Errorf("Error decoding evaluate-uplet: %s", err)
+		}
+		item.Key, submitOpts, problem = eval.Key, eval.submitOptions, eval.Problem
+		check = func() error {
+			if eval.CVFolds > 0 {
+				return fmt.Errorf("cv_folds only applies to learnuplets")
+			}
+			return eval.Evaluateuplet.Check()
+		}
+	default:
+		upletsRejected.WithLabelValues(UpletLearn, RejectMalformed).Inc()
+		return nil, BatchItemRejected, fmt.Errorf("Invalid item type %q, expected %q, %q, %q or %q", itemType.Type, envelope.TypeLearn, envelope.TypePred, envelope.TypeAggregate, envelope.TypeEvaluate)
+	}
+
+	d, err := s.dispatchOf(submitOpts, problem, submitter)
+	if err == nil {
+		err = check()
+	}
+	if err != nil {
+		upletsRejected.WithLabelValues(upletLabel, RejectInvalid).Inc()
+		return nil, BatchItemRejected, fmt.Errorf("Invalid %s-uplet: %s", itemType.Type, err)
+	}
+	d.Push = push
+
+	var scheduled *scheduledTask
+	switch itemType.Type {
+	case envelope.TypeLearn:
+		scheduled, err = s.postLearnuplet(learn.Learnuplet, d, span)
+	case envelope.TypeAggregate:
+		scheduled, err = s.postAggregateuplet(agg.Aggregateuplet, d, span)
+	case envelope.TypeEvaluate:
+		scheduled, err = s.postEvaluateuplet(eval.Evaluateuplet, d, span)
+	default:
+		scheduled, err = s.enqueue(envelope.TypePred, common.PredictTopic, pred.Key, pred.Preduplet, d, span)
+	}
+	if err != nil {
+		return nil, BatchItemFailed, err
+	}
+	return scheduled, "", nil
+}
+
+// pushBatch pushes the messages of a batch (see pushAll). Items whose message couldn't be pushed
+// are marked as failed, and so are the scheduled items, which are removed from the scheduler
+// (unless they're already being pushed).
+func (s *Server) pushBatch(batch *batchRecord, messages []batchMessage) error {
+	entries := make([]outboxEntry, 0, len(messages))
+	for _, m := range messages {
+		entries = append(entries, m.message)
+	}
+	pushed, err := s.pushAll(entries)
+	if err == nil {
+		return nil
+	}
+	for _, m := range messages[pushed:] {
+		batch.Items[m.item].Status = BatchItemFailed
+		batch.Items[m.item].Error = fmt.Sprintf("Failed to push into broker: %s", err)
+	}
+	for i := range batch.Items {
+		item := &batch.Items[i]
+		if item.Status != BatchItemScheduled {
+			continue
+		}
+		if err2 := s.scheduler.Cancel(item.ScheduledID); err2 != nil {
+			log.Printf("[ERROR] Batch %s: error cancelling scheduled task %s of %s: %s", batch.ID, item.ScheduledID, item.Key, err2)
+			continue
+		}
+		item.Status = BatchItemFailed
+		item.Error = fmt.Sprintf("Cancelled, the rest of the batch failed to be pushed into broker: %s", err)
+	}
+	return err
+}
+
+// batchStatusOf computes the current status of the items of a batch: learnuplets take the status
+// of their learnuplet on the peer, if any (see unconfirmed otherwise), and items that are still
+// scheduled stay scheduled
+func (s *Server) batchStatusOf(batch *batchRecord) (*batchStatus, error) {
+	status := &batchStatus{
+		batchRecord: *batch,
+		Counts:      make(map[string]int),
+	}
+	status.Items = append([]batchItem(nil), batch.Items...)
+
+	var onPeer map[string]peerLearnuplet
+	for i := range status.Items {
+		item := &status.Items[i]
+		if item.Status == BatchItemScheduled && s.scheduler != nil && !s.scheduler.Has(item.ScheduledID) {
+			item.Status = BatchItemAccepted
+		}
+		if item.Status == BatchItemAccepted && item.Type == envelope.TypeLearn {
+			if onPeer == nil {
+				var err error
+				if onPeer, err = s.peerLearnuplets(); err != nil {
+					return nil, err
+				}
+			}
+			if learnuplet, ok := onPeer[item.Key]; ok {
+				item.Status = learnuplet.Status
+			} else if s.unconfirmed(batch, item) {
+				item.Status = BatchItemUnknown
+			}
+		}
+		status.Counts[item.Status]++
+	}
+
+	// Preduplets aren't tracked on the peer: they're settled once accepted
+	running := status.Counts[BatchItemScheduled] + status.Counts[common.TaskStatusTodo] + status.Counts[common.TaskStatusPending]
+	for _, item := range status.Items {
+		if item.Status == BatchItemAccepted && item.Type == envelope.TypeLearn {
+			running++
+		}
+	}
+	failed := status.Counts[BatchItemRejected] + status.Counts[BatchItemFailed] + status.Counts[common.TaskStatusFailed] + status.Counts[BatchItemUnknown]
+	switch {
+	case running > 0:
+		status.Status = BatchRunning
+	case failed > 0:
+		status.Status = BatchFailed
+	default:
+		status.Status = BatchDone
+	}
+	return status, nil
+}
+
+// unconfirmed returns true if an accepted learn item the peer doesn't know of was pushed longer
+// than the batch confirmation timeout ago (at the latest)
+func (s *Server) unconfirmed(batch *batchRecord, item *batchItem) bool {
+	if s.conf.BatchConfirmTimeout <= 0 {
+		return false
+	}
+	pushedBy := batch.CreatedAt
+	if item.PushBy != nil && item.PushBy.After(pushedBy) {
+		pushedBy = *item.PushBy
+	}
+	return time.Since(pushedBy) > s.conf.BatchConfirmTimeout
+}
+
+// peerLearnuplet is what the API reads of the learnuplets queried on the peer
+type peerLearnuplet struct {
+	Key    string  `json:"key"`
+	Status string  `json:"-"`
+	Perf   float64 `json:"perf"`
+}
+
+// peerLearnuplets returns the learnuplets on the peer, by key
+func (s *Server) peerLearnuplets() (map[string]peerLearnuplet, error) {
+	learnuplets := make(map[string]peerLearnuplet)
+	for _, status := range []string{common.TaskStatusTodo, common.TaskStatusPending, common.TaskStatusDone, common.TaskStatusFailed} {
+		learnupletsBytes, err := s.peer.QueryStatusLearnuplet(status)
+		if err != nil {
+			return nil, fmt.Errorf("Error querying %s learnuplets on the peer: %s", status, err)
+		}
+		var queried []peerLearnuplet
+		if err = json.Unmarshal(learnupletsBytes, &queried); err != nil {
+			return nil, fmt.Errorf("Error un-marshaling %s learnuplets: %s", status, err)
+		}
+		for _, learnuplet := range queried {
+			learnuplet.Status = status
+			learnuplets[learnuplet.Key] = learnuplet
+		}
+	}
+	return learnuplets, nil
+}
+
+// getBatch reports the aggregate status of a batch
+func (s *Server) getBatch(c *iris.Context) {
+	if s.batches == nil {
+		c.JSON(iris.StatusNotFound, common.NewAPIError(errBatchNotFound.Error()))
+		return
+	}
+	var batch batchRecord
+	err := s.batches.Get(c.Param("id"), &batch)
+	if err == errBatchNotFound {
+		c.JSON(iris.StatusNotFound, common.NewAPIError(err.Error()))
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(err.Error()))
+		return
+	}
+	status, err := s.batchStatusOf(&batch)
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		c.JSON(iris.StatusBadGateway, common.NewAPIError(err.Error()))
+		return
+	}
+	c.JSON(iris.StatusOK, status)
+}
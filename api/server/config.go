@@ -0,0 +1,321 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package server
+
+import (
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/priority"
+)
+
+// ProducerConfig Compute API configuration, subject to dynamic changes for the addresses of
+// storage & orchestrator endpoints, and any RESTFul HTTP API added in the future.
+type ProducerConfig struct {
+	Hostname             string
+	Port                 int
+	OchestratorEndpoints []string
+	StorageEndpoints     []string
+	StorageUser          string
+	StoragePassword      string
+	Broker               string
+	BrokerHost           string
+	BrokerPort           int
+	BrokerFolder         string
+	CertFile             string
+	KeyFile              string
+	ClientCAFile         string
+	AllowedSubjects      map[string][]string
+	DebugRoutes          bool
+	AdminSubjects        []string
+	AdminToken           string
+	WorkerSubjects       []string
+	ChaincodeFunctions   []string
+	AuditLogFile         string
+	ReadyTimeout         time.Duration
+	OutboxFolder         string
+	OutboxFlushInterval  time.Duration
+	OutboxMaxBackoff     time.Duration
+	OutboxMaxDepth       int
+	ScheduledFolder      string
+	ScheduledInterval    time.Duration
+	SchedulesFolder      string
+	SchedulesInterval    time.Duration
+	ChainMaxWait         time.Duration
+	BatchesFolder        string
+	BatchMaxItems        int
+	BatchConfirmTimeout  time.Duration
+	SweepsFolder         string
+	SweepMaxTrials       int
+	ServingWorkers       []string
+	ServingTimeout       time.Duration
+	ServingCertFile      string
+	ServingKeyFile       string
+	ServingCAFile        string
+	WorkersFolder        string
+	WorkersInterval      time.Duration
+	WorkersRetention     time.Duration
+	DefaultPriority      string
+	ProblemPriorities    map[string]string
+	TraceExporter        string
+	TraceFile            string
+	TraceEndpoint        string
+
+	lock sync.Mutex
+}
+
+// TLSOn returns true if TLS credentials have been provided
+func (c *ProducerConfig) TLSOn() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// MutualTLSOn returns true if clients have to be authenticated with a certificate issued by the
+// client CA bundle
+func (c *ProducerConfig) MutualTLSOn() bool {
+	return c.TLSOn() && c.ClientCAFile != ""
+}
+
+// Lock locks the config store
+func (c *ProducerConfig) Lock() {
+	c.lock.Lock()
+}
+
+// Unlock unlocks the config store to be written to
+func (c *ProducerConfig) Unlock() {
+	c.lock.Unlock()
+}
+
+// NewProducerConfig computes the configuration object. Note that a pointer is returned not to avoid
+// copy but rather to allow the configuration to be dynamically changed.  If this isn't possible
+// with a flags or env. variables, we may later make it possible to get the config from a K/V store
+// such as etcd or consul to allow dynamic conf updates without requiring a restart.
+//
+// When using the config, please keep in mind that it can therefore be changed at any time. If you
+// don't want this to happen, please use the object's Lock()/Unlock() features.
+func NewProducerConfig() (conf *ProducerConfig) {
+	var (
+		hostname      string
+		port          int
+		orchestrators common.MultiStringFlag
+		storages      common.MultiStringFlag
+		storageUser   string
+		storagePass   string
+		broker        string
+		brokerHost    string
+		brokerPort    int
+		brokerFolder  string
+		certFile      string
+		keyFile       string
+		clientCAFile  string
+		allowSubjects common.MultiStringFlag
+		debugRoutes   bool
+		adminSubjects common.MultiStringFlag
+		workerSubject common.MultiStringFlag
+		adminToken    string
+		chaincodeFcns common.MultiStringFlag
+		auditLogFile  string
+		readyTimeout  time.Duration
+		outboxFolder  string
+		outboxFlush   time.Duration
+		outboxBackoff time.Duration
+		outboxDepth   int
+		schedFolder   string
+		schedInterval time.Duration
+		schedsFolder  string
+		schedsInterv  time.Duration
+		chainMaxWait  time.Duration
+		batchesFolder string
+		batchMaxItems int
+		batchConfirm  time.Duration
+		sweepsFolder  string
+		sweepMaxTrial int
+		servingWorker common.MultiStringFlag
+		proxyTimeout  time.Duration
+		servingCert   string
+		servingKey    string
+		servingCA     string
+		workersFolder string
+		reapInterval  time.Duration
+		deadRetention time.Duration
+		defaultPrio   string
+		problemPrios  common.MultiStringFlag
+		traceExporter string
+		traceFile     string
+		traceEndpoint string
+	)
+
+	// CLI Flags
+	flag.StringVar(&hostname, "host", "0.0.0.0", "The hostname our server will be listening on")
+	flag.IntVar(&port, "port", 8000, "The port our compute API will be listening on")
+	flag.Var(&orchestrators, "orchestrator", "List of endpoints (scheme and port included) for the orchestrators we want to bind to.")
+	flag.Var(&storages, "storage", "List of endpoints (scheme and port included) for the storage nodes to bind to.")
+	flag.StringVar(&storageUser, "storage-user", "", "Basic Authentication username of the storage API (leave blank for no authentication)")
+	flag.StringVar(&storagePass, "storage-password", "", "Basic Authentication password of the storage API")
+	flag.StringVar(&broker, "broker", "mock", "Broker type to use ('nsq', 'embedded' or 'mock')")
+	flag.StringVar(&brokerHost, "broker-host", "nsqd", "The address of the NSQ Broker to talk to")
+	flag.IntVar(&brokerPort, "broker-port", 4160, "The port of the NSQ Broker to talk to")
+	flag.StringVar(&brokerFolder, "broker-dir", "/var/lib/compute/broker", "The folder of the embedded broker (shared with the workers)")
+	flag.StringVar(&certFile, "cert", "", "The TLS certs to serve to clients (leave blank for no TLS)")
+	flag.StringVar(&keyFile, "key", "", "The TLS key used to encrypt connection (leave blank for no TLS)")
+	flag.StringVar(&clientCAFile, "client-ca", "", "CA bundle client certificates are verified against (leave blank for no client authentication, requires -cert and -key)")
+	flag.Var(&allowSubjects, "allow-subject", "Certificate subject (DN or CN) allowed on a route, as <route>=<subject> (use * as route for all routes, routes without entries accept any valid certificate)")
+	flag.BoolVar(&debugRoutes, "debug-routes", false, "Enable the /query and /invoke debug routes (administrators only)")
+	flag.Var(&adminSubjects, "admin-subject", "Certificate subject (DN or CN) of an administrator (requires -client-ca)")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token authenticating administrators, over TLS only (leave blank to only rely on -admin-subject)")
+	flag.Var(&chaincodeFcns, "debug-chaincode-function", "Chaincode function the debug routes are allowed to query/invoke")
+	flag.StringVar(&auditLogFile, "audit-log", "", "File audit records are appended to (leave blank to write them to the standard log)")
+	flag.DurationVar(&readyTimeout, "ready-timeout", 5*time.Second, "Timeout of each dependency check ran by the readiness probe")
+	flag.StringVar(&outboxFolder, "outbox", "", "Folder accepted messages are durably stored in until they're pushed to the broker (e.g. /var/lib/compute-api/outbox, messages are pushed directly if blank)")
+	flag.DurationVar(&outboxFlush, "outbox-flush-interval", 5*time.Second, "Interval between two outbox flushes when no new message is accepted")
+	flag.DurationVar(&outboxBackoff, "outbox-max-backoff", time.Minute, "Maximum delay between two attempts to push outbox messages to a failing broker")
+	flag.IntVar(&outboxDepth, "outbox-max-depth", 10000, "Number of messages waiting in the outbox past which the API isn't ready anymore (0 for no limit)")
+	flag.StringVar(&schedFolder, "scheduled-dir", "", "Folder tasks submitted with a not_before date or a delay are stored in until they're due (e.g. /var/lib/compute-api/scheduled, delayed submission is disabled if blank)")
+	flag.DurationVar(&schedInterval, "scheduled-interval", 10*time.Second, "Interval between two checks for due scheduled tasks")
+	flag.StringVar(&schedsFolder, "schedules-dir", "", "Folder retraining schedules are stored in (e.g. /var/lib/compute-api/schedules, retraining schedules are disabled if blank)")
+	flag.DurationVar(&schedsInterv, "schedules-interval", 30*time.Second, "Interval between two checks for due retraining schedules")
+	flag.DurationVar(&chainMaxWait, "chain-max-wait", 24*time.Hour, "Maximum time a chained learnuplet (rank > 0) is held until its start model is on storage before being pushed anyway (requires -scheduled-dir)")
+	flag.StringVar(&batchesFolder, "batches-dir", "", "Folder submitted batches are stored in, for their status to be queried (e.g. /var/lib/compute-api/batches, batches aren't kept if blank)")
+	flag.IntVar(&batchMaxItems, "batch-max-items", 1000, "Maximum number of uplets in a batch (0 for no limit)")
+	flag.DurationVar(&batchConfirm, "batch-confirm-timeout", time.Hour, "Time after which the accepted learnuplets of a batch the peer doesn't know of are reported unknown, instead of running (0 for never)")
+	flag.StringVar(&sweepsFolder, "sweeps-dir", "", "Folder hyperparameter sweeps are stored in (e.g. /var/lib/compute-api/sweeps, sweeps are disabled if blank)")
+	flag.IntVar(&sweepMaxTrial, "sweep-max-trials", 500, "Maximum number of trials (child learnuplets) of a sweep (0 for no limit)")
+	flag.Var(&servingWorker, "serving-worker", "Endpoint (scheme and port included) of a worker serving models online, prediction requests are proxied to (leave blank to disable online predictions)")
+	flag.DurationVar(&proxyTimeout, "serving-timeout", 3*time.Minute, "Timeout of the online prediction requests proxied to the workers (model loading included)")
+	flag.StringVar(&servingCert, "serving-cert", "", "Client certificate sent to the model servers of the workers, for those requiring mutual TLS")
+	flag.StringVar(&servingKey, "serving-key", "", "Private key of the client certificate sent to the model servers of the workers")
+	flag.StringVar(&servingCA, "serving-ca", "", "CA bundle the certificates of the model servers of the workers are verified against (leave blank for the system roots)")
+	flag.StringVar(&workersFolder, "workers-dir", "", "Folder the leases of the workers sending heartbeats are stored in (e.g. /var/lib/compute-api/workers, the worker registry is disabled if blank)")
+	flag.DurationVar(&reapInterval, "workers-reap-interval", 30*time.Second, "Interval between two checks for workers that missed their heartbeats, whose tasks are recovered")
+	flag.Var(&workerSubject, "worker-subject", "Certificate subject (DN or CN) of a worker, the only clients allowed to post heartbeats under client authentication")
+	flag.DurationVar(&deadRetention, "workers-dead-retention", 24*time.Hour, "How long dead workers are listed by the worker registry (0 to keep them)")
+	flag.StringVar(&defaultPrio, "default-priority", priority.Normal, "Priority of the tasks submitted without any, unless set for their problem ('high', 'normal' or 'low')")
+	flag.Var(&problemPrios, "problem-priority", "Priority of the tasks of a problem submitted without any, as <problem UUID>=<priority>")
+	flag.StringVar(&traceExporter, "trace-exporter", "none", "Trace exporter to use ('none', 'stdout', 'file' or 'otlp')")
+	flag.StringVar(&traceFile, "trace-file", "traces.json", "File the 'file' trace exporter appends spans to")
+	flag.StringVar(&traceEndpoint, "trace-endpoint", "http://otel-collector:4318", "OTLP/HTTP collector the 'otlp' trace exporter posts spans to")
+	flag.Parse()
+
+	// Apply custom defaults on list flags if necessary
+	if len(orchestrators) == 0 {
+		orchestrators = append(orchestrators, "http://orchestrator")
+	}
+
+	if len(storages) == 0 {
+		storages = append(storages, "http://storages")
+	}
+
+	allowedSubjects, err := parseSubjectAllowlist(allowSubjects)
+	if err != nil {
+		log.Panicf("Error parsing -allow-subject flags: %s", err)
+	}
+	problemPriorities, err := ParseProblemPriorities(defaultPrio, problemPrios)
+	if err != nil {
+		log.Panicf("Error parsing -problem-priority flags: %s", err)
+	}
+	if clientCAFile != "" && (certFile == "" || keyFile == "") {
+		log.Panicln("Client authentication (-client-ca) requires TLS to be enabled (-cert and -key)")
+	}
+
+	if adminToken != "" && (certFile == "" || keyFile == "") {
+		log.Panicln("The admin token (-admin-token) requires TLS to be enabled (-cert and -key), not to be sent in clear")
+	}
+	if debugRoutes && len(adminSubjects) == 0 && adminToken == "" {
+		log.Panicln("Debug routes (-debug-routes) require administrator authentication (-admin-subject or -admin-token)")
+	}
+	if clientCAFile != "" && workersFolder != "" && len(workerSubject) == 0 {
+		log.Println("[WARNING] Worker registry enabled under client authentication without any -worker-subject: all heartbeats will be rejected")
+	}
+	if debugRoutes && len(chaincodeFcns) == 0 {
+		log.Println("[WARNING] Debug routes enabled without any -debug-chaincode-function: all calls will be rejected")
+	}
+
+	// Let's create the config structure
+	conf = &ProducerConfig{
+		Hostname:             hostname,
+		Port:                 port,
+		OchestratorEndpoints: orchestrators,
+		StorageEndpoints:     storages,
+		StorageUser:          storageUser,
+		StoragePassword:      storagePass,
+		Broker:               broker,
+		BrokerHost:           brokerHost,
+		BrokerPort:           brokerPort,
+		BrokerFolder:         brokerFolder,
+		CertFile:             certFile,
+		KeyFile:              keyFile,
+		ClientCAFile:         clientCAFile,
+		AllowedSubjects:      allowedSubjects,
+		DebugRoutes:          debugRoutes,
+		AdminSubjects:        adminSubjects,
+		AdminToken:           adminToken,
+		WorkerSubjects:       workerSubject,
+		ChaincodeFunctions:   chaincodeFcns,
+		AuditLogFile:         auditLogFile,
+		ReadyTimeout:         readyTimeout,
+		OutboxFolder:         outboxFolder,
+		OutboxFlushInterval:  outboxFlush,
+		OutboxMaxBackoff:     outboxBackoff,
+		OutboxMaxDepth:       outboxDepth,
+		ScheduledFolder:      schedFolder,
+		ScheduledInterval:    schedInterval,
+		SchedulesFolder:      schedsFolder,
+		SchedulesInterval:    schedsInterv,
+		ChainMaxWait:         chainMaxWait,
+		BatchesFolder:        batchesFolder,
+		BatchMaxItems:        batchMaxItems,
+		BatchConfirmTimeout:  batchConfirm,
+		SweepsFolder:         sweepsFolder,
+		SweepMaxTrials:       sweepMaxTrial,
+		ServingWorkers:       servingWorker,
+		ServingTimeout:       proxyTimeout,
+		ServingCertFile:      servingCert,
+		ServingKeyFile:       servingKey,
+		ServingCAFile:        servingCA,
+		WorkersFolder:        workersFolder,
+		WorkersInterval:      reapInterval,
+		WorkersRetention:     deadRetention,
+		DefaultPriority:      defaultPrio,
+		ProblemPriorities:    problemPriorities,
+		TraceExporter:        traceExporter,
+		TraceFile:            traceFile,
+		TraceEndpoint:        traceEndpoint,
+	}
+	return
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/envelope"
+	"github.com/MorpheoOrg/morpheo-compute/evaluate"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// EvaluateRoute accepts evaluation tasks
+const EvaluateRoute = "/evaluate"
+
+// EvaluationReporter is implemented by the peers that record evaluations: workers report the perf
+// of an evaluation with it, so evaluations are rejected by the API if the peer can't
+type EvaluationReporter interface {
+	ReportEvaluation(key string, model uuid.UUID, status string, perf float64, testPerf map[string]float64) (string, []byte, error)
+}
+
+var errEvaluationsUnsupported = errors.New("Evaluations aren't supported by this peer: their perf can't be recorded on it")
+
+// evaluateSubmission is an evaluation task posted to the API, along with its submission options
+type evaluateSubmission struct {
+	evaluate.Evaluateuplet
+	submitOptions
+}
+
+func (s *Server) submitEvaluateuplet(c *iris.Context) {
+	var submission evaluateSubmission
+
+	// Let's continue the submitter's trace, if any
+	span := s.tracer.StartFromTraceparent("api.submitEvaluateuplet", c.Request.Header.Get(tracing.TraceparentHeader))
+	var err error
+	defer func() { span.End(err) }()
+
+	if err = json.NewDecoder(c.Request.Body).Decode(&submission); err != nil {
+		upletsRejected.WithLabelValues(UpletEvaluate, RejectMalformed).Inc()
+		msg := fmt.Sprintf("Error decoding body to JSON: %s", err)
+		log.Printf("[INFO] %s", msg)
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+		return
+	}
+
+	d, err := s.dispatchOf(submission.submitOptions, submission.Problem, identityOf(c))
+	if err == nil && d.CVFolds > 0 {
+		err = fmt.Errorf("cv_folds only applies to learnuplets")
+	}
+	if err == nil {
+		err = submission.Evaluateuplet.Check()
+	}
+	if err != nil {
+		upletsRejected.WithLabelValues(UpletEvaluate, RejectInvalid).Inc()
+		msg := fmt.Sprintf("Invalid evaluate-uplet: %s", err)
+		log.Printf("[INFO] %s", msg)
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+		return
+	}
+
+	scheduled, err := s.postEvaluateuplet(submission.Evaluateuplet, d, span)
+	if err == errEvaluationsUnsupported {
+		c.JSON(iris.StatusNotImplemented, common.NewAPIError(err.Error()))
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(err.Error()))
+		return
+	}
+	c.JSON(iris.StatusAccepted, accepted("Evaluate-uplet ingested", d, scheduled))
+}
+
+// postEvaluateuplet pushes an evaluation task to the broker, or holds it until it's due and its
+// model is on storage (in which case the scheduled task is returned)
+func (s *Server) postEvaluateuplet(uplet evaluate.Evaluateuplet, d dispatch, parent *tracing.Span) (scheduled *scheduledTask, err error) {
+	span := parent.Child("api.postEvaluateuplet")
+	span.SetAttribute("uplet.key", uplet.Key)
+	span.SetAttribute("uplet.priority", d.Priority)
+	defer func() { span.End(err) }()
+
+	if _, ok := s.peer.(EvaluationReporter); !ok {
+		return nil, errEvaluationsUnsupported
+	}
+
+	// The model may be the ModelEnd of a learnuplet that isn't done yet
+	d.WaitForModels = []uuid.UUID{uplet.Model}
+
+	scheduled, err = s.enqueue(envelope.TypeEvaluate, evaluate.Topic, uplet.Key, uplet, d, span)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to push evaluate-uplet into broker: %s", err)
+	}
+	countAccepted(UpletEvaluate, d)
+	return scheduled, nil
+}
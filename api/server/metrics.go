@@ -0,0 +1,235 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package server
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/kataras/iris.v6"
+)
+
+// Uplet rejection reasons, used as label values for the uplets rejected counter
+const (
+	RejectMalformed = "malformed"
+	RejectInvalid   = "invalid"
+	RejectFormat    = "format"
+)
+
+// Uplet types, used as label values for uplet counters
+const (
+	UpletLearn     = "learnuplet"
+	UpletPred      = "preduplet"
+	UpletAggregate = "aggregateuplet"
+	UpletEvaluate  = "evaluateuplet"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "compute_api",
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests served, by route, method and status code.",
+		},
+		[]string{"route", "method", "status"},
+	)
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "compute_api",
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP requests latency, by route, method and status code.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"route", "method", "status"},
+	)
+	upletsAccepted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "compute_api",
+			Name:      "uplets_accepted_total",
+			Help:      "Number of uplets validated and pushed to the broker, by uplet type.",
+		},
+		[]string{"type"},
+	)
+	upletsRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "compute_api",
+			Name:      "uplets_rejected_total",
+			Help:      "Number of uplets rejected, by uplet type and validation reason.",
+		},
+		[]string{"type", "reason"},
+	)
+	brokerPushFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "compute_api",
+			Name:      "broker_push_failures_total",
+			Help:      "Number of failed pushes to the broker, by topic.",
+		},
+		[]string{"topic"},
+	)
+	relayIterations = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "compute_api",
+			Name:      "relay_iterations_total",
+			Help:      "Number of iterations of the learnuplet relay loop.",
+		},
+	)
+	relayQueryDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "compute_api",
+			Name:      "relay_query_status_learnuplet_duration_seconds",
+			Help:      "Latency of the QueryStatusLearnuplet peer calls made by the relay loop.",
+			Buckets:   prometheus.DefBuckets,
+		},
+	)
+	outboxDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "compute_api",
+			Name:      "outbox_depth",
+			Help:      "Number of accepted messages stored in the outbox and not pushed to the broker yet.",
+		},
+	)
+	scheduledTasks = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "compute_api",
+			Name:      "scheduled_tasks",
+			Help:      "Number of tasks held by the API until their not_before date (or their start model).",
+		},
+	)
+	chainedHeld = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "compute_api",
+			Name:      "chained_learnuplets_held_total",
+			Help:      "Number of chained learnuplets held until their start model is on storage.",
+		},
+	)
+	chainWaitTimeouts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "compute_api",
+			Name:      "chain_wait_timeouts_total",
+			Help:      "Number of chained learnuplets pushed without their start model after their wait deadline.",
+		},
+	)
+	relayBrokerQueueSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "compute_api",
+			Name:      "relay_broker_queue_size",
+			Help:      "Number of learnuplets pushed to the broker by the relay loop and still \"todo\" on the peer.",
+		},
+	)
+	registeredWorkers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "compute_api",
+			Name:      "registered_workers",
+			Help:      "Number of workers in the worker registry, by status.",
+		},
+		[]string{"status"},
+	)
+	workerTasksRecovered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "compute_api",
+			Name:      "worker_tasks_recovered_total",
+			Help:      "Number of tasks of dead workers recovered, by action.",
+		},
+		[]string{"action"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequests,
+		httpRequestDuration,
+		upletsAccepted,
+		upletsRejected,
+		brokerPushFailures,
+		outboxDepth,
+		scheduledTasks,
+		chainedHeld,
+		chainWaitTimeouts,
+		relayIterations,
+		relayQueryDuration,
+		relayBrokerQueueSize,
+		registeredWorkers,
+		workerTasksRecovered,
+	)
+}
+
+// parameterizedRoutes are the routes with path parameters: requests are labeled (and allowed, see
+// subjectAllowed) by route rather than by path
+var parameterizedRoutes = []string{BatchStatusRoute, ScheduledTaskRoute, ScheduleRoute, SweepRoute, ModelPredictRoute, WorkerHeartbeatRoute}
+
+// routeOf returns the route a path was requested on: the parameterized route it matches, or the
+// path itself
+func routeOf(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, route := range parameterizedRoutes {
+		routeSegments := strings.Split(strings.Trim(route, "/"), "/")
+		if len(routeSegments) != len(segments) {
+			continue
+		}
+		matches := true
+		for i, segment := range routeSegments {
+			if !strings.HasPrefix(segment, ":") && segment != segments[i] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return route
+		}
+	}
+	return path
+}
+
+// metricsMiddleware records the count and latency of the requests going through the iris
+// middleware chain
+func metricsMiddleware(c *iris.Context) {
+	start := time.Now()
+	c.Next()
+
+	statusCode := c.ResponseWriter.StatusCode()
+	route := routeOf(c.Path())
+	if statusCode == iris.StatusNotFound {
+		// Let's not create a new time serie for each unknown path we're asked for
+		route = "unmatched"
+	}
+	status := strconv.Itoa(statusCode)
+	method := c.Method()
+
+	httpRequests.WithLabelValues(route, method, status).Inc()
+	httpRequestDuration.WithLabelValues(route, method, status).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,275 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// outboxEntry is a message waiting to be pushed to the broker, as stored on disk
+type outboxEntry struct {
+	Topic string `json:"topic"`
+	Body  []byte `json:"body"`
+	// Batch holds the messages of a batch committed at once (Topic and Body are then empty)
+	Batch []outboxEntry `json:"batch,omitempty"`
+}
+
+// messages returns the messages of an entry, in order
+func (e outboxEntry) messages() []outboxEntry {
+	if len(e.Batch) > 0 {
+		return e.Batch
+	}
+	return []outboxEntry{e}
+}
+
+// outbox is a durable on-disk queue of the messages accepted by the API and not pushed to the
+// broker yet. Messages are written to disk first and a background flusher pushes them (in
+// order) to the broker, retrying with an exponential backoff, and removes them once pushed.
+type outbox struct {
+	folder     string
+	producer   common.Producer
+	interval   time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	wake chan struct{}
+}
+
+// newOutbox creates an outbox storing its entries in folder (created if need be)
+func newOutbox(folder string, producer common.Producer, interval, maxBackoff time.Duration) (*outbox, error) {
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return nil, fmt.Errorf("Error creating outbox folder %s: %s", folder, err)
+	}
+	o := &outbox{
+		folder:     folder,
+		producer:   producer,
+		interval:   interval,
+		minBackoff: time.Second,
+		maxBackoff: maxBackoff,
+		wake:       make(chan struct{}, 1),
+	}
+	o.updateDepth()
+	return o, nil
+}
+
+// Put durably stores a message to be pushed to the broker
+func (o *outbox) Put(topic string, body []byte) error {
+	return o.commit(outboxEntry{Topic: topic, Body: body})
+}
+
+// PutBatch durably stores several messages at once: either all of them are stored, or none
+func (o *outbox) PutBatch(messages []outboxEntry) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	return o.commit(outboxEntry{Batch: messages})
+}
+
+func (o *outbox) commit(entry outboxEntry) error {
+	// Let's write the entry atomically: entries are named after their creation date so that
+	// they're pushed in order
+	name := fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), uuid.NewV4())
+	if err := o.write(name, entry); err != nil {
+		return err
+	}
+
+	o.updateDepth()
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// write (over)writes an entry atomically
+func (o *outbox) write(name string, entry outboxEntry) error {
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("Error marshaling outbox entry: %s", err)
+	}
+
+	if err = writeAtomic(filepath.Join(o.folder, name), entryBytes); err != nil {
+		return fmt.Errorf("Error writing outbox entry %s: %s", name, err)
+	}
+	return nil
+}
+
+// writeAtomic (over)writes a file through a temporary file renamed once synced, the rename being
+// synced along with the folder, so that the file is either fully written or left unchanged by a
+// crash
+func writeAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	// The rename itself only survives a crash once the folder is synced
+	return syncFolder(filepath.Dir(path))
+}
+
+// syncFolder flushes the entries of a folder (such as a file renamed into it) to disk
+func syncFolder(folder string) error {
+	f, err := os.Open(folder)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Depth returns the number of entries (messages or batches of messages) waiting to be pushed
+func (o *outbox) Depth() (int, error) {
+	entries, err := o.entries()
+	return len(entries), err
+}
+
+// FlushUntilKilled pushes the outbox entries to the broker, forever
+func (o *outbox) FlushUntilKilled() {
+	backoff := o.minBackoff
+	for {
+		if err := o.flush(); err != nil {
+			log.Printf("[ERROR][outbox] %s (retrying in %s)", err, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > o.maxBackoff {
+				backoff = o.maxBackoff
+			}
+			continue
+		}
+		backoff = o.minBackoff
+
+		select {
+		case <-o.wake:
+		case <-time.After(o.interval):
+		}
+	}
+}
+
+// flush pushes all the entries to the broker, in order, and stops at the first failure
+func (o *outbox) flush() error {
+	defer o.updateDepth()
+
+	entries, err := o.entries()
+	if err != nil {
+		return err
+	}
+	for _, name := range entries {
+		path := filepath.Join(o.folder, name)
+		entryBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Error reading outbox entry %s: %s", name, err)
+		}
+		var entry outboxEntry
+		if err = json.Unmarshal(entryBytes, &entry); err != nil {
+			// There's no way this entry will ever be pushed, let's put it aside
+			log.Printf("[ERROR][outbox] Corrupted entry %s, moving it aside: %s", name, err)
+			os.Rename(path, path+".corrupted")
+			continue
+		}
+
+		messages := entry.messages()
+		for i, message := range messages {
+			if err = o.producer.Push(message.Topic, message.Body); err != nil {
+				brokerPushFailures.WithLabelValues(message.Topic).Inc()
+				if i > 0 {
+					// Let's not push the first messages of the batch again on the next flush
+					if err2 := o.write(name, outboxEntry{Batch: messages[i:]}); err2 != nil {
+						log.Printf("[ERROR][outbox] %s", err2)
+					}
+				}
+				return fmt.Errorf("Error pushing outbox entry %s into %s: %s", name, message.Topic, err)
+			}
+		}
+		if err = os.Remove(path); err != nil {
+			return fmt.Errorf("Error removing pushed outbox entry %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// entries lists the committed entries, oldest first
+func (o *outbox) entries() ([]string, error) {
+	files, err := ioutil.ReadDir(o.folder)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing outbox folder %s: %s", o.folder, err)
+	}
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (o *outbox) updateDepth() {
+	depth, err := o.Depth()
+	if err != nil {
+		log.Printf("[ERROR][outbox] %s", err)
+		return
+	}
+	outboxDepth.Set(float64(depth))
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-compute/priority"
+)
+
+// ParseProblemPriorities parses <problem UUID>=<priority> entries, after checking the default
+// priority they override
+func ParseProblemPriorities(defaultPriority string, entries []string) (map[string]string, error) {
+	if err := priority.Check(defaultPriority); err != nil {
+		return nil, fmt.Errorf("Invalid default priority: %s", err)
+	}
+	problemPriorities := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid problem priority %q, expected <problem UUID>=<priority>", entry)
+		}
+		problem, err := uuid.FromString(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid problem UUID in %q: %s", entry, err)
+		}
+		if err = priority.Check(parts[1]); err != nil {
+			return nil, err
+		}
+		problemPriorities[problem.String()] = parts[1]
+	}
+	return problemPriorities, nil
+}
+
+// priorityOf returns the priority of a task: the one requested by its submitter if any, the one of
+// its problem otherwise, or the default priority
+func (s *Server) priorityOf(requested string, problem uuid.UUID) (string, error) {
+	if requested != "" {
+		return requested, priority.Check(requested)
+	}
+
+	s.conf.Lock()
+	defer s.conf.Unlock()
+	if p, ok := s.conf.ProblemPriorities[problem.String()]; ok {
+		return p, nil
+	}
+	if s.conf.DefaultPriority == "" {
+		return priority.Normal, nil
+	}
+	return s.conf.DefaultPriority, nil
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// readinessCheck is a named connectivity probe run against one of the API dependencies. info
+// optionally provides details about the dependency state.
+type readinessCheck struct {
+	name  string
+	probe func() error
+	info  func() map[string]interface{}
+}
+
+// dependencyStatus is the per-dependency status returned by the readiness route
+type dependencyStatus struct {
+	Status string                 `json:"status"`
+	Error  string                 `json:"error,omitempty"`
+	Info   map[string]interface{} `json:"info,omitempty"`
+}
+
+// pinger is implemented by producers able to check their connection to the broker by
+// themselves
+type pinger interface {
+	Ping() error
+}
+
+// readinessChecks lists the dependencies the API can't work without
+func (s *Server) readinessChecks() []readinessCheck {
+	checks := []readinessCheck{
+		{name: "broker", probe: s.probeBroker},
+		{name: "peer", probe: s.probePeer},
+	}
+	if s.outbox != nil {
+		checks = append(checks, readinessCheck{name: "outbox", probe: s.probeOutbox, info: s.outboxInfo})
+	}
+	return checks
+}
+
+// ready is a readiness probe: unlike health, it actively checks that the broker and the peer
+// can be reached and returns 503 if any of them can't.
+func (s *Server) ready(c *iris.Context) {
+	s.conf.Lock()
+	timeout := s.conf.ReadyTimeout
+	s.conf.Unlock()
+
+	checks := s.readinessChecks()
+	statuses := make(map[string]dependencyStatus, len(checks))
+
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+	)
+	ready := true
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check readinessCheck) {
+			defer wg.Done()
+			status := dependencyStatus{Status: "ok"}
+			if err := probeWithTimeout(check.probe, timeout); err != nil {
+				status = dependencyStatus{Status: "unavailable", Error: err.Error()}
+			}
+			if check.info != nil {
+				status.Info = check.info()
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			statuses[check.name] = status
+			if status.Status != "ok" {
+				ready = false
+			}
+		}(check)
+	}
+	wg.Wait()
+
+	if !ready {
+		c.JSON(iris.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "dependencies": statuses})
+		return
+	}
+	c.JSON(iris.StatusOK, map[string]interface{}{"status": "ok", "dependencies": statuses})
+}
+
+// probeWithTimeout runs a probe and gives up on it once timeout is over. Note that the probe's
+// goroutine isn't killed, its result is simply discarded.
+func probeWithTimeout(probe func() error, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- probe()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
+// probeBroker checks that our producer can reach the broker
+func (s *Server) probeBroker() error {
+	if p, ok := s.producer.(pinger); ok {
+		return p.Ping()
+	}
+
+	s.conf.Lock()
+	broker := s.conf.Broker
+	address := net.JoinHostPort(s.conf.BrokerHost, strconv.Itoa(s.conf.BrokerPort))
+	timeout := s.conf.ReadyTimeout
+	s.conf.Unlock()
+
+	switch broker {
+	case common.BrokerNSQ:
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err != nil {
+			return fmt.Errorf("Error connecting to NSQ broker %s: %s", address, err)
+		}
+		return conn.Close()
+	default:
+		return nil
+	}
+}
+
+// probeOutbox checks that the outbox can be read and isn't full: past its maximum depth, the
+// broker can't keep up (or is down) and we'd rather have traffic routed elsewhere
+func (s *Server) probeOutbox() error {
+	depth, err := s.outbox.Depth()
+	if err != nil {
+		return err
+	}
+
+	s.conf.Lock()
+	maxDepth := s.conf.OutboxMaxDepth
+	s.conf.Unlock()
+	if maxDepth > 0 && depth >= maxDepth {
+		return fmt.Errorf("Outbox is full (%d messages waiting to be pushed, max %d)", depth, maxDepth)
+	}
+	return nil
+}
+
+func (s *Server) outboxInfo() map[string]interface{} {
+	depth, err := s.outbox.Depth()
+	if err != nil {
+		return nil
+	}
+	return map[string]interface{}{"depth": depth}
+}
+
+// probePeer checks that the peer answers queries
+func (s *Server) probePeer() error {
+	if _, err := s.peer.QueryStatusLearnuplet("todo"); err != nil {
+		return fmt.Errorf("Error querying peer: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// recordStore durably stores JSON records (such as batches or sweeps), as one file per record
+type recordStore struct {
+	folder   string
+	notFound error
+}
+
+// newRecordStore creates a record store in folder (created if need be), whose Get returns
+// notFound for unknown records
+func newRecordStore(folder string, notFound error) (*recordStore, error) {
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return nil, fmt.Errorf("Error creating records folder %s: %s", folder, err)
+	}
+	return &recordStore{folder: folder, notFound: notFound}, nil
+}
+
+// Put (over)writes a record atomically
+func (st *recordStore) Put(id string, record interface{}) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("Error marshaling record %s: %s", id, err)
+	}
+	if err = writeAtomic(st.path(id), recordBytes); err != nil {
+		return fmt.Errorf("Error writing record %s: %s", id, err)
+	}
+	return nil
+}
+
+// Get reads a record into record
+func (st *recordStore) Get(id string, record interface{}) error {
+	recordBytes, err := ioutil.ReadFile(st.path(id))
+	if os.IsNotExist(err) {
+		return st.notFound
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading record %s: %s", id, err)
+	}
+	if err = json.Unmarshal(recordBytes, record); err != nil {
+		return fmt.Errorf("Error un-marshaling record %s: %s", id, err)
+	}
+	return nil
+}
+
+// IDs lists the IDs of the stored records
+func (st *recordStore) IDs() ([]string, error) {
+	files, err := ioutil.ReadDir(st.folder)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing records: %s", err)
+	}
+	var ids []string
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(file.Name(), ".json"))
+	}
+	return ids, nil
+}
+
+// Delete removes a record (removing an unknown record isn't an error)
+func (st *recordStore) Delete(id string) error {
+	if err := os.Remove(st.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing record %s: %s", id, err)
+	}
+	return nil
+}
+
+// path returns the file of a record (IDs can't point outside of the store folder)
+func (st *recordStore) path(id string) string {
+	return filepath.Join(st.folder, filepath.Base(id)+".json")
+}
@@ -0,0 +1,354 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// ScheduledRoute lists the scheduled tasks, ScheduledTaskRoute cancels one of them
+const (
+	ScheduledRoute     = "/scheduled"
+	ScheduledTaskRoute = "/scheduled/:id"
+)
+
+// Suffix of the scheduled tasks being pushed to the broker (they can't be cancelled anymore)
+const scheduledPushingSuffix = ".pushing"
+
+var (
+	errScheduledTaskNotFound = errors.New("Scheduled task not found")
+	errScheduledTaskPushing  = errors.New("Scheduled task is due and already being pushed to the broker")
+)
+
+// scheduledTask is a task held by the API until it's due, as stored on disk
+type scheduledTask struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Key       string    `json:"key"`
+	Priority  string    `json:"priority"`
+	Submitter string    `json:"submitter"`
+	NotBefore time.Time `json:"not_before"`
+	CreatedAt time.Time `json:"created_at"`
+	Topic     string    `json:"topic"`
+	// WaitForModels are the input models of the task (the start model of a chained learnuplet,
+	// the models of an aggregation): the task is held (past NotBefore) until they're on storage,
+	// or until WaitDeadline
+	WaitForModels []string   `json:"wait_for_models,omitempty"`
+	WaitDeadline  *time.Time `json:"wait_deadline,omitempty"`
+	// Message is the enveloped task pushed to Topic once due (omitted from listings)
+	Message []byte `json:"message,omitempty"`
+}
+
+// scheduler durably stores the tasks submitted with a not_before date (one JSON file per task)
+// and pushes them once due. Since tasks are stored on disk, they survive restarts of the API.
+type scheduler struct {
+	folder   string
+	push     func(topic string, message []byte) error
+	interval time.Duration
+	// modelExists tells whether the model a task waits for is on storage (tasks waiting for a
+	// model are pushed right away if nil)
+	modelExists func(model uuid.UUID) (bool, error)
+}
+
+// newScheduler creates a scheduler storing its tasks in folder (created if need be) and pushing
+// them with push. Tasks left half-pushed by a previous run are rescheduled.
+func newScheduler(folder string, push func(topic string, message []byte) error, interval time.Duration) (*scheduler, error) {
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return nil, fmt.Errorf("Error creating scheduled tasks folder %s: %s", folder, err)
+	}
+	s := &scheduler{
+		folder:   folder,
+		push:     push,
+		interval: interval,
+	}
+
+	pushing, err := filepath.Glob(filepath.Join(folder, "*.json"+scheduledPushingSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("Error listing scheduled tasks: %s", err)
+	}
+	for _, path := range pushing {
+		if err = os.Rename(path, strings.TrimSuffix(path, scheduledPushingSuffix)); err != nil {
+			return nil, fmt.Errorf("Error rescheduling %s: %s", path, err)
+		}
+	}
+	s.updateCount()
+	return s, nil
+}
+
+// Add durably stores a task until it's due
+func (s *scheduler) Add(task *scheduledTask) error {
+	taskBytes, err := json.Marshal(task)
+	if err != nil {
+		return fmt.Errorf("Error marshaling scheduled task: %s", err)
+	}
+
+	if err = writeAtomic(s.path(task.ID), taskBytes); err != nil {
+		return fmt.Errorf("Error writing scheduled task %s: %s", task.ID, err)
+	}
+	s.updateCount()
+	return nil
+}
+
+// List returns the scheduled tasks (without their message), the soonest due first
+func (s *scheduler) List() ([]scheduledTask, error) {
+	names, err := filepath.Glob(filepath.Join(s.folder, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("Error listing scheduled tasks: %s", err)
+	}
+	tasks := []scheduledTask{}
+	for _, name := range names {
+		task, err := s.read(name)
+		if os.IsNotExist(err) {
+			// Cancelled or pushed in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		task.Message = nil
+		tasks = append(tasks, *task)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].NotBefore.Before(tasks[j].NotBefore) })
+	return tasks, nil
+}
+
+// Keys returns the keys of the uplets of a type that are scheduled (or being pushed)
+func (s *scheduler) Keys(taskType string) ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(s.folder, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("Error listing scheduled tasks: %s", err)
+	}
+	pushing, err := filepath.Glob(filepath.Join(s.folder, "*.json"+scheduledPushingSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("Error listing scheduled tasks: %s", err)
+	}
+	var keys []string
+	for _, name := range append(names, pushing...) {
+		task, err := s.read(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if task.Type == taskType {
+			keys = append(keys, task.Key)
+		}
+	}
+	return keys, nil
+}
+
+// Cancel removes a scheduled task which isn't being pushed yet
+func (s *scheduler) Cancel(id string) error {
+	defer s.updateCount()
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		if _, err2 := os.Stat(s.path(id) + scheduledPushingSuffix); err2 == nil {
+			return errScheduledTaskPushing
+		}
+		return errScheduledTaskNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("Error cancelling scheduled task %s: %s", id, err)
+	}
+	return nil
+}
+
+// Has returns true if a task is still scheduled (or being pushed)
+func (s *scheduler) Has(id string) bool {
+	if _, err := os.Stat(s.path(id)); err == nil {
+		return true
+	}
+	_, err := os.Stat(s.path(id) + scheduledPushingSuffix)
+	return err == nil
+}
+
+// RunUntilKilled pushes the tasks that are due, forever
+func (s *scheduler) RunUntilKilled() {
+	for {
+		if err := s.pushDue(time.Now()); err != nil {
+			log.Printf("[ERROR][scheduler] %s", err)
+		}
+		time.Sleep(s.interval)
+	}
+}
+
+// pushDue pushes the tasks due at now. Each task is claimed (renamed) before being pushed, so that
+// it can't be cancelled while it's being pushed, and only removed once pushed (the claim is
+// released if the push fails).
+func (s *scheduler) pushDue(now time.Time) error {
+	defer s.updateCount()
+
+	names, err := filepath.Glob(filepath.Join(s.folder, "*.json"))
+	if err != nil {
+		return fmt.Errorf("Error listing scheduled tasks: %s", err)
+	}
+	for _, name := range names {
+		task, err := s.read(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Printf("[ERROR][scheduler] Corrupted task %s, moving it aside: %s", name, err)
+			os.Rename(name, name+".corrupted")
+			continue
+		}
+		if task.NotBefore.After(now) || s.waiting(task, now) {
+			continue
+		}
+
+		claimed := name + scheduledPushingSuffix
+		if err = os.Rename(name, claimed); err != nil {
+			// Cancelled in the meantime
+			continue
+		}
+		if err = s.push(task.Topic, task.Message); err != nil {
+			os.Rename(claimed, name)
+			return fmt.Errorf("Error pushing scheduled task %s into %s: %s", task.ID, task.Topic, err)
+		}
+		if err = os.Remove(claimed); err != nil {
+			return fmt.Errorf("Error removing pushed scheduled task %s: %s", task.ID, err)
+		}
+		log.Printf("[INFO][scheduler] Pushed %s %s (scheduled task %s, due %s)", task.Type, task.Key, task.ID, task.NotBefore.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// waiting returns true if a task is still waiting for its input models to be on storage. Tasks
+// are released once the models are found or once their wait deadline is over, so that a chain
+// whose predecessor failed doesn't stay stuck forever (the worker then fails it for good).
+func (s *scheduler) waiting(task *scheduledTask, now time.Time) bool {
+	if len(task.WaitForModels) == 0 || s.modelExists == nil {
+		return false
+	}
+	if task.WaitDeadline != nil && !task.WaitDeadline.After(now) {
+		log.Printf("[WARNING][scheduler] Input models %v of %s %s still not on storage after its wait deadline, pushing it anyway", task.WaitForModels, task.Type, task.Key)
+		chainWaitTimeouts.Inc()
+		return false
+	}
+	for _, id := range task.WaitForModels {
+		model, err := uuid.FromString(id)
+		if err != nil {
+			log.Printf("[ERROR][scheduler] Invalid input model %q for scheduled task %s, ignoring it", id, task.ID)
+			continue
+		}
+		exists, err := s.modelExists(model)
+		if err != nil {
+			log.Printf("[ERROR][scheduler] Error checking input model %s of %s %s: %s", model, task.Type, task.Key, err)
+			return true
+		}
+		if !exists {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *scheduler) read(path string) (*scheduledTask, error) {
+	taskBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var task scheduledTask
+	if err = json.Unmarshal(taskBytes, &task); err != nil {
+		return nil, fmt.Errorf("Error un-marshaling scheduled task %s: %s", path, err)
+	}
+	return &task, nil
+}
+
+// path returns the file of a scheduled task (IDs can't point outside of the scheduler folder)
+func (s *scheduler) path(id string) string {
+	return filepath.Join(s.folder, filepath.Base(id)+".json")
+}
+
+func (s *scheduler) updateCount() {
+	names, err := filepath.Glob(filepath.Join(s.folder, "*.json"))
+	if err != nil {
+		log.Printf("[ERROR][scheduler] Error listing scheduled tasks: %s", err)
+		return
+	}
+	scheduledTasks.Set(float64(len(names)))
+}
+
+// listScheduled lists the tasks waiting to be due
+func (s *Server) listScheduled(c *iris.Context) {
+	if s.scheduler == nil {
+		c.JSON(iris.StatusOK, []scheduledTask{})
+		return
+	}
+	tasks, err := s.scheduler.List()
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(err.Error()))
+		return
+	}
+	c.JSON(iris.StatusOK, tasks)
+}
+
+// cancelScheduled cancels a task waiting to be due
+func (s *Server) cancelScheduled(c *iris.Context) {
+	id := c.Param("id")
+	if s.scheduler == nil {
+		c.JSON(iris.StatusNotFound, common.NewAPIError(errScheduledTaskNotFound.Error()))
+		return
+	}
+	switch err := s.scheduler.Cancel(id); err {
+	case nil:
+		s.auditf("Scheduled task %s cancelled by %q", id, identityOf(c))
+		c.JSON(iris.StatusOK, map[string]string{"message": "Scheduled task cancelled", "id": id})
+	case errScheduledTaskNotFound:
+		c.JSON(iris.StatusNotFound, common.NewAPIError(err.Error()))
+	case errScheduledTaskPushing:
+		c.JSON(iris.StatusConflict, common.NewAPIError(err.Error()))
+	default:
+		log.Printf("[ERROR] %s", err)
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(err.Error()))
+	}
+}
@@ -0,0 +1,600 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/cron"
+	"github.com/MorpheoOrg/morpheo-compute/priority"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// Retraining schedules routes
+const (
+	SchedulesRoute = "/schedules"
+	ScheduleRoute  = "/schedules/:id"
+)
+
+// LastRunPlaceholder is replaced by the date of the previous run of a schedule (RFC 3339) in its
+// data selection queries, to select the data added since then
+const LastRunPlaceholder = "{{last_run}}"
+
+var errScheduleNotFound = errors.New("Schedule not found")
+
+// learnupletTemplate describes the learnuplets produced by a retraining schedule
+type learnupletTemplate struct {
+	Problem uuid.UUID `json:"problem"`
+	Algo    uuid.UUID `json:"algo"`
+	// TrainDataQuery and TestDataQuery select data on storage, see storageClient
+	TrainDataQuery string `json:"train_data_query"`
+	TestDataQuery  string `json:"test_data_query"`
+	Priority       string `json:"priority,omitempty"`
+	// ModelStart and Rank are those of the first run (a nil ModelStart and a zero Rank to train
+	// from scratch). The following runs start from the model produced by the previous one.
+	ModelStart uuid.UUID `json:"model_start"`
+	Rank       int       `json:"rank"`
+}
+
+// scheduleDefinition is the part of a retraining schedule managed through the API
+type scheduleDefinition struct {
+	Name     string             `json:"name"`
+	Cron     string             `json:"cron"`
+	Enabled  *bool              `json:"enabled,omitempty"`
+	Template learnupletTemplate `json:"template"`
+}
+
+// scheduleRun is a learnuplet produced by a retraining schedule
+type scheduleRun struct {
+	At         time.Time `json:"at"`
+	Key        string    `json:"key"`
+	ModelStart uuid.UUID `json:"model_start"`
+	ModelEnd   uuid.UUID `json:"model_end"`
+	Rank       int       `json:"rank"`
+}
+
+// retrainSchedule produces learnuplets from a template, on a cron schedule
+type retrainSchedule struct {
+	ID string `json:"id"`
+	scheduleDefinition
+	CreatedAt time.Time `json:"created_at"`
+
+	// Run state
+	NextRun   time.Time    `json:"next_run"`
+	Runs      int          `json:"runs"`
+	LastRun   *scheduleRun `json:"last_run,omitempty"`
+	LastError string       `json:"last_error,omitempty"`
+}
+
+// check validates a schedule definition and returns its parsed cron expression
+func (d *scheduleDefinition) check() (*cron.Schedule, error) {
+	if d.Name == "" {
+		return nil, fmt.Errorf("A schedule needs a name")
+	}
+	cronSchedule, err := cron.Parse(d.Cron)
+	if err != nil {
+		return nil, err
+	}
+	t := d.Template
+	if uuid.Equal(t.Problem, uuid.Nil) || uuid.Equal(t.Algo, uuid.Nil) {
+		return nil, fmt.Errorf("The template needs a problem and an algo")
+	}
+	if t.TrainDataQuery == "" || t.TestDataQuery == "" {
+		return nil, fmt.Errorf("The template needs a train and a test data query")
+	}
+	if t.Rank < 0 || (t.Rank > 0) == uuid.Equal(t.ModelStart, uuid.Nil) {
+		return nil, fmt.Errorf("The template needs a model_start if and only if its rank is greater than 0")
+	}
+	if t.Priority != "" {
+		if err = priority.Check(t.Priority); err != nil {
+			return nil, err
+		}
+	}
+	return cronSchedule, nil
+}
+
+// next returns the ModelStart and Rank of the next run: the first run uses the template's, and the
+// following ones start from the model produced by the previous run.
+//
+// Runs are chained optimistically: the next run is produced even if the previous one isn't done
+// training yet (or failed), and it's up to the dispatch to hold it until its ModelStart exists.
+func (r *retrainSchedule) next() (modelStart uuid.UUID, rank int) {
+	if r.LastRun == nil {
+		return r.Template.ModelStart, r.Template.Rank
+	}
+	return r.LastRun.ModelEnd, r.LastRun.Rank + 1
+}
+
+// DataSelector selects the data of the learnuplets produced by retraining schedules
+type DataSelector interface {
+	SelectData(query string) ([]uuid.UUID, error)
+}
+
+// ModelChecker tells whether a model is on storage, so that chained learnuplets can be held until
+// their start model has been produced
+type ModelChecker interface {
+	ModelExists(model uuid.UUID) (bool, error)
+}
+
+// storageClient is both a DataSelector and a ModelChecker relying on the storage API. It selects
+// data through its data listing route: queries are sent as is as the query string of GET /data,
+// and data UUIDs are read from the "uuid" field of the listed items (either a JSON array or an
+// object with an "items" array).
+type storageClient struct {
+	endpoint string
+	user     string
+	password string
+	client   *http.Client
+}
+
+// SelectData lists the UUIDs of the data matching query
+func (s *storageClient) SelectData(query string) ([]uuid.UUID, error) {
+	resp, err := s.get(fmt.Sprintf("/data?%s", query))
+	if err != nil {
+		return nil, fmt.Errorf("Error selecting data on storage: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading data selection response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error selecting data on storage: %s -- Body: %s", resp.Status, body)
+	}
+
+	type item struct {
+		UUID string `json:"uuid"`
+	}
+	var items []item
+	if err = json.Unmarshal(body, &items); err != nil {
+		var page struct {
+			Items []item `json:"items"`
+		}
+		if err = json.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("Error un-marshaling data selection response: %s -- Body: %s", err, body)
+		}
+		items = page.Items
+	}
+	ids := make([]uuid.UUID, 0, len(items))
+	for _, it := range items {
+		id, err := uuid.FromString(it.UUID)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid data UUID %q in data selection response: %s", it.UUID, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ModelExists checks the model metadata route of the storage API
+func (s *storageClient) ModelExists(model uuid.UUID) (bool, error) {
+	resp, err := s.get(fmt.Sprintf("/model/%s", model))
+	if err != nil {
+		return false, fmt.Errorf("Error checking model %s on storage: %s", model, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		body, _ := ioutil.ReadAll(resp.Body)
+		return false, fmt.Errorf("Error checking model %s on storage: %s -- Body: %s", model, resp.Status, body)
+	}
+}
+
+func (s *storageClient) get(route string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(s.endpoint, "/")+route, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error building storage request: %s", err)
+	}
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+	return s.client.Do(req)
+}
+
+// scheduleStore durably stores the retraining schedules, as one JSON file per schedule, and keeps
+// them in memory
+type scheduleStore struct {
+	folder string
+
+	lock      sync.Mutex
+	schedules map[string]*retrainSchedule
+}
+
+// newScheduleStore loads the schedules stored in folder (created if need be)
+func newScheduleStore(folder string) (*scheduleStore, error) {
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return nil, fmt.Errorf("Error creating schedules folder %s: %s", folder, err)
+	}
+	st := &scheduleStore{
+		folder:    folder,
+		schedules: make(map[string]*retrainSchedule),
+	}
+	paths, err := filepath.Glob(filepath.Join(folder, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("Error listing schedules: %s", err)
+	}
+	for _, path := range paths {
+		scheduleBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading schedule %s: %s", path, err)
+		}
+		var sched retrainSchedule
+		if err = json.Unmarshal(scheduleBytes, &sched); err != nil {
+			return nil, fmt.Errorf("Error un-marshaling schedule %s: %s", path, err)
+		}
+		st.schedules[sched.ID] = &sched
+	}
+	return st, nil
+}
+
+// List returns copies of all the schedules, sorted by name
+func (st *scheduleStore) List() []retrainSchedule {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	schedules := make([]retrainSchedule, 0, len(st.schedules))
+	for _, sched := range st.schedules {
+		schedules = append(schedules, *sched)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].Name < schedules[j].Name })
+	return schedules
+}
+
+// Get returns a copy of a schedule
+func (st *scheduleStore) Get(id string) (retrainSchedule, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	sched, ok := st.schedules[id]
+	if !ok {
+		return retrainSchedule{}, errScheduleNotFound
+	}
+	return *sched, nil
+}
+
+// Put creates or replaces a schedule
+func (st *scheduleStore) Put(sched retrainSchedule) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.write(&sched)
+}
+
+// Update applies change to a schedule and stores it, unless change returns an error
+func (st *scheduleStore) Update(id string, change func(*retrainSchedule) error) (retrainSchedule, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	sched, ok := st.schedules[id]
+	if !ok {
+		return retrainSchedule{}, errScheduleNotFound
+	}
+	updated := *sched
+	if err := change(&updated); err != nil {
+		return retrainSchedule{}, err
+	}
+	return updated, st.write(&updated)
+}
+
+// Delete removes a schedule
+func (st *scheduleStore) Delete(id string) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if _, ok := st.schedules[id]; !ok {
+		return errScheduleNotFound
+	}
+	if err := os.Remove(st.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing schedule %s: %s", id, err)
+	}
+	delete(st.schedules, id)
+	return nil
+}
+
+// Due returns the IDs of the enabled schedules whose next run is due at now
+func (st *scheduleStore) Due(now time.Time) []string {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	var due []string
+	for id, sched := range st.schedules {
+		if sched.Enabled != nil && *sched.Enabled && !sched.NextRun.IsZero() && !sched.NextRun.After(now) {
+			due = append(due, id)
+		}
+	}
+	sort.Strings(due)
+	return due
+}
+
+// write atomically stores a schedule on disk, then in memory (the lock must be held)
+func (st *scheduleStore) write(sched *retrainSchedule) error {
+	scheduleBytes, err := json.Marshal(sched)
+	if err != nil {
+		return fmt.Errorf("Error marshaling schedule %s: %s", sched.ID, err)
+	}
+	tmpPath := st.path(sched.ID) + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, scheduleBytes, 0600); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error writing schedule %s: %s", sched.ID, err)
+	}
+	if err = os.Rename(tmpPath, st.path(sched.ID)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error committing schedule %s: %s", sched.ID, err)
+	}
+	st.schedules[sched.ID] = sched
+	return nil
+}
+
+func (st *scheduleStore) path(id string) string {
+	return filepath.Join(st.folder, filepath.Base(id)+".json")
+}
+
+// RunSchedulesUntilKilled produces the learnuplets of the due schedules, forever. Runs missed
+// while the API was down are caught up with a single run.
+func (s *Server) RunSchedulesUntilKilled() {
+	for {
+		now := time.Now().UTC()
+		for _, id := range s.schedules.Due(now) {
+			s.runSchedule(id, now)
+		}
+		s.conf.Lock()
+		interval := s.conf.SchedulesInterval
+		s.conf.Unlock()
+		time.Sleep(interval)
+	}
+}
+
+// runSchedule produces the learnuplet of a schedule's run and plans the next run
+func (s *Server) runSchedule(id string, now time.Time) {
+	sched, err := s.schedules.Get(id)
+	if err != nil {
+		return
+	}
+	span := s.tracer.Start("api.runSchedule", tracing.SpanContext{})
+	span.SetAttribute("schedule.id", id)
+
+	run, runErr := s.produceScheduledLearnuplet(sched, now, span)
+	if runErr != nil {
+		log.Printf("[ERROR][schedules] Run of schedule %s (%s) failed: %s", sched.Name, id, runErr)
+	} else {
+		log.Printf("[INFO][schedules] Schedule %s (%s) produced %s (rank %d)", sched.Name, id, run.Key, run.Rank)
+	}
+	span.End(runErr)
+
+	_, err = s.schedules.Update(id, func(r *retrainSchedule) error {
+		if runErr == nil {
+			r.LastRun = run
+			r.Runs++
+			r.LastError = ""
+		} else {
+			r.LastError = runErr.Error()
+		}
+		cronSchedule, err := cron.Parse(r.Cron)
+		if err != nil {
+			return err
+		}
+		r.NextRun = cronSchedule.Next(now)
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR][schedules] Error updating schedule %s: %s", id, err)
+	}
+}
+
+// produceScheduledLearnuplet resolves a schedule's template into a learnuplet and posts it
+func (s *Server) produceScheduledLearnuplet(sched retrainSchedule, now time.Time, span *tracing.Span) (*scheduleRun, error) {
+	if s.dataSelector == nil {
+		return nil, fmt.Errorf("No data selector configured")
+	}
+	lastRun := time.Unix(0, 0).UTC()
+	if sched.LastRun != nil {
+		lastRun = sched.LastRun.At
+	}
+	selectData := func(query string) ([]uuid.UUID, error) {
+		query = strings.Replace(query, LastRunPlaceholder, url.QueryEscape(lastRun.Format(time.RFC3339)), -1)
+		ids, err := s.dataSelector.SelectData(query)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, fmt.Errorf("No data selected by %q", query)
+		}
+		return ids, nil
+	}
+	trainData, err := selectData(sched.Template.TrainDataQuery)
+	if err != nil {
+		return nil, err
+	}
+	testData, err := selectData(sched.Template.TestDataQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	modelStart, rank := sched.next()
+	learnuplet := common.Learnuplet{
+		Key:         fmt.Sprintf("learnuplet_%s", uuid.NewV4()),
+		Problem:     sched.Template.Problem,
+		Algo:        sched.Template.Algo,
+		TrainData:   trainData,
+		TestData:    testData,
+		ModelStart:  modelStart,
+		ModelEnd:    uuid.NewV4(),
+		Rank:        rank,
+		Status:      common.TaskStatusTodo,
+		RequestDate: int(now.Unix()),
+	}
+
+	taskPriority, err := s.priorityOf(sched.Template.Priority, sched.Template.Problem)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.postLearnuplet(learnuplet, dispatch{Priority: taskPriority, Submitter: "schedule:" + sched.ID}, span); err != nil {
+		return nil, err
+	}
+	return &scheduleRun{
+		At:         now,
+		Key:        learnuplet.Key,
+		ModelStart: learnuplet.ModelStart,
+		ModelEnd:   learnuplet.ModelEnd,
+		Rank:       learnuplet.Rank,
+	}, nil
+}
+
+// configureScheduleRoutes registers the retraining schedules management routes
+func (s *Server) configureScheduleRoutes(app *iris.Framework) {
+	app.Get(SchedulesRoute, s.listSchedules)
+	app.Post(SchedulesRoute, s.createSchedule)
+	app.Get(ScheduleRoute, s.getSchedule)
+	app.Put(ScheduleRoute, s.updateSchedule)
+	app.Delete(ScheduleRoute, s.deleteSchedule)
+}
+
+func (s *Server) listSchedules(c *iris.Context) {
+	c.JSON(iris.StatusOK, s.schedules.List())
+}
+
+func (s *Server) getSchedule(c *iris.Context) {
+	sched, err := s.schedules.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(iris.StatusNotFound, common.NewAPIError(err.Error()))
+		return
+	}
+	c.JSON(iris.StatusOK, sched)
+}
+
+// decodeScheduleDefinition decodes and validates the schedule definition posted, and computes its
+// next run (if enabled, which is the default)
+func decodeScheduleDefinition(c *iris.Context, now time.Time) (def scheduleDefinition, nextRun time.Time, err error) {
+	if err = json.NewDecoder(c.Request.Body).Decode(&def); err != nil {
+		return def, nextRun, fmt.Errorf("Error decoding body to JSON: %s", err)
+	}
+	cronSchedule, err := def.check()
+	if err != nil {
+		return def, nextRun, fmt.Errorf("Invalid schedule: %s", err)
+	}
+	if def.Enabled == nil {
+		enabled := true
+		def.Enabled = &enabled
+	}
+	nextRun = cronSchedule.Next(now)
+	if nextRun.IsZero() {
+		return def, nextRun, fmt.Errorf("Invalid schedule: %q never runs", def.Cron)
+	}
+	return def, nextRun, nil
+}
+
+func (s *Server) createSchedule(c *iris.Context) {
+	now := time.Now().UTC()
+	def, nextRun, err := decodeScheduleDefinition(c, now)
+	if err != nil {
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(err.Error()))
+		return
+	}
+
+	sched := retrainSchedule{
+		ID:                 uuid.NewV4().String(),
+		scheduleDefinition: def,
+		CreatedAt:          now,
+		NextRun:            nextRun,
+	}
+	if err = s.schedules.Put(sched); err != nil {
+		log.Printf("[ERROR] %s", err)
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(err.Error()))
+		return
+	}
+	s.auditf("Schedule %s (%s) created by %q", sched.ID, sched.Name, identityOf(c))
+	c.JSON(iris.StatusCreated, sched)
+}
+
+// updateSchedule replaces the definition of a schedule, keeping its run state (the next run
+// starts from the model produced by the last one)
+func (s *Server) updateSchedule(c *iris.Context) {
+	now := time.Now().UTC()
+	def, nextRun, err := decodeScheduleDefinition(c, now)
+	if err != nil {
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(err.Error()))
+		return
+	}
+
+	id := c.Param("id")
+	sched, err := s.schedules.Update(id, func(r *retrainSchedule) error {
+		r.scheduleDefinition = def
+		r.NextRun = nextRun
+		return nil
+	})
+	if err == errScheduleNotFound {
+		c.JSON(iris.StatusNotFound, common.NewAPIError(err.Error()))
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(err.Error()))
+		return
+	}
+	s.auditf("Schedule %s (%s) updated by %q", id, sched.Name, identityOf(c))
+	c.JSON(iris.StatusOK, sched)
+}
+
+func (s *Server) deleteSchedule(c *iris.Context) {
+	id := c.Param("id")
+	err := s.schedules.Delete(id)
+	if err == errScheduleNotFound {
+		c.JSON(iris.StatusNotFound, common.NewAPIError(err.Error()))
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(err.Error()))
+		return
+	}
+	s.auditf("Schedule %s deleted by %q", id, identityOf(c))
+	c.JSON(iris.StatusOK, map[string]string{"message": "Schedule deleted", "id": id})
+}
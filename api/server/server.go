@@ -0,0 +1,887 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/satori/go.uuid"
+	"gopkg.in/kataras/iris.v6"
+	"gopkg.in/kataras/iris.v6/adaptors/httprouter"
+	"gopkg.in/kataras/iris.v6/middleware/logger"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/client"
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/broker"
+	"github.com/MorpheoOrg/morpheo-compute/envelope"
+	"github.com/MorpheoOrg/morpheo-compute/predict"
+	"github.com/MorpheoOrg/morpheo-compute/priority"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// TODO: write tests for the two main views
+
+// Available HTTP Routes
+const (
+	RootRoute    = "/"
+	HealthRoute  = "/health"
+	ReadyRoute   = "/ready"
+	MetricsRoute = "/metrics"
+	LearnRoute   = "/learn"
+	PredRoute    = "/pred"
+)
+
+// SubmitterRelay is the submitter identity of the learnuplets relayed from the peer
+const SubmitterRelay = "relay"
+
+// Server is the compute API: it validates the uplets it's given (or relays from the peer) and
+// puts them in the broker
+type Server struct {
+	conf     *ProducerConfig
+	producer common.Producer
+	peer     client.Peer
+	tracer   *tracing.Tracer
+	audit    *log.Logger
+	// outbox stores accepted messages until they're pushed to the broker (nil if disabled)
+	outbox *outbox
+	// scheduler holds the tasks submitted with a not_before date until they're due (nil if disabled)
+	scheduler *scheduler
+	// schedules produce learnuplets periodically (nil if disabled), with data selected by
+	// dataSelector
+	schedules    *scheduleStore
+	dataSelector DataSelector
+	// batches and sweeps store the submitted batches and sweeps, for their status to be queried
+	// (nil if disabled)
+	batches *recordStore
+	sweeps  *recordStore
+	// modelChecker tells whether the start model of chained learnuplets is on storage yet (they
+	// aren't held if nil)
+	modelChecker ModelChecker
+	// predictor answers online prediction requests (they're rejected if nil)
+	predictor Predictor
+	// workers stores the leases of the workers sending heartbeats (nil if the registry is
+	// disabled), read and renewed under workersLock
+	workers     *recordStore
+	workersLock sync.Mutex
+	// requeued are the tasks of dead workers pushed again, with when they were, by key (only used
+	// if the broker doesn't redeliver messages, under workersLock)
+	requeued map[string]time.Time
+	// resetLearnuplets are the learnuplets of dead workers reset to todo on the peer, that the
+	// relay mustn't push again since the broker redelivers them
+	resetLearnuplets     []string
+	resetLearnupletsLock sync.Mutex
+}
+
+func (s *Server) configureRoutes(app *iris.Framework) {
+	app.Get(RootRoute, s.index)
+	app.Get(HealthRoute, s.health)
+	app.Get(ReadyRoute, s.ready)
+	app.Get(MetricsRoute, iris.ToHandler(promhttp.Handler()))
+	app.Post(LearnRoute, s.submitLearnuplet)
+	app.Post(PredRoute, s.postPreduplet)
+	app.Post(AggregateRoute, s.submitAggregateuplet)
+	app.Post(EvaluateRoute, s.submitEvaluateuplet)
+	app.Get(ScheduledRoute, s.listScheduled)
+	app.Delete(ScheduledTaskRoute, s.cancelScheduled)
+	app.Post(BatchRoute, s.submitBatch)
+	app.Get(BatchStatusRoute, s.getBatch)
+	app.Post(SweepsRoute, s.submitSweep)
+	app.Get(SweepRoute, s.getSweep)
+	app.Post(ModelPredictRoute, s.predictModel)
+	s.configureWorkerRoutes(app)
+
+	s.conf.Lock()
+	debug := s.conf.DebugRoutes
+	s.conf.Unlock()
+	if debug {
+		s.configureDebugRoutes(app)
+	}
+	if s.schedules != nil {
+		s.configureScheduleRoutes(app)
+	}
+}
+
+// SetIrisApp sets the base for the Iris App
+func (s *Server) SetIrisApp() *iris.Framework {
+	// Iris setup
+	app := iris.New()
+	app.Adapt(iris.DevLogger())
+	app.Adapt(httprouter.New())
+
+	// Logging middleware configuration
+	customLogger := logger.New(logger.Config{
+		Status: true,
+		IP:     true,
+		Method: true,
+		Path:   true,
+	})
+	app.Use(customLogger)
+	app.Use(iris.HandlerFunc(metricsMiddleware))
+	app.Use(iris.HandlerFunc(s.authMiddleware))
+
+	s.configureRoutes(app)
+	return app
+}
+
+// NewProducer creates the producer of the configured broker
+func NewProducer(conf *ProducerConfig) (common.Producer, error) {
+	switch conf.Broker {
+	case common.BrokerNSQ:
+		return common.NewNSQProducer(conf.BrokerHost, conf.BrokerPort)
+	case broker.BrokerEmbedded:
+		return broker.NewEmbeddedProducer(conf.BrokerFolder)
+	case common.BrokerMOCK:
+		return &common.ProducerMOCK{}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported broker (%s). Available brokers: 'nsq', 'embedded', 'mock'", conf.Broker)
+	}
+}
+
+// NewServer creates a Server pushing tasks with the given producer and relaying the learnuplets
+// of the given peer
+func NewServer(conf *ProducerConfig, producer common.Producer, peer client.Peer) (*Server, error) {
+	// Let's set our tracer up
+	exporter, err := tracing.NewExporter(conf.TraceExporter, conf.TraceFile, conf.TraceEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating trace exporter: %s", err)
+	}
+
+	audit, err := newAuditLogger(conf.AuditLogFile)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		conf:     conf,
+		producer: producer,
+		peer:     peer,
+		tracer:   tracing.NewTracer("compute-api", exporter),
+		audit:    audit,
+		requeued: make(map[string]time.Time),
+	}
+
+	// Accepted messages go through our outbox, so that they aren't lost if the broker is down
+	if conf.OutboxFolder != "" {
+		s.outbox, err = newOutbox(conf.OutboxFolder, producer, conf.OutboxFlushInterval, conf.OutboxMaxBackoff)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Tasks submitted with a not_before date are held in the scheduler until they're due
+	if conf.ScheduledFolder != "" {
+		s.scheduler, err = newScheduler(conf.ScheduledFolder, s.push, conf.ScheduledInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Retraining schedules select their data on (the first) storage, and chained learnuplets are
+	// held until their start model is found there, unless told otherwise
+	if len(conf.StorageEndpoints) > 0 {
+		storage := &storageClient{
+			endpoint: conf.StorageEndpoints[0],
+			user:     conf.StorageUser,
+			password: conf.StoragePassword,
+			client:   &http.Client{Timeout: time.Minute},
+		}
+		s.dataSelector = storage
+		s.modelChecker = storage
+	}
+	// Online prediction requests are proxied to the model servers of the workers, if any
+	if len(conf.ServingWorkers) > 0 {
+		client, err := newServingClient(conf)
+		if err != nil {
+			return nil, err
+		}
+		s.predictor = &servingProxy{
+			workers: conf.ServingWorkers,
+			client:  client,
+		}
+	}
+	if conf.SchedulesFolder != "" {
+		s.schedules, err = newScheduleStore(conf.SchedulesFolder)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.scheduler != nil {
+		s.scheduler.modelExists = s.modelExists
+	}
+
+	if conf.BatchesFolder != "" {
+		s.batches, err = newRecordStore(conf.BatchesFolder, errBatchNotFound)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if conf.SweepsFolder != "" {
+		s.sweeps, err = newRecordStore(conf.SweepsFolder, errSweepNotFound)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if conf.WorkersFolder != "" {
+		s.workers, err = newRecordStore(conf.WorkersFolder, errWorkerNotFound)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// SetDataSelector replaces the storage data listing route as the data selector of the retraining
+// schedules
+func (s *Server) SetDataSelector(selector DataSelector) {
+	s.dataSelector = selector
+}
+
+// SetModelChecker replaces the storage model route as the model checker of chained learnuplets
+func (s *Server) SetModelChecker(checker ModelChecker) {
+	s.modelChecker = checker
+}
+
+// modelExists tells whether a model is on storage (models are assumed to be there if there's no
+// way to check)
+func (s *Server) modelExists(model uuid.UUID) (bool, error) {
+	if s.modelChecker == nil {
+		return true, nil
+	}
+	return s.modelChecker.ModelExists(model)
+}
+
+// ListenAndServe flushes the outbox, pushes scheduled tasks, runs retraining schedules and
+// recovers the tasks of dead workers in the background, and serves the API
+func (s *Server) ListenAndServe() error {
+	if s.outbox != nil {
+		go s.outbox.FlushUntilKilled()
+	}
+	if s.scheduler != nil {
+		go s.scheduler.RunUntilKilled()
+	}
+	if s.schedules != nil {
+		go s.RunSchedulesUntilKilled()
+	}
+	if s.workers != nil {
+		go s.RunWorkerReaperUntilKilled()
+	}
+
+	app := s.SetIrisApp()
+
+	// Main server loop
+	if s.conf.MutualTLSOn() {
+		listener, err := newMutualTLSListener(s.conf)
+		if err != nil {
+			return fmt.Errorf("Error setting mutual TLS up: %s", err)
+		}
+		return app.Serve(listener)
+	} else if s.conf.TLSOn() {
+		app.ListenTLS(fmt.Sprintf("%s:%d", s.conf.Hostname, s.conf.Port), s.conf.CertFile, s.conf.KeyFile)
+	} else {
+		app.Listen(fmt.Sprintf("%s:%d", s.conf.Hostname, s.conf.Port))
+	}
+	return nil
+}
+
+func (s *Server) index(c *iris.Context) {
+	c.JSON(iris.StatusOK, []string{RootRoute, HealthRoute, ReadyRoute, MetricsRoute, LearnRoute, PredRoute, AggregateRoute, EvaluateRoute, ScheduledRoute, SchedulesRoute, BatchRoute, SweepsRoute, ModelPredictRoute, WorkersRoute})
+}
+
+// health is a pure liveness probe, see ready for dependencies connectivity
+func (s *Server) health(c *iris.Context) {
+	c.JSON(iris.StatusOK, map[string]string{"status": "ok"})
+}
+
+// submitOptions are the options submitters can post along with an uplet
+type submitOptions struct {
+	Priority string `json:"priority"`
+	// NotBefore holds the task until the given date, Delay until the given duration (e.g. "2h")
+	// has elapsed
+	NotBefore *time.Time `json:"not_before"`
+	Delay     string     `json:"delay"`
+	// CVFolds cross-validates learnuplets on as many folds of their train data
+	CVFolds int `json:"cv_folds"`
+}
+
+// learnSubmission is a learnuplet posted to the API, along with its submission options
+type learnSubmission struct {
+	common.Learnuplet
+	submitOptions
+}
+
+// predSubmission is a preduplet (predicting on one or several data blobs) posted to the API, along
+// with its submission options
+type predSubmission struct {
+	predict.Preduplet
+	submitOptions
+}
+
+// dispatch tells how an accepted task is pushed to the broker
+type dispatch struct {
+	Priority  string
+	Submitter string
+	// NotBefore is the date the task is held until (zero to push it right away)
+	NotBefore time.Time
+	// WaitForModels are the models the task is held until, if they aren't on storage yet
+	WaitForModels []uuid.UUID
+	// Params are the hyperparameters the task is trained with (nil for the algo's defaults)
+	Params map[string]interface{}
+	// CVFolds is the number of cross-validation folds of a learnuplet (0 not to cross-validate)
+	CVFolds int
+	// Push pushes the task once due, instead of the outbox (nil for the outbox). Tasks pushed
+	// with Push are collected to be pushed along with others: they're only counted as accepted
+	// by the caller, once pushed (see countAccepted).
+	Push func(topic string, message []byte) error
+}
+
+// countAccepted counts an accepted uplet, unless it's collected to be pushed along with others
+func countAccepted(upletLabel string, d dispatch) {
+	if d.Push == nil {
+		upletsAccepted.WithLabelValues(upletLabel).Inc()
+	}
+}
+
+// dispatchOf resolves the submission options of a task
+func (s *Server) dispatchOf(opts submitOptions, problem uuid.UUID, submitter string) (d dispatch, err error) {
+	d.Submitter = submitter
+	if d.Priority, err = s.priorityOf(opts.Priority, problem); err != nil {
+		return d, err
+	}
+
+	switch {
+	case opts.NotBefore != nil && opts.Delay != "":
+		return d, fmt.Errorf("Only one of not_before and delay can be set")
+	case opts.NotBefore != nil:
+		d.NotBefore = *opts.NotBefore
+	case opts.Delay != "":
+		delay, err := time.ParseDuration(opts.Delay)
+		if err != nil || delay < 0 {
+			return d, fmt.Errorf("Invalid delay %q: expected a positive duration such as \"90m\"", opts.Delay)
+		}
+		d.NotBefore = time.Now().Add(delay)
+	}
+	if d.NotBefore.After(time.Now()) && s.scheduler == nil {
+		return d, fmt.Errorf("Delayed submission is disabled on this API")
+	}
+	if opts.CVFolds < 0 || opts.CVFolds == 1 {
+		return d, fmt.Errorf("Invalid cv_folds %d: expected at least 2 folds (or 0 not to cross-validate)", opts.CVFolds)
+	}
+	d.CVFolds = opts.CVFolds
+	return d, nil
+}
+
+// accepted is the response to an accepted task, pushed right away or scheduled
+func accepted(message string, d dispatch, scheduled *scheduledTask) map[string]interface{} {
+	response := map[string]interface{}{"message": message, "priority": d.Priority}
+	if scheduled != nil {
+		response["message"] = message + " (scheduled)"
+		response["scheduled_id"] = scheduled.ID
+		response["not_before"] = scheduled.NotBefore
+		if len(scheduled.WaitForModels) > 0 {
+			response["message"] = message + " (held until its input models are on storage)"
+			response["wait_for_models"] = scheduled.WaitForModels
+		}
+	}
+	return response
+}
+
+func (s *Server) submitLearnuplet(c *iris.Context) {
+	var submission learnSubmission
+
+	// Let's continue the submitter's trace, if any
+	span := s.tracer.StartFromTraceparent("api.submitLearnuplet", c.Request.Header.Get(tracing.TraceparentHeader))
+	var err error
+	defer func() { span.End(err) }()
+
+	// Unserializing the request body
+	if err = json.NewDecoder(c.Request.Body).Decode(&submission); err != nil {
+		upletsRejected.WithLabelValues(UpletLearn, RejectMalformed).Inc()
+		msg := fmt.Sprintf("Error decoding body to JSON: %s", err)
+		log.Printf("[INFO] %s", msg)
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+		return
+	}
+
+	d, err := s.dispatchOf(submission.submitOptions, submission.Problem, identityOf(c))
+	if err != nil {
+		upletsRejected.WithLabelValues(UpletLearn, RejectInvalid).Inc()
+		msg := fmt.Sprintf("Invalid learnuplet: %s", err)
+		log.Printf("[INFO] %s", msg)
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+		return
+	}
+
+	if err = submission.Learnuplet.Check(); err == nil {
+		err = checkCVFolds(d.CVFolds, submission.Learnuplet)
+	}
+	if err != nil {
+		upletsRejected.WithLabelValues(UpletLearn, RejectInvalid).Inc()
+		msg := fmt.Sprintf("Invalid learnuplet: %s", err)
+		log.Printf("[INFO] %s", msg)
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+		return
+	}
+
+	scheduled, err := s.postLearnuplet(submission.Learnuplet, d, span)
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(err.Error()))
+		return
+	}
+	c.JSON(iris.StatusAccepted, accepted("Learn-uplet ingested", d, scheduled))
+}
+
+// checkCVFolds makes sure each cross-validation fold of a learnuplet gets train data
+func checkCVFolds(folds int, learnuplet common.Learnuplet) error {
+	if folds > len(learnuplet.TrainData) {
+		return fmt.Errorf("%d cv_folds for %d train data blobs", folds, len(learnuplet.TrainData))
+	}
+	return nil
+}
+
+// postLearnuplet pushes a learnuplet to the broker, or schedules it if it isn't due yet (in which
+// case the scheduled task is returned)
+func (s *Server) postLearnuplet(learnuplet common.Learnuplet, d dispatch, parent *tracing.Span) (scheduled *scheduledTask, err error) {
+	span := parent.Child("api.postLearnuplet")
+	span.SetAttribute("uplet.key", learnuplet.Key)
+	span.SetAttribute("uplet.priority", d.Priority)
+	defer func() { span.End(err) }()
+
+	// Let's check for required arguments presence and validity
+	if err := learnuplet.Check(); err != nil {
+		upletsRejected.WithLabelValues(UpletLearn, RejectInvalid).Inc()
+		return nil, fmt.Errorf("[ERROR] Invalid learnuplet: %s", err)
+	}
+
+	if err := checkCVFolds(d.CVFolds, learnuplet); err != nil {
+		upletsRejected.WithLabelValues(UpletLearn, RejectInvalid).Inc()
+		return nil, fmt.Errorf("[ERROR] Invalid learnuplet: %s", err)
+	}
+
+	// Chained learnuplets can't be trained before their predecessor produced their start model
+	if learnuplet.Rank > 0 {
+		d.WaitForModels = []uuid.UUID{learnuplet.ModelStart}
+	}
+
+	// Let's put our Learnuplet in the right topic so that it gets processed for real
+	scheduled, err = s.enqueue(envelope.TypeLearn, common.TrainTopic, learnuplet.Key, learnuplet, d, span)
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed push learn-uplet into broker: %s", err)
+	}
+	countAccepted(UpletLearn, d)
+	return scheduled, nil
+}
+
+func (s *Server) postPreduplet(c *iris.Context) {
+	var submission predSubmission
+
+	// Let's continue the submitter's trace, if any
+	span := s.tracer.StartFromTraceparent("api.postPreduplet", c.Request.Header.Get(tracing.TraceparentHeader))
+	var err error
+	defer func() { span.End(err) }()
+
+	// Unserializing the request body
+	if err = json.NewDecoder(c.Request.Body).Decode(&submission); err != nil {
+		upletsRejected.WithLabelValues(UpletPred, RejectMalformed).Inc()
+		msg := fmt.Sprintf("Error decoding body to JSON: %s", err)
+		log.Printf("[INFO] %s", msg)
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+		return
+	}
+
+	predUplet := submission.Preduplet
+	d, err := s.dispatchOf(submission.submitOptions, predUplet.Problem, identityOf(c))
+	if err != nil {
+		upletsRejected.WithLabelValues(UpletPred, RejectInvalid).Inc()
+		msg := fmt.Sprintf("Invalid pred-uplet: %s", err)
+		log.Printf("[INFO] %s", msg)
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+		return
+	}
+
+	// Let's check for required arguments presence and validity
+	if err = predUplet.Check(); err != nil {
+		upletsRejected.WithLabelValues(UpletPred, RejectInvalid).Inc()
+		msg := fmt.Sprintf("Invalid pred-uplet: %s", err)
+		log.Printf("[INFO] %s", msg)
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+		return
+	}
+
+	span.SetAttribute("uplet.key", predUplet.Key)
+	span.SetAttribute("uplet.priority", d.Priority)
+	scheduled, err := s.enqueue(envelope.TypePred, common.PredictTopic, predUplet.Key, predUplet, d, span)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to push preduplet task into broker: %s", err)
+		log.Printf("[ERROR] %s", msg)
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(msg))
+		return
+	}
+
+	// TODO: notify the orchestrator we're starting this learning process (using the Go orchestrator
+	// API). We can either do a PATCH the status field or re-PUT the whole learnuplet (since it has
+	// already been computed and is stored in variable taskBytes)
+
+	upletsAccepted.WithLabelValues(UpletPred).Inc()
+	c.JSON(iris.StatusAccepted, accepted("Pred-uplet ingested", d, scheduled))
+}
+
+// enqueue envelopes an uplet and pushes it to the topic of its priority, unless it isn't due yet:
+// it's then handed over to the scheduler and the scheduled task is returned
+func (s *Server) enqueue(taskType, baseTopic, key string, uplet interface{}, d dispatch, span *tracing.Span) (*scheduledTask, error) {
+	task, err := envelope.New(taskType, uplet, span.Traceparent(), d.Submitter)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to envelope %s uplet: %s", taskType, err)
+	}
+	task.Priority = d.Priority
+	task.Params = d.Params
+	if taskType == envelope.TypeLearn {
+		task.CVFolds = d.CVFolds
+	}
+	taskBytes, err := task.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to remarshal %s uplet to JSON: %s", taskType, err)
+	}
+	topic := priority.Topic(baseTopic, d.Priority)
+
+	waitForModels := s.missingModels(key, d.WaitForModels)
+	if !d.NotBefore.After(time.Now()) && len(waitForModels) == 0 {
+		if d.Push != nil {
+			return nil, d.Push(topic, taskBytes)
+		}
+		return nil, s.push(topic, taskBytes)
+	}
+	scheduled := &scheduledTask{
+		ID:        uuid.NewV4().String(),
+		Type:      taskType,
+		Key:       key,
+		Priority:  d.Priority,
+		Submitter: d.Submitter,
+		NotBefore: d.NotBefore.UTC(),
+		CreatedAt: time.Now().UTC(),
+		Topic:     topic,
+		Message:   taskBytes,
+	}
+	if len(waitForModels) > 0 {
+		if scheduled.NotBefore.Before(scheduled.CreatedAt) {
+			scheduled.NotBefore = scheduled.CreatedAt
+		}
+		deadline := scheduled.NotBefore.Add(s.conf.ChainMaxWait)
+		scheduled.WaitForModels = waitForModels
+		scheduled.WaitDeadline = &deadline
+	}
+	if err = s.scheduler.Add(scheduled); err != nil {
+		return nil, err
+	}
+	span.SetAttribute("scheduled.id", scheduled.ID)
+	if len(waitForModels) > 0 {
+		chainedHeld.Inc()
+		span.SetAttribute("scheduled.wait_for_models", strings.Join(waitForModels, ","))
+		log.Printf("[INFO] %s %s held until its input models %v are on storage (scheduled task %s)", taskType, key, waitForModels, scheduled.ID)
+		return scheduled, nil
+	}
+	log.Printf("[INFO] %s %s scheduled for %s (scheduled task %s)", taskType, key, scheduled.NotBefore.Format(time.RFC3339), scheduled.ID)
+	return scheduled, nil
+}
+
+// missingModels returns the models a task has to wait for, those that aren't on storage yet (none
+// if tasks can't be held). Models that can't be checked are considered missing, the scheduler
+// checks them again later.
+func (s *Server) missingModels(key string, models []uuid.UUID) []string {
+	if s.scheduler == nil {
+		return nil
+	}
+	var missing []string
+	for _, model := range models {
+		if uuid.Equal(model, uuid.Nil) {
+			continue
+		}
+		exists, err := s.modelExists(model)
+		if err != nil {
+			log.Printf("[ERROR] Error checking input model %s of %s, holding it: %s", model, key, err)
+		}
+		if err != nil || !exists {
+			missing = append(missing, model.String())
+		}
+	}
+	return missing
+}
+
+// pushAll pushes several messages: through the outbox, they're all committed at once, or none of
+// them is. Otherwise, they're pushed one by one to the broker until one fails. The number of
+// messages pushed is returned.
+func (s *Server) pushAll(messages []outboxEntry) (int, error) {
+	if s.outbox != nil {
+		if err := s.outbox.PutBatch(messages); err != nil {
+			return 0, err
+		}
+		return len(messages), nil
+	}
+	for i, m := range messages {
+		if err := s.push(m.Topic, m.Body); err != nil {
+			return i, err
+		}
+	}
+	return len(messages), nil
+}
+
+// push hands a message over to the outbox, or directly to the broker if the outbox is disabled
+func (s *Server) push(topic string, taskBytes []byte) error {
+	if s.outbox != nil {
+		return s.outbox.Put(topic, taskBytes)
+	}
+	if err := s.producer.Push(topic, taskBytes); err != nil {
+		brokerPushFailures.WithLabelValues(topic).Inc()
+		return err
+	}
+	return nil
+}
+
+// ================================================================================
+// Go routine that pings the blockchain
+// ================================================================================
+// Note that this might be changed after a while if a successfull event listenner
+// can be easily plugged to the blockchain.
+// The code is not clean
+
+// RelayNewLearnuplet polls the peer for "todo" learnuplets and pushes them to the broker, forever
+func (s *Server) RelayNewLearnuplet() {
+	// brokerLearnQueue represents the learnuplet(s) that have been posted to the
+	// broker, but are still with a status "todo".
+	// Without this poor little slice of string, each learnuplet in the broker queue
+	// with a status "todo" would be posted again every 5s... TOFIX this logic
+	var brokerLearnQueue []string
+	// Learnuplets held by the scheduler (chained ones waiting for their start model) were posted
+	// before the API restarted: posting them again would schedule them, and push them, twice
+	if s.scheduler != nil {
+		keys, err := s.scheduler.Keys(envelope.TypeLearn)
+		if err != nil {
+			log.Printf("[ERROR] Failed to list scheduled learnuplets: %s", err)
+		}
+		brokerLearnQueue = keys
+	}
+
+	for {
+		time.Sleep(5 * time.Second)
+		relayIterations.Inc()
+		brokerLearnQueue = s.relayIteration(brokerLearnQueue)
+	}
+}
+
+// relayIteration polls the peer once for "todo" learnuplets, pushes those that aren't in
+// brokerLearnQueue yet to the broker and returns the updated brokerLearnQueue
+func (s *Server) relayIteration(brokerLearnQueue []string) []string {
+	span := s.tracer.Start("api.relayIteration", tracing.SpanContext{})
+	defer span.End(nil)
+
+	// Learnuplets reset by the worker registry are delivered again by the broker already
+	for _, key := range s.takeResetLearnuplets() {
+		if !stringInSlice(key, brokerLearnQueue) {
+			brokerLearnQueue = append(brokerLearnQueue, key)
+		}
+	}
+
+	// Retrieve Learnuplets with status "todo" from peer
+	querySpan := span.Child("peer.QueryStatusLearnuplet")
+	queryStart := time.Now()
+	learnupletsBytes, err := s.peer.QueryStatusLearnuplet("todo")
+	relayQueryDuration.Observe(time.Since(queryStart).Seconds())
+	querySpan.End(err)
+	if err != nil {
+		log.Printf("[ERROR] Failed to queryStatusLearnuplet: %s", err)
+		return brokerLearnQueue
+	}
+
+	// Unmarshal Learnuplets
+	var learnupletsChaincode []common.LearnupletChaincode
+	err = json.Unmarshal(learnupletsBytes, &learnupletsChaincode)
+	if err != nil {
+		log.Printf("[ERROR] Failed to Unmarshal learnuplets: %s", err)
+		return brokerLearnQueue
+	}
+	log.Printf("[INFO] %d learnuplet(s) with status \"todo\" received from peer", len(learnupletsChaincode))
+	if len(learnupletsChaincode) == 0 {
+		return brokerLearnQueue
+	}
+
+	// Convert them in the Compute format (TEMPORARY)
+	var learnuplets []common.Learnuplet
+	for _, learnupletChaincode := range learnupletsChaincode {
+		learnupletFormat, err := learnupletChaincode.LearnupletFormat()
+		if err != nil {
+			log.Printf("[ERROR] Failed to format chaincode-%s: %s", learnupletChaincode.Key, err)
+			upletsRejected.WithLabelValues(UpletLearn, RejectFormat).Inc()
+			continue
+		}
+		// Check learnuplet is valid and add it to the list
+		err = learnupletFormat.Check()
+		if err != nil {
+			log.Printf("[ERROR] Invalid %s: %s", learnupletChaincode.Key, err)
+			upletsRejected.WithLabelValues(UpletLearn, RejectInvalid).Inc()
+			continue
+		}
+		learnuplets = append(learnuplets, learnupletFormat)
+	}
+	if len(learnuplets) == 0 {
+		return brokerLearnQueue
+	}
+
+	// post the learnuplets if not already done
+	var learnupletTodoList []string
+	for _, learnuplet := range learnuplets {
+		learnupletTodoList = append(learnupletTodoList, learnuplet.Key)
+		if stringInSlice(learnuplet.Key, brokerLearnQueue) {
+			continue
+		}
+		log.Printf("[DEBUG] Posting %s to broker", learnuplet.Key)
+		// Learnuplets relayed from the peer get the priority of their problem
+		taskPriority, err := s.priorityOf("", learnuplet.Problem)
+		if err != nil {
+			log.Printf("[ERROR] Failed to prioritize %s: %s", learnuplet.Key, err)
+			continue
+		}
+		_, err = s.postLearnuplet(learnuplet, dispatch{Priority: taskPriority, Submitter: SubmitterRelay}, span)
+		if err != nil {
+			log.Printf("[ERROR] Failed to postLearnuplet: %s", err)
+			continue
+		}
+		brokerLearnQueue = append(brokerLearnQueue, learnuplet.Key)
+	}
+	relayBrokerQueueSize.Set(float64(len(brokerLearnQueue)))
+
+	// Clean brokerLearnQueue
+	log.Printf("[INFO] %d learnuplet(s) already in the broker queue", len(brokerLearnQueue))
+	for len(brokerLearnQueue) > 0 {
+		if !stringInSlice(brokerLearnQueue[0], learnupletTodoList) {
+			brokerLearnQueue = brokerLearnQueue[1:]
+			relayBrokerQueueSize.Set(float64(len(brokerLearnQueue)))
+			log.Printf("[INFO] %d learnuplet(s) already in the broker queue", len(brokerLearnQueue))
+		} else {
+			break
+		}
+	}
+	return brokerLearnQueue
+}
+
+func stringInSlice(a string, list []string) bool {
+	for _, b := range list {
+		if b == a {
+			return true
+		}
+	}
+	return false
+}
+
+// ================================================================================
+// Debug routes (only registered in debug mode, for administrators, see admin.go)
+// ================================================================================
+
+// query allows to query the blockchain via URL PARAMETERS
+func (s *Server) query(c *iris.Context) {
+	// Retrieve and format URL parameters
+	queryFcn := c.URLParam("fcn")
+	queryArgs := strings.Split(c.URLParam("args"), "|")
+
+	if !s.chaincodeFunctionAllowed(queryFcn) {
+		s.auditf("Rejected query fcn=%q args=%q by %q: function not allowed", queryFcn, queryArgs, identityOf(c))
+		c.JSON(iris.StatusForbidden, map[string]string{"error": fmt.Sprintf("Chaincode function %q isn't allowed", queryFcn)})
+		return
+	}
+
+	// Query the peer
+	query, err := s.peer.Query(queryFcn, queryArgs)
+	if err != nil {
+		s.auditf("Query fcn=%q args=%q by %q failed: %s", queryFcn, queryArgs, identityOf(c), err)
+		c.JSON(iris.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	s.auditf("Query fcn=%q args=%q by %q succeeded", queryFcn, queryArgs, identityOf(c))
+	showJSON(c, query)
+}
+
+// invoke allows to invoke a transaction in the blockchain via URL PARAMETERS
+func (s *Server) invoke(c *iris.Context) {
+	// Retrieve and format URL parameters
+	queryFcn := c.URLParam("fcn")
+	queryArgs := strings.Split(c.URLParam("args"), "|")
+
+	if !s.chaincodeFunctionAllowed(queryFcn) {
+		s.auditf("Rejected invoke fcn=%q args=%q by %q: function not allowed", queryFcn, queryArgs, identityOf(c))
+		c.JSON(iris.StatusForbidden, map[string]string{"error": fmt.Sprintf("Chaincode function %q isn't allowed", queryFcn)})
+		return
+	}
+
+	// Invoke the peer
+	id, nonce, err := s.peer.Invoke(queryFcn, queryArgs)
+	if err != nil {
+		s.auditf("Invoke fcn=%q args=%q by %q failed: %s", queryFcn, queryArgs, identityOf(c), err)
+		c.JSON(iris.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	s.auditf("Invoke fcn=%q args=%q by %q succeeded: transaction %s", queryFcn, queryArgs, identityOf(c), id)
+
+	// Display the results
+	c.JSON(iris.StatusOK, map[string]string{"id": id, "nonce": string(nonce)})
+}
+
+func showJSON(c *iris.Context, bytesJSON []byte) {
+	if len(bytesJSON) == 0 {
+		c.JSON(iris.StatusInternalServerError, map[string]string{})
+		return
+	}
+
+	var m []map[string]interface{}
+	var m2 map[string]interface{}
+	if err := json.Unmarshal(bytesJSON, &m); err != nil {
+		if err := json.Unmarshal(bytesJSON, &m2); err != nil {
+			msg := fmt.Sprintf("Failed to unmarshal peer response: %s. RAW bytes: %s", err, bytesJSON)
+			c.JSON(iris.StatusInternalServerError, map[string]string{"error": msg})
+			return
+		}
+		c.JSON(iris.StatusOK, m2)
+		return
+	}
+	// Display the results
+	c.JSON(iris.StatusOK, m)
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// ModelPredictRoute answers online prediction requests on a trained model
+const ModelPredictRoute = "/models/:id/predict"
+
+// Predictor answers online prediction requests on a model, returning the HTTP status and body of
+// the prediction response
+type Predictor interface {
+	Predict(model uuid.UUID, request []byte) (status int, response []byte, err error)
+}
+
+// servingProxy is a Predictor proxying prediction requests to the model servers of the workers.
+// Each model is sent to the worker of highest rendezvous hash, so that it's only loaded by one of
+// them, and to the next ones if that worker can't be reached.
+type servingProxy struct {
+	workers []string
+	client  *http.Client
+}
+
+// newServingClient creates the client of the model servers of the workers, sending them the
+// configured client certificate (if any) and verifying theirs against the configured CA bundle (if
+// any)
+func newServingClient(conf *ProducerConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if conf.ServingCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.ServingCertFile, conf.ServingKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading model servers client key pair: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if conf.ServingCAFile != "" {
+		caBundle, err := ioutil.ReadFile(conf.ServingCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading model servers CA bundle %s: %s", conf.ServingCAFile, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("No certificate found in model servers CA bundle %s", conf.ServingCAFile)
+		}
+	}
+	return &http.Client{
+		Timeout:   conf.ServingTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// Predict forwards a prediction request to the workers serving model
+func (p *servingProxy) Predict(model uuid.UUID, request []byte) (int, []byte, error) {
+	var errs []string
+	for _, worker := range p.rank(model) {
+		url := fmt.Sprintf("%s/models/%s/predict", strings.TrimRight(worker, "/"), model)
+		resp, err := p.client.Post(url, "application/json", bytes.NewReader(request))
+		if err != nil {
+			log.Printf("[WARNING][serving] Error proxying prediction on model %s to %s: %s", model, worker, err)
+			errs = append(errs, err.Error())
+			continue
+		}
+		response, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("[WARNING][serving] Error reading prediction on model %s from %s: %s", model, worker, err)
+			errs = append(errs, err.Error())
+			continue
+		}
+		return resp.StatusCode, response, nil
+	}
+	return 0, nil, fmt.Errorf("Error proxying prediction on model %s, no worker answered: %s", model, strings.Join(errs, "; "))
+}
+
+// rank orders the workers by decreasing rendezvous hash of model
+func (p *servingProxy) rank(model uuid.UUID) []string {
+	score := func(worker string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(worker))
+		h.Write(model.Bytes())
+		return h.Sum64()
+	}
+	workers := append([]string(nil), p.workers...)
+	sort.Slice(workers, func(i, j int) bool { return score(workers[i]) > score(workers[j]) })
+	return workers
+}
+
+// SetPredictor replaces the serving workers proxy as the answerer of online prediction requests
+func (s *Server) SetPredictor(predictor Predictor) {
+	s.predictor = predictor
+}
+
+// predictModel answers an online prediction request, the response of the served model being
+// returned as is
+func (s *Server) predictModel(c *iris.Context) {
+	span := s.tracer.StartFromTraceparent("api.predictModel", c.Request.Header.Get(tracing.TraceparentHeader))
+	var err error
+	defer func() { span.End(err) }()
+
+	model, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(fmt.Sprintf("Invalid model UUID %s: %s", c.Param("id"), err)))
+		return
+	}
+	span.SetAttribute("model.id", model.String())
+	if s.predictor == nil {
+		c.JSON(iris.StatusNotImplemented, common.NewAPIError("Online predictions aren't enabled (see -serving-worker)"))
+		return
+	}
+
+	request, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(fmt.Sprintf("Error reading request body: %s", err)))
+		return
+	}
+	status, response, err := s.predictor.Predict(model, request)
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		c.JSON(iris.StatusBadGateway, common.NewAPIError(err.Error()))
+		return
+	}
+	c.SetHeader("Content-Type", "application/json")
+	c.SetStatusCode(status)
+	c.Write(response)
+}
@@ -0,0 +1,337 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/sweep"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// SweepsRoute accepts hyperparameter sweeps, SweepRoute reports the leaderboard of a sweep
+const (
+	SweepsRoute = "/sweeps"
+	SweepRoute  = "/sweeps/:id"
+)
+
+var errSweepNotFound = errors.New("Sweep not found")
+
+// LearnupletRegisterer is implemented by the peers learnuplets can be created on. The trials of a
+// sweep are registered there before they're pushed, for workers to report them (and the
+// leaderboard to be read back).
+type LearnupletRegisterer interface {
+	RegisterLearnuplet(learnuplet common.Learnuplet) (string, []byte, error)
+}
+
+// sweepSubmission is a hyperparameter sweep posted to the API: a learnuplet (whose key and
+// model_end are ignored) trained once per parameter set of the sweep specification
+type sweepSubmission struct {
+	Name       string            `json:"name"`
+	Learnuplet common.Learnuplet `json:"learnuplet"`
+	// Minimize ranks the lowest performances first
+	Minimize bool `json:"minimize"`
+	sweep.Spec
+	submitOptions
+}
+
+// sweepTrial is a child learnuplet of a sweep, with its status on submission (accepted,
+// scheduled or failed)
+type sweepTrial struct {
+	Key         string       `json:"key"`
+	Params      sweep.Params `json:"params"`
+	ModelEnd    uuid.UUID    `json:"model_end"`
+	Status      string       `json:"status"`
+	Error       string       `json:"error,omitempty"`
+	ScheduledID string       `json:"scheduled_id,omitempty"`
+}
+
+// sweepRecord is a submitted sweep, as stored on disk
+type sweepRecord struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	Submitter string       `json:"submitter"`
+	CreatedAt time.Time    `json:"created_at"`
+	Problem   uuid.UUID    `json:"problem"`
+	Algo      uuid.UUID    `json:"algo"`
+	Minimize  bool         `json:"minimize"`
+	Spec      sweep.Spec   `json:"spec"`
+	Trials    []sweepTrial `json:"trials"`
+}
+
+// sweepStatus is the aggregate status of a sweep: its trials ranked by performance, and the best
+// of them so far
+type sweepStatus struct {
+	ID          string         `json:"id"`
+	Name        string         `json:"name"`
+	Status      string         `json:"status"`
+	Counts      map[string]int `json:"counts"`
+	Leaderboard []sweep.Result `json:"leaderboard"`
+	Best        *sweep.Result  `json:"best"`
+}
+
+// submitSweep fans a sweep out into one child learnuplet per parameter set. The children are
+// registered on the peer, then pushed at once through the outbox (or scheduled together), and the
+// workers mount their parameters as params.json in the training container.
+func (s *Server) submitSweep(c *iris.Context) {
+	span := s.tracer.StartFromTraceparent("api.submitSweep", c.Request.Header.Get(tracing.TraceparentHeader))
+	var err error
+	defer func() { span.End(err) }()
+
+	if s.sweeps == nil {
+		c.JSON(iris.StatusBadRequest, common.NewAPIError("Sweeps are disabled on this API"))
+		return
+	}
+	registerer, ok := s.peer.(LearnupletRegisterer)
+	if !ok {
+		c.JSON(iris.StatusNotImplemented, common.NewAPIError("Sweeps aren't supported by this peer: their trials can't be registered on it"))
+		return
+	}
+
+	var submission sweepSubmission
+	if err = json.NewDecoder(c.Request.Body).Decode(&submission); err != nil {
+		upletsRejected.WithLabelValues(UpletLearn, RejectMalformed).Inc()
+		msg := fmt.Sprintf("Error decoding body to JSON: %s", err)
+		log.Printf("[INFO] %s", msg)
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+		return
+	}
+
+	d, err := s.dispatchOf(submission.submitOptions, submission.Learnuplet.Problem, identityOf(c))
+	if err == nil {
+		err = submission.Spec.Check(s.conf.SweepMaxTrials)
+	}
+	if err != nil {
+		upletsRejected.WithLabelValues(UpletLearn, RejectInvalid).Inc()
+		msg := fmt.Sprintf("Invalid sweep: %s", err)
+		log.Printf("[INFO] %s", msg)
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+		return
+	}
+
+	now := time.Now().UTC()
+	record := &sweepRecord{
+		ID:        uuid.NewV4().String(),
+		Name:      submission.Name,
+		Submitter: d.Submitter,
+		CreatedAt: now,
+		Problem:   submission.Learnuplet.Problem,
+		Algo:      submission.Learnuplet.Algo,
+		Minimize:  submission.Minimize,
+		Spec:      submission.Spec,
+	}
+	span.SetAttribute("sweep.id", record.ID)
+
+	// Let's build the children, and make sure they're valid before pushing any of them
+	var children []common.Learnuplet
+	for _, params := range submission.Spec.Expand() {
+		child := submission.Learnuplet
+		child.Key = fmt.Sprintf("learnuplet_%s", uuid.NewV4())
+		child.ModelEnd = uuid.NewV4()
+		child.Status = common.TaskStatusTodo
+		child.RequestDate = int(now.Unix())
+		if err = child.Check(); err == nil {
+			err = checkCVFolds(d.CVFolds, child)
+		}
+		if err != nil {
+			upletsRejected.WithLabelValues(UpletLearn, RejectInvalid).Inc()
+			msg := fmt.Sprintf("Invalid sweep learnuplet: %s", err)
+			log.Printf("[INFO] %s", msg)
+			c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+			return
+		}
+		children = append(children, child)
+		record.Trials = append(record.Trials, sweepTrial{Key: child.Key, Params: params, ModelEnd: child.ModelEnd})
+	}
+
+	// The record is stored first, so that the trials can't run without their sweep
+	if err = s.sweeps.Put(record.ID, record); err != nil {
+		log.Printf("[ERROR] %s", err)
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(err.Error()))
+		return
+	}
+
+	var messages []outboxEntry
+	var pending []int
+	for i, child := range children {
+		trial := &record.Trials[i]
+
+		// Trials are registered as pending: they're pushed here, the relay mustn't push them again
+		registered := child
+		registered.Status = common.TaskStatusPending
+		if _, _, err := registerer.RegisterLearnuplet(registered); err != nil {
+			log.Printf("[ERROR] Sweep %s: error registering %s on the peer: %s", record.ID, child.Key, err)
+			trial.Status = BatchItemFailed
+			trial.Error = fmt.Sprintf("Failed to register on the peer: %s", err)
+			continue
+		}
+
+		childDispatch := d
+		childDispatch.Submitter = "sweep:" + record.ID
+		childDispatch.Params = trial.Params
+		childDispatch.Push = func(topic string, message []byte) error {
+			messages = append(messages, outboxEntry{Topic: topic, Body: message})
+			pending = append(pending, i)
+			return nil
+		}
+		scheduled, err := s.postLearnuplet(child, childDispatch, span)
+		switch {
+		case err != nil:
+			trial.Status = BatchItemFailed
+			trial.Error = err.Error()
+		case scheduled != nil:
+			trial.Status = BatchItemScheduled
+			trial.ScheduledID = scheduled.ID
+		default:
+			trial.Status = BatchItemAccepted
+		}
+	}
+	pushed, err := s.pushAll(messages)
+	if err != nil {
+		log.Printf("[ERROR] Sweep %s: %s", record.ID, err)
+		for _, i := range pending[pushed:] {
+			record.Trials[i].Status = BatchItemFailed
+			record.Trials[i].Error = fmt.Sprintf("Failed to push into broker: %s", err)
+		}
+	}
+	if err = s.sweeps.Put(record.ID, record); err != nil {
+		log.Printf("[ERROR] %s", err)
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(err.Error()))
+		return
+	}
+
+	failed := 0
+	for _, trial := range record.Trials {
+		if trial.Status == BatchItemFailed {
+			failed++
+		} else {
+			upletsAccepted.WithLabelValues(UpletLearn).Inc()
+		}
+	}
+	log.Printf("[INFO] Sweep %s (%s) fanned out into %d learnuplet(s), %d failed", record.ID, record.Name, len(record.Trials), failed)
+	response := map[string]interface{}{
+		"message":  fmt.Sprintf("Sweep ingested: %d/%d trial(s) accepted", len(record.Trials)-failed, len(record.Trials)),
+		"sweep_id": record.ID,
+		"trials":   record.Trials,
+	}
+	if failed == len(record.Trials) {
+		c.JSON(iris.StatusInternalServerError, response)
+		return
+	}
+	c.JSON(iris.StatusAccepted, response)
+}
+
+// sweepStatusOf ranks the trials of a sweep by the performance reported on the peer
+func (s *Server) sweepStatusOf(record *sweepRecord) (*sweepStatus, error) {
+	onPeer, err := s.peerLearnuplets()
+	if err != nil {
+		return nil, err
+	}
+
+	status := &sweepStatus{
+		ID:     record.ID,
+		Name:   record.Name,
+		Counts: make(map[string]int),
+	}
+	results := make([]sweep.Result, 0, len(record.Trials))
+	for _, trial := range record.Trials {
+		result := sweep.Result{
+			Key:      trial.Key,
+			Params:   trial.Params,
+			ModelEnd: trial.ModelEnd.String(),
+			Status:   trial.Status,
+		}
+		if result.Status == BatchItemScheduled && s.scheduler != nil && !s.scheduler.Has(trial.ScheduledID) {
+			result.Status = BatchItemAccepted
+		}
+		if learnuplet, ok := onPeer[trial.Key]; ok {
+			result.Status = learnuplet.Status
+			if learnuplet.Status == common.TaskStatusDone {
+				perf := learnuplet.Perf
+				result.Perf = &perf
+			}
+		}
+		status.Counts[result.Status]++
+		results = append(results, result)
+	}
+	status.Leaderboard, status.Best = sweep.Leaderboard(results, record.Minimize)
+
+	settled := status.Counts[common.TaskStatusDone] + status.Counts[common.TaskStatusFailed] + status.Counts[BatchItemFailed]
+	switch {
+	case settled < len(results):
+		status.Status = BatchRunning
+	case status.Best == nil:
+		status.Status = BatchFailed
+	default:
+		status.Status = BatchDone
+	}
+	return status, nil
+}
+
+// getSweep reports the leaderboard of a sweep, and its best model so far
+func (s *Server) getSweep(c *iris.Context) {
+	if s.sweeps == nil {
+		c.JSON(iris.StatusNotFound, common.NewAPIError(errSweepNotFound.Error()))
+		return
+	}
+	var record sweepRecord
+	err := s.sweeps.Get(c.Param("id"), &record)
+	if err == errSweepNotFound {
+		c.JSON(iris.StatusNotFound, common.NewAPIError(err.Error()))
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(err.Error()))
+		return
+	}
+	status, err := s.sweepStatusOf(&record)
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		c.JSON(iris.StatusBadGateway, common.NewAPIError(err.Error()))
+		return
+	}
+	c.JSON(iris.StatusOK, status)
+}
@@ -0,0 +1,420 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/aggregate"
+	"github.com/MorpheoOrg/morpheo-compute/broker"
+	"github.com/MorpheoOrg/morpheo-compute/envelope"
+	"github.com/MorpheoOrg/morpheo-compute/evaluate"
+	"github.com/MorpheoOrg/morpheo-compute/priority"
+	"github.com/MorpheoOrg/morpheo-compute/registry"
+)
+
+// Worker registry routes
+const (
+	WorkersRoute         = "/workers"
+	WorkerHeartbeatRoute = "/workers/:id/heartbeat"
+)
+
+// Actions taken on the tasks of dead workers, used as label values for the recovered tasks counter
+const (
+	RecoverReset     = "reset"
+	RecoverRedeliver = "redeliver"
+	RecoverRequeue   = "requeue"
+	RecoverSkip      = "skip"
+)
+
+// redeliveringBrokers deliver the messages their consumers didn't acknowledge in time (e.g. because
+// they died) again: the tasks of dead workers are left to them
+var redeliveringBrokers = []string{common.BrokerNSQ, broker.BrokerEmbedded, broker.BrokerMemory}
+
+var errWorkerNotFound = errors.New("Worker not found")
+
+// UpletResetter is implemented by the peers that can hand a learnuplet assigned to a worker back
+// ("todo"), for another worker to be assigned it. Learnuplets assigned to another worker in the
+// meantime are left as is.
+type UpletResetter interface {
+	ResetUplet(key, worker string) (string, []byte, error)
+}
+
+func (s *Server) configureWorkerRoutes(app *iris.Framework) {
+	app.Get(WorkersRoute, s.listWorkers)
+	app.Post(WorkerHeartbeatRoute, s.workerOnly(s.postHeartbeat))
+}
+
+// RecordHeartbeat renews the lease of a worker, registering it on its first heartbeat
+func (s *Server) RecordHeartbeat(heartbeat registry.Heartbeat) (*registry.Lease, error) {
+	if s.workers == nil {
+		return nil, fmt.Errorf("The worker registry is disabled")
+	}
+	if err := heartbeat.Check(); err != nil {
+		return nil, fmt.Errorf("Invalid heartbeat: %s", err)
+	}
+
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+
+	var lease registry.Lease
+	err := s.workers.Get(heartbeat.Worker, &lease)
+	switch {
+	case err == errWorkerNotFound:
+		log.Printf("[INFO][registry] Worker %s (version %s) registered, capabilities: %v", heartbeat.Worker, heartbeat.Version, heartbeat.Capabilities)
+	case err != nil:
+		return nil, err
+	case len(lease.Recovered) > 0:
+		log.Printf("[WARNING][registry] Worker %s is sending heartbeats again since it missed them (last seen %s): some of its tasks were recovered already (%v)", heartbeat.Worker, lease.LastSeen, lease.Recovered)
+	}
+	lease.Renew(heartbeat, time.Now().UTC())
+	if err = s.workers.Put(heartbeat.Worker, lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// leases returns the leases of all the registered workers, by worker ID
+func (s *Server) leases() ([]registry.Lease, error) {
+	ids, err := s.workers.IDs()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+	leases := make([]registry.Lease, 0, len(ids))
+	for _, id := range ids {
+		var lease registry.Lease
+		if err = s.workers.Get(id, &lease); err == errWorkerNotFound {
+			// Removed in the meantime
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		leases = append(leases, lease)
+	}
+	return leases, nil
+}
+
+// RunWorkerReaperUntilKilled looks for the workers that missed their heartbeats and recovers
+// their tasks every reap interval, forever
+func (s *Server) RunWorkerReaperUntilKilled() {
+	s.conf.Lock()
+	interval := s.conf.WorkersInterval
+	s.conf.Unlock()
+
+	for {
+		time.Sleep(interval)
+		if err := s.reapWorkers(time.Now().UTC()); err != nil {
+			log.Printf("[ERROR][registry] Error reaping dead workers: %s", err)
+		}
+	}
+}
+
+// reapWorkers marks the workers whose lease expired as dead and recovers the tasks they were
+// running, unless a live worker is running them already (the broker may have redelivered them).
+// A worker stays alive (and expired) until all its tasks are recovered, for the failed recoveries
+// to be attempted again. Dead workers are forgotten after the retention period.
+func (s *Server) reapWorkers(now time.Time) error {
+	s.conf.Lock()
+	retention := s.conf.WorkersRetention
+	s.conf.Unlock()
+
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+
+	leases, err := s.leases()
+	if err != nil {
+		return err
+	}
+	runningOn := make(map[string]string)
+	for _, lease := range leases {
+		if lease.Status == registry.StatusAlive && !lease.Expired(now) {
+			for _, task := range lease.Running {
+				runningOn[task.Key] = lease.Worker
+			}
+		}
+	}
+
+	for key, requeuedAt := range s.requeued {
+		if retention > 0 && now.Sub(requeuedAt) > retention {
+			delete(s.requeued, key)
+		}
+	}
+
+	counts := map[string]int{registry.StatusAlive: 0, registry.StatusDead: 0}
+	for _, lease := range leases {
+		switch {
+		case lease.Expired(now):
+			s.recoverTasks(&lease, runningOn)
+			if len(lease.Recovered) == len(lease.Running) {
+				lease.Kill(now)
+				log.Printf("[WARNING][registry] Worker %s is dead (no heartbeat since %s), %d task(s) recovered", lease.Worker, lease.LastSeen, len(lease.Recovered))
+			}
+			if err = s.workers.Put(lease.Worker, lease); err != nil {
+				return err
+			}
+		case lease.Status == registry.StatusDead && retention > 0 && now.Sub(lease.DiedAt) > retention:
+			if err = s.workers.Delete(lease.Worker); err != nil {
+				return err
+			}
+			continue
+		}
+		counts[lease.Status]++
+	}
+	for status, count := range counts {
+		registeredWorkers.WithLabelValues(status).Set(float64(count))
+	}
+	return nil
+}
+
+// recoverTasks recovers the running tasks of a dead worker that aren't recovered yet, adding them
+// to its recovered tasks
+func (s *Server) recoverTasks(lease *registry.Lease, runningOn map[string]string) {
+	for _, task := range lease.Running {
+		if stringInSlice(task.Key, lease.Recovered) {
+			continue
+		}
+		action := RecoverSkip
+		if task.Key == "" || taskType(task.Topic) == "" {
+			log.Printf("[WARNING][registry] Task of dead worker %s without key or task topic (%s) isn't recovered: %s", lease.Worker, task.Topic, task.Message)
+		} else if worker, ok := runningOn[task.Key]; ok {
+			log.Printf("[INFO][registry] Task %s of dead worker %s is being ran by worker %s already", task.Key, lease.Worker, worker)
+		} else {
+			var err error
+			if action, err = s.recoverTask(lease.Worker, task); err != nil {
+				log.Printf("[ERROR][registry] Error recovering task %s of dead worker %s (will retry): %s", task.Key, lease.Worker, err)
+				continue
+			}
+			log.Printf("[INFO][registry] Task %s of dead worker %s recovered (%s)", task.Key, lease.Worker, action)
+		}
+		workerTasksRecovered.WithLabelValues(action).Inc()
+		lease.Recovered = append(lease.Recovered, task.Key)
+	}
+}
+
+// recoverTask hands a task of a dead worker back: learnuplets are reset to "todo" on the peer (if
+// it can), for the attempt the broker redelivers to be assigned to another worker. Tasks are only
+// pushed again, as a new attempt, if the broker doesn't redeliver messages, and once per delivery.
+func (s *Server) recoverTask(worker string, task registry.Task) (string, error) {
+	taskType := taskType(task.Topic)
+	action := RecoverRedeliver
+	if resetter, ok := s.peer.(UpletResetter); ok && taskType == envelope.TypeLearn {
+		if _, _, err := resetter.ResetUplet(task.Key, worker); err != nil {
+			return "", fmt.Errorf("Error resetting learnuplet %s on the peer: %s", task.Key, err)
+		}
+		// The relay mustn't push it again, now that it's todo
+		s.resetLearnupletsLock.Lock()
+		s.resetLearnuplets = append(s.resetLearnuplets, task.Key)
+		s.resetLearnupletsLock.Unlock()
+		action = RecoverReset
+	}
+
+	s.conf.Lock()
+	redelivers := stringInSlice(s.conf.Broker, redeliveringBrokers)
+	s.conf.Unlock()
+	if redelivers {
+		return action, nil
+	}
+	if requeuedAt, ok := s.requeued[task.Key]; ok && !task.StartedAt.After(requeuedAt) {
+		log.Printf("[INFO][registry] Task %s of dead worker %s was pushed again already, at %s", task.Key, worker, requeuedAt)
+		return action, nil
+	}
+
+	msg, err := envelope.Decode(task.Message, taskType)
+	if err != nil {
+		return "", fmt.Errorf("Error decoding task %s: %s", task.Key, err)
+	}
+	if err = checkTask(msg); err != nil {
+		return "", fmt.Errorf("Invalid task %s: %s", task.Key, err)
+	}
+	message := []byte(task.Message)
+	if msg.SchemaVersion > 0 {
+		msg.Attempt++
+		if message, err = msg.Marshal(); err != nil {
+			return "", fmt.Errorf("Error marshaling task %s: %s", task.Key, err)
+		}
+	}
+	if err = s.push(task.Topic, message); err != nil {
+		return "", fmt.Errorf("Error pushing task %s to %s: %s", task.Key, task.Topic, err)
+	}
+	s.requeued[task.Key] = time.Now().UTC()
+	return RecoverRequeue, nil
+}
+
+// takeResetLearnuplets returns the learnuplets reset since the previous call
+func (s *Server) takeResetLearnuplets() []string {
+	s.resetLearnupletsLock.Lock()
+	defer s.resetLearnupletsLock.Unlock()
+	keys := s.resetLearnuplets
+	s.resetLearnuplets = nil
+	return keys
+}
+
+// taskType returns the type of the tasks pushed to topic, if it's the topic of a task type and
+// priority (workers can't have tasks of dead workers pushed anywhere else)
+func taskType(topic string) string {
+	bases := map[string]string{
+		common.TrainTopic:   envelope.TypeLearn,
+		common.PredictTopic: envelope.TypePred,
+		aggregate.Topic:     envelope.TypeAggregate,
+		evaluate.Topic:      envelope.TypeEvaluate,
+	}
+	for base, taskType := range bases {
+		for _, p := range priority.Levels {
+			if topic == priority.Topic(base, p) {
+				return taskType
+			}
+		}
+	}
+	return ""
+}
+
+// checkTask checks the uplet of a task message, as if it were submitted
+func checkTask(msg *envelope.Envelope) error {
+	var uplet interface {
+		Check() error
+	}
+	switch msg.Type {
+	case envelope.TypeLearn:
+		uplet = &common.Learnuplet{}
+	case envelope.TypePred:
+		uplet = &common.Preduplet{}
+	case envelope.TypeAggregate:
+		uplet = &aggregate.Aggregateuplet{}
+	case envelope.TypeEvaluate:
+		uplet = &evaluate.Evaluateuplet{}
+	default:
+		return fmt.Errorf("unknown task type %q", msg.Type)
+	}
+	if err := msg.Unmarshal(uplet); err != nil {
+		return err
+	}
+	return uplet.Check()
+}
+
+// workerOnly restricts a handler to workers: under client authentication, the clients whose
+// certificate subject is in the worker list
+func (s *Server) workerOnly(handler iris.HandlerFunc) iris.HandlerFunc {
+	return func(c *iris.Context) {
+		s.conf.Lock()
+		mutualTLS := s.conf.MutualTLSOn()
+		workerSubjects := s.conf.WorkerSubjects
+		s.conf.Unlock()
+
+		if mutualTLS {
+			if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+				c.JSON(iris.StatusUnauthorized, common.NewAPIError("A client certificate is required"))
+				return
+			}
+			subject := c.Request.TLS.PeerCertificates[0].Subject
+			if !stringInSlice(subject.String(), workerSubjects) && !stringInSlice(subject.CommonName, workerSubjects) {
+				s.auditf("Rejected %s %s from %s: subject %q isn't a worker", c.Method(), c.Path(), c.Request.RemoteAddr, subject.String())
+				c.JSON(iris.StatusForbidden, common.NewAPIError(fmt.Sprintf("Subject %s isn't a worker", subject.String())))
+				return
+			}
+		}
+		handler(c)
+	}
+}
+
+// postHeartbeat records the heartbeat of a worker, and returns its lease
+func (s *Server) postHeartbeat(c *iris.Context) {
+	if s.workers == nil {
+		c.JSON(iris.StatusNotImplemented, common.NewAPIError("The worker registry is disabled on this API (see -workers-dir)"))
+		return
+	}
+
+	var heartbeat registry.Heartbeat
+	if err := json.NewDecoder(c.Request.Body).Decode(&heartbeat); err != nil {
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(fmt.Sprintf("Error decoding body to JSON: %s", err)))
+		return
+	}
+	if heartbeat.Worker != c.Param("id") {
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(fmt.Sprintf("Heartbeat of worker %q posted for worker %q", heartbeat.Worker, c.Param("id"))))
+		return
+	}
+	if err := heartbeat.Check(); err != nil {
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(fmt.Sprintf("Invalid heartbeat: %s", err)))
+		return
+	}
+
+	lease, err := s.RecordHeartbeat(heartbeat)
+	if err != nil {
+		log.Printf("[ERROR][registry] Error recording heartbeat of worker %s: %s", heartbeat.Worker, err)
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(err.Error()))
+		return
+	}
+	c.JSON(iris.StatusOK, lease)
+}
+
+// listWorkers returns the leases of the registered workers, optionally filtered by status
+func (s *Server) listWorkers(c *iris.Context) {
+	if s.workers == nil {
+		c.JSON(iris.StatusNotImplemented, common.NewAPIError("The worker registry is disabled on this API (see -workers-dir)"))
+		return
+	}
+	status := c.URLParam("status")
+	if status != "" && status != registry.StatusAlive && status != registry.StatusDead {
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(fmt.Sprintf("Invalid status %q: expected %q or %q", status, registry.StatusAlive, registry.StatusDead)))
+		return
+	}
+
+	s.workersLock.Lock()
+	leases, err := s.leases()
+	s.workersLock.Unlock()
+	if err != nil {
+		log.Printf("[ERROR][registry] Error listing workers: %s", err)
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(err.Error()))
+		return
+	}
+
+	workers := []registry.Lease{}
+	for _, lease := range leases {
+		if status == "" || lease.Status == status {
+			workers = append(workers, lease)
+		}
+	}
+	c.JSON(iris.StatusOK, workers)
+}
@@ -0,0 +1,280 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package broker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// EmbeddedProducer pushes messages to the embedded broker folder
+type EmbeddedProducer struct {
+	folder string
+
+	lock   sync.Mutex
+	queues map[string]*queue
+}
+
+// NewEmbeddedProducer creates an EmbeddedProducer writing to folder (created if need be)
+func NewEmbeddedProducer(folder string) (*EmbeddedProducer, error) {
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return nil, fmt.Errorf("Error creating embedded broker folder %s: %s", folder, err)
+	}
+	return &EmbeddedProducer{
+		folder: folder,
+		queues: make(map[string]*queue),
+	}, nil
+}
+
+// Push durably enqueues a message in a topic
+func (p *EmbeddedProducer) Push(topic string, body []byte) error {
+	return p.PushAt(topic, body, time.Now())
+}
+
+// PushAt durably enqueues a message in a topic, to be delivered after notBefore
+func (p *EmbeddedProducer) PushAt(topic string, body []byte, notBefore time.Time) error {
+	q, err := p.queue(topic)
+	if err != nil {
+		return err
+	}
+	return q.push(body, notBefore)
+}
+
+// Ping checks that the broker folder can be written to
+func (p *EmbeddedProducer) Ping() error {
+	f, err := ioutil.TempFile(p.folder, ".ping")
+	if err != nil {
+		return fmt.Errorf("Error writing to embedded broker folder %s: %s", p.folder, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Stop stops the producer (messages are written synchronously, there's nothing to flush)
+func (p *EmbeddedProducer) Stop() {}
+
+func (p *EmbeddedProducer) queue(topic string) (*queue, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if q, ok := p.queues[topic]; ok {
+		return q, nil
+	}
+	q, err := newQueue(p.folder, topic)
+	if err != nil {
+		return nil, err
+	}
+	p.queues[topic] = q
+	return q, nil
+}
+
+// GiveUpper is implemented by the handler errors that have something left to do once the broker
+// gives up on their message (it won't be delivered again), such as reporting their task failed
+type GiveUpper interface {
+	GiveUp()
+}
+
+// giveUp lets the error of the last attempt of a message know that the broker gave up on it
+func giveUp(err error) {
+	if giveUpper, ok := err.(GiveUpper); ok {
+		giveUpper.GiveUp()
+	}
+}
+
+// EmbeddedConsumer consumes messages from the embedded broker folder. Like NSQ, it delivers each
+// message to a single handler at least once: messages whose handler fails are requeued (with a
+// delay growing with the number of attempts), and so are messages whose in-flight timeout is over.
+// Handler errors implementing GiveUpper are told when their message is dropped.
+type EmbeddedConsumer struct {
+	folder       string
+	pollInterval time.Duration
+	requeueDelay time.Duration
+	maxAttempts  int
+
+	groups []topicGroup
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewEmbeddedConsumer creates an EmbeddedConsumer reading from folder. Failed messages are
+// requeued with a delay of attempt*requeueDelay and dropped to the failed folder after maxAttempts
+// attempts (0 meaning no limit).
+func NewEmbeddedConsumer(folder string, pollInterval, requeueDelay time.Duration, maxAttempts int) *EmbeddedConsumer {
+	return &EmbeddedConsumer{
+		folder:       folder,
+		pollInterval: pollInterval,
+		requeueDelay: requeueDelay,
+		maxAttempts:  maxAttempts,
+		stop:         make(chan struct{}),
+	}
+}
+
+// AddHandler registers a message handler on a topic, running at most parallelism messages at once
+// and timing them out after timeout
+func (c *EmbeddedConsumer) AddHandler(topic string, handler func(message []byte) error, parallelism int, timeout time.Duration) {
+	c.AddWeightedHandlers([]WeightedTopic{{Topic: topic, Weight: 1, Handler: handler}}, parallelism, timeout)
+}
+
+// AddWeightedHandlers registers the message handlers of several topics, running at most
+// parallelism messages at once between them (see WeightedTopic) and timing them out after timeout
+func (c *EmbeddedConsumer) AddWeightedHandlers(topics []WeightedTopic, parallelism int, timeout time.Duration) {
+	c.groups = append(c.groups, newTopicGroup(topics, parallelism, timeout))
+}
+
+// Start starts consuming messages in the background
+func (c *EmbeddedConsumer) Start() error {
+	for _, g := range c.groups {
+		queues := make([]*queue, 0, len(g.topics))
+		for _, topic := range g.topics {
+			q, err := newQueue(c.folder, topic.Topic)
+			if err != nil {
+				return err
+			}
+			queues = append(queues, q)
+			c.wg.Add(1)
+			go c.reapUntilStopped(q)
+		}
+		for i := 0; i < g.parallelism; i++ {
+			c.wg.Add(1)
+			go c.consumeUntilStopped(queues, g)
+		}
+	}
+	return nil
+}
+
+// Stop stops consuming and waits for the running handlers to return
+func (c *EmbeddedConsumer) Stop() {
+	close(c.stop)
+	c.wg.Wait()
+}
+
+// ConsumeUntilKilled consumes messages until SIGINT or SIGTERM is received, and then waits for
+// the running handlers to return
+func (c *EmbeddedConsumer) ConsumeUntilKilled() {
+	if err := c.Start(); err != nil {
+		log.Panicf("[FATAL ERROR] Impossible to start the embedded broker consumer: %s", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	log.Println("[INFO][embedded-broker] Stopping consumer, waiting for running handlers to return...")
+	c.Stop()
+}
+
+func (c *EmbeddedConsumer) consumeUntilStopped(queues []*queue, g topicGroup) {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+
+		if !c.claimNext(queues, g) {
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(c.pollInterval):
+			}
+		}
+	}
+}
+
+// claimNext claims a message from the queues of a group, picked by weight among the queues with
+// messages ready, and handles it. It returns false if no message is ready.
+func (c *EmbeddedConsumer) claimNext(queues []*queue, g topicGroup) bool {
+	for _, i := range g.picker.order() {
+		msg, err := queues[i].claim(g.timeout)
+		if err != nil {
+			log.Printf("[ERROR][embedded-broker] Error claiming message from %s: %s", g.topics[i].Topic, err)
+		}
+		if msg == nil {
+			continue
+		}
+		g.picker.picked(i)
+		c.handle(queues[i], g.topics[i], msg)
+		return true
+	}
+	return false
+}
+
+func (c *EmbeddedConsumer) handle(q *queue, h WeightedTopic, msg *message) {
+	err := h.Handler(msg.body)
+	if err == nil {
+		if err = q.ack(msg); err != nil {
+			log.Printf("[ERROR][embedded-broker] %s", err)
+		}
+		return
+	}
+
+	log.Printf("[ERROR][embedded-broker] Error handling message %s from %s (attempt %d): %s", msg.id, h.Topic, msg.attempt, err)
+	if c.maxAttempts > 0 && msg.attempt >= c.maxAttempts {
+		log.Printf("[ERROR][embedded-broker] Message %s from %s failed %d times, giving up (see %s)", msg.id, h.Topic, msg.attempt, filepath.Join(q.folder, failedFolder))
+		giveUp(err)
+		err = q.fail(msg)
+	} else {
+		err = q.requeue(msg, time.Duration(msg.attempt)*c.requeueDelay)
+	}
+	if err != nil {
+		log.Printf("[ERROR][embedded-broker] %s", err)
+	}
+}
+
+func (c *EmbeddedConsumer) reapUntilStopped(q *queue) {
+	defer c.wg.Done()
+	for {
+		reaped, err := q.reap(c.maxAttempts)
+		if err != nil {
+			log.Printf("[ERROR][embedded-broker] Error requeuing timed out messages: %s", err)
+		} else if reaped > 0 {
+			log.Printf("[INFO][embedded-broker] %d timed out message(s) requeued in %s", reaped, q.folder)
+		}
+
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(c.pollInterval):
+		}
+	}
+}
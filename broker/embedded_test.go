@@ -0,0 +1,131 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package broker
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmbeddedBroker(t *testing.T) {
+	folder, err := ioutil.TempDir("", "morpheo_embedded_broker")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+
+	producer, err := NewEmbeddedProducer(folder)
+	assert.Nil(t, err)
+	assert.Nil(t, producer.Ping())
+	assert.Nil(t, producer.Push("train", []byte("first")))
+	assert.Nil(t, producer.Push("train", []byte("second")))
+
+	// The first message fails once and is requeued
+	var (
+		lock     sync.Mutex
+		received []string
+		failed   bool
+	)
+	done := make(chan struct{})
+	consumer := NewEmbeddedConsumer(folder, 10*time.Millisecond, 10*time.Millisecond, 3)
+	consumer.AddHandler("train", func(message []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if string(message) == "first" && !failed {
+			failed = true
+			return errors.New("transient failure")
+		}
+		received = append(received, string(message))
+		if len(received) == 2 {
+			close(done)
+		}
+		return nil
+	}, 1, time.Minute)
+	assert.Nil(t, consumer.Start())
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Messages weren't consumed in time")
+	}
+	consumer.Stop()
+
+	assert.Equal(t, []string{"second", "first"}, received)
+	q, err := newQueue(folder, "train")
+	assert.Nil(t, err)
+	depth, err := q.depth()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, depth)
+}
+
+func TestEmbeddedBrokerInflightTimeout(t *testing.T) {
+	folder, err := ioutil.TempDir("", "morpheo_embedded_broker")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+
+	q, err := newQueue(folder, "train")
+	assert.Nil(t, err)
+	assert.Nil(t, q.push([]byte("task"), time.Now()))
+
+	// A consumer claims the message and dies
+	msg, err := q.claim(-time.Second)
+	assert.Nil(t, err)
+	assert.NotNil(t, msg)
+	assert.Equal(t, 1, msg.attempt)
+
+	// Its deadline being over, the message gets requeued for a second attempt
+	reaped, err := q.reap(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, reaped)
+
+	msg, err = q.claim(time.Minute)
+	assert.Nil(t, err)
+	assert.NotNil(t, msg)
+	assert.Equal(t, 2, msg.attempt)
+	assert.Equal(t, "task", string(msg.body))
+	assert.NotNil(t, q.requeue(&message{name: "missing-id-1", id: "id", attempt: 1}, 0))
+
+	// Messages aren't delivered before their not-before date
+	assert.Nil(t, q.ack(msg))
+	assert.Nil(t, q.push([]byte("later"), time.Now().Add(time.Hour)))
+	msg, err = q.claim(time.Minute)
+	assert.Nil(t, err)
+	assert.Nil(t, msg)
+}
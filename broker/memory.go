@@ -0,0 +1,221 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package broker
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// BrokerMemory is the broker type of the in-process MemoryBroker
+const BrokerMemory = "memory"
+
+// memoryMessage is a message waiting in a MemoryBroker topic
+type memoryMessage struct {
+	body    []byte
+	attempt int
+}
+
+// MemoryBroker is an in-process broker, for the producer and the consumers living in the same
+// process (the all-in-one command and tests). It delivers messages the same way as the
+// EmbeddedConsumer, except that they don't survive restarts.
+type MemoryBroker struct {
+	requeueDelay time.Duration
+	maxAttempts  int
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	topics  map[string][]memoryMessage
+	groups  []topicGroup
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// NewMemoryBroker creates a MemoryBroker. Failed messages are requeued with a delay of
+// attempt*requeueDelay and dropped after maxAttempts attempts (0 meaning no limit).
+func NewMemoryBroker(requeueDelay time.Duration, maxAttempts int) *MemoryBroker {
+	b := &MemoryBroker{
+		requeueDelay: requeueDelay,
+		maxAttempts:  maxAttempts,
+		topics:       make(map[string][]memoryMessage),
+	}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+// Push enqueues a message in a topic
+func (b *MemoryBroker) Push(topic string, body []byte) error {
+	return b.push(topic, memoryMessage{body: body})
+}
+
+func (b *MemoryBroker) push(topic string, msg memoryMessage) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.stopped {
+		return fmt.Errorf("Error pushing to %s: the memory broker is stopped", topic)
+	}
+	b.topics[topic] = append(b.topics[topic], msg)
+	b.cond.Broadcast()
+	return nil
+}
+
+// Ping checks that the broker still accepts messages
+func (b *MemoryBroker) Ping() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.stopped {
+		return fmt.Errorf("The memory broker is stopped")
+	}
+	return nil
+}
+
+// Depth returns the number of messages waiting in a topic
+func (b *MemoryBroker) Depth(topic string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.topics[topic])
+}
+
+// AddHandler registers a message handler on a topic, running at most parallelism messages at once
+// and timing them out after timeout
+func (b *MemoryBroker) AddHandler(topic string, handler func(message []byte) error, parallelism int, timeout time.Duration) {
+	b.AddWeightedHandlers([]WeightedTopic{{Topic: topic, Weight: 1, Handler: handler}}, parallelism, timeout)
+}
+
+// AddWeightedHandlers registers the message handlers of several topics, running at most
+// parallelism messages at once between them (see WeightedTopic) and timing them out after timeout
+func (b *MemoryBroker) AddWeightedHandlers(topics []WeightedTopic, parallelism int, timeout time.Duration) {
+	b.groups = append(b.groups, newTopicGroup(topics, parallelism, timeout))
+}
+
+// Start starts consuming messages in the background
+func (b *MemoryBroker) Start() {
+	for _, g := range b.groups {
+		for i := 0; i < g.parallelism; i++ {
+			b.wg.Add(1)
+			go b.consumeUntilStopped(g)
+		}
+	}
+}
+
+// Stop stops accepting and consuming messages and waits for the running handlers to return. It
+// can safely be called several times (the broker is both a producer and a consumer).
+func (b *MemoryBroker) Stop() {
+	b.lock.Lock()
+	b.stopped = true
+	b.cond.Broadcast()
+	b.lock.Unlock()
+	b.wg.Wait()
+}
+
+// ConsumeUntilKilled consumes messages until SIGINT or SIGTERM is received, and then waits for
+// the running handlers to return
+func (b *MemoryBroker) ConsumeUntilKilled() {
+	b.Start()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	log.Println("[INFO][memory-broker] Stopping consumer, waiting for running handlers to return...")
+	b.Stop()
+}
+
+func (b *MemoryBroker) consumeUntilStopped(g topicGroup) {
+	defer b.wg.Done()
+	for {
+		topic, msg, ok := b.pop(g)
+		if !ok {
+			return
+		}
+		b.handle(g, topic, msg)
+	}
+}
+
+// pop waits for a message in the topics of a group and removes it from its topic, picked by weight
+// among the topics with messages waiting (false if the broker was stopped)
+func (b *MemoryBroker) pop(g topicGroup) (WeightedTopic, memoryMessage, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for !b.stopped {
+		for _, i := range g.picker.order() {
+			topic := g.topics[i]
+			if len(b.topics[topic.Topic]) == 0 {
+				continue
+			}
+			g.picker.picked(i)
+			msg := b.topics[topic.Topic][0]
+			b.topics[topic.Topic] = b.topics[topic.Topic][1:]
+			return topic, msg, true
+		}
+		b.cond.Wait()
+	}
+	return WeightedTopic{}, memoryMessage{}, false
+}
+
+func (b *MemoryBroker) handle(g topicGroup, topic WeightedTopic, msg memoryMessage) {
+	msg.attempt++
+
+	// Like NSQ, timed out messages are requeued even though their handler may still be running
+	result := make(chan error, 1)
+	go func() { result <- topic.Handler(msg.body) }()
+	var err error
+	select {
+	case err = <-result:
+	case <-time.After(g.timeout):
+		err = fmt.Errorf("Handler timed out after %s", g.timeout)
+	}
+	if err == nil {
+		return
+	}
+
+	log.Printf("[ERROR][memory-broker] Error handling message from %s (attempt %d): %s", topic.Topic, msg.attempt, err)
+	if b.maxAttempts > 0 && msg.attempt >= b.maxAttempts {
+		log.Printf("[ERROR][memory-broker] Message from %s failed %d times, giving up -- Body: %s", topic.Topic, msg.attempt, msg.body)
+		giveUp(err)
+		return
+	}
+	time.AfterFunc(time.Duration(msg.attempt)*b.requeueDelay, func() {
+		if err := b.push(topic.Topic, msg); err != nil {
+			log.Printf("[ERROR][memory-broker] Error requeuing message: %s", err)
+		}
+	})
+}
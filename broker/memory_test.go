@@ -0,0 +1,158 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package broker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// giveUpError is a handler error telling when the broker gives up on its message
+type giveUpError struct {
+	message string
+	gaveUp  chan string
+}
+
+func (e giveUpError) Error() string { return "failure" }
+
+func (e giveUpError) GiveUp() { e.gaveUp <- e.message }
+
+func TestMemoryBroker(t *testing.T) {
+	b := NewMemoryBroker(10*time.Millisecond, 2)
+	assert.Nil(t, b.Ping())
+
+	// The first message fails once and is requeued, the second one always fails and is dropped
+	var (
+		lock     sync.Mutex
+		attempts = make(map[string]int)
+	)
+	done := make(chan struct{})
+	gaveUp := make(chan string, 10)
+	b.AddHandler("train", func(message []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts[string(message)]++
+		if string(message) == "first" && attempts["first"] == 2 {
+			close(done)
+			return nil
+		}
+		return giveUpError{string(message), gaveUp}
+	}, 2, time.Minute)
+	b.Start()
+
+	assert.Nil(t, b.Push("train", []byte("second")))
+	assert.Nil(t, b.Push("train", []byte("first")))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the messages to be handled")
+	}
+	// Leave some time for a (wrong) third attempt of the second message
+	time.Sleep(50 * time.Millisecond)
+	b.Stop()
+	b.Stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, 2, attempts["first"])
+	assert.Equal(t, 2, attempts["second"])
+	assert.Equal(t, 0, b.Depth("train"))
+	assert.Len(t, gaveUp, 1)
+	assert.Equal(t, "second", <-gaveUp)
+	assert.NotNil(t, b.Push("train", []byte("third")))
+}
+
+func TestMemoryBrokerWeighted(t *testing.T) {
+	b := NewMemoryBroker(10*time.Millisecond, 2)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, b.Push("train-high", []byte("high")))
+		assert.Nil(t, b.Push("train-low", []byte("low")))
+	}
+
+	// A single slot is shared between the topics, messages being taken in proportion to weights
+	var (
+		lock    sync.Mutex
+		handled []string
+		running int
+		maxRun  int
+	)
+	done := make(chan struct{})
+	handler := func(message []byte) error {
+		lock.Lock()
+		running++
+		if running > maxRun {
+			maxRun = running
+		}
+		handled = append(handled, string(message))
+		if len(handled) == 20 {
+			close(done)
+		}
+		lock.Unlock()
+		time.Sleep(time.Millisecond)
+		lock.Lock()
+		running--
+		lock.Unlock()
+		return nil
+	}
+	b.AddWeightedHandlers([]WeightedTopic{
+		{Topic: "train-high", Weight: 3, Handler: handler},
+		{Topic: "train-low", Weight: 1, Handler: handler},
+	}, 1, time.Minute)
+	b.Start()
+	defer b.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the messages to be handled")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, 1, maxRun)
+	highs := 0
+	for _, message := range handled[:8] {
+		if message == "high" {
+			highs++
+		}
+	}
+	assert.Equal(t, 6, highs)
+	// Once the high priority topic is empty, the slot goes to the low priority one
+	assert.Equal(t, []string{"low", "low", "low", "low"}, handled[16:])
+}
@@ -0,0 +1,260 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package broker
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// nsqMaxRequeueDelay caps the delay NSQ requeues failed messages with
+const nsqMaxRequeueDelay = 15 * time.Minute
+
+// NSQConsumer consumes messages from NSQ, on the "compute" channel of its topics. Failed messages
+// are requeued by NSQ (with a delay of attempt*requeueDelay) and given up on after maxAttempts
+// attempts (0 meaning no limit): unlike the consumer of morpheo-go-packages, handler errors
+// implementing GiveUpper are told when their message's last attempt failed.
+type NSQConsumer struct {
+	lookupdURLs  []string
+	nsqdURL      string
+	requeueDelay time.Duration
+	maxAttempts  int
+	logger       *log.Logger
+
+	consumers []*nsq.Consumer
+}
+
+// NewNSQConsumer creates an NSQConsumer connecting to nsqdURL if given, and discovering nsqd
+// instances through lookupdURLs otherwise
+func NewNSQConsumer(lookupdURLs []string, nsqdURL string, requeueDelay time.Duration, maxAttempts int) *NSQConsumer {
+	return &NSQConsumer{
+		lookupdURLs:  lookupdURLs,
+		nsqdURL:      nsqdURL,
+		requeueDelay: requeueDelay,
+		maxAttempts:  maxAttempts,
+		logger:       log.New(os.Stdout, "[NSQ]", log.LstdFlags),
+	}
+}
+
+// AddHandler registers a message handler on a topic, running at most parallelism messages at once
+// and timing them out after timeout
+func (c *NSQConsumer) AddHandler(topic string, handler func(message []byte) error, parallelism int, timeout time.Duration) {
+	c.AddWeightedHandlers([]WeightedTopic{{Topic: topic, Weight: 1, Handler: handler}}, parallelism, timeout)
+}
+
+// AddWeightedHandlers registers the message handlers of several topics, running at most
+// parallelism messages at once between them (see WeightedTopic) and timing them out after timeout.
+// NSQ pushes messages to consumers: each topic is delivered at most as many messages as there are
+// free slots, and the messages delivered while no slot is free wait for one (see nsqGroup).
+func (c *NSQConsumer) AddWeightedHandlers(topics []WeightedTopic, parallelism int, timeout time.Duration) {
+	g := &nsqGroup{
+		topicGroup: newTopicGroup(topics, parallelism, timeout),
+		free:       parallelism,
+		running:    make([]int, len(topics)),
+		waiting:    make([][]chan struct{}, len(topics)),
+	}
+	for i, topic := range topics {
+		config := nsq.NewConfig()
+		config.MaxInFlight = parallelism
+		config.MsgTimeout = timeout
+		config.DefaultRequeueDelay = c.requeueDelay
+		config.MaxRequeueDelay = nsqMaxRequeueDelay
+		config.LookupdPollInterval = 5 * time.Second
+		// Messages are given up on by handle, after their last attempt failed
+		config.MaxAttempts = 0
+
+		consumer, err := nsq.NewConsumer(topic.Topic, "compute", config)
+		if err != nil {
+			log.Panicf("[FATAL ERROR] Impossible to create the NSQ consumer of %s: %s", topic.Topic, err)
+		}
+		consumer.SetLogger(c.logger, nsq.LogLevelInfo)
+		i, topic := i, topic
+		consumer.AddConcurrentHandlers(nsq.HandlerFunc(func(message *nsq.Message) error {
+			g.acquire(i, message)
+			defer g.release(i)
+			return c.handle(topic.Topic, topic.Handler, message)
+		}), parallelism)
+		g.consumers = append(g.consumers, consumer)
+		c.consumers = append(c.consumers, consumer)
+	}
+}
+
+// nsqGroup hands the slots of a group of topics to the messages NSQ delivered, picking their topic
+// by weight among the topics with messages waiting for a slot. Every topic is allowed as many
+// messages in flight as it's running and waiting, plus the free slots no message waits for, so that
+// NSQ stops delivering messages to the worker while all its slots are taken.
+type nsqGroup struct {
+	topicGroup
+	consumers []*nsq.Consumer
+
+	lock    sync.Mutex
+	free    int
+	running []int
+	waiting [][]chan struct{}
+}
+
+// acquire waits for a slot to run a message of topic i, touching the message meanwhile for NSQ not
+// to time it out
+func (g *nsqGroup) acquire(i int, message *nsq.Message) {
+	ready := make(chan struct{})
+	g.lock.Lock()
+	g.waiting[i] = append(g.waiting[i], ready)
+	g.dispatch()
+	g.lock.Unlock()
+
+	interval := g.timeout / 2
+	if interval <= 0 {
+		interval = time.Second
+	}
+	touch := time.NewTicker(interval)
+	defer touch.Stop()
+	for {
+		select {
+		case <-ready:
+			message.Touch()
+			return
+		case <-touch.C:
+			message.Touch()
+		}
+	}
+}
+
+// release frees the slot of a message of topic i
+func (g *nsqGroup) release(i int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.free++
+	g.running[i]--
+	g.dispatch()
+}
+
+// dispatch hands the free slots to the waiting messages and updates the number of messages each
+// topic may have in flight (must be called with the lock held)
+func (g *nsqGroup) dispatch() {
+	for g.free > 0 {
+		next := -1
+		for _, i := range g.picker.order() {
+			if len(g.waiting[i]) > 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		g.picker.picked(next)
+		close(g.waiting[next][0])
+		g.waiting[next] = g.waiting[next][1:]
+		g.free--
+		g.running[next]++
+	}
+
+	room := g.free
+	for i := range g.waiting {
+		room -= len(g.waiting[i])
+	}
+	if room < 0 {
+		room = 0
+	}
+	for i, consumer := range g.consumers {
+		consumer.ChangeMaxInFlight(g.running[i] + len(g.waiting[i]) + room)
+	}
+}
+
+// handle runs handler on a message. Failed messages are requeued by NSQ, unless it was their last
+// attempt: they're then finished (NSQ won't deliver them again) and their error is given up on.
+func (c *NSQConsumer) handle(topic string, handler func(message []byte) error, message *nsq.Message) error {
+	err := handler(message.Body)
+	if err == nil {
+		return nil
+	}
+
+	log.Printf("[ERROR][nsq] Error handling message from %s (attempt %d): %s", topic, message.Attempts, err)
+	if c.maxAttempts > 0 && int(message.Attempts) >= c.maxAttempts {
+		log.Printf("[ERROR][nsq] Message from %s failed %d times, giving up -- Body: %s", topic, message.Attempts, message.Body)
+		giveUp(err)
+		return nil
+	}
+	return err
+}
+
+// Start connects the consumers of all topics to NSQ
+func (c *NSQConsumer) Start() error {
+	for _, consumer := range c.consumers {
+		var err error
+		if c.nsqdURL != "" {
+			err = consumer.ConnectToNSQD(c.nsqdURL)
+		} else {
+			err = consumer.ConnectToNSQLookupds(c.lookupdURLs)
+		}
+		if err != nil {
+			return fmt.Errorf("Error connecting to NSQ: %s", err)
+		}
+	}
+	return nil
+}
+
+// Stop stops consuming and waits for the running handlers to return
+func (c *NSQConsumer) Stop() {
+	for _, consumer := range c.consumers {
+		consumer.Stop()
+	}
+	for _, consumer := range c.consumers {
+		<-consumer.StopChan
+	}
+}
+
+// ConsumeUntilKilled consumes messages until SIGINT or SIGTERM is received, and then waits for
+// the running handlers to return
+func (c *NSQConsumer) ConsumeUntilKilled() {
+	if err := c.Start(); err != nil {
+		log.Panicf("[FATAL ERROR] Impossible to start the NSQ consumer: %s", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	log.Println("[INFO][nsq] Stopping consumer, waiting for running handlers to return...")
+	c.Stop()
+}
@@ -0,0 +1,267 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+// Package broker implements an embedded, durable broker for single-node deployments and
+// integration tests: no external service is needed, the producer and the consumers (in the same
+// process or in different processes) share a folder.
+//
+// Each topic is an on-disk queue of one file per message. State changes are atomic renames
+// between the topic subfolders, which makes them safe across processes:
+//
+//	<folder>/<topic>/tmp/       messages being written
+//	<folder>/<topic>/ready/     messages waiting to be consumed
+//	<folder>/<topic>/inflight/  messages being handled (their mtime is their in-flight deadline)
+//	<folder>/<topic>/failed/    messages that exceeded the maximum number of attempts
+//
+// Message files are named <not-before>-<id>-<attempt>, not-before being the date (in nanoseconds)
+// before which the message mustn't be delivered, so that ready messages are consumed in order.
+package broker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// BrokerEmbedded is the broker type of the embedded broker
+const BrokerEmbedded = "embedded"
+
+// Topic subfolders
+const (
+	tmpFolder      = "tmp"
+	readyFolder    = "ready"
+	inflightFolder = "inflight"
+	failedFolder   = "failed"
+)
+
+// queue is the on-disk queue of a topic
+type queue struct {
+	folder string
+}
+
+// message is a message claimed from a queue
+type message struct {
+	name    string
+	id      string
+	attempt int
+	body    []byte
+}
+
+func newQueue(folder, topic string) (*queue, error) {
+	q := &queue{folder: filepath.Join(folder, topic)}
+	for _, sub := range []string{tmpFolder, readyFolder, inflightFolder, failedFolder} {
+		if err := os.MkdirAll(filepath.Join(q.folder, sub), 0700); err != nil {
+			return nil, fmt.Errorf("Error creating queue folder %s: %s", filepath.Join(q.folder, sub), err)
+		}
+	}
+	return q, nil
+}
+
+func messageName(notBefore time.Time, id string, attempt int) string {
+	return fmt.Sprintf("%020d-%s-%d", notBefore.UnixNano(), id, attempt)
+}
+
+// parseMessageName extracts the not-before date, ID and attempt of a message file name
+func parseMessageName(name string) (notBefore time.Time, id string, attempt int, err error) {
+	first := strings.Index(name, "-")
+	last := strings.LastIndex(name, "-")
+	if first <= 0 || last <= first {
+		return notBefore, "", 0, fmt.Errorf("invalid message name %s", name)
+	}
+	nanos, err := strconv.ParseInt(name[:first], 10, 64)
+	if err != nil {
+		return notBefore, "", 0, fmt.Errorf("invalid message name %s: %s", name, err)
+	}
+	attempt, err = strconv.Atoi(name[last+1:])
+	if err != nil {
+		return notBefore, "", 0, fmt.Errorf("invalid message name %s: %s", name, err)
+	}
+	return time.Unix(0, nanos), name[first+1 : last], attempt, nil
+}
+
+// push durably writes a message to the queue, to be delivered after notBefore
+func (q *queue) push(body []byte, notBefore time.Time) error {
+	name := messageName(notBefore, uuid.NewV4().String(), 1)
+	tmpPath := filepath.Join(q.folder, tmpFolder, name)
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Error creating message file %s: %s", tmpPath, err)
+	}
+	if _, err = f.Write(body); err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error writing message file %s: %s", tmpPath, err)
+	}
+
+	if err = os.Rename(tmpPath, filepath.Join(q.folder, readyFolder, name)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error enqueuing message %s: %s", name, err)
+	}
+	return nil
+}
+
+// list returns the names of the messages in a queue subfolder, oldest first
+func (q *queue) list(sub string) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(q.folder, sub))
+	if err != nil {
+		return nil, fmt.Errorf("Error listing %s messages of %s: %s", sub, q.folder, err)
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if !f.IsDir() {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// claim moves the oldest deliverable message to the in-flight folder, with a deadline of timeout.
+// It returns nil if no message is ready to be delivered.
+func (q *queue) claim(timeout time.Duration) (*message, error) {
+	names, err := q.list(readyFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, name := range names {
+		notBefore, id, attempt, err := parseMessageName(name)
+		if err != nil {
+			continue
+		}
+		if notBefore.After(now) {
+			// Messages are sorted by not-before date: none of the following ones is due either
+			return nil, nil
+		}
+
+		readyPath := filepath.Join(q.folder, readyFolder, name)
+		inflightPath := filepath.Join(q.folder, inflightFolder, name)
+		// The in-flight deadline is set before the rename so that the message is never seen
+		// in-flight with an expired deadline. Losing the rename race to another consumer simply
+		// means trying the next message.
+		deadline := now.Add(timeout)
+		if err := os.Chtimes(readyPath, deadline, deadline); err != nil {
+			continue
+		}
+		if err := os.Rename(readyPath, inflightPath); err != nil {
+			continue
+		}
+
+		body, err := ioutil.ReadFile(inflightPath)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading claimed message %s: %s", name, err)
+		}
+		return &message{name: name, id: id, attempt: attempt, body: body}, nil
+	}
+	return nil, nil
+}
+
+// ack removes a successfully handled message
+func (q *queue) ack(msg *message) error {
+	if err := os.Remove(filepath.Join(q.folder, inflightFolder, msg.name)); err != nil {
+		return fmt.Errorf("Error acknowledging message %s (did it time out?): %s", msg.id, err)
+	}
+	return nil
+}
+
+// requeue puts an in-flight message back in the ready folder, to be delivered again after delay
+func (q *queue) requeue(msg *message, delay time.Duration) error {
+	name := messageName(time.Now().Add(delay), msg.id, msg.attempt+1)
+	if err := os.Rename(filepath.Join(q.folder, inflightFolder, msg.name), filepath.Join(q.folder, readyFolder, name)); err != nil {
+		return fmt.Errorf("Error requeuing message %s (did it time out?): %s", msg.id, err)
+	}
+	return nil
+}
+
+// fail moves an in-flight message to the failed folder, for good
+func (q *queue) fail(msg *message) error {
+	if err := os.Rename(filepath.Join(q.folder, inflightFolder, msg.name), filepath.Join(q.folder, failedFolder, msg.name)); err != nil {
+		return fmt.Errorf("Error moving message %s to the failed messages (did it time out?): %s", msg.id, err)
+	}
+	return nil
+}
+
+// reap requeues the in-flight messages whose deadline is over (their consumer died or their
+// handler timed out) and returns the number of requeued messages
+func (q *queue) reap(maxAttempts int) (int, error) {
+	names, err := q.list(inflightFolder)
+	if err != nil {
+		return 0, err
+	}
+
+	reaped := 0
+	now := time.Now()
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(q.folder, inflightFolder, name))
+		if err != nil || info.ModTime().After(now) {
+			continue
+		}
+		_, id, attempt, err := parseMessageName(name)
+		if err != nil {
+			continue
+		}
+
+		msg := &message{name: name, id: id, attempt: attempt}
+		if maxAttempts > 0 && attempt >= maxAttempts {
+			err = q.fail(msg)
+		} else {
+			err = q.requeue(msg, 0)
+		}
+		if err == nil {
+			reaped++
+		}
+	}
+	return reaped, nil
+}
+
+// depth returns the number of ready messages
+func (q *queue) depth() (int, error) {
+	names, err := q.list(readyFolder)
+	return len(names), err
+}
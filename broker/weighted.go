@@ -0,0 +1,122 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package broker
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// WeightedTopic is a topic consumed along with others, its handler sharing their parallelism: when
+// a slot is free, the next message is taken from the topics with messages waiting, in proportion
+// to their weights
+type WeightedTopic struct {
+	Topic   string
+	Weight  int
+	Handler func(message []byte) error
+}
+
+// topicGroup is a group of weighted topics sharing their parallelism, registered on a consumer
+type topicGroup struct {
+	topics      []WeightedTopic
+	parallelism int
+	timeout     time.Duration
+	picker      *picker
+}
+
+func newTopicGroup(topics []WeightedTopic, parallelism int, timeout time.Duration) topicGroup {
+	return topicGroup{
+		topics:      topics,
+		parallelism: parallelism,
+		timeout:     timeout,
+		picker:      newPicker(topics),
+	}
+}
+
+// picker picks the topic the next message is taken from by stride scheduling: each topic advances
+// by 1/weight every time a message is taken from it, and the topic that advanced the least goes
+// first. Topics left without messages for a while don't catch up on the others once they have
+// some: they start from the position of the latest topic picked.
+type picker struct {
+	lock    sync.Mutex
+	weights []float64
+	passes  []float64
+	clock   float64
+}
+
+func newPicker(topics []WeightedTopic) *picker {
+	p := &picker{
+		weights: make([]float64, len(topics)),
+		passes:  make([]float64, len(topics)),
+	}
+	for i, topic := range topics {
+		p.weights[i] = float64(topic.Weight)
+		if p.weights[i] <= 0 {
+			p.weights[i] = 1
+		}
+	}
+	return p
+}
+
+// pass returns the position of topic i (must be called with the lock held)
+func (p *picker) pass(i int) float64 {
+	if p.passes[i] < p.clock {
+		return p.clock
+	}
+	return p.passes[i]
+}
+
+// order returns the indices of the topics, from the one the next message should be taken from
+// (ties go to the topic registered first)
+func (p *picker) order() []int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	order := make([]int, len(p.passes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return p.pass(order[a]) < p.pass(order[b]) })
+	return order
+}
+
+// picked records that a message was taken from topic i
+func (p *picker) picked(i int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clock = p.pass(i)
+	p.passes[i] = p.clock + 1/p.weights[i]
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+// Package cron parses cron expressions and computes their next activation dates.
+//
+// Expressions have the five standard fields (minute, hour, day of month, month and day of week),
+// each being "*", a value, a range ("1-5"), a list ("1,15") or a step ("*/15", "0-30/10"). Months
+// and days of week can't be named. As with Vixie cron, a date matches when both its day of month
+// and day of week match, or when either does if both fields are restricted. The "@hourly",
+// "@daily", "@weekly", "@monthly" and "@yearly" shorthands are also accepted.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var shorthands = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// field bounds
+type bounds struct {
+	name     string
+	min, max uint
+}
+
+var (
+	minutes  = bounds{"minute", 0, 59}
+	hours    = bounds{"hour", 0, 23}
+	days     = bounds{"day of month", 1, 31}
+	months   = bounds{"month", 1, 12}
+	weekdays = bounds{"day of week", 0, 7}
+)
+
+// Schedule is a parsed cron expression
+type Schedule struct {
+	minute, hour, day, month, weekday uint64
+	// dayStar and weekdayStar tell whether the day of month/week fields are unrestricted
+	dayStar, weekdayStar bool
+}
+
+// Parse parses a cron expression
+func Parse(expr string) (*Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if shorthand, ok := shorthands[expr]; ok {
+		expr = shorthand
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid cron expression %q: expected 5 fields, got %d", expr, len(fields))
+	}
+
+	s := &Schedule{}
+	var err error
+	if s.minute, err = parseField(fields[0], minutes); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseField(fields[1], hours); err != nil {
+		return nil, err
+	}
+	if s.day, err = parseField(fields[2], days); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseField(fields[3], months); err != nil {
+		return nil, err
+	}
+	if s.weekday, err = parseField(fields[4], weekdays); err != nil {
+		return nil, err
+	}
+	// Sunday is both 0 and 7
+	if s.weekday&(1<<7) != 0 {
+		s.weekday |= 1
+	}
+	s.dayStar = fields[2] == "*" || fields[2] == "?"
+	s.weekdayStar = fields[4] == "*" || fields[4] == "?"
+	return s, nil
+}
+
+// parseField parses a comma-separated list of ranges into a bitset
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangeBits, err := parseRange(part, b)
+		if err != nil {
+			return 0, err
+		}
+		bits |= rangeBits
+	}
+	return bits, nil
+}
+
+// parseRange parses "*", "n", "n-m" with an optional "/step" into a bitset
+func parseRange(part string, b bounds) (uint64, error) {
+	rangeAndStep := strings.SplitN(part, "/", 2)
+	low, high := b.min, b.max
+	step := uint(1)
+
+	switch r := rangeAndStep[0]; {
+	case r == "*" || r == "?":
+	case strings.Contains(r, "-"):
+		ends := strings.SplitN(r, "-", 2)
+		var err error
+		if low, err = parseValue(ends[0], b); err != nil {
+			return 0, err
+		}
+		if high, err = parseValue(ends[1], b); err != nil {
+			return 0, err
+		}
+		if low > high {
+			return 0, fmt.Errorf("Invalid %s range %q: %d is greater than %d", b.name, r, low, high)
+		}
+	default:
+		value, err := parseValue(r, b)
+		if err != nil {
+			return 0, err
+		}
+		low = value
+		// "n/step" means from n to the max
+		if len(rangeAndStep) == 1 {
+			high = value
+		}
+	}
+
+	if len(rangeAndStep) == 2 {
+		s, err := strconv.ParseUint(rangeAndStep[1], 10, 8)
+		if err != nil || s == 0 {
+			return 0, fmt.Errorf("Invalid %s step in %q", b.name, part)
+		}
+		step = uint(s)
+	}
+
+	var bits uint64
+	for v := low; v <= high; v += step {
+		bits |= 1 << v
+	}
+	return bits, nil
+}
+
+func parseValue(value string, b bounds) (uint, error) {
+	v, err := strconv.ParseUint(value, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s %q", b.name, value)
+	}
+	if uint(v) < b.min || uint(v) > b.max {
+		return 0, fmt.Errorf("Invalid %s %d: expected a value between %d and %d", b.name, v, b.min, b.max)
+	}
+	return uint(v), nil
+}
+
+// Next returns the first activation date strictly after t (in t's location), or the zero time if
+// there's none within the next five years (e.g. "0 0 30 2 *")
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Add(time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	day := s.day&(1<<uint(t.Day())) != 0
+	weekday := s.weekday&(1<<uint(t.Weekday())) != 0
+	if s.dayStar || s.weekdayStar {
+		return day && weekday
+	}
+	return day || weekday
+}
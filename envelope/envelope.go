@@ -0,0 +1,157 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+// Package envelope defines the versioned envelope wrapping the task payloads pushed to the
+// broker by the compute API and consumed by the workers.
+//
+// Workers must accept both enveloped messages and legacy ones (raw uplets, possibly along with a
+// top-level traceparent field), which Decode wraps in a version 0 envelope.
+package envelope
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SchemaVersion is the current version of the envelope format. Version 0 denotes legacy,
+// un-enveloped messages. Version 2 adds the fields changing what a worker trains (Params and
+// CVFolds): envelopes only get it if they're set, so that workers supporting version 1 at most
+// keep consuming the others, and requeue the ones they'd train wrong.
+const SchemaVersion = 2
+
+// baseSchemaVersion is the version of the envelopes without any version 2 field
+const baseSchemaVersion = 1
+
+// Task types
+const (
+	TypeLearn     = "learn"
+	TypePred      = "pred"
+	TypeAggregate = "aggregate"
+	TypeEvaluate  = "evaluate"
+)
+
+// Envelope wraps an uplet along with metadata about its submission
+type Envelope struct {
+	SchemaVersion int       `json:"schema_version"`
+	Type          string    `json:"type"`
+	EnqueuedAt    time.Time `json:"enqueued_at"`
+	// Attempt counts the times the API pushed the task (it's pushed again when the worker running
+	// it is declared dead), not the deliveries of the broker, which redelivers it as is
+	Attempt int `json:"attempt"`
+	// Traceparent is the W3C trace context of the span that pushed the message
+	Traceparent string `json:"traceparent,omitempty"`
+	// Submitter identifies who submitted the task to the compute API
+	Submitter string `json:"submitter,omitempty"`
+	// Priority is the priority of the task (which also picked its topic)
+	Priority string `json:"priority,omitempty"`
+	// Params are the hyperparameters the task is trained with (set for the trials of a sweep)
+	Params map[string]interface{} `json:"params,omitempty"`
+	// CVFolds is the number of folds learnuplets are cross-validated on (0 not to cross-validate)
+	CVFolds int             `json:"cv_folds,omitempty"`
+	Body    json.RawMessage `json:"body"`
+}
+
+// New wraps an uplet in an envelope for its first attempt
+func New(taskType string, uplet interface{}, traceparent, submitter string) (*Envelope, error) {
+	body, err := json.Marshal(uplet)
+	if err != nil {
+		return nil, fmt.Errorf("Error marshaling %s uplet to JSON: %s", taskType, err)
+	}
+	return &Envelope{
+		SchemaVersion: baseSchemaVersion,
+		Type:          taskType,
+		EnqueuedAt:    time.Now().UTC(),
+		Attempt:       1,
+		Traceparent:   traceparent,
+		Submitter:     submitter,
+		Body:          body,
+	}, nil
+}
+
+// Marshal serializes the envelope to be pushed to the broker, with the oldest schema version
+// supporting the fields it sets
+func (e *Envelope) Marshal() ([]byte, error) {
+	e.SchemaVersion = baseSchemaVersion
+	if len(e.Params) > 0 || e.CVFolds > 0 {
+		e.SchemaVersion = 2
+	}
+	return json.Marshal(e)
+}
+
+// Unmarshal decodes the envelope body in the given uplet
+func (e *Envelope) Unmarshal(uplet interface{}) error {
+	if err := json.Unmarshal(e.Body, uplet); err != nil {
+		return fmt.Errorf("Error un-marshaling %s uplet: %s", e.Type, err)
+	}
+	return nil
+}
+
+// probe holds the fields telling enveloped and legacy messages apart
+type probe struct {
+	SchemaVersion *int            `json:"schema_version"`
+	Body          json.RawMessage `json:"body"`
+	Traceparent   string          `json:"traceparent"`
+}
+
+// Decode parses a message consumed from the broker. Legacy messages are wrapped in a version 0
+// envelope of type legacyType.
+func Decode(message []byte, legacyType string) (*Envelope, error) {
+	var p probe
+	if err := json.Unmarshal(message, &p); err != nil {
+		return nil, fmt.Errorf("Error un-marshaling message: %s", err)
+	}
+
+	if p.SchemaVersion == nil || len(p.Body) == 0 {
+		return &Envelope{
+			Type:        legacyType,
+			Attempt:     1,
+			Traceparent: p.Traceparent,
+			Body:        json.RawMessage(message),
+		}, nil
+	}
+
+	if *p.SchemaVersion > SchemaVersion {
+		return nil, fmt.Errorf("Unsupported envelope schema version %d (latest supported: %d)", *p.SchemaVersion, SchemaVersion)
+	}
+	var e Envelope
+	if err := json.Unmarshal(message, &e); err != nil {
+		return nil, fmt.Errorf("Error un-marshaling envelope: %s", err)
+	}
+	if e.Type != legacyType {
+		return nil, fmt.Errorf("Unexpected task type %q in envelope (expected %q)", e.Type, legacyType)
+	}
+	return &e, nil
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package envelope
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type uplet struct {
+	Key string `json:"key"`
+}
+
+func TestDecodeEnveloped(t *testing.T) {
+	e, err := New(TypeLearn, uplet{Key: "learnuplet_1"}, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "relay")
+	assert.Nil(t, err)
+	message, err := e.Marshal()
+	assert.Nil(t, err)
+
+	decoded, err := Decode(message, TypeLearn)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, decoded.SchemaVersion)
+	assert.Equal(t, 1, decoded.Attempt)
+	assert.Equal(t, "relay", decoded.Submitter)
+	assert.Equal(t, e.Traceparent, decoded.Traceparent)
+
+	var u uplet
+	assert.Nil(t, decoded.Unmarshal(&u))
+	assert.Equal(t, "learnuplet_1", u.Key)
+
+	// Enveloped messages must be consumed from the right topic
+	_, err = Decode(message, TypePred)
+	assert.NotNil(t, err)
+}
+
+func TestMarshalVersion(t *testing.T) {
+	e, err := New(TypeLearn, uplet{Key: "learnuplet_1"}, "", "relay")
+	assert.Nil(t, err)
+	e.CVFolds = 5
+	message, err := e.Marshal()
+	assert.Nil(t, err)
+
+	// Workers that don't know about cross-validation can't consume it
+	decoded, err := Decode(message, TypeLearn)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, decoded.SchemaVersion)
+	assert.Equal(t, 5, decoded.CVFolds)
+	assert.Contains(t, string(message), `"schema_version":2`)
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	message := []byte(`{"key":"learnuplet_1","traceparent":"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}`)
+
+	decoded, err := Decode(message, TypeLearn)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, decoded.SchemaVersion)
+	assert.Equal(t, TypeLearn, decoded.Type)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", decoded.Traceparent)
+
+	var u uplet
+	assert.Nil(t, decoded.Unmarshal(&u))
+	assert.Equal(t, "learnuplet_1", u.Key)
+}
+
+func TestDecodeUnsupportedVersion(t *testing.T) {
+	_, err := Decode([]byte(`{"schema_version":42,"type":"learn","body":{}}`), TypeLearn)
+	assert.NotNil(t, err)
+}
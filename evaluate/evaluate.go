@@ -0,0 +1,87 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+// Package evaluate defines the evaluation tasks, which re-score an existing model on (new) test
+// data without retraining it.
+//
+// The model makes predictions on the un-targeted test data with its algo's predict entrypoint,
+// which the problem workflow then scores, exactly like the test step of a learning task.
+package evaluate
+
+import (
+	"fmt"
+
+	"github.com/satori/go.uuid"
+)
+
+// Topic is the broker topic of normal priority evaluation tasks (see priority.Topic)
+const Topic = "evaluate"
+
+// Evaluateuplet is an evaluation task: Model is scored on TestData by the problem workflow, and
+// the perf is reported to the peer under Key. Algo is the algo of the model, read from its storage
+// metadata if it isn't given.
+type Evaluateuplet struct {
+	Key      string      `json:"key"`
+	Problem  uuid.UUID   `json:"problem"`
+	Algo     uuid.UUID   `json:"algo"`
+	Model    uuid.UUID   `json:"model"`
+	TestData []uuid.UUID `json:"test_data"`
+}
+
+// Check validates an evaluation task
+func (e *Evaluateuplet) Check() error {
+	switch {
+	case e.Key == "":
+		return fmt.Errorf("key is required")
+	case uuid.Equal(e.Problem, uuid.Nil):
+		return fmt.Errorf("problem is required")
+	case uuid.Equal(e.Model, uuid.Nil):
+		return fmt.Errorf("model is required")
+	case len(e.TestData) == 0:
+		return fmt.Errorf("test_data is required")
+	}
+
+	seen := make(map[string]bool, len(e.TestData))
+	for _, data := range e.TestData {
+		switch {
+		case uuid.Equal(data, uuid.Nil):
+			return fmt.Errorf("test_data can't hold Nil uuids")
+		case seen[data.String()]:
+			return fmt.Errorf("test data %s is given twice", data)
+		}
+		seen[data.String()] = true
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+// Package predict defines the prediction tasks of the compute API and workers: preduplets whose
+// model makes predictions on one or many data blobs at once (its algo image being loaded once),
+// and the per-data results reported for them.
+package predict
+
+import (
+	"fmt"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// Statuses of the items of a prediction task
+const (
+	ItemDone   = "done"
+	ItemFailed = "failed"
+)
+
+// Preduplet is a preduplet predicting on its Data blob and/or on the blobs of DataBatch. The
+// predictions are posted to storage one per data blob, or as a single tar-gzipped bundle (of one
+// file per data blob, named after it) if Bundle is set.
+type Preduplet struct {
+	common.Preduplet
+	DataBatch []uuid.UUID `json:"data_batch,omitempty"`
+	Bundle    bool        `json:"bundle,omitempty"`
+}
+
+// AllData returns the data blobs to predict on: Data (unless Nil), then DataBatch
+func (p *Preduplet) AllData() []uuid.UUID {
+	var data []uuid.UUID
+	if !uuid.Equal(p.Data, uuid.Nil) {
+		data = append(data, p.Data)
+	}
+	return append(data, p.DataBatch...)
+}
+
+// Check validates a prediction task
+func (p *Preduplet) Check() error {
+	switch {
+	case p.Key == "":
+		return fmt.Errorf("key is required")
+	case uuid.Equal(p.Problem, uuid.Nil):
+		return fmt.Errorf("problem is required")
+	case uuid.Equal(p.Model, uuid.Nil):
+		return fmt.Errorf("model is required")
+	}
+
+	data := p.AllData()
+	if len(data) == 0 {
+		return fmt.Errorf("data or data_batch is required")
+	}
+	seen := make(map[string]bool, len(data))
+	for _, id := range data {
+		switch {
+		case uuid.Equal(id, uuid.Nil):
+			return fmt.Errorf("data_batch can't hold Nil uuids")
+		case seen[id.String()]:
+			return fmt.Errorf("data %s is given twice", id)
+		}
+		seen[id.String()] = true
+	}
+	return nil
+}
+
+// Item is the result of a prediction task for one of its data blobs: the prediction it's in (the
+// bundle for bundled predictions), or why it failed
+type Item struct {
+	Data       uuid.UUID `json:"data"`
+	Status     string    `json:"status"`
+	Prediction uuid.UUID `json:"prediction"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Status returns the overall status of a prediction task from the status of its items: done if
+// any prediction was made, failed otherwise
+func Status(items []Item) string {
+	for _, item := range items {
+		if item.Status == ItemDone {
+			return common.TaskStatusDone
+		}
+	}
+	return common.TaskStatusFailed
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+// Package priority defines the task priorities shared by the compute API and workers: each
+// priority has its own broker topic, and workers take the next task to run from these topics in
+// proportion to their weights.
+package priority
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Task priorities, from the most to the least urgent
+const (
+	High   = "high"
+	Normal = "normal"
+	Low    = "low"
+)
+
+// Levels lists all the priorities, from the most to the least urgent
+var Levels = []string{High, Normal, Low}
+
+// DefaultWeights are the weights the next task to run is picked with, between priorities
+var DefaultWeights = map[string]int{High: 6, Normal: 3, Low: 1}
+
+// Check returns an error if p isn't a known priority
+func Check(p string) error {
+	for _, level := range Levels {
+		if p == level {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown priority %q (expected one of %s)", p, strings.Join(Levels, ", "))
+}
+
+// Topic returns the broker topic of the tasks of a given priority. Normal priority tasks keep
+// using the base topic, so that messages pushed before priorities existed are still consumed.
+func Topic(base, p string) string {
+	if p == Normal || p == "" {
+		return base
+	}
+	return base + "-" + p
+}
+
+// ParseWeights parses <priority>=<weight> entries, on top of DefaultWeights. A zero weight means
+// the priority isn't consumed at all.
+func ParseWeights(entries []string) (map[string]int, error) {
+	weights := make(map[string]int, len(DefaultWeights))
+	for p, weight := range DefaultWeights {
+		weights[p] = weight
+	}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid priority weight %q, expected <priority>=<weight>", entry)
+		}
+		if err := Check(parts[0]); err != nil {
+			return nil, err
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("Invalid weight in %q: expected a positive integer", entry)
+		}
+		weights[parts[0]] = weight
+	}
+	return weights, nil
+}
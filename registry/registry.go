@@ -0,0 +1,154 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+// Package registry defines the heartbeats workers periodically send to the compute API, and the
+// leases the API keeps of them.
+//
+// A heartbeat records what a worker can do and which tasks it is running, and renews its lease. A
+// worker whose lease expired is considered dead: the tasks it was running are recovered by the
+// API, so that they don't stay assigned to it forever.
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Worker statuses
+const (
+	StatusAlive = "alive"
+	StatusDead  = "dead"
+)
+
+// Capabilities that aren't task types
+const (
+	CapabilityServing = "serving"
+)
+
+// Task is a task a worker is running. Its broker message is kept for the task to be pushed again
+// if the worker dies.
+type Task struct {
+	Topic     string          `json:"topic"`
+	Key       string          `json:"key"`
+	StartedAt time.Time       `json:"started_at"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// keyed holds the key of an uplet, or the body of an envelope (see the envelope package)
+type keyed struct {
+	Key  string          `json:"key"`
+	Body json.RawMessage `json:"body"`
+}
+
+// NewTask describes a task consumed from topic, reading its key from its (enveloped or legacy)
+// message
+func NewTask(topic string, message []byte) Task {
+	task := Task{Topic: topic, StartedAt: time.Now().UTC(), Message: json.RawMessage(message)}
+	var uplet keyed
+	if json.Unmarshal(message, &uplet) == nil {
+		if len(uplet.Body) > 0 {
+			json.Unmarshal(uplet.Body, &uplet)
+		}
+		task.Key = uplet.Key
+	}
+	return task
+}
+
+// Heartbeat is sent periodically by workers. Capabilities are the task types a worker consumes
+// (see the envelope package), along with how many of each it runs at once, and CapabilityServing
+// if it serves models online. The worker is considered alive for LeaseSeconds after its heartbeat.
+type Heartbeat struct {
+	Worker       string         `json:"worker"`
+	Version      string         `json:"version"`
+	Capabilities map[string]int `json:"capabilities"`
+	Running      []Task         `json:"running"`
+	LeaseSeconds int            `json:"lease_seconds"`
+}
+
+// Check returns an error if the heartbeat is invalid
+func (h *Heartbeat) Check() error {
+	if h.Worker == "" {
+		return fmt.Errorf("worker field is unset")
+	}
+	if h.LeaseSeconds <= 0 {
+		return fmt.Errorf("lease_seconds must be positive, got %d", h.LeaseSeconds)
+	}
+	for i, task := range h.Running {
+		if task.Topic == "" || len(task.Message) == 0 {
+			return fmt.Errorf("running task %d has no topic or message", i)
+		}
+	}
+	return nil
+}
+
+// Lease is the API's record of a worker: its latest heartbeat, and when its lease expires
+type Lease struct {
+	Heartbeat
+	Status    string    `json:"status"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// DiedAt is when the worker was found dead (zero while it's alive)
+	DiedAt time.Time `json:"died_at,omitempty"`
+	// Recovered are the keys of the running tasks dealt with since the worker missed its
+	// heartbeats: recovered, or left to the live worker running them already
+	Recovered []string `json:"recovered,omitempty"`
+}
+
+// Renew records a heartbeat received at now. Dead workers that send a heartbeat again are alive
+// again (the tasks recovered in the meantime stay recovered).
+func (l *Lease) Renew(heartbeat Heartbeat, now time.Time) {
+	if l.FirstSeen.IsZero() {
+		l.FirstSeen = now
+	}
+	l.Heartbeat = heartbeat
+	l.Status = StatusAlive
+	l.LastSeen = now
+	l.ExpiresAt = now.Add(time.Duration(heartbeat.LeaseSeconds) * time.Second)
+	l.DiedAt = time.Time{}
+	l.Recovered = nil
+}
+
+// Expired tells whether the worker of a live lease missed its heartbeats, as of now
+func (l *Lease) Expired(now time.Time) bool {
+	return l.Status == StatusAlive && now.After(l.ExpiresAt)
+}
+
+// Kill marks the worker dead as of now. Its running tasks are left for the caller to recover.
+func (l *Lease) Kill(now time.Time) {
+	l.Status = StatusDead
+	l.DiedAt = now
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/MorpheoOrg/morpheo-compute/envelope"
+)
+
+func TestNewTask(t *testing.T) {
+	legacy := NewTask("train", []byte(`{"key": "learnuplet_1", "problem": "p"}`))
+	assert.Equal(t, "learnuplet_1", legacy.Key)
+
+	msg, err := envelope.New(envelope.TypePred, map[string]string{"key": "preduplet_1"}, "", "")
+	assert.Nil(t, err)
+	message, err := msg.Marshal()
+	assert.Nil(t, err)
+	enveloped := NewTask("predict", message)
+	assert.Equal(t, "preduplet_1", enveloped.Key)
+	assert.Equal(t, "predict", enveloped.Topic)
+
+	garbage := NewTask("train", []byte("not json"))
+	assert.Equal(t, "", garbage.Key)
+}
+
+func TestCheck(t *testing.T) {
+	running := []Task{NewTask("train", []byte(`{"key": "learnuplet_1"}`))}
+	heartbeat := Heartbeat{Worker: "worker-1", Version: "v1.2.0", Running: running, LeaseSeconds: 60}
+	assert.Nil(t, heartbeat.Check())
+
+	anonymous := Heartbeat{Running: running, LeaseSeconds: 60}
+	assert.NotNil(t, anonymous.Check())
+
+	leaseless := Heartbeat{Worker: "worker-1", Running: running}
+	assert.NotNil(t, leaseless.Check())
+
+	emptyTask := Heartbeat{Worker: "worker-1", Running: []Task{{Topic: "train"}}, LeaseSeconds: 60}
+	assert.NotNil(t, emptyTask.Check())
+}
+
+func TestLease(t *testing.T) {
+	heartbeat := Heartbeat{Worker: "worker-1", Capabilities: map[string]int{envelope.TypeLearn: 2}, LeaseSeconds: 60}
+	now := time.Now()
+	var lease Lease
+	lease.Renew(heartbeat, now)
+	assert.Equal(t, StatusAlive, lease.Status)
+	assert.False(t, lease.Expired(now.Add(59*time.Second)))
+	assert.True(t, lease.Expired(now.Add(61*time.Second)))
+
+	lease.Kill(now.Add(61 * time.Second))
+	lease.Recovered = []string{"learnuplet_1"}
+	assert.False(t, lease.Expired(now.Add(2*time.Minute)), "dead workers don't expire again")
+
+	// A dead worker sending heartbeats again is alive again
+	lease.Renew(heartbeat, now.Add(2*time.Minute))
+	assert.Equal(t, StatusAlive, lease.Status)
+	assert.Equal(t, now, lease.FirstSeen)
+	assert.Nil(t, lease.Recovered)
+	assert.True(t, lease.DiedAt.IsZero())
+}
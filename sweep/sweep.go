@@ -0,0 +1,238 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+// Package sweep expands hyperparameter sweep specifications into parameter sets, and ranks the
+// results of the trials into a leaderboard.
+//
+// A sweep is either a grid (every combination of the listed values of each parameter) or a
+// random search (a number of trials, each parameter being drawn from a list of values or from a
+// uniform, optionally log-uniform, range).
+package sweep
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Params is a set of hyperparameters, by name
+type Params map[string]interface{}
+
+// Spec is a sweep specification: exactly one of Grid and Random is set
+type Spec struct {
+	Grid   map[string][]interface{} `json:"grid,omitempty"`
+	Random *RandomSearch            `json:"random,omitempty"`
+}
+
+// RandomSearch draws Trials parameter sets, with a pseudo-random generator seeded with Seed (so
+// that a sweep can be reproduced)
+type RandomSearch struct {
+	Trials int                     `json:"trials"`
+	Seed   int64                   `json:"seed"`
+	Params map[string]Distribution `json:"params"`
+}
+
+// Distribution is the distribution a parameter is drawn from: either one of Values, or a number
+// between Min and Max (uniformly, or log-uniformly if Log is set), rounded if Int is set
+type Distribution struct {
+	Values []interface{} `json:"values,omitempty"`
+	Min    *float64      `json:"min,omitempty"`
+	Max    *float64      `json:"max,omitempty"`
+	Log    bool          `json:"log,omitempty"`
+	Int    bool          `json:"int,omitempty"`
+}
+
+// Check validates the specification, and that it doesn't expand to more than maxTrials parameter
+// sets (0 for no limit)
+func (s *Spec) Check(maxTrials int) error {
+	switch {
+	case len(s.Grid) > 0 && s.Random != nil:
+		return fmt.Errorf("only one of grid and random can be set")
+	case len(s.Grid) == 0 && s.Random == nil:
+		return fmt.Errorf("one of grid and random is required")
+	}
+
+	trials := 1
+	if s.Random != nil {
+		if s.Random.Trials <= 0 {
+			return fmt.Errorf("random search needs a positive number of trials")
+		}
+		if len(s.Random.Params) == 0 {
+			return fmt.Errorf("random search needs at least one parameter")
+		}
+		for name, dist := range s.Random.Params {
+			if err := dist.check(); err != nil {
+				return fmt.Errorf("invalid distribution for %q: %s", name, err)
+			}
+		}
+		trials = s.Random.Trials
+	}
+	for name, values := range s.Grid {
+		if len(values) == 0 {
+			return fmt.Errorf("no values for grid parameter %q", name)
+		}
+		trials *= len(values)
+		if maxTrials > 0 && trials > maxTrials {
+			break
+		}
+	}
+	if maxTrials > 0 && trials > maxTrials {
+		return fmt.Errorf("sweep expands to more than %d trials", maxTrials)
+	}
+	return nil
+}
+
+func (d *Distribution) check() error {
+	switch {
+	case len(d.Values) > 0 && (d.Min != nil || d.Max != nil):
+		return fmt.Errorf("only one of values and min/max can be set")
+	case len(d.Values) > 0:
+		return nil
+	case d.Min == nil || d.Max == nil:
+		return fmt.Errorf("either values or min and max are required")
+	case *d.Min > *d.Max:
+		return fmt.Errorf("min is greater than max")
+	case d.Log && *d.Min <= 0:
+		return fmt.Errorf("log-uniform ranges must be positive")
+	}
+	return nil
+}
+
+// Expand returns the parameter sets of the sweep, in a deterministic order. The specification is
+// expected to be valid.
+func (s *Spec) Expand() []Params {
+	if s.Random != nil {
+		return s.Random.draw()
+	}
+
+	names := make([]string, 0, len(s.Grid))
+	for name := range s.Grid {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sets := []Params{{}}
+	for _, name := range names {
+		var expanded []Params
+		for _, set := range sets {
+			for _, value := range s.Grid[name] {
+				next := make(Params, len(set)+1)
+				for k, v := range set {
+					next[k] = v
+				}
+				next[name] = value
+				expanded = append(expanded, next)
+			}
+		}
+		sets = expanded
+	}
+	return sets
+}
+
+func (r *RandomSearch) draw() []Params {
+	names := make([]string, 0, len(r.Params))
+	for name := range r.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rng := rand.New(rand.NewSource(r.Seed))
+	sets := make([]Params, 0, r.Trials)
+	for i := 0; i < r.Trials; i++ {
+		set := make(Params, len(names))
+		for _, name := range names {
+			set[name] = r.Params[name].draw(rng)
+		}
+		sets = append(sets, set)
+	}
+	return sets
+}
+
+func (d Distribution) draw(rng *rand.Rand) interface{} {
+	if len(d.Values) > 0 {
+		return d.Values[rng.Intn(len(d.Values))]
+	}
+	var value float64
+	if d.Log {
+		value = math.Exp(math.Log(*d.Min) + rng.Float64()*(math.Log(*d.Max)-math.Log(*d.Min)))
+	} else {
+		value = *d.Min + rng.Float64()*(*d.Max-*d.Min)
+	}
+	if d.Int {
+		return int(math.Floor(value + 0.5))
+	}
+	return value
+}
+
+// Result is the outcome of a trial of a sweep. Perf is only set once the trial is done.
+type Result struct {
+	Key      string   `json:"key"`
+	Params   Params   `json:"params"`
+	ModelEnd string   `json:"model_end"`
+	Status   string   `json:"status"`
+	Perf     *float64 `json:"perf,omitempty"`
+	// Rank is the position of the trial in the leaderboard (1 being the best), 0 if it has no
+	// performance yet
+	Rank int `json:"rank,omitempty"`
+}
+
+// Leaderboard ranks the trials by performance (the highest first, or the lowest if minimize is
+// set), followed by those without any performance yet in their original order. The best trial is
+// returned too (nil if no trial has a performance).
+func Leaderboard(results []Result, minimize bool) ([]Result, *Result) {
+	ranked := append([]Result(nil), results...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i].Perf, ranked[j].Perf
+		switch {
+		case a == nil || b == nil:
+			return a != nil && b == nil
+		case minimize:
+			return *a < *b
+		default:
+			return *a > *b
+		}
+	})
+	for i := range ranked {
+		if ranked[i].Perf != nil {
+			ranked[i].Rank = i + 1
+		}
+	}
+	if len(ranked) == 0 || ranked[0].Perf == nil {
+		return ranked, nil
+	}
+	best := ranked[0]
+	return ranked, &best
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package sweep
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandGrid(t *testing.T) {
+	spec := Spec{Grid: map[string][]interface{}{
+		"lr":    {0.1, 0.01},
+		"depth": {3, 5, 7},
+	}}
+	assert.Nil(t, spec.Check(0))
+	sets := spec.Expand()
+	assert.Len(t, sets, 6)
+	assert.Equal(t, Params{"depth": 3, "lr": 0.1}, sets[0])
+	assert.Equal(t, Params{"depth": 3, "lr": 0.01}, sets[1])
+	assert.Equal(t, Params{"depth": 7, "lr": 0.01}, sets[5])
+
+	assert.NotNil(t, spec.Check(5))
+}
+
+func TestExpandRandom(t *testing.T) {
+	var spec Spec
+	assert.Nil(t, json.Unmarshal([]byte(`{"random": {"trials": 20, "seed": 42, "params": {
+		"lr": {"min": 0.0001, "max": 0.1, "log": true},
+		"depth": {"min": 2, "max": 8, "int": true},
+		"loss": {"values": ["l1", "l2"]}
+	}}}`), &spec))
+	assert.Nil(t, spec.Check(100))
+
+	sets := spec.Expand()
+	assert.Len(t, sets, 20)
+	for _, set := range sets {
+		lr := set["lr"].(float64)
+		assert.True(t, lr >= 0.0001 && lr <= 0.1)
+		depth := set["depth"].(int)
+		assert.True(t, depth >= 2 && depth <= 8)
+		assert.Contains(t, []interface{}{"l1", "l2"}, set["loss"])
+	}
+	// Sweeps are reproducible
+	assert.Equal(t, sets, spec.Expand())
+}
+
+func TestCheck(t *testing.T) {
+	min, max := 1.0, 0.0
+	for _, spec := range []Spec{
+		{},
+		{Grid: map[string][]interface{}{"lr": {0.1}}, Random: &RandomSearch{Trials: 1}},
+		{Grid: map[string][]interface{}{"lr": {}}},
+		{Random: &RandomSearch{Trials: 0, Params: map[string]Distribution{"lr": {Values: []interface{}{1}}}}},
+		{Random: &RandomSearch{Trials: 1, Params: map[string]Distribution{"lr": {Min: &min, Max: &max}}}},
+		{Random: &RandomSearch{Trials: 1, Params: map[string]Distribution{"lr": {Min: &max, Max: &min, Log: true}}}},
+	} {
+		assert.NotNil(t, spec.Check(0))
+	}
+}
+
+func TestLeaderboard(t *testing.T) {
+	perf := func(p float64) *float64 { return &p }
+	results := []Result{
+		{Key: "a", Status: "pending"},
+		{Key: "b", Status: "done", Perf: perf(0.7)},
+		{Key: "c", Status: "done", Perf: perf(0.9)},
+		{Key: "d", Status: "failed"},
+	}
+
+	ranked, best := Leaderboard(results, false)
+	assert.Equal(t, []string{"c", "b", "a", "d"}, keys(ranked))
+	assert.Equal(t, 1, ranked[0].Rank)
+	assert.Equal(t, 0, ranked[2].Rank)
+	assert.Equal(t, "c", best.Key)
+
+	ranked, best = Leaderboard(results, true)
+	assert.Equal(t, []string{"b", "c", "a", "d"}, keys(ranked))
+	assert.Equal(t, "b", best.Key)
+
+	_, best = Leaderboard(results[:1], false)
+	assert.Nil(t, best)
+}
+
+func keys(results []Result) []string {
+	var k []string
+	for _, r := range results {
+		k = append(k, r.Key)
+	}
+	return k
+}
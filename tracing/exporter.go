@@ -0,0 +1,316 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Available exporters
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+	ExporterOTLP   = "otlp"
+)
+
+// Exporter ships ended spans somewhere
+type Exporter interface {
+	Export(span SpanData) error
+}
+
+// NewExporter creates the exporter of the given kind. file is only used by the file exporter and
+// endpoint (the base URL of an OTLP/HTTP collector) by the otlp exporter.
+func NewExporter(kind, file, endpoint string) (Exporter, error) {
+	switch kind {
+	case ExporterNone, "":
+		return nil, nil
+	case ExporterStdout:
+		return NewWriterExporter(os.Stdout), nil
+	case ExporterFile:
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening trace file %s: %s", file, err)
+		}
+		return NewWriterExporter(f), nil
+	case ExporterOTLP:
+		return NewOTLPExporter(endpoint), nil
+	default:
+		return nil, fmt.Errorf("Unsupported trace exporter (%s). Available exporters: 'none', 'stdout', 'file', 'otlp'", kind)
+	}
+}
+
+// WriterExporter writes spans to an io.Writer as OTLP/JSON lines, one export request per span.
+// This is the format read by the OpenTelemetry collector's file receiver.
+type WriterExporter struct {
+	writer io.Writer
+	lock   sync.Mutex
+}
+
+// NewWriterExporter creates a WriterExporter
+func NewWriterExporter(writer io.Writer) *WriterExporter {
+	return &WriterExporter{writer: writer}
+}
+
+// Export writes a span
+func (e *WriterExporter) Export(span SpanData) error {
+	line, err := json.Marshal(newOTLPRequest(span))
+	if err != nil {
+		return fmt.Errorf("Error marshaling span to JSON: %s", err)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err = e.writer.Write(append(line, '\n'))
+	return err
+}
+
+// OTLP exporter queue and batch sizes, and the interval between two posts of a partial batch
+const (
+	otlpQueueSize     = 2048
+	otlpBatchSize     = 256
+	otlpFlushInterval = 2 * time.Second
+)
+
+// OTLPExporter posts spans to an OpenTelemetry collector using OTLP/HTTP with JSON encoding. Spans
+// are queued and posted in batches in the background, so that a slow or down collector doesn't slow
+// down the code ending them: spans ended while the queue is full are dropped.
+type OTLPExporter struct {
+	// dropped counts the spans dropped since the last batch was posted (first for 64-bit
+	// alignment)
+	dropped int64
+
+	url           string
+	client        *http.Client
+	queue         chan SpanData
+	batchSize     int
+	flushInterval time.Duration
+}
+
+// NewOTLPExporter creates an OTLPExporter posting to the given collector base URL (for instance
+// http://otel-collector:4318)
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return newOTLPExporter(endpoint, otlpQueueSize, otlpBatchSize, otlpFlushInterval)
+}
+
+func newOTLPExporter(endpoint string, queueSize, batchSize int, flushInterval time.Duration) *OTLPExporter {
+	e := &OTLPExporter{
+		url:           strings.TrimRight(endpoint, "/") + "/v1/traces",
+		client:        &http.Client{Timeout: 5 * time.Second},
+		queue:         make(chan SpanData, queueSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+	}
+	go e.run()
+	return e
+}
+
+// Export queues a span to be posted to the collector, or drops it if the queue is full
+func (e *OTLPExporter) Export(span SpanData) error {
+	select {
+	case e.queue <- span:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+	return nil
+}
+
+// run posts the queued spans in batches, once a batch is full or every flush interval, forever
+func (e *OTLPExporter) run() {
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+
+	var batch []SpanData
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) < e.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if dropped := atomic.SwapInt64(&e.dropped, 0); dropped > 0 {
+			log.Printf("[WARNING][tracing] %d span(s) dropped: the export queue is full", dropped)
+		}
+		if err := e.post(batch); err != nil {
+			log.Printf("[ERROR][tracing] Failed to export %d span(s): %s", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+// post posts a batch of spans to the collector
+func (e *OTLPExporter) post(spans []SpanData) error {
+	body, err := json.Marshal(newOTLPRequest(spans...))
+	if err != nil {
+		return fmt.Errorf("Error marshaling spans to JSON: %s", err)
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Error posting spans to %s: %s", e.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Error posting spans to %s: unexpected status %s", e.url, resp.Status)
+	}
+	return nil
+}
+
+// OTLP/JSON structures (see opentelemetry-proto's trace/v1/trace.proto)
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// OTLP span kind and status codes
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOK         = 1
+	otlpStatusError      = 2
+)
+
+// newOTLPRequest builds the export request of spans, grouped by service
+func newOTLPRequest(spans ...SpanData) otlpRequest {
+	var req otlpRequest
+	services := make(map[string]int)
+	for _, span := range spans {
+		i, ok := services[span.Service]
+		if !ok {
+			i = len(req.ResourceSpans)
+			services[span.Service] = i
+			req.ResourceSpans = append(req.ResourceSpans, otlpResourceSpans{
+				Resource: otlpResource{
+					Attributes: []otlpAttribute{{Key: "service.name", Value: otlpValue{span.Service}}},
+				},
+				ScopeSpans: []otlpScopeSpans{{
+					Scope: otlpScope{Name: "github.com/MorpheoOrg/morpheo-compute/tracing"},
+				}},
+			})
+		}
+		scope := &req.ResourceSpans[i].ScopeSpans[0]
+		scope.Spans = append(scope.Spans, newOTLPSpan(span))
+	}
+	return req
+}
+
+func newOTLPSpan(span SpanData) otlpSpan {
+	keys := make([]string, 0, len(span.Attributes))
+	for key := range span.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var attributes []otlpAttribute
+	for _, key := range keys {
+		attributes = append(attributes, otlpAttribute{Key: key, Value: otlpValue{span.Attributes[key]}})
+	}
+
+	status := otlpStatus{Code: otlpStatusOK}
+	if span.Error != "" {
+		status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+	}
+
+	return otlpSpan{
+		TraceID:           span.TraceID,
+		SpanID:            span.SpanID,
+		ParentSpanID:      span.ParentSpanID,
+		Name:              span.Name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Attributes:        attributes,
+		Status:            status,
+	}
+}
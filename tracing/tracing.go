@@ -0,0 +1,222 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+// Package tracing propagates trace contexts across the compute API, the broker and the workers,
+// and exports spans in the OpenTelemetry (OTLP/JSON) format.
+//
+// Trace contexts are carried as W3C traceparent strings (https://www.w3.org/TR/trace-context/),
+// both in HTTP headers and in the task payloads pushed to the broker.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader is the HTTP header carrying the trace context
+const TraceparentHeader = "traceparent"
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// IsValid returns true if the span context holds a trace ID and a span ID
+func (sc SpanContext) IsValid() bool {
+	return len(sc.TraceID) == 32 && len(sc.SpanID) == 16
+}
+
+// Traceparent serializes the span context as a W3C traceparent string
+func (sc SpanContext) Traceparent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", sc.TraceID, sc.SpanID)
+}
+
+// ParseTraceparent parses a W3C traceparent string
+func ParseTraceparent(traceparent string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) != 4 {
+		return SpanContext{}, fmt.Errorf("Invalid traceparent %q: expected 4 dash-separated fields", traceparent)
+	}
+	sc := SpanContext{TraceID: strings.ToLower(parts[1]), SpanID: strings.ToLower(parts[2])}
+	if !sc.IsValid() || !isHex(sc.TraceID) || !isHex(sc.SpanID) {
+		return SpanContext{}, fmt.Errorf("Invalid traceparent %q: malformed trace or span ID", traceparent)
+	}
+	return sc, nil
+}
+
+// Tracer creates spans and hands them over to an exporter once they're ended. A nil Tracer is
+// valid: it still generates IDs (so that trace contexts get propagated) but exports nothing.
+type Tracer struct {
+	service  string
+	exporter Exporter
+}
+
+// NewTracer creates a Tracer for a given service name
+func NewTracer(service string, exporter Exporter) *Tracer {
+	return &Tracer{
+		service:  service,
+		exporter: exporter,
+	}
+}
+
+// Start starts a new span. If parent is invalid, the span is the root of a new trace.
+func (t *Tracer) Start(name string, parent SpanContext) *Span {
+	span := &Span{
+		tracer:     t,
+		name:       name,
+		start:      time.Now(),
+		attributes: map[string]string{},
+	}
+	if parent.IsValid() {
+		span.context.TraceID = parent.TraceID
+		span.parentSpanID = parent.SpanID
+	} else {
+		span.context.TraceID = randomHex(16)
+	}
+	span.context.SpanID = randomHex(8)
+	return span
+}
+
+// StartFromTraceparent starts a new span whose parent is given as a traceparent string. Invalid or
+// empty traceparents start a new trace.
+func (t *Tracer) StartFromTraceparent(name, traceparent string) *Span {
+	parent, err := ParseTraceparent(traceparent)
+	if err != nil && traceparent != "" {
+		log.Printf("[WARNING][tracing] %s, starting a new trace", err)
+	}
+	return t.Start(name, parent)
+}
+
+// Span is a timed operation within a trace
+type Span struct {
+	tracer       *Tracer
+	context      SpanContext
+	parentSpanID string
+	name         string
+	start        time.Time
+	attributes   map[string]string
+
+	lock  sync.Mutex
+	ended bool
+}
+
+// Context returns the span context, to be used as a parent for child spans
+func (s *Span) Context() SpanContext {
+	return s.context
+}
+
+// Traceparent returns the span context serialized as a traceparent string
+func (s *Span) Traceparent() string {
+	return s.context.Traceparent()
+}
+
+// Child starts a child span
+func (s *Span) Child(name string) *Span {
+	return s.tracer.Start(name, s.context)
+}
+
+// SetAttribute adds a key/value attribute to the span
+func (s *Span) SetAttribute(key, value string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attributes[key] = value
+}
+
+// End ends the span and exports it. A non-nil err marks the span as failed. Ending a span twice
+// is a no-op.
+func (s *Span) End(err error) {
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	data := SpanData{
+		TraceID:      s.context.TraceID,
+		SpanID:       s.context.SpanID,
+		ParentSpanID: s.parentSpanID,
+		Name:         s.name,
+		Start:        s.start,
+		End:          time.Now(),
+		Attributes:   s.attributes,
+	}
+	s.lock.Unlock()
+
+	if err != nil {
+		data.Error = err.Error()
+	}
+	if s.tracer == nil || s.tracer.exporter == nil {
+		return
+	}
+	data.Service = s.tracer.service
+	if err := s.tracer.exporter.Export(data); err != nil {
+		log.Printf("[ERROR][tracing] Failed to export span %s: %s", s.name, err)
+	}
+}
+
+// SpanData is an ended span, as handed over to exporters
+type SpanData struct {
+	Service      string
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]string
+	Error        string
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Panicf("[FATAL ERROR] Impossible to generate random trace ID: %s", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceparent(t *testing.T) {
+	span := (*Tracer)(nil).Start("root", SpanContext{})
+	assert.True(t, span.Context().IsValid())
+
+	parsed, err := ParseTraceparent(span.Traceparent())
+	assert.Nil(t, err)
+	assert.Equal(t, span.Context(), parsed)
+
+	child := span.Child("child")
+	assert.Equal(t, span.Context().TraceID, child.Context().TraceID)
+	assert.NotEqual(t, span.Context().SpanID, child.Context().SpanID)
+
+	for _, invalid := range []string{"", "00-abc-def-01", "00-zz0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"} {
+		_, err := ParseTraceparent(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestWriterExporter(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewTracer("test", NewWriterExporter(&buf))
+
+	parent := tracer.Start("parent", SpanContext{})
+	child := parent.Child("child")
+	child.SetAttribute("uplet.key", "learnuplet_1")
+	child.End(errors.New("boom"))
+	child.End(nil)
+
+	var req otlpRequest
+	assert.Nil(t, json.NewDecoder(&buf).Decode(&req))
+	span := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	assert.Equal(t, "child", span.Name)
+	assert.Equal(t, parent.Context().SpanID, span.ParentSpanID)
+	assert.Equal(t, otlpStatusError, span.Status.Code)
+	assert.Equal(t, "learnuplet_1", span.Attributes[0].Value.StringValue)
+	assert.Equal(t, "test", req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+
+	// Ending a span twice only exports it once
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan otlpRequest, 10)
+	unblock := make(chan struct{})
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		requests <- req
+		<-unblock
+	}))
+	defer collector.Close()
+	defer close(unblock)
+
+	// Spans are posted in batches of 2
+	exporter := newOTLPExporter(collector.URL, 2, 2, time.Hour)
+	tracer := NewTracer("test", exporter)
+	tracer.Start("first", SpanContext{}).End(nil)
+	tracer.Start("second", SpanContext{}).End(nil)
+	req := <-requests
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "second", spans[1].Name)
+
+	// While the collector hangs, spans past the queue size are dropped instead of blocking
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		tracer.Start("dropped", SpanContext{}).End(nil)
+	}
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, int64(3), atomic.LoadInt64(&exporter.dropped))
+}
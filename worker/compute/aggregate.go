@@ -0,0 +1,274 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package compute
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/aggregate"
+	"github.com/MorpheoOrg/morpheo-compute/envelope"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// AggregateInputsFile describes the input models to the aggregate entrypoint: it's written next
+// to their folders (named after their UUID) and holds a list of aggregate.Input
+const AggregateInputsFile = "aggregate.json"
+
+// HandleAggregate manages an aggregation task. Aggregations aren't registered on the peer: the
+// aggregated model and its lineage are only posted to storage.
+func (w *Worker) HandleAggregate(message []byte) (err error) {
+	log.Println("[DEBUG][aggregate] Starting aggregation task")
+
+	msg, err := envelope.Decode(message, envelope.TypeAggregate)
+	if err != nil {
+		taskFailures.WithLabelValues("aggregate", StageDecode).Inc()
+		return fmt.Errorf("Error decoding aggregate-uplet message: %s -- Body: %s", err, message)
+	}
+	var task aggregate.Aggregateuplet
+	if err = msg.Unmarshal(&task); err != nil {
+		taskFailures.WithLabelValues("aggregate", StageDecode).Inc()
+		return fmt.Errorf("Error un-marshaling aggregate-uplet: %s -- Body: %s", err, message)
+	}
+	log.Printf("[DEBUG][aggregate] Received %s (schema version %d, submitted by %q, priority %q, %d models)", task.Key, msg.SchemaVersion, msg.Submitter, msg.Priority, len(task.Models))
+
+	// Let's continue the trace started by the API
+	span := w.tracer.StartFromTraceparent("worker.HandleAggregate", msg.Traceparent)
+	span.SetAttribute("uplet.key", task.Key)
+	span.SetAttribute("worker.id", w.ID.String())
+	span.SetAttribute("message.priority", msg.Priority)
+	defer func() { span.End(err) }()
+
+	if err = task.Check(); err != nil {
+		taskFailures.WithLabelValues("aggregate", StageCheck).Inc()
+		return fmt.Errorf("Error in aggregate task: %s -- Body: %s", err, message)
+	}
+
+	// Input models may still be trained: let the broker deliver the task again later
+	for _, model := range task.Models {
+		if err = w.checkStartModel(model); err != nil {
+			taskDeferrals.WithLabelValues("aggregate", DeferInputModels).Inc()
+			return fmt.Errorf("Input model %s of %s isn't on storage yet, requeuing it: %s", model, task.Key, err)
+		}
+	}
+
+	if err = w.AggregateWorkflow(task, span); err != nil {
+		return fmt.Errorf("Error in AggregateWorkflow: %s", err)
+	}
+	return nil
+}
+
+// AggregateWorkflow combines the input models of an aggregation task into a new model, using the
+// aggregate entrypoint of the algo (or problem workflow) container, and posts it to storage along
+// with its lineage. Each of its stages is traced as a child span of parent.
+func (w *Worker) AggregateWorkflow(task aggregate.Aggregateuplet, parent *tracing.Span) (err error) {
+	log.Printf("[DEBUG][aggregate] Starting aggregation workflow for %s", task.Key)
+
+	timer := newStageTimer("aggregate", task.Key, parent)
+	defer func() { timer.Done(err) }()
+
+	// Setup directory structure
+	taskDataFolder := filepath.Join(w.dataFolder, fmt.Sprintf("aggregate-%s", task.ModelEnd))
+	inputsFolder := filepath.Join(taskDataFolder, "models")
+	modelFolder := filepath.Join(taskDataFolder, w.modelFolder)
+	for _, path := range []string{taskDataFolder, inputsFolder, modelFolder} {
+		if err = os.MkdirAll(path, os.ModeDir); err != nil {
+			return fmt.Errorf("Error creating folder under %s: %s", path, err)
+		}
+	}
+	defer os.RemoveAll(taskDataFolder)
+
+	// Load the container providing the aggregate entrypoint
+	timer.Stage(StageImageLoad)
+	lineage := task.Lineage()
+	var imageName string
+	if lineage.Entrypoint == aggregate.EntrypointProblem {
+		problemWorkflow, err := w.storage.GetProblemWorkflowBlob(task.Problem)
+		if err != nil {
+			return fmt.Errorf("Error pulling problem workflow %s from storage: %s", task.Problem, err)
+		}
+		imageName = fmt.Sprintf("%s-%s", w.problemImagePrefix, task.Problem)
+		err = w.ImageLoad(imageName, problemWorkflow)
+		problemWorkflow.Close()
+		if err != nil {
+			return fmt.Errorf("Error loading problem workflow image %s in Docker daemon: %s", task.Problem, err)
+		}
+	} else {
+		algo, err := w.storage.GetAlgoBlob(task.Algo)
+		if err != nil {
+			return fmt.Errorf("Error pulling algo %s from storage: %s", task.Algo, err)
+		}
+		imageName = fmt.Sprintf("%s-%s", w.algoImagePrefix, task.Algo)
+		err = w.ImageLoad(imageName, algo)
+		algo.Close()
+		if err != nil {
+			return fmt.Errorf("Error loading algo image %s in Docker daemon: %s", imageName, err)
+		}
+	}
+	defer w.containerRuntime.ImageUnload(imageName)
+
+	// Pull the input models, each in its own folder
+	timer.Stage(StageModelDownload)
+	for _, model := range task.Models {
+		folder := filepath.Join(inputsFolder, model.String())
+		if err = os.MkdirAll(folder, os.ModeDir); err != nil {
+			return fmt.Errorf("Error creating folder under %s: %s", folder, err)
+		}
+		blob, err := w.storage.GetModelBlob(model)
+		if err != nil {
+			return fmt.Errorf("Error pulling input model %s from storage: %s", model, err)
+		}
+		err = w.UntargzInFolder(folder, &countingReader{blob, TransferDownload, TransferModel})
+		blob.Close()
+		if err != nil {
+			return fmt.Errorf("Error un-tar-gz-ing input model %s: %s", model, err)
+		}
+	}
+	if err = writeJSON(filepath.Join(inputsFolder, AggregateInputsFile), lineage.Inputs); err != nil {
+		return err
+	}
+
+	timer.Stage(StageAggregate)
+	if _, err = w.Aggregate(imageName, lineage.Entrypoint, inputsFolder, modelFolder); err != nil {
+		return fmt.Errorf("Error in aggregate task: %s -- Body: %v", err, task)
+	}
+
+	// The aggregated model records the models it comes from
+	timer.Stage(StageModelUpload)
+	if err = writeJSON(filepath.Join(modelFolder, aggregate.LineageFile), lineage); err != nil {
+		return err
+	}
+	algoInfo, err := w.storage.GetAlgo(task.Algo)
+	if err != nil {
+		return fmt.Errorf("Error retrieving algorithm %s metadata: %s", task.Algo, err)
+	}
+	if err = w.postModelFolder(task.ModelEnd, algoInfo, modelFolder, filepath.Join(taskDataFolder, "model.tar.gz"), TransferModel); err != nil {
+		return err
+	}
+
+	log.Printf("[INFO][aggregate] Aggregated %d models into %s (%s), cleaning up...", len(task.Models), task.ModelEnd, task.Key)
+	return nil
+}
+
+// Aggregate launches the aggregate routines of the algo or problem workflow container (depending
+// on entrypoint), over the input models in inputsFolder. The aggregated model is written in
+// modelFolder.
+func (w *Worker) Aggregate(image, entrypoint, inputsFolder, modelFolder string) (containerID string, err error) {
+	if entrypoint == aggregate.EntrypointProblem {
+		return w.containerRuntime.RunImageInUntrustedContainer(
+			image,
+			[]string{"-T", "aggregate", "-i", "/hidden_data", "-s", "/submission_data"},
+			map[string]string{
+				inputsFolder: "/submission_data/models",
+				modelFolder:  "/submission_data/model",
+			}, true)
+	}
+	return w.containerRuntime.RunImageInUntrustedContainer(
+		image,
+		[]string{"-V", "/data", "-T", "aggregate"},
+		map[string]string{
+			inputsFolder: "/data/models",
+			modelFolder:  "/data/model",
+		}, true)
+}
+
+// postModelFolder tar-gzips a model folder into archivePath and streams it to storage, the bytes
+// uploaded being counted as kind
+func (w *Worker) postModelFolder(modelID uuid.UUID, algoInfo *common.Algo, modelFolder, archivePath, kind string) error {
+	newModel := common.NewModel(modelID, algoInfo)
+	newModel.ID = modelID
+
+	archiveWriter, err := os.Create(archivePath)
+	if err != nil {
+		return fmt.Errorf("Error creating new model archive file %s: %s", archivePath, err)
+	}
+	var skip func(path string) bool
+	if kind == TransferCheckpoint {
+		skip = checkpointTmp
+	}
+	err = targzFolder(modelFolder, archiveWriter, skip)
+	archiveWriter.Close()
+	if err != nil {
+		return fmt.Errorf("Error tar-gzipping new model %s: %s", modelID, err)
+	}
+
+	archiveReader, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("Error reading new model archive file %s: %s", archivePath, err)
+	}
+	defer archiveReader.Close()
+	stat, err := archiveReader.Stat()
+	if err != nil {
+		return fmt.Errorf("Error reading new model archive size %s: %s", archivePath, err)
+	}
+	if err = w.storage.PostModel(newModel, archiveReader, stat.Size()); err != nil {
+		return fmt.Errorf("Error streaming new model %s to storage: %s", modelID, err)
+	}
+	bytesTransferred.WithLabelValues(TransferUpload, kind).Add(float64(stat.Size()))
+	return nil
+}
+
+// writeJSON writes v as a JSON file
+func writeJSON(path string, v interface{}) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("Error marshaling %s: %s", path, err)
+	}
+	if err = ioutil.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("Error writing %s: %s", path, err)
+	}
+	return nil
+}
+
+// readJSON reads a JSON file into v
+func readJSON(path string, v interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %s", path, err)
+	}
+	if err = json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("Error un-marshaling %s: %s", path, err)
+	}
+	return nil
+}
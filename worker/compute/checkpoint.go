@@ -0,0 +1,286 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package compute
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/workflow"
+)
+
+// CheckpointNamespace is the namespace of the storage IDs of training checkpoints (see
+// CheckpointID)
+var CheckpointNamespace = uuid.FromStringOrNil("5f0b3c8e-2d4a-4e71-9a6c-8b1f7d2e4c90")
+
+// maxCheckpoints bounds the search for the latest checkpoint of a task
+const maxCheckpoints = 1 << 16
+
+// CheckpointID is the storage ID of the seq-th checkpoint of a learnuplet. Checkpoints are posted
+// to storage as models of the task's algo, numbered from 1 without gaps, for any worker to find
+// the latest one.
+func CheckpointID(key string, seq int) uuid.UUID {
+	return uuid.NewV5(CheckpointNamespace, fmt.Sprintf("%s/%d", key, seq))
+}
+
+// SetCheckpointInterval sets how often the checkpoint folder of training containers is uploaded
+// to storage (0 disables checkpoints)
+func (w *Worker) SetCheckpointInterval(interval time.Duration) {
+	w.checkpointInterval = interval
+}
+
+// checkpointedTrain trains a model, as Train, with checkpoints (if enabled): the checkpoint folder
+// is restored from the latest checkpoint of the task first, if any (left by a previous attempt, on
+// any worker), and uploaded every checkpoint interval while the training runs. The checkpoint
+// folder is uploaded one last time if the training fails, for the next attempt to resume from there.
+func (w *Worker) checkpointedTrain(task common.Learnuplet, manifest *workflow.Manifest, algoImage, trainFolder, testFolder, modelFolder, paramsFolder, checkpointFolder, archivePath string) error {
+	if err := resetFolder(checkpointFolder); err != nil {
+		return err
+	}
+	if w.checkpointInterval <= 0 {
+		_, err := w.Train(manifest, algoImage, trainFolder, testFolder, modelFolder, paramsFolder, checkpointFolder)
+		return err
+	}
+
+	algoInfo, err := w.storage.GetAlgo(task.Algo)
+	if err != nil {
+		return fmt.Errorf("Error retrieving algorithm %s metadata: %s", task.Algo, err)
+	}
+	// Training from scratch (or an older checkpoint) after a storage error would lose progress, and
+	// the next checkpoint uploads would clash with the ones already on storage
+	seq, err := w.restoreCheckpoint(task.Key, checkpointFolder)
+	if err != nil {
+		return fmt.Errorf("Error restoring the latest checkpoint of %s: %s", task.Key, err)
+	}
+	if seq > 0 {
+		log.Printf("[INFO][learn] Resuming training of %s from checkpoint %d", task.Key, seq)
+	}
+
+	checkpoints := w.startCheckpointer(task.Key, algoInfo, checkpointFolder, archivePath, seq)
+	_, err = w.Train(manifest, algoImage, trainFolder, testFolder, modelFolder, paramsFolder, checkpointFolder)
+	checkpoints.Stop(err != nil)
+	return err
+}
+
+// latestCheckpoint finds the number of the latest checkpoint of a task on storage (0 if it has
+// none), by exponential then binary search
+func (w *Worker) latestCheckpoint(key string) (int, error) {
+	exists := func(seq int) (bool, error) {
+		return w.modelExists(CheckpointID(key, seq))
+	}
+	found, err := exists(1)
+	if err != nil || !found {
+		return 0, err
+	}
+	low, high := 1, 2
+	for {
+		if found, err = exists(high); err != nil {
+			return 0, err
+		} else if !found {
+			break
+		}
+		if high >= maxCheckpoints {
+			return 0, fmt.Errorf("Found more than %d checkpoints of %s on storage", maxCheckpoints, key)
+		}
+		low, high = high, high*2
+	}
+	// Checkpoint low exists, high doesn't
+	for high-low > 1 {
+		mid := (low + high) / 2
+		if found, err = exists(mid); err != nil {
+			return 0, err
+		} else if found {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+	return low, nil
+}
+
+// restoreCheckpoint pulls the latest checkpoint of a task into folder, and returns its number (0
+// if the task has none)
+func (w *Worker) restoreCheckpoint(key, folder string) (int, error) {
+	seq, err := w.latestCheckpoint(key)
+	if err != nil || seq == 0 {
+		return 0, err
+	}
+	id := CheckpointID(key, seq)
+	blob, err := w.storage.GetModelBlob(id)
+	if err != nil {
+		return 0, fmt.Errorf("Error pulling checkpoint %d (%s) from storage: %s", seq, id, err)
+	}
+	defer blob.Close()
+	if err = w.UntargzInFolder(folder, &countingReader{blob, TransferDownload, TransferCheckpoint}); err != nil {
+		return 0, fmt.Errorf("Error un-tar-gzipping checkpoint %d (%s): %s", seq, id, err)
+	}
+	checkpointOps.WithLabelValues(CheckpointRestore).Inc()
+	return seq, nil
+}
+
+// deleteCheckpoints deletes the checkpoints of a task from storage, once its model is uploaded or
+// once it's reported failed, if the storage can (see ModelDeleter). Failures are only logged.
+func (w *Worker) deleteCheckpoints(key string) {
+	deleter, ok := w.storage.(ModelDeleter)
+	if w.checkpointInterval <= 0 || !ok {
+		return
+	}
+	seq, err := w.latestCheckpoint(key)
+	if err != nil {
+		log.Printf("[WARNING][checkpoint] Error finding the checkpoints of %s to delete: %s", key, err)
+		return
+	}
+	// Latest first, for the remaining checkpoints to stay numbered without gaps
+	for ; seq > 0; seq-- {
+		if err = deleter.DeleteModel(CheckpointID(key, seq)); err != nil {
+			log.Printf("[WARNING][checkpoint] Error deleting checkpoint %d of %s: %s", seq, key, err)
+			return
+		}
+		checkpointOps.WithLabelValues(CheckpointDelete).Inc()
+	}
+}
+
+// checkpointer uploads the checkpoint folder of a running training container to storage every
+// checkpoint interval, if its content changed
+type checkpointer struct {
+	w           *Worker
+	key         string
+	algo        *common.Algo
+	folder      string
+	archivePath string
+
+	seq    int    // number of the latest checkpoint uploaded (or restored)
+	digest string // digest of its content
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startCheckpointer starts uploading a checkpoint folder, the checkpoint numbers following seq
+func (w *Worker) startCheckpointer(key string, algo *common.Algo, folder, archivePath string, seq int) *checkpointer {
+	c := &checkpointer{
+		w:           w,
+		key:         key,
+		algo:        algo,
+		folder:      folder,
+		archivePath: archivePath,
+		seq:         seq,
+		digest:      folderDigest(folder),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *checkpointer) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.w.checkpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.upload()
+		}
+	}
+}
+
+// Stop stops the periodic uploads, and uploads the checkpoint folder one last time if final
+func (c *checkpointer) Stop(final bool) {
+	close(c.stop)
+	<-c.done
+	if final {
+		c.upload()
+	}
+}
+
+// upload posts the checkpoint folder to storage as the next checkpoint, unless it's empty or
+// unchanged since the latest checkpoint. Failed uploads are only logged: the training goes on,
+// and the next upload is attempted under the same number.
+func (c *checkpointer) upload() {
+	digest := folderDigest(c.folder)
+	if digest == "" || digest == c.digest {
+		return
+	}
+	seq := c.seq + 1
+	id := CheckpointID(c.key, seq)
+	if err := c.w.postModelFolder(id, c.algo, c.folder, c.archivePath, TransferCheckpoint); err != nil {
+		checkpointOps.WithLabelValues(CheckpointUploadFailed).Inc()
+		log.Printf("[WARNING][checkpoint] Error uploading checkpoint %d of %s: %s", seq, c.key, err)
+		return
+	}
+	os.Remove(c.archivePath)
+	checkpointOps.WithLabelValues(CheckpointUpload).Inc()
+	log.Printf("[DEBUG][checkpoint] Uploaded checkpoint %d of %s (%s)", seq, c.key, id)
+	c.seq, c.digest = seq, digest
+}
+
+// checkpointTmp returns true for the temporary files checkpoints are being written to, which
+// aren't uploaded (algos write checkpoint files atomically, renaming them once written)
+func checkpointTmp(path string) bool {
+	return strings.HasSuffix(path, ".tmp")
+}
+
+// folderDigest digests the paths, sizes and modification times of the files in a checkpoint folder
+// ("" if it holds no file), temporary files aside
+func folderDigest(folder string) string {
+	hash := sha256.New()
+	files := 0
+	filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || checkpointTmp(path) {
+			return nil
+		}
+		files++
+		fmt.Fprintf(hash, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if files == 0 {
+		return ""
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,751 @@
+
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package compute
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/client"
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/envelope"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+	"github.com/MorpheoOrg/morpheo-compute/workflow"
+)
+
+// Worker describes a worker (where it stores its data, which container runtime it uses...).
+// Most importantly, it carefully implements all the steps of our learning/testing/prediction
+// workflow.
+//
+// For an in-detail understanding of what these different steps do and how, check out Camille's
+// awesome example: https://github.com/MorpheoOrg/hypnogram-wf
+// The doc also gets there in detail: https://morpheoorg.github.io/morpheo/modules/learning.html
+type Worker struct {
+	ID uuid.UUID
+	// Worker configuration variables
+	dataFolder           string
+	trainFolder          string
+	testFolder           string
+	untargetedTestFolder string
+	modelFolder          string
+	predFolder           string
+	perfFolder           string
+	problemImagePrefix   string
+	algoImagePrefix      string
+
+	// ContainerRuntime abstractions
+	containerRuntime common.ContainerRuntime
+
+	// Morpheo API clients
+	storage client.Storage
+	peer    client.Peer
+
+	// Tracing (a nil tracer propagates trace contexts but exports nothing)
+	tracer *tracing.Tracer
+
+	// How long the workspace of failed tasks is kept for their next attempt (0 not to journal them)
+	journalMaxAge time.Duration
+
+	// How often training containers' checkpoint folder is uploaded to storage (0 not to checkpoint)
+	checkpointInterval time.Duration
+
+	// Whether the broker retries failed tasks forever: they're reported failed right away then
+	noGiveUp bool
+
+	// How long chained learnuplets wait for their start model (0 for as long as the broker retries)
+	startModelWait time.Duration
+
+	// Running tasks and consumed task types, reported in heartbeats
+	tasks *taskTracker
+}
+
+// Perfuplet describes the performance.json file, an output of learning tasks
+type Perfuplet struct {
+	Perf      float64            `json:"perf"`
+	TrainPerf map[string]float64 `json:"train_perf"`
+	TestPerf  map[string]float64 `json:"test_perf"`
+	// PerfStd and Folds are set for cross-validated tasks, see MergeFolds
+	PerfStd float64     `json:"perf_std,omitempty"`
+	Folds   []Perfuplet `json:"folds,omitempty"`
+}
+
+// LearnOptions are the options a learnuplet was pushed with, along with it
+type LearnOptions struct {
+	// Params are the hyperparameters mounted as params.json in the training container
+	Params map[string]interface{}
+	// CVFolds is the number of cross-validation folds (0 or 1 not to cross-validate)
+	CVFolds int
+}
+
+// NewWorker creates a Worker instance
+func NewWorker(dataFolder, trainFolder, testFolder, untargetedTestFolder, predFolder, perfFolder, modelFolder, problemImagePrefix, algoImagePrefix string, containerRuntime common.ContainerRuntime, storage client.Storage, peer client.Peer) *Worker {
+	return &Worker{
+		ID: uuid.NewV4(),
+
+		dataFolder:           dataFolder,
+		trainFolder:          trainFolder,
+		testFolder:           testFolder,
+		predFolder:           predFolder,
+		perfFolder:           perfFolder,
+		untargetedTestFolder: untargetedTestFolder,
+		modelFolder:          modelFolder,
+
+		problemImagePrefix: problemImagePrefix,
+		algoImagePrefix:    algoImagePrefix,
+		containerRuntime:   containerRuntime,
+
+		storage: storage,
+		peer:    peer,
+
+		tasks: newTaskTracker(),
+	}
+}
+
+// SetTracer sets the tracer the worker's tasks spans are exported with
+func (w *Worker) SetTracer(tracer *tracing.Tracer) {
+	w.tracer = tracer
+}
+
+// HandleLearn manages a learning task (peer status updates, etc...)
+func (w *Worker) HandleLearn(message []byte) (err error) {
+	log.Println("[DEBUG][learn] Starting learning task")
+
+	// Unmarshal the learn-uplet (both enveloped and legacy messages are accepted)
+	msg, err := envelope.Decode(message, envelope.TypeLearn)
+	if err != nil {
+		taskFailures.WithLabelValues("learn", StageDecode).Inc()
+		return fmt.Errorf("Error decoding learn-uplet message: %s -- Body: %s", err, message)
+	}
+	var task common.Learnuplet
+	err = msg.Unmarshal(&task)
+	if err != nil {
+		taskFailures.WithLabelValues("learn", StageDecode).Inc()
+		return fmt.Errorf("Error un-marshaling learn-uplet: %s -- Body: %s", err, message)
+	}
+	log.Printf("[DEBUG][learn] Received %s (schema version %d, submitted by %q, priority %q, params %v, %d CV folds)", task.Key, msg.SchemaVersion, msg.Submitter, msg.Priority, msg.Params, msg.CVFolds)
+
+	// Let's continue the trace started by the API
+	span := w.tracer.StartFromTraceparent("worker.HandleLearn", msg.Traceparent)
+	span.SetAttribute("uplet.key", task.Key)
+	span.SetAttribute("worker.id", w.ID.String())
+	span.SetAttribute("message.priority", msg.Priority)
+	defer func() { span.End(err) }()
+
+	if err = task.Check(); err != nil {
+		taskFailures.WithLabelValues("learn", StageCheck).Inc()
+		// No attempt can complete an invalid learnuplet: it's reported failed right away, and not
+		// handed back to the broker
+		log.Printf("[ERROR][learn] Invalid learnuplet %s, reporting it failed: %s -- Body: %s", task.Key, err, message)
+		if err = w.reportLearnFailed(task.Key, span); err != nil {
+			return fmt.Errorf("Error setting invalid learnuplet %s status to failed on the peer: %s", task.Key, err)
+		}
+		return nil
+	}
+
+	// Chained learnuplets can't be trained before their predecessor produced their start model: let
+	// the broker deliver them again later (with its backoff) rather than failing them for good
+	if task.Rank > 0 {
+		found, err := w.modelExists(task.ModelStart)
+		if err != nil {
+			taskFailures.WithLabelValues("learn", StageModelDownload).Inc()
+			return w.deferChained(task.Key, msg.EnqueuedAt, fmt.Errorf("Error looking up start model %s of %s on storage: %s", task.ModelStart, task.Key, err), span)
+		}
+		if !found {
+			taskDeferrals.WithLabelValues("learn", DeferStartModel).Inc()
+			return w.deferChained(task.Key, msg.EnqueuedAt, fmt.Errorf("Start model %s of %s isn't on storage yet, requeuing it", task.ModelStart, task.Key), span)
+		}
+	}
+
+	// Update its status to pending on the peer
+	peerSpan := span.Child("peer.SetUpletWorker")
+	_, _, err = w.peer.SetUpletWorker(task.Key, w.ID.String())
+	peerSpan.End(err)
+	if err != nil {
+		taskFailures.WithLabelValues("learn", StagePeerAssign).Inc()
+		return fmt.Errorf("Error setting uplet worker: %s", err)
+	}
+
+	err = w.LearnWorkflow(task, LearnOptions{Params: msg.Params, CVFolds: msg.CVFolds}, span)
+	if err != nil {
+		// Its next attempt may complete the learnuplet (resuming at the stage that failed): it's only
+		// reported failed once the broker gives up on it
+		return w.retry(fmt.Errorf("Error in LearnWorkflow: %s", err), func() error {
+			return w.reportLearnFailed(task.Key, span)
+		})
+	}
+	return nil
+}
+
+// reportLearnFailed sets the status of a learnuplet to failed on the peer, and deletes its
+// checkpoints since no attempt will resume from them anymore
+func (w *Worker) reportLearnFailed(key string, parent *tracing.Span) error {
+	var m map[string]float64
+	var f float64
+	reportSpan := parent.Child("peer.ReportLearn")
+	_, _, err := w.peer.ReportLearn(key, common.TaskStatusFailed, f, m, m)
+	reportSpan.End(err)
+	if err != nil {
+		return err
+	}
+	w.deleteCheckpoints(key)
+	return nil
+}
+
+// SetStartModelWait limits how long chained learnuplets wait for their start model, from the time
+// they were enqueued, before being reported failed (0 for as long as the broker retries them)
+func (w *Worker) SetStartModelWait(wait time.Duration) {
+	w.startModelWait = wait
+}
+
+// deferChained hands a chained learnuplet whose start model can't be found back to the broker. It's
+// reported failed once it has waited for its start model for longer than startModelWait, or once
+// the broker gives up on it (brokers retrying tasks forever only fail it on the wait limit).
+func (w *Worker) deferChained(key string, enqueuedAt time.Time, err error, span *tracing.Span) error {
+	if w.startModelWait > 0 && !enqueuedAt.IsZero() && time.Since(enqueuedAt) > w.startModelWait {
+		log.Printf("[ERROR][learn] %s waited for its start model for more than %s, reporting it failed: %s", key, w.startModelWait, err)
+		if err = w.reportLearnFailed(key, span); err != nil {
+			return fmt.Errorf("Error setting learnuplet %s status to failed on the peer: %s", key, err)
+		}
+		return nil
+	}
+	if w.noGiveUp {
+		return err
+	}
+	return retryError{err, func() error { return w.reportLearnFailed(key, span) }}
+}
+
+// checkStartModel makes sure the start model of a learnuplet (or the input model of another task)
+// can be pulled from storage (the blob is closed right away, the workflow pulls it for real)
+func (w *Worker) checkStartModel(model uuid.UUID) error {
+	blob, err := w.storage.GetModelBlob(model)
+	if err != nil {
+		return err
+	}
+	return blob.Close()
+}
+
+// LearnWorkflow implements our learning workflow. Each of its stages is traced as a child span of
+// parent. Stages are journaled (if enabled): a failed task keeps its workspace, and its next
+// attempt resumes at the stage that failed.
+func (w *Worker) LearnWorkflow(task common.Learnuplet, opts LearnOptions, parent *tracing.Span) (err error) {
+	log.Printf("[DEBUG][learn] Starting learning workflow for %s", task.Key)
+
+	// Let's time (and trace) each stage of the workflow
+	timer := newStageTimer("learn", task.Key, parent)
+	defer func() { timer.Done(err) }()
+
+	// Setup directory structure (the trials of a sweep share their algo, and may run side by side).
+	// Journaled tasks get a workspace of their own, kept across attempts.
+	taskDataFolder := filepath.Join(w.dataFolder, task.Algo.String())
+	if opts.Params != nil {
+		taskDataFolder = filepath.Join(w.dataFolder, fmt.Sprintf("%s-%s", task.Algo, task.ModelEnd))
+	}
+	journal, err := w.openJournal("learn", task.Key, []interface{}{task, opts})
+	if err != nil {
+		return err
+	}
+	taskDataFolder = journal.workspace(taskDataFolder)
+	trainFolder := filepath.Join(taskDataFolder, w.trainFolder)
+	testFolder := filepath.Join(taskDataFolder, w.testFolder)
+	untargetedTestFolder := filepath.Join(taskDataFolder, w.untargetedTestFolder)
+	modelFolder := filepath.Join(taskDataFolder, w.modelFolder)
+	startModelFolder := filepath.Join(taskDataFolder, "start_model")
+	checkpointFolder := filepath.Join(taskDataFolder, "checkpoint")
+	perfFolder := filepath.Join(taskDataFolder, w.perfFolder)
+
+	pathList := []string{taskDataFolder, trainFolder, testFolder, untargetedTestFolder, modelFolder, startModelFolder, perfFolder}
+	for _, path := range pathList {
+		err = os.MkdirAll(path, os.ModeDir)
+		if err != nil {
+			return fmt.Errorf("Error creating folder under %s: %s", path, err)
+		}
+	}
+
+	// Let's make sure these folders are wiped out once the task is done (or failed, unless its next
+	// attempt can resume it)
+	defer func() {
+		if err != nil && journal != nil {
+			log.Printf("[INFO][learn] Keeping the workspace of %s for its next attempt: %s", task.Key, taskDataFolder)
+			return
+		}
+		os.RemoveAll(taskDataFolder)
+		journal.remove()
+	}()
+
+	// Load problem workflow
+	timer.Stage(StageImageLoad)
+	problemWorkflow, err := w.storage.GetProblemWorkflowBlob(task.Problem)
+	if err != nil {
+		return fmt.Errorf("Error pulling problem workflow %s from storage: %s", task.Problem, err)
+	}
+	problemImageName := fmt.Sprintf("%s-%s", w.problemImagePrefix, task.Problem)
+	manifest, err := w.ProblemImageLoad(problemImageName, problemWorkflow)
+	if err != nil {
+		return fmt.Errorf("Error loading problem workflow image %s in Docker daemon: %s", task.Problem, err)
+	}
+	problemWorkflow.Close()
+	defer w.containerRuntime.ImageUnload(problemImageName)
+
+	log.Println("[DEBUG][learn] 1st Image loaded")
+	// Load algo
+	algo, err := w.storage.GetAlgoBlob(task.Algo)
+	if err != nil {
+		return fmt.Errorf("Error pulling algo %s from storage: %s", task.Algo, err)
+	}
+
+	algoImageName := fmt.Sprintf("%s-%s", w.algoImagePrefix, task.Algo)
+	err = w.ImageLoad(algoImageName, algo)
+	if err != nil {
+		return fmt.Errorf("Error loading algo image %s in Docker daemon: %s", algoImageName, err)
+	}
+	algo.Close()
+	defer w.containerRuntime.ImageUnload(algoImageName)
+
+	// Pull the start model (if a model_start parameter was given in the learn-uplet) and the
+	// datasets
+	err = journal.step(timer, StageDataDownload, func() error {
+		return w.pullLearnData(task, startModelFolder, trainFolder, testFolder)
+	}, localOutputs(startModelFolder, trainFolder, testFolder)...)
+	if err != nil {
+		return err
+	}
+
+	// Let's copy test data into untargetedTestFolder and remove targets
+	err = journal.step(timer, StageDetarget, func() error {
+		if err := resetFolder(untargetedTestFolder); err != nil {
+			return err
+		}
+		if _, err := w.UntargetTestingVolume(manifest, problemImageName, testFolder, untargetedTestFolder); err != nil {
+			return fmt.Errorf("Error preparing problem %s for model %s: %s", task.Problem, task.ModelStart, err)
+		}
+		return nil
+	}, localOutputs(untargetedTestFolder)...)
+	if err != nil {
+		return err
+	}
+
+	// Hyperparameters are handed over to the algo as /data/params/params.json
+	paramsFolder := ""
+	if opts.Params != nil {
+		paramsFolder = filepath.Join(taskDataFolder, "params")
+		if err = w.WriteParams(paramsFolder, opts.Params); err != nil {
+			return err
+		}
+	}
+
+	// Let's cross-validate the algo on the train data first (the folds perfs are kept in the
+	// workspace until the task is done)
+	var folds []Perfuplet
+	if opts.CVFolds > 1 {
+		foldsFile := filepath.Join(taskDataFolder, "folds.json")
+		err = journal.step(timer, StageCrossValidation, func() error {
+			folds, err := w.CrossValidate(task, opts.CVFolds, manifest, problemImageName, algoImageName, taskDataFolder, startModelFolder, paramsFolder)
+			if err != nil {
+				return fmt.Errorf("Error cross-validating %s: %s", task.Key, err)
+			}
+			return writeJSON(foldsFile, folds)
+		}, localOutputs(foldsFile)...)
+		if err != nil {
+			return err
+		}
+		if err = readJSON(foldsFile, &folds); err != nil {
+			return err
+		}
+	}
+
+	// Let's pass the task to our execution backend, now that everything should be in place (the
+	// model is trained from a copy of the start model, for the training to be ran again if need be,
+	// and checkpointed to storage, for it to resume on any worker)
+	err = journal.step(timer, StageTrain, func() error {
+		if err := resetFolder(modelFolder); err != nil {
+			return err
+		}
+		if err := copyTree(startModelFolder, modelFolder); err != nil {
+			return fmt.Errorf("Error copying start model %s: %s", task.ModelStart, err)
+		}
+		if err := w.checkpointedTrain(task, manifest, algoImageName, trainFolder, untargetedTestFolder, modelFolder, paramsFolder, checkpointFolder, filepath.Join(taskDataFolder, "checkpoint.tar.gz")); err != nil {
+			return fmt.Errorf("Error in train task: %s -- Body: %s", err, task)
+		}
+		return nil
+	}, localOutputs(modelFolder, untargetedTestFolder)...)
+	if err != nil {
+		return err
+	}
+
+	// Let's compute the performance !
+	performanceFilePath := fmt.Sprintf("%s/performance.json", perfFolder)
+	err = journal.step(timer, StagePerf, func() error {
+		if err := resetFolder(perfFolder); err != nil {
+			return err
+		}
+		if _, err := w.ComputePerf(manifest, problemImageName, trainFolder, testFolder, untargetedTestFolder, perfFolder); err != nil {
+			// FIXME: do not return here
+			return fmt.Errorf("Error computing perf for problem %s and model (new) %s: %s", task.Problem, task.ModelEnd, err)
+		}
+		return nil
+	}, localOutputs(performanceFilePath)...)
+	if err != nil {
+		return err
+	}
+
+	// Let's create a new model and post it to storage
+	err = journal.step(timer, StageModelUpload, func() error {
+		algoInfo, err := w.storage.GetAlgo(task.Algo)
+		if err != nil {
+			return fmt.Errorf("Error retrieving algorithm %s metadata: %s", task.Algo, err)
+		}
+		return w.postModelFolder(task.ModelEnd, algoInfo, modelFolder, fmt.Sprintf("%s/model.tar.gz", taskDataFolder), TransferModel)
+	}, JournalOutput{Storage: fmt.Sprintf("model/%s", task.ModelEnd)})
+	if err != nil {
+		return err
+	}
+	w.deleteCheckpoints(task.Key)
+
+	// Let's send the perf file to the peer
+	timer.Stage(StagePeerReport)
+	resultFile, err := os.Open(performanceFilePath)
+	if err != nil {
+		return fmt.Errorf("Error reading performance file %s: %s", performanceFilePath, err)
+	}
+	perfuplet := Perfuplet{}
+	err = json.NewDecoder(resultFile).Decode(&perfuplet)
+	if err != nil {
+		return fmt.Errorf("Error un-marshaling performance file to JSON: %s", err)
+	}
+	if len(folds) > 0 {
+		perfuplet = MergeFolds(perfuplet, folds)
+		log.Printf("[INFO][learn] %d-fold cross-validation perf of %s: %f (std %f), holdout perf: %f", len(folds), task.Key, perfuplet.Perf, perfuplet.PerfStd, perfuplet.TestPerf[PerfHoldout])
+	}
+	if _, _, err := w.peer.ReportLearn(task.Key, common.TaskStatusDone, perfuplet.Perf, perfuplet.TrainPerf, perfuplet.TestPerf); err != nil {
+		return fmt.Errorf("Error posting learn result %s to peer: %s", task.ModelEnd, err)
+	}
+
+	resultFile.Close()
+	os.Remove(performanceFilePath)
+
+	log.Printf("[INFO][learn] Train finished with success, cleaning up...")
+
+	return
+}
+
+// pullLearnData pulls the start model of a learnuplet (if any) and its train and test datasets
+func (w *Worker) pullLearnData(task common.Learnuplet, startModelFolder, trainFolder, testFolder string) error {
+	if task.Rank > 0 {
+		// Check that modelStart is set
+		if uuid.Equal(uuid.Nil, task.ModelStart) {
+			return fmt.Errorf("Error in learnuplet: ModelStart is a Nil uuid, although Rank is set to %d", task.Rank)
+		}
+		// Pull model from storage
+		model, err := w.storage.GetModelBlob(task.ModelStart)
+		if err != nil {
+			return fmt.Errorf("Error pulling start model %s from storage: %s", task.ModelStart, err)
+		}
+		err = w.UntargzInFolder(startModelFolder, &countingReader{model, TransferDownload, TransferModel})
+		if err != nil {
+			return fmt.Errorf("Error un-tar-gz-ing model: %s", err)
+		}
+		model.Close()
+	}
+
+	// Pulling train dataset
+	for _, dataID := range task.TrainData {
+		data, err := w.storage.GetDataBlob(dataID)
+		if err != nil {
+			return fmt.Errorf("Error pulling train dataset %s from storage: %s", dataID, err)
+		}
+		path := fmt.Sprintf("%s/%s", trainFolder, dataID)
+		dataFile, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("Error creating file %s: %s", path, err)
+		}
+		n, err := io.Copy(dataFile, data)
+		bytesTransferred.WithLabelValues(TransferDownload, TransferData).Add(float64(n))
+		if err != nil {
+			return fmt.Errorf("Error copying train data file %s (%d bytes written): %s", path, n, err)
+		}
+		dataFile.Close()
+		data.Close()
+	}
+
+	// And the test data
+	for _, dataID := range task.TestData {
+		data, err := w.storage.GetDataBlob(dataID)
+		if err != nil {
+			return fmt.Errorf("Error pulling test dataset %s from storage: %s", dataID, err)
+		}
+		path := fmt.Sprintf("%s/%s", testFolder, dataID)
+		dataFile, err := os.Create(path)
+		n, err := io.Copy(dataFile, data)
+		bytesTransferred.WithLabelValues(TransferDownload, TransferData).Add(float64(n))
+		if err != nil {
+			return fmt.Errorf("Error copying test data file %s (%d bytes written): %s", path, n, err)
+		}
+		dataFile.Close()
+		data.Close()
+	}
+	return nil
+}
+
+// ImageLoad loads the docker image corresponding to a problem workflow/submission container in the
+// container runtime that will then run this problem workflow/submission container
+func (w *Worker) ImageLoad(imageName string, imageReader io.Reader) error {
+	imageTarReader, err := gzip.NewReader(&countingReader{imageReader, TransferDownload, TransferImage})
+	if err != nil {
+		return fmt.Errorf("Error un-gzipping image %s: %s", imageName, err)
+	}
+	defer imageTarReader.Close()
+
+	image, err := w.containerRuntime.ImageBuild(imageName, imageTarReader)
+	if err != nil {
+		return fmt.Errorf("Error building image %s: %s", imageName, err)
+	}
+	defer image.Close()
+
+	log.Printf("[DEBUG][containerRuntime] Loading image %s...", imageName)
+	return w.containerRuntime.ImageLoad(imageName, image)
+}
+
+// UntargzInFolder unflattens a .tar.gz archive provided as an io.Reader into a given folder
+func (w *Worker) UntargzInFolder(folder string, tarGzReader io.Reader) error {
+	zipReader, err := gzip.NewReader(tarGzReader)
+	if err != nil {
+		return fmt.Errorf("Error un-gzipping model: %s", err)
+	}
+	defer zipReader.Close()
+
+	tarReader := tar.NewReader(zipReader)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Error reading model tar archive: %s", err)
+		}
+
+		path := filepath.Join(folder, header.Name)
+		info := header.FileInfo()
+		if info.IsDir() {
+			if err := os.MkdirAll(path, info.Mode()); err != nil {
+				return fmt.Errorf("Error unflattening tar archive: error creating directory %s: %s", path, err)
+			}
+			continue
+		}
+
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+		if err != nil {
+			return fmt.Errorf("Error unflattening tar archive: error creating file %s: %s", path, err)
+		}
+		defer file.Close()
+
+		_, err = io.Copy(file, tarReader)
+		if err != nil {
+			return fmt.Errorf("Error unflattening tar archive: error writing to file %s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// TargzFolder tars and gzips a folder and forwards it to an io.Writer
+func (w *Worker) TargzFolder(folder string, dest io.Writer) error {
+	return targzFolder(folder, dest, nil)
+}
+
+// targzFolder tars and gzips a folder, but the files skip returns true for (if not nil), and
+// forwards it to an io.Writer
+func targzFolder(folder string, dest io.Writer, skip func(path string) bool) error {
+	// Let's wire our writer together
+	zipWriter := gzip.NewWriter(dest)
+	defer zipWriter.Close()
+	tarWriter := tar.NewWriter(zipWriter)
+	defer tarWriter.Close()
+
+	// Let's walk the target folder recursively and add each file entry to the tar archive
+	return filepath.Walk(folder, func(path string, info os.FileInfo, walkerr error) error {
+		if walkerr != nil {
+			return fmt.Errorf("Error walking %s: %s", folder, walkerr)
+		}
+
+		if info.IsDir() || (skip != nil && skip(path)) {
+			return nil
+		}
+
+		filename, err := filepath.Rel(folder, path)
+		if err != nil {
+			return fmt.Errorf("Error removing %s component from path %s: %s", folder, path, err)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("Error opening file from path %s: %s", path, err)
+		}
+		defer file.Close()
+		header := &tar.Header{
+			Name:    filename,
+			Size:    info.Size(),
+			Mode:    0664,
+			ModTime: info.ModTime(),
+		}
+
+		if err = tarWriter.WriteHeader(header); err != nil {
+			return fmt.Errorf("Error writing tar header for file %s: %s", path, err)
+		}
+
+		if _, err := io.Copy(tarWriter, file); err != nil {
+			return fmt.Errorf("Error writing file %s to tar archive: %s", path, err)
+		}
+
+		return nil
+	})
+}
+
+// TargzFile tars and gzips a file and forwards it to an io.Writer
+func TargzFile(file *os.File, dest io.Writer) error {
+	// Let's wire our writer together
+	zipWriter := gzip.NewWriter(dest)
+	defer zipWriter.Close()
+	tarWriter := tar.NewWriter(zipWriter)
+	defer tarWriter.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("Error getting file info: %s", err)
+	}
+	// Let's create the header
+	header := &tar.Header{
+		Name:    stat.Name(),
+		Size:    stat.Size(),
+		Mode:    0664,
+		ModTime: stat.ModTime(),
+	}
+	// write the header to the tarball archive
+	if err = tarWriter.WriteHeader(header); err != nil {
+		return fmt.Errorf("Error writing tar header for file %s", err)
+	}
+	if _, err := io.Copy(tarWriter, file); err != nil {
+		return fmt.Errorf("Error writing file %s to tar archive", err)
+	}
+	return nil
+}
+
+// SetupDirectories creates all the required directory. Useful for testing
+func (w *Worker) SetupDirectories(taskDataFolder string, filemode os.FileMode) error {
+	trainFolder := filepath.Join(taskDataFolder, w.trainFolder)
+	testFolder := filepath.Join(taskDataFolder, w.testFolder)
+	modelFolder := filepath.Join(taskDataFolder, w.modelFolder)
+	predFolder := filepath.Join(testFolder, w.predFolder)
+	untargetedTestFolder := filepath.Join(taskDataFolder, w.untargetedTestFolder)
+	perfFolder := filepath.Join(taskDataFolder, w.perfFolder)
+
+	pathList := []string{taskDataFolder, trainFolder, testFolder, modelFolder, predFolder, untargetedTestFolder, perfFolder}
+	for _, path := range pathList {
+		err := os.MkdirAll(path, filemode)
+		if err != nil {
+			return fmt.Errorf("Error creating folder under %s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// UntargetTestingVolume copies test data from /<host-data-volume>/<model>/test to
+// /<host-data-volume>/<model>/untargeted_test and removes targets from files... using the problem
+// workflow container, as its manifest's detarget step.
+func (w *Worker) UntargetTestingVolume(manifest *workflow.Manifest, problemImage, testFolder, untargetedTestFolder string) (containerID string, err error) {
+	return w.runStep(manifest, workflow.StepDetarget, problemImage, map[string]string{
+		workflow.VolumeTest:           testFolder,
+		workflow.VolumeUntargetedTest: untargetedTestFolder,
+	}, true)
+}
+
+// Train launches the submission container's train routines, as the manifest's train step. The
+// hyperparameters in paramsFolder (if any) are mounted as the params volume.
+func (w *Worker) Train(manifest *workflow.Manifest, modelImage, trainFolder, testFolder, modelFolder, paramsFolder, checkpointFolder string) (containerID string, err error) {
+	return w.runStep(manifest, workflow.StepTrain, modelImage, map[string]string{
+		workflow.VolumeTrain:      trainFolder,
+		workflow.VolumeTest:       testFolder,
+		workflow.VolumeModel:      modelFolder,
+		workflow.VolumeParams:     paramsFolder,
+		workflow.VolumeCheckpoint: checkpointFolder,
+	}, false)
+}
+
+// WriteParams writes the hyperparameters of a task as params.json in paramsFolder
+func (w *Worker) WriteParams(paramsFolder string, params map[string]interface{}) error {
+	if err := os.MkdirAll(paramsFolder, os.ModeDir); err != nil {
+		return fmt.Errorf("Error creating folder under %s: %s", paramsFolder, err)
+	}
+	paramsBytes, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("Error marshaling hyperparameters: %s", err)
+	}
+	path := filepath.Join(paramsFolder, "params.json")
+	if err = ioutil.WriteFile(path, paramsBytes, 0644); err != nil {
+		return fmt.Errorf("Error writing hyperparameters file %s: %s", path, err)
+	}
+	return nil
+}
+
+// Predict launches the submission container's predict routines, as the manifest's predict step
+func (w *Worker) Predict(manifest *workflow.Manifest, modelImage, testFolder string, predFolder string, modelFolder string) (containerID string, err error) {
+	return w.runStep(manifest, workflow.StepPredict, modelImage, map[string]string{
+		workflow.VolumeTest:  testFolder,
+		workflow.VolumePred:  predFolder,
+		workflow.VolumeModel: modelFolder,
+	}, true)
+}
+
+// ComputePerf analyses the prediction folders and computes a score for the model, as the
+// manifest's perf step
+func (w *Worker) ComputePerf(manifest *workflow.Manifest, problemImage, trainFolder, testFolder, untargetedTestFolder, perfFolder string) (containerID string, err error) {
+	return w.runStep(manifest, workflow.StepPerf, problemImage, map[string]string{
+		workflow.VolumeTest:           testFolder,
+		workflow.VolumePerf:           perfFolder,
+		workflow.VolumeTrain:          trainFolder,
+		workflow.VolumeUntargetedTest: untargetedTestFolder,
+	}, true)
+}
\ No newline at end of file
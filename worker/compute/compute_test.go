@@ -0,0 +1,576 @@
+
+package compute_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MorpheoOrg/morpheo-compute/aggregate"
+	"github.com/MorpheoOrg/morpheo-compute/broker"
+	"github.com/MorpheoOrg/morpheo-compute/envelope"
+	"github.com/MorpheoOrg/morpheo-compute/evaluate"
+	"github.com/MorpheoOrg/morpheo-compute/predict"
+	. "github.com/MorpheoOrg/morpheo-compute/worker/compute"
+	"github.com/MorpheoOrg/morpheo-go-packages/client"
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	worker      *Worker
+	runtime     *mockRuntime
+	peer        *recordingPeer
+	fixtures    *common.DataParser
+	tmpPathData string
+	learnuplet  = &common.Learnuplet{
+		Key:            "learnuplet" + uuid.NewV4().String(),
+		Problem:        uuid.NewV4(),
+		TrainData:      []uuid.UUID{uuid.NewV4(), uuid.NewV4()},
+		TestData:       []uuid.UUID{uuid.NewV4(), uuid.NewV4()},
+		Algo:           uuid.NewV4(),
+		ModelStart:     uuid.NewV4(),
+		ModelEnd:       uuid.NewV4(),
+		Rank:           0,
+		Worker:         uuid.NewV4(),
+		Status:         "todo",
+		RequestDate:    22,
+		CompletionDate: 22,
+	}
+)
+
+const (
+	perfString = "{\"perf\":0.5,\"train_perf\":{\"p\":0.5},\"test_perf\":{\"p\":0.5}}"
+)
+
+// mockRuntime is the container runtime mock, whose perf step writes perfString (or fails if
+// failPerf is set), whose predict step writes a prediction for each test data file (but noPred) and
+// whose aggregate step keeps the description of its input models
+type mockRuntime struct {
+	*common.MockRuntime
+	failPerf bool
+	noPred   string
+
+	lock            sync.Mutex
+	aggregateInputs []aggregate.Input
+}
+
+func (r *mockRuntime) RunImageInUntrustedContainer(imageName string, args []string, mounts map[string]string, autoRemove bool) (string, error) {
+	containerID, err := r.MockRuntime.RunImageInUntrustedContainer(imageName, args, mounts, autoRemove)
+	for host, container := range mounts {
+		if container == "/data/serve" {
+			return containerID, serveModel(filepath.Join(host, ServeSocket))
+		}
+		if container == "/data/models" {
+			r.lock.Lock()
+			r.aggregateInputs = nil
+			err = readJSON(filepath.Join(host, AggregateInputsFile), &r.aggregateInputs)
+			r.lock.Unlock()
+		}
+		if container == "/data/test/pred" {
+			err = writePredictions(filepath.Dir(host), host, r.noPred)
+		}
+		if container != "/hidden_data/perf" {
+			continue
+		}
+		if r.failPerf {
+			return containerID, fmt.Errorf("perf container crashed")
+		}
+		err = ioutil.WriteFile(filepath.Join(host, "performance.json"), []byte(perfString), 0644)
+	}
+	return containerID, err
+}
+
+// writePredictions writes a prediction in predFolder for each data file of testFolder but skipped
+func writePredictions(testFolder, predFolder, skipped string) error {
+	files, err := ioutil.ReadDir(testFolder)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || file.Name() == skipped {
+			continue
+		}
+		if err = ioutil.WriteFile(filepath.Join(predFolder, file.Name()), []byte("prediction"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readJSON reads a JSON file into v
+func readJSON(path string, v interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// serveModel serves the routes of a serving container on socket, until it's shut down
+func serveModel(socket string) error {
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/predict", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+	mux.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
+		listener.Close()
+	})
+	http.Serve(listener, mux)
+	return nil
+}
+
+// recordingPeer is the peer mock, recording the statuses reported for each uplet, and the items of
+// prediction tasks
+type recordingPeer struct {
+	*client.PeerMock
+
+	lock     sync.Mutex
+	statuses map[string][]string
+	items    map[string][]predict.Item
+}
+
+func (p *recordingPeer) ReportLearn(key string, status string, perf float64, trainPerf, testPerf map[string]float64) (string, []byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.statuses[key] = append(p.statuses[key], status)
+	return p.PeerMock.ReportLearn(key, status, perf, trainPerf, testPerf)
+}
+
+func (p *recordingPeer) ReportEvaluation(key string, model uuid.UUID, status string, perf float64, testPerf map[string]float64) (string, []byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.statuses[key] = append(p.statuses[key], status)
+	return "", nil, nil
+}
+
+func (p *recordingPeer) ReportPred(key string, status string, items []predict.Item) (string, []byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.statuses[key] = append(p.statuses[key], status)
+	p.items[key] = items
+	return "", nil, nil
+}
+
+func (p *recordingPeer) reported(key string) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.statuses[key]
+}
+
+// checkpointStorage is the storage mock, telling which models (checkpoints) it holds, or failing
+// to if err is set
+type checkpointStorage struct {
+	*client.StorageAPIMock
+
+	lock   sync.Mutex
+	models map[uuid.UUID]bool
+	err    error
+}
+
+func (s *checkpointStorage) ModelExists(id uuid.UUID) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.models[id], s.err
+}
+
+func (s *checkpointStorage) DeleteModel(id uuid.UUID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.models, id)
+	return nil
+}
+
+// taskStorage is the storage mock, failing to serve the data blobs in missing and keeping the
+// models posted to it
+type taskStorage struct {
+	*client.StorageAPIMock
+
+	lock    sync.Mutex
+	missing map[uuid.UUID]bool
+	models  map[uuid.UUID][]byte
+}
+
+func (s *taskStorage) GetDataBlob(id uuid.UUID) (io.ReadCloser, error) {
+	if s.missing[id] {
+		return nil, fmt.Errorf("data %s not found", id)
+	}
+	return s.StorageAPIMock.GetDataBlob(id)
+}
+
+func (s *taskStorage) PostModel(model *common.Model, blobReader io.Reader, size int64) error {
+	blob, err := ioutil.ReadAll(blobReader)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.models[model.ID] = blob
+	return nil
+}
+
+func TestMain(m *testing.M) {
+	// Let's hook to our container mock
+	runtime = &mockRuntime{MockRuntime: common.NewMockRuntime()}
+	peer = &recordingPeer{PeerMock: &client.PeerMock{}, statuses: make(map[string][]string), items: make(map[string][]predict.Item)}
+
+	// Create storage Mock
+	storageMock, err := client.NewStorageAPIMock()
+	if err != nil {
+		log.Panicln("Error loading Storage Mock: ", err)
+	}
+
+	// Let's finally create our worker
+	tmpPathData = filepath.Join(os.TempDir(), "morpheo_tmp_data")
+	worker = NewWorker(
+		tmpPathData, "train", "test", "untargeted_test", "pred", "perf", "model",
+		"problem", "algo", runtime,
+		storageMock, peer,
+	)
+
+	// Run the tests
+	exitcode := m.Run()
+
+	// Wipe out everything once the tests are done/failed
+	if err := os.RemoveAll(tmpPathData); err != nil {
+		log.Println(err)
+	}
+
+	os.Exit(exitcode)
+}
+
+func TestHandleLearn(t *testing.T) {
+	// t.Parallel()
+
+	// Pre-setup directory structure for Learn to avoid permission issues
+	taskDataFolder := filepath.Join(tmpPathData, learnuplet.Algo.String())
+	assert.Nil(t, worker.SetupDirectories(taskDataFolder, 0777))
+
+	// Test the whole pipeline works...
+	msg, _ := json.Marshal(learnuplet)
+	assert.Nil(t, worker.HandleLearn(msg))
+	assert.Equal(t, []string{common.TaskStatusDone}, peer.reported(learnuplet.Key))
+}
+
+func TestHandleLearnRetry(t *testing.T) {
+	task := *learnuplet
+	task.Key = "learnuplet" + uuid.NewV4().String()
+	msg, _ := json.Marshal(task)
+
+	// A failed attempt is handed back to the broker, without reporting the learnuplet failed...
+	runtime.failPerf = true
+	defer func() { runtime.failPerf = false }()
+	err := worker.HandleLearn(msg)
+	assert.NotNil(t, err)
+	assert.Empty(t, peer.reported(task.Key))
+
+	// ... until the broker gives up on it
+	giveUpper, ok := err.(broker.GiveUpper)
+	assert.True(t, ok)
+	giveUpper.GiveUp()
+	assert.Equal(t, []string{common.TaskStatusFailed}, peer.reported(task.Key))
+}
+
+func TestHandleLearnChained(t *testing.T) {
+	storageMock, _ := client.NewStorageAPIMock()
+	storage := &checkpointStorage{StorageAPIMock: storageMock, models: make(map[uuid.UUID]bool)}
+	chained := NewWorker(
+		tmpPathData, "train", "test", "untargeted_test", "pred", "perf", "model",
+		"problem", "algo", runtime,
+		storage, peer,
+	)
+
+	// A learnuplet whose start model isn't on storage yet is deferred, and only reported failed once
+	// the broker gives up on it...
+	task := *learnuplet
+	task.Key = "learnuplet" + uuid.NewV4().String()
+	task.Rank = 1
+	msg, _ := json.Marshal(task)
+	err := chained.HandleLearn(msg)
+	assert.NotNil(t, err)
+	assert.Empty(t, peer.reported(task.Key))
+	err.(broker.GiveUpper).GiveUp()
+	assert.Equal(t, []string{common.TaskStatusFailed}, peer.reported(task.Key))
+
+	// ... and so is one whose start model can't be looked up
+	task.Key = "learnuplet" + uuid.NewV4().String()
+	storage.err = fmt.Errorf("storage unavailable")
+	msg, _ = json.Marshal(task)
+	err = chained.HandleLearn(msg)
+	assert.Contains(t, err.Error(), "storage unavailable")
+	assert.Empty(t, peer.reported(task.Key))
+	err.(broker.GiveUpper).GiveUp()
+	assert.Equal(t, []string{common.TaskStatusFailed}, peer.reported(task.Key))
+
+	// Learnuplets waiting for their start model for too long are reported failed right away
+	chained.SetStartModelWait(time.Hour)
+	storage.err = nil
+	task.Key = "learnuplet" + uuid.NewV4().String()
+	env, _ := envelope.New(envelope.TypeLearn, task, "", "")
+	env.EnqueuedAt = time.Now().Add(-2 * time.Hour)
+	msg, _ = env.Marshal()
+	assert.Nil(t, chained.HandleLearn(msg))
+	assert.Equal(t, []string{common.TaskStatusFailed}, peer.reported(task.Key))
+
+	// Learnuplets whose start model is there are trained
+	task.Key = "learnuplet" + uuid.NewV4().String()
+	storage.models[task.ModelStart] = true
+	msg, _ = json.Marshal(task)
+	assert.Nil(t, chained.HandleLearn(msg))
+	assert.Equal(t, []string{common.TaskStatusDone}, peer.reported(task.Key))
+}
+
+func TestHandleLearnCheckpoints(t *testing.T) {
+	storageMock, _ := client.NewStorageAPIMock()
+	storage := &checkpointStorage{StorageAPIMock: storageMock, models: make(map[uuid.UUID]bool)}
+	checkpointed := NewWorker(
+		tmpPathData, "train", "test", "untargeted_test", "pred", "perf", "model",
+		"problem", "algo", runtime,
+		storage, peer,
+	)
+	checkpointed.SetCheckpointInterval(time.Hour)
+
+	// A task resumes from its latest checkpoint, deleted once its model is uploaded
+	task := *learnuplet
+	task.Key = "learnuplet" + uuid.NewV4().String()
+	for seq := 1; seq <= 3; seq++ {
+		storage.models[CheckpointID(task.Key, seq)] = true
+	}
+	msg, _ := json.Marshal(task)
+	assert.Nil(t, checkpointed.HandleLearn(msg))
+	assert.Empty(t, storage.models)
+
+	// A failed attempt keeps them for the next one, until the broker gives up on the task
+	task.Key = "learnuplet" + uuid.NewV4().String()
+	storage.models[CheckpointID(task.Key, 1)] = true
+	msg, _ = json.Marshal(task)
+	runtime.failPerf = true
+	err := checkpointed.HandleLearn(msg)
+	runtime.failPerf = false
+	assert.NotNil(t, err)
+	assert.Len(t, storage.models, 1)
+	err.(broker.GiveUpper).GiveUp()
+	assert.Equal(t, []string{common.TaskStatusFailed}, peer.reported(task.Key))
+	assert.Empty(t, storage.models)
+
+	// A storage error doesn't restart the training from scratch
+	task.Key = "learnuplet" + uuid.NewV4().String()
+	storage.models[CheckpointID(task.Key, 1)] = true
+	storage.err = fmt.Errorf("storage unavailable")
+	msg, _ = json.Marshal(task)
+	assert.NotNil(t, checkpointed.HandleLearn(msg))
+	assert.Empty(t, peer.reported(task.Key))
+	assert.Len(t, storage.models, 1)
+}
+
+func TestHandleEvaluate(t *testing.T) {
+	task := evaluate.Evaluateuplet{
+		Key:      "evaluateuplet" + uuid.NewV4().String(),
+		Problem:  uuid.NewV4(),
+		Model:    uuid.NewV4(),
+		TestData: []uuid.UUID{uuid.NewV4(), uuid.NewV4()},
+	}
+	msg, _ := json.Marshal(task)
+	assert.Nil(t, worker.HandleEvaluate(msg))
+	assert.Equal(t, []string{common.TaskStatusDone}, peer.reported(task.Key))
+
+	// A failed evaluation is reported as such
+	task.Key = "evaluateuplet" + uuid.NewV4().String()
+	msg, _ = json.Marshal(task)
+	runtime.failPerf = true
+	defer func() { runtime.failPerf = false }()
+	assert.NotNil(t, worker.HandleEvaluate(msg))
+	assert.Equal(t, []string{common.TaskStatusFailed}, peer.reported(task.Key))
+}
+
+func TestHandlePred(t *testing.T) {
+	storageMock, _ := client.NewStorageAPIMock()
+	storage := &taskStorage{StorageAPIMock: storageMock, missing: make(map[uuid.UUID]bool)}
+	predicting := NewWorker(
+		tmpPathData, "train", "test", "untargeted_test", "pred", "perf", "model",
+		"problem", "algo", runtime,
+		storage, peer,
+	)
+
+	// Each data blob gets its own result: predicted, not pulled from storage, or not predicted on
+	task := predict.Preduplet{DataBatch: []uuid.UUID{uuid.NewV4(), uuid.NewV4(), uuid.NewV4()}}
+	task.Key = "preduplet" + uuid.NewV4().String()
+	task.Problem = uuid.NewV4()
+	task.Model = uuid.NewV4()
+	storage.missing[task.DataBatch[1]] = true
+	runtime.noPred = task.DataBatch[2].String()
+	defer func() { runtime.noPred = "" }()
+	msg, _ := json.Marshal(task)
+	assert.Nil(t, predicting.HandlePred(msg))
+	assert.Equal(t, []string{common.TaskStatusDone}, peer.reported(task.Key))
+
+	items := peer.items[task.Key]
+	assert.Len(t, items, 3)
+	for i, item := range items {
+		assert.Equal(t, task.DataBatch[i], item.Data)
+	}
+	assert.Equal(t, predict.ItemDone, items[0].Status)
+	assert.NotEqual(t, uuid.Nil, items[0].Prediction)
+	assert.Equal(t, predict.ItemFailed, items[1].Status)
+	assert.Contains(t, items[1].Error, "not found")
+	assert.Equal(t, predict.ItemFailed, items[2].Status)
+	assert.Contains(t, items[2].Error, "Missing prediction file")
+
+	// Bundled predictions all point to the bundle
+	task.Key = "preduplet" + uuid.NewV4().String()
+	task.Bundle = true
+	runtime.noPred = ""
+	delete(storage.missing, task.DataBatch[1])
+	msg, _ = json.Marshal(task)
+	assert.Nil(t, predicting.HandlePred(msg))
+	items = peer.items[task.Key]
+	assert.Len(t, items, 3)
+	for _, item := range items {
+		assert.Equal(t, predict.ItemDone, item.Status)
+		assert.Equal(t, items[0].Prediction, item.Prediction)
+	}
+}
+
+func TestHandleAggregate(t *testing.T) {
+	storageMock, _ := client.NewStorageAPIMock()
+	storage := &taskStorage{StorageAPIMock: storageMock, models: make(map[uuid.UUID][]byte)}
+	aggregating := NewWorker(
+		tmpPathData, "train", "test", "untargeted_test", "pred", "perf", "model",
+		"problem", "algo", runtime,
+		storage, peer,
+	)
+
+	task := aggregate.Aggregateuplet{
+		Key:      "aggregateuplet" + uuid.NewV4().String(),
+		Problem:  uuid.NewV4(),
+		Algo:     uuid.NewV4(),
+		Models:   []uuid.UUID{uuid.NewV4(), uuid.NewV4()},
+		Weights:  []float64{300, 100},
+		ModelEnd: uuid.NewV4(),
+		Rank:     2,
+	}
+	msg, _ := json.Marshal(task)
+	assert.Nil(t, aggregating.HandleAggregate(msg))
+
+	// The aggregate entrypoint is given the normalized weights of the input models...
+	expected := []aggregate.Input{{Model: task.Models[0], Weight: 0.75}, {Model: task.Models[1], Weight: 0.25}}
+	assert.Equal(t, expected, runtime.aggregateInputs)
+
+	// ... and the aggregated model records its lineage
+	blob, ok := storage.models[task.ModelEnd]
+	assert.True(t, ok)
+	folder := filepath.Join(tmpPathData, "aggregated-"+task.ModelEnd.String())
+	assert.Nil(t, os.MkdirAll(folder, 0777))
+	assert.Nil(t, aggregating.UntargzInFolder(folder, bytes.NewReader(blob)))
+	var lineage aggregate.Lineage
+	assert.Nil(t, readJSON(filepath.Join(folder, aggregate.LineageFile), &lineage))
+	assert.Equal(t, task.Lineage(), lineage)
+	assert.Equal(t, aggregate.EntrypointAlgo, lineage.Entrypoint)
+	assert.Equal(t, expected, lineage.Inputs)
+}
+
+func TestMergeFolds(t *testing.T) {
+	final := Perfuplet{Perf: 0.8, TrainPerf: map[string]float64{"p": 0.9}, TestPerf: map[string]float64{"p": 0.8}}
+	folds := []Perfuplet{
+		{Perf: 0.6, TrainPerf: map[string]float64{"p": 0.7}, TestPerf: map[string]float64{"p": 0.6}},
+		{Perf: 0.8, TrainPerf: map[string]float64{"p": 0.9}, TestPerf: map[string]float64{"p": 0.8}},
+	}
+
+	merged := MergeFolds(final, folds)
+	assert.InDelta(t, 0.7, merged.Perf, 1e-9)
+	assert.InDelta(t, 0.1, merged.PerfStd, 1e-9)
+	assert.Equal(t, 0.8, merged.TestPerf[PerfHoldout])
+	assert.InDelta(t, 0.7, merged.TestPerf[PerfCVMean], 1e-9)
+	assert.Equal(t, 0.6, merged.TestPerf["fold_0_p"])
+	assert.Equal(t, 0.9, merged.TrainPerf["fold_1_p"])
+	assert.Equal(t, 0.9, merged.TrainPerf["p"])
+	assert.Len(t, merged.Folds, 2)
+}
+
+// func TestHandlePred(t *testing.T) {
+// 	// t.Parallel()
+
+// 	// Pre-setup directory structure for Pred to avoid permission issues
+// 	taskDataFolder := filepath.Join(tmpPathData, preduplet.Model.String())
+// 	assert.Nil(t, worker.SetupDirectories(taskDataFolder, 0777))
+
+// 	// Create a tar-gzed model mock in tmp
+// 	modelID := preduplet.Data.String()
+// 	tmpPathPerfFile := filepath.Join(taskDataFolder, filepath.Join("test/pred/", modelID))
+
+// 	f, err := os.Create(tmpPathPerfFile)
+// 	assert.Nil(t, err)
+
+// 	mock, err := TargzedMock()
+// 	assert.Nil(t, err)
+
+// 	_, err = io.Copy(f, mock)
+// 	assert.Nil(t, err)
+
+// 	f.Close()
+
+// 	// Test the whole pipeline works
+// 	preduplet := preduplet
+// 	msg, _ := json.Marshal(preduplet)
+// 	assert.Nil(t, worker.HandlePred(msg))
+// }
+
+// TargzedMock create a Readcloser which can be ungzip-ed
+func TargzedMock() (io.ReadCloser, error) {
+	// Create tmp file
+	tmpPath := filepath.Join(os.TempDir(), "morpheo_mock")
+	if err := ioutil.WriteFile(tmpPath, []byte("mock"), 0777); err != nil {
+		return nil, fmt.Errorf("Error writing file: %s", err)
+	}
+	f, _ := os.Open(tmpPath)
+	defer os.Remove(tmpPath)
+
+	buf := bytes.NewBuffer([]byte(""))
+	if err := TargzFile(f, buf); err != nil {
+		return nil, fmt.Errorf("Error Targz-ing the file: %s", err)
+	}
+
+	return ioutil.NopCloser(buf), nil
+}
+
+func TestModelServerEviction(t *testing.T) {
+	models := worker.NewModelServer(ServingConfig{
+		Concurrency:    1,
+		MaxModels:      1,
+		IdleTimeout:    time.Hour,
+		StartTimeout:   10 * time.Second,
+		RequestTimeout: 10 * time.Second,
+		HealthInterval: time.Hour,
+	})
+	defer models.Stop()
+
+	first, second := uuid.NewV4(), uuid.NewV4()
+	status, response, err := models.Predict(first, []byte(`{"x":1}`))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"x":1}`, string(response))
+
+	// Loading another model unloads the least recently used one
+	status, _, err = models.Predict(second, []byte(`{"x":2}`))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	served := models.Models()
+	assert.Len(t, served, 1)
+	assert.Equal(t, second, served[0].ID)
+}
@@ -0,0 +1,337 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package compute
+
+import (
+	"flag"
+	"log"
+	"net"
+	"time"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/priority"
+)
+
+// ConsumerConfig holds the consumer configuration
+type ConsumerConfig struct {
+	// Broker
+	Broker               string
+	BrokerFolder         string
+	BrokerRequeueDelay   time.Duration
+	BrokerMaxAttempts    int
+	NsqlookupdURLs       []string
+	NsqdURL              string
+	LearnParallelism     int
+	PredictParallelism   int
+	AggregateParallelism int
+	EvaluateParallelism  int
+	LearnTimeout         time.Duration
+	PredictTimeout       time.Duration
+	AggregateTimeout     time.Duration
+	EvaluateTimeout      time.Duration
+	// PriorityWeights are the shares of the learn/predict parallelism given to each priority
+	PriorityWeights map[string]int
+	// JournalMaxAge is how long failed tasks keep their workspace for their next attempt
+	JournalMaxAge time.Duration
+	// StartModelWait is how long chained learnuplets wait for their start model
+	StartModelWait time.Duration
+	// CheckpointInterval is how often training checkpoints are uploaded to storage
+	CheckpointInterval time.Duration
+
+	// Other compute services
+	OrchestratorHost     string
+	OrchestratorPort     int
+	OrchestratorUser     string
+	OrchestratorPassword string
+	StorageHost          string
+	StoragePort          int
+	StorageUser          string
+	StoragePassword      string
+
+	// Container Runtime
+	DockerHost    string
+	DockerTimeout time.Duration
+
+	// Admin server (metrics & liveness probe)
+	AdminHost string
+	AdminPort int
+
+	// Online prediction serving (disabled if ServingPort is 0), over TLS if ServingCertFile is set
+	ServingHost         string
+	ServingPort         int
+	ServingCertFile     string
+	ServingKeyFile      string
+	ServingClientCAFile string
+	Serving             ServingConfig
+
+	// Worker registry of the compute API (no heartbeats are sent if RegistryURL is empty)
+	RegistryURL      string
+	RegistryCertFile string
+	RegistryKeyFile  string
+	RegistryCAFile   string
+	Heartbeat        HeartbeatConfig
+
+	// Tracing
+	TraceExporter string
+	TraceFile     string
+	TraceEndpoint string
+}
+
+// NewConsumerConfig parses CLI flags, generates and validates a ConsumerConfig
+func NewConsumerConfig() (conf *ConsumerConfig) {
+	var (
+		broker               string
+		brokerFolder         string
+		brokerRequeueDelay   time.Duration
+		brokerMaxAttempts    int
+		nsqlookupdURLs       common.MultiStringFlag
+		nsqdURL              string
+		learnParallelism     int
+		predictParallelism   int
+		aggregateParallelism int
+		evaluateParallelism  int
+		learnTimeout         time.Duration
+		predictTimeout       time.Duration
+		aggregateTimeout     time.Duration
+		evaluateTimeout      time.Duration
+		priorityWeights      common.MultiStringFlag
+		journalMaxAge        time.Duration
+		startModelWait       time.Duration
+		checkpointInterval   time.Duration
+
+		orchestratorHost     string
+		orchestratorPort     int
+		orchestratorUser     string
+		orchestratorPassword string
+		storageHost          string
+		storagePort          int
+		storageUser          string
+		storagePassword      string
+
+		dockerHost    string
+		dockerTimeout time.Duration
+
+		adminHost string
+		adminPort int
+
+		servingHost           string
+		servingPort           int
+		servingCertFile       string
+		servingKeyFile        string
+		servingClientCAFile   string
+		servingConcurrency    int
+		servingMaxModels      int
+		servingIdleTimeout    time.Duration
+		servingStartTimeout   time.Duration
+		servingRequestTimeout time.Duration
+		servingHealthInterval time.Duration
+
+		registryURL       string
+		registryCertFile  string
+		registryKeyFile   string
+		registryCAFile    string
+		heartbeatInterval time.Duration
+		heartbeatLease    time.Duration
+
+		traceExporter string
+		traceFile     string
+		traceEndpoint string
+	)
+
+	// CLI Flags
+	flag.StringVar(&broker, "broker", "nsq", "Broker type to use ('nsq' or 'embedded')")
+	flag.StringVar(&brokerFolder, "broker-dir", "/var/lib/compute/broker", "The folder of the embedded broker (shared with the API)")
+	flag.DurationVar(&brokerRequeueDelay, "broker-requeue-delay", 10*time.Second, "Delay before failed tasks are retried, multiplied by the number of attempts")
+	flag.IntVar(&brokerMaxAttempts, "broker-max-attempts", 5, "Number of attempts after which a task is given up on (0 for no limit, failed learnuplets being reported failed right away)")
+	flag.Var(&nsqlookupdURLs, "nsqlookupd-urls", "URL(s) of NSQLookupd instances to connect to")
+	flag.StringVar(&nsqdURL, "http-address", "nsqd:4151", "URL of NSQd instance to connect to")
+	flag.IntVar(&learnParallelism, "learn-parallelism", 1, "Number of learning task that this worker can execute in parallel.")
+	flag.IntVar(&predictParallelism, "predict-parallelism", 1, "Number of learning task that this worker can execute in parallel.")
+	flag.DurationVar(&learnTimeout, "learn-timeout", 20*time.Minute, "After this delay, learning tasks are timed out (default: 20m)")
+	flag.DurationVar(&predictTimeout, "predict-timeout", 20*time.Minute, "After this delay, prediction tasks are timed out (default: 20m)")
+	flag.IntVar(&aggregateParallelism, "aggregate-parallelism", 1, "Number of aggregation task that this worker can execute in parallel.")
+	flag.DurationVar(&aggregateTimeout, "aggregate-timeout", 20*time.Minute, "After this delay, aggregation tasks are timed out (default: 20m)")
+	flag.IntVar(&evaluateParallelism, "evaluate-parallelism", 1, "Number of evaluation task that this worker can execute in parallel.")
+	flag.DurationVar(&evaluateTimeout, "evaluate-timeout", 20*time.Minute, "After this delay, evaluation tasks are timed out (default: 20m)")
+	flag.DurationVar(&journalMaxAge, "journal-max-age", 24*time.Hour, "How long failed learning tasks keep their workspace and journal, for their next attempt to resume at the stage that failed (0 disables journaling)")
+	flag.DurationVar(&startModelWait, "start-model-wait", 48*time.Hour, "Maximum time a chained learnuplet (rank > 0) waits for its start model since its submission, before being reported failed (0 for as long as the broker retries it)")
+	flag.DurationVar(&checkpointInterval, "checkpoint-interval", 10*time.Minute, "How often the checkpoint folder of training containers is uploaded to storage, for a redelivered learning task to resume from its latest checkpoint on any worker (0 disables checkpoints)")
+	flag.Var(&priorityWeights, "priority-weight", "Weight of a task priority when picking the next task to run, as <priority>=<weight> (0 to not consume it, defaults: high=6, normal=3, low=1)")
+
+	flag.StringVar(&orchestratorHost, "orchestrator-host", "", "Hostname of the orchestrator to send notifications to (leave blank to use the Orchestrator API Mock)")
+	flag.IntVar(&orchestratorPort, "orchestrator-port", 80, "TCP port to contact the orchestrator on (default: 80)")
+	flag.StringVar(&orchestratorUser, "orchestrator-user", "u", "Basic Authentication username of the orchestrator API")
+	flag.StringVar(&orchestratorPassword, "orchestrator-password", "p", "Basic Authentication password of the orchestrator API")
+
+	flag.StringVar(&storageHost, "storage-host", "", "Hostname of the storage API to retrieve data from (leave blank to use the Storage API Mock)")
+	flag.IntVar(&storagePort, "storage-port", 80, "TCP port to contact storage on (default: 80)")
+	flag.StringVar(&storageUser, "storage-user", "u", "Basic Authentication username of the storage API")
+	flag.StringVar(&storagePassword, "storage-password", "p", "Basic Authentication password of the storage API")
+
+	flag.DurationVar(&dockerTimeout, "docker-timeout", 15*time.Minute, "Docker commands timeout (concerns builds, runs, pulls, etc...) (default: 15m)")
+
+	flag.StringVar(&adminHost, "admin-host", "0.0.0.0", "The hostname the admin server (metrics & health) will be listening on")
+	flag.IntVar(&adminPort, "admin-port", 8001, "The port the admin server (metrics & health) will be listening on (0 disables it)")
+
+	flag.StringVar(&servingHost, "serving-host", "127.0.0.1", "The hostname the online prediction server will be listening on (a non-loopback one requires -serving-client-ca)")
+	flag.IntVar(&servingPort, "serving-port", 0, "The port the online prediction server will be listening on (0 disables it)")
+	flag.StringVar(&servingCertFile, "serving-cert", "", "The TLS certs the online prediction server serves (leave blank for no TLS)")
+	flag.StringVar(&servingKeyFile, "serving-key", "", "The TLS key of the online prediction server")
+	flag.StringVar(&servingClientCAFile, "serving-client-ca", "", "CA bundle the client certificates of the online prediction server (the compute API's) are verified against (requires -serving-cert and -serving-key)")
+	flag.IntVar(&servingMaxModels, "serving-max-models", 4, "Number of models loaded at once for online predictions, the least recently used idle one being unloaded to load another")
+	flag.IntVar(&servingConcurrency, "serving-concurrency", 4, "Number of prediction requests a served model handles at once (others get a 429)")
+	flag.DurationVar(&servingIdleTimeout, "serving-idle-timeout", 15*time.Minute, "Served models receiving no request for this long are unloaded (default: 15m)")
+	flag.DurationVar(&servingStartTimeout, "serving-start-timeout", 2*time.Minute, "Served models whose container isn't healthy after this delay fail to load (default: 2m)")
+	flag.DurationVar(&servingRequestTimeout, "serving-request-timeout", 30*time.Second, "After this delay, prediction requests to a served model are timed out (default: 30s)")
+	flag.DurationVar(&servingHealthInterval, "serving-health-interval", 30*time.Second, "Interval between two health checks of the served models (default: 30s)")
+
+	flag.StringVar(&registryURL, "registry-url", "", "Base URL of the compute API whose worker registry heartbeats are sent to, e.g. https://compute-api (leave blank not to send heartbeats)")
+	flag.StringVar(&registryCertFile, "registry-cert", "", "Client certificate sent to the worker registry, for compute APIs requiring mutual TLS")
+	flag.StringVar(&registryKeyFile, "registry-key", "", "Private key of the client certificate sent to the worker registry")
+	flag.StringVar(&registryCAFile, "registry-ca", "", "CA bundle the certificate of the worker registry is verified against (leave blank for the system roots)")
+	flag.DurationVar(&heartbeatInterval, "heartbeat-interval", 15*time.Second, "Interval between two heartbeats sent to the worker registry (default: 15s)")
+	flag.DurationVar(&heartbeatLease, "heartbeat-lease", time.Minute, "How long the worker is considered alive after a heartbeat: past it, its tasks are recovered (default: 1m)")
+
+	flag.StringVar(&traceExporter, "trace-exporter", "none", "Trace exporter to use ('none', 'stdout', 'file' or 'otlp')")
+	flag.StringVar(&traceFile, "trace-file", "traces.json", "File the 'file' trace exporter appends spans to")
+	flag.StringVar(&traceEndpoint, "trace-endpoint", "http://otel-collector:4318", "OTLP/HTTP collector the 'otlp' trace exporter posts spans to")
+
+	flag.Parse()
+
+	if len(nsqlookupdURLs) == 0 {
+		nsqlookupdURLs = append(nsqlookupdURLs, "nsqlookupd:4161")
+	}
+
+	weights, err := priority.ParseWeights(priorityWeights)
+	if err != nil {
+		log.Panicf("Error parsing -priority-weight flags: %s", err)
+	}
+
+	if servingConcurrency < 1 {
+		log.Panicf("Error: -serving-concurrency must be at least 1, got %d", servingConcurrency)
+	}
+	if servingMaxModels < 1 {
+		log.Panicf("Error: -serving-max-models must be at least 1, got %d", servingMaxModels)
+	}
+	if servingClientCAFile != "" && (servingCertFile == "" || servingKeyFile == "") {
+		log.Panicln("Error: -serving-client-ca requires TLS to be enabled (-serving-cert and -serving-key)")
+	}
+	if servingPort != 0 && servingClientCAFile == "" && !loopback(servingHost) {
+		log.Panicf("Error: the online prediction server can't listen on %s without client authentication: set -serving-cert, -serving-key and -serving-client-ca, or a loopback -serving-host", servingHost)
+	}
+	if heartbeatLease < 2*heartbeatInterval {
+		log.Panicf("Error: -heartbeat-lease (%s) must be at least twice -heartbeat-interval (%s)", heartbeatLease, heartbeatInterval)
+	}
+
+	return &ConsumerConfig{
+		Broker:               broker,
+		BrokerFolder:         brokerFolder,
+		BrokerRequeueDelay:   brokerRequeueDelay,
+		BrokerMaxAttempts:    brokerMaxAttempts,
+		NsqlookupdURLs:       nsqlookupdURLs,
+		NsqdURL:              nsqdURL,
+		LearnParallelism:     learnParallelism,
+		PredictParallelism:   predictParallelism,
+		AggregateParallelism: aggregateParallelism,
+		EvaluateParallelism:  evaluateParallelism,
+		LearnTimeout:         learnTimeout,
+		PredictTimeout:       predictTimeout,
+		AggregateTimeout:     aggregateTimeout,
+		EvaluateTimeout:      evaluateTimeout,
+		PriorityWeights:      weights,
+		JournalMaxAge:        journalMaxAge,
+		StartModelWait:       startModelWait,
+		CheckpointInterval:   checkpointInterval,
+
+		// Other compute services
+		OrchestratorHost:     orchestratorHost,
+		OrchestratorPort:     orchestratorPort,
+		OrchestratorUser:     orchestratorUser,
+		OrchestratorPassword: orchestratorPassword,
+		StorageHost:          storageHost,
+		StoragePort:          storagePort,
+		StorageUser:          storageUser,
+		StoragePassword:      storagePassword,
+
+		// Container Runtime
+		DockerHost:    dockerHost,
+		DockerTimeout: dockerTimeout,
+
+		// Admin server
+		AdminHost: adminHost,
+		AdminPort: adminPort,
+
+		// Online prediction serving
+		ServingHost:         servingHost,
+		ServingPort:         servingPort,
+		ServingCertFile:     servingCertFile,
+		ServingKeyFile:      servingKeyFile,
+		ServingClientCAFile: servingClientCAFile,
+		Serving: ServingConfig{
+			Concurrency:    servingConcurrency,
+			MaxModels:      servingMaxModels,
+			IdleTimeout:    servingIdleTimeout,
+			StartTimeout:   servingStartTimeout,
+			RequestTimeout: servingRequestTimeout,
+			HealthInterval: servingHealthInterval,
+		},
+
+		// Worker registry
+		RegistryURL:      registryURL,
+		RegistryCertFile: registryCertFile,
+		RegistryKeyFile:  registryKeyFile,
+		RegistryCAFile:   registryCAFile,
+		Heartbeat: HeartbeatConfig{
+			Interval: heartbeatInterval,
+			Lease:    heartbeatLease,
+		},
+
+		// Tracing
+		TraceExporter: traceExporter,
+		TraceFile:     traceFile,
+		TraceEndpoint: traceEndpoint,
+	}
+}
+
+// loopback tells whether host only accepts connections from the local machine
+func loopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package compute
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/aggregate"
+	"github.com/MorpheoOrg/morpheo-compute/broker"
+	"github.com/MorpheoOrg/morpheo-compute/envelope"
+	"github.com/MorpheoOrg/morpheo-compute/evaluate"
+	"github.com/MorpheoOrg/morpheo-compute/priority"
+	"github.com/MorpheoOrg/morpheo-compute/registry"
+)
+
+// TaskConsumer is implemented by the consumers of all the supported brokers
+type TaskConsumer interface {
+	ConsumeUntilKilled()
+}
+
+// AddHandlersFunc registers the message handlers of several topics on a TaskConsumer, running at
+// most parallelism messages at once between them (see broker.WeightedTopic)
+type AddHandlersFunc func(topics []broker.WeightedTopic, parallelism int, timeout time.Duration)
+
+// retryError is the error of a task its next attempt may complete: the broker delivers it again,
+// and giveUp (reporting the task failed) is only called once the broker gives up on it, after the
+// last attempt failed (see broker.GiveUpper).
+type retryError struct {
+	error
+	giveUp func() error
+}
+
+// GiveUp runs giveUp, now that the broker won't deliver the task again
+func (e retryError) GiveUp() {
+	if err := e.giveUp(); err != nil {
+		log.Printf("[ERROR] Error giving up on a task (%s): %s", e.error, err)
+	}
+}
+
+// retry hands a failed task back to the broker, giveUp being called once the broker gives up on
+// it. Brokers without a maximum number of attempts never give up: giveUp is then called right away.
+func (w *Worker) retry(err error, giveUp func() error) error {
+	if w.noGiveUp {
+		if err2 := giveUp(); err2 != nil {
+			return fmt.Errorf("%s. Error giving up on the task: %s", err, err2)
+		}
+		return err
+	}
+	return retryError{err, giveUp}
+}
+
+// NewConsumer creates the consumer of the configured broker, as well as the function its message
+// handlers are registered with
+func NewConsumer(conf *ConsumerConfig) (TaskConsumer, AddHandlersFunc, error) {
+	switch conf.Broker {
+	case common.BrokerNSQ:
+		nsqConsumer := broker.NewNSQConsumer(conf.NsqlookupdURLs, conf.NsqdURL, conf.BrokerRequeueDelay, conf.BrokerMaxAttempts)
+		return nsqConsumer, nsqConsumer.AddWeightedHandlers, nil
+	case broker.BrokerEmbedded:
+		embeddedConsumer := broker.NewEmbeddedConsumer(conf.BrokerFolder, time.Second, conf.BrokerRequeueDelay, conf.BrokerMaxAttempts)
+		return embeddedConsumer, embeddedConsumer.AddWeightedHandlers, nil
+	default:
+		return nil, nil, fmt.Errorf("Unsupported broker (%s). Available brokers: 'nsq', 'embedded'", conf.Broker)
+	}
+}
+
+// RegisterHandlers wires the worker's message handlers to a consumer, on the topics of every
+// priority with a non-zero weight. The task types consumed are reported in heartbeats, as are the
+// tasks being ran.
+func (w *Worker) RegisterHandlers(addHandlers AddHandlersFunc, conf *ConsumerConfig) {
+	w.registerPrioritized(addHandlers, common.TrainTopic, w.HandleLearn, conf.LearnParallelism, conf.LearnTimeout, conf.PriorityWeights)
+	w.registerPrioritized(addHandlers, common.PredictTopic, w.HandlePred, conf.PredictParallelism, conf.PredictTimeout, conf.PriorityWeights)
+	w.registerPrioritized(addHandlers, aggregate.Topic, w.HandleAggregate, conf.AggregateParallelism, conf.AggregateTimeout, conf.PriorityWeights)
+	w.registerPrioritized(addHandlers, evaluate.Topic, w.HandleEvaluate, conf.EvaluateParallelism, conf.EvaluateTimeout, conf.PriorityWeights)
+
+	w.noGiveUp = conf.BrokerMaxAttempts == 0
+
+	w.tasks.setCapability(envelope.TypeLearn, conf.LearnParallelism)
+	w.tasks.setCapability(envelope.TypePred, conf.PredictParallelism)
+	w.tasks.setCapability(envelope.TypeAggregate, conf.AggregateParallelism)
+	w.tasks.setCapability(envelope.TypeEvaluate, conf.EvaluateParallelism)
+	if conf.ServingPort != 0 {
+		w.tasks.setCapability(registry.CapabilityServing, conf.Serving.Concurrency)
+	}
+}
+
+// registerPrioritized consumes the topics of all priorities with a non-zero weight, sharing
+// parallelism: whenever a slot is free, the next message is taken from the priorities with tasks
+// waiting, in proportion to their weights. Urgent tasks overtake the backlog without starving it,
+// and idle slots go to whatever priority has tasks waiting.
+func (w *Worker) registerPrioritized(addHandlers AddHandlersFunc, baseTopic string, handler func([]byte) error, parallelism int, timeout time.Duration, weights map[string]int) {
+	var topics []broker.WeightedTopic
+	for _, p := range priority.Levels {
+		if weights[p] <= 0 {
+			log.Printf("[INFO] Not consuming %s priority tasks from %s (zero weight)", p, baseTopic)
+			continue
+		}
+		topic := priority.Topic(baseTopic, p)
+		topics = append(topics, broker.WeightedTopic{
+			Topic:   topic,
+			Weight:  weights[p],
+			Handler: InstrumentHandler(topic, parallelism, w.tasks.track(topic, handler)),
+		})
+	}
+	if len(topics) > 0 {
+		addHandlers(topics, parallelism, timeout)
+	}
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package compute
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/workflow"
+)
+
+// Keys of the cross-validation summary added to the test performances of cross-validated tasks
+// (see MergeFolds)
+const (
+	PerfCVMean  = "cv_mean"
+	PerfCVStd   = "cv_std"
+	PerfHoldout = "holdout"
+)
+
+// CrossValidate runs a k-fold cross-validation of a learnuplet on its train data: the train data
+// blobs are dealt into folds in turn, and each fold is scored (as test data) by a model trained
+// on the other folds, in its own workspace under taskDataFolder. The train data and the start
+// model (if any) are expected to be in place already, in the task's train folder and modelFolder.
+func (w *Worker) CrossValidate(task common.Learnuplet, folds int, manifest *workflow.Manifest, problemImage, algoImage, taskDataFolder, modelFolder, paramsFolder string) ([]Perfuplet, error) {
+	if folds > len(task.TrainData) {
+		return nil, fmt.Errorf("Can't cross-validate on %d folds with %d train data blobs", folds, len(task.TrainData))
+	}
+	trainFolder := filepath.Join(taskDataFolder, w.trainFolder)
+
+	var perfs []Perfuplet
+	for fold := 0; fold < folds; fold++ {
+		foldFolder := filepath.Join(taskDataFolder, "cv", fmt.Sprintf("fold-%d", fold))
+		foldTrain := filepath.Join(foldFolder, w.trainFolder)
+		foldTest := filepath.Join(foldFolder, w.testFolder)
+		foldUntargetedTest := filepath.Join(foldFolder, w.untargetedTestFolder)
+		foldModel := filepath.Join(foldFolder, w.modelFolder)
+		foldPerf := filepath.Join(foldFolder, w.perfFolder)
+		for _, path := range []string{foldTrain, foldTest, foldUntargetedTest, foldModel, foldPerf} {
+			if err := os.MkdirAll(path, os.ModeDir); err != nil {
+				return nil, fmt.Errorf("Error creating folder under %s: %s", path, err)
+			}
+		}
+
+		for i, dataID := range task.TrainData {
+			dest := foldTrain
+			if i%folds == fold {
+				dest = foldTest
+			}
+			if err := linkOrCopy(filepath.Join(trainFolder, dataID.String()), filepath.Join(dest, dataID.String())); err != nil {
+				return nil, fmt.Errorf("Error dealing train data %s into fold %d: %s", dataID, fold, err)
+			}
+		}
+		if err := copyTree(modelFolder, foldModel); err != nil {
+			return nil, fmt.Errorf("Error copying start model into fold %d: %s", fold, err)
+		}
+
+		if _, err := w.UntargetTestingVolume(manifest, problemImage, foldTest, foldUntargetedTest); err != nil {
+			return nil, fmt.Errorf("Error preparing fold %d: %s", fold, err)
+		}
+		if _, err := w.Train(manifest, algoImage, foldTrain, foldUntargetedTest, foldModel, paramsFolder, ""); err != nil {
+			return nil, fmt.Errorf("Error training fold %d: %s", fold, err)
+		}
+		if _, err := w.ComputePerf(manifest, problemImage, foldTrain, foldTest, foldUntargetedTest, foldPerf); err != nil {
+			return nil, fmt.Errorf("Error computing perf of fold %d: %s", fold, err)
+		}
+		perf, err := readPerfuplet(filepath.Join(foldPerf, "performance.json"))
+		if err != nil {
+			return nil, fmt.Errorf("Error reading perf of fold %d: %s", fold, err)
+		}
+		log.Printf("[DEBUG][learn] Fold %d/%d of %s: perf %f", fold+1, folds, task.Key, perf.Perf)
+		perfs = append(perfs, *perf)
+
+		// Fold workspaces hold a copy of the train data: let's not keep them around
+		os.RemoveAll(foldFolder)
+	}
+	return perfs, nil
+}
+
+// MergeFolds merges the performances of the folds of a cross-validated task into the performance
+// of its final model (trained on all the train data and scored on the test data). The perf
+// becomes the mean perf of the folds and PerfStd their standard deviation. The train and test
+// performance maps get each fold's, as fold_<fold>_<metric>, and the test performance map gets
+// the cross-validation summary (PerfCVMean, PerfCVStd) and the perf of the final model
+// (PerfHoldout).
+func MergeFolds(final Perfuplet, folds []Perfuplet) Perfuplet {
+	merged := Perfuplet{
+		TrainPerf: make(map[string]float64),
+		TestPerf:  make(map[string]float64),
+		Folds:     folds,
+	}
+	for metric, value := range final.TrainPerf {
+		merged.TrainPerf[metric] = value
+	}
+	for metric, value := range final.TestPerf {
+		merged.TestPerf[metric] = value
+	}
+	if len(folds) == 0 {
+		merged.Perf = final.Perf
+		return merged
+	}
+
+	for i, fold := range folds {
+		merged.Perf += fold.Perf / float64(len(folds))
+		for metric, value := range fold.TrainPerf {
+			merged.TrainPerf[fmt.Sprintf("fold_%d_%s", i, metric)] = value
+		}
+		for metric, value := range fold.TestPerf {
+			merged.TestPerf[fmt.Sprintf("fold_%d_%s", i, metric)] = value
+		}
+	}
+	for _, fold := range folds {
+		merged.PerfStd += (fold.Perf - merged.Perf) * (fold.Perf - merged.Perf) / float64(len(folds))
+	}
+	merged.PerfStd = math.Sqrt(merged.PerfStd)
+
+	merged.TestPerf[PerfCVMean] = merged.Perf
+	merged.TestPerf[PerfCVStd] = merged.PerfStd
+	merged.TestPerf[PerfHoldout] = final.Perf
+	return merged
+}
+
+func readPerfuplet(path string) (*Perfuplet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var perf Perfuplet
+	if err = json.NewDecoder(f).Decode(&perf); err != nil {
+		return nil, fmt.Errorf("Error un-marshaling performance file %s to JSON: %s", path, err)
+	}
+	return &perf, nil
+}
+
+// linkOrCopy hard-links a file, or copies it if it can't be linked
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyTree copies the content of a folder (models are trained in place, so they can't be linked)
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, os.ModeDir|0755)
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package compute
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/envelope"
+	"github.com/MorpheoOrg/morpheo-compute/evaluate"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// EvaluationReporter is implemented by the peers that record evaluations. The compute API only
+// accepts evaluations if its peer does.
+type EvaluationReporter interface {
+	ReportEvaluation(key string, model uuid.UUID, status string, perf float64, testPerf map[string]float64) (string, []byte, error)
+}
+
+// HandleEvaluate manages an evaluation task: the perf of the model (or its failure) is reported to
+// the peer, no model is posted to storage
+func (w *Worker) HandleEvaluate(message []byte) (err error) {
+	log.Println("[DEBUG][evaluate] Starting evaluation task")
+
+	msg, err := envelope.Decode(message, envelope.TypeEvaluate)
+	if err != nil {
+		taskFailures.WithLabelValues("evaluate", StageDecode).Inc()
+		return fmt.Errorf("Error decoding evaluate-uplet message: %s -- Body: %s", err, message)
+	}
+	var task evaluate.Evaluateuplet
+	if err = msg.Unmarshal(&task); err != nil {
+		taskFailures.WithLabelValues("evaluate", StageDecode).Inc()
+		return fmt.Errorf("Error un-marshaling evaluate-uplet: %s -- Body: %s", err, message)
+	}
+	log.Printf("[DEBUG][evaluate] Received %s (schema version %d, submitted by %q, priority %q, model %s)", task.Key, msg.SchemaVersion, msg.Submitter, msg.Priority, task.Model)
+
+	// Let's continue the trace started by the API
+	span := w.tracer.StartFromTraceparent("worker.HandleEvaluate", msg.Traceparent)
+	span.SetAttribute("uplet.key", task.Key)
+	span.SetAttribute("worker.id", w.ID.String())
+	span.SetAttribute("message.priority", msg.Priority)
+	defer func() { span.End(err) }()
+
+	if err = task.Check(); err != nil {
+		taskFailures.WithLabelValues("evaluate", StageCheck).Inc()
+		return fmt.Errorf("Error in evaluate task: %s -- Body: %s", err, message)
+	}
+
+	// The model may still be trained: let the broker deliver the task again later
+	if err = w.checkStartModel(task.Model); err != nil {
+		taskDeferrals.WithLabelValues("evaluate", DeferInputModels).Inc()
+		return fmt.Errorf("Model %s of %s isn't on storage yet, requeuing it: %s", task.Model, task.Key, err)
+	}
+
+	perfuplet, err := w.EvaluateWorkflow(task, span)
+	if err != nil {
+		var m map[string]float64
+		var f float64
+		reportSpan := span.Child("peer.ReportEvaluation")
+		err2 := w.reportEvaluation(task, common.TaskStatusFailed, f, m)
+		reportSpan.End(err2)
+		if err2 != nil {
+			return fmt.Errorf("Error in EvaluateWorkflow: %s. Error reporting the evaluation as failed to the peer: %s", err, err2)
+		}
+		return fmt.Errorf("Error in EvaluateWorkflow: %s", err)
+	}
+
+	reportSpan := span.Child("peer.ReportEvaluation")
+	err = w.reportEvaluation(task, common.TaskStatusDone, perfuplet.Perf, perfuplet.TestPerf)
+	reportSpan.End(err)
+	if err != nil {
+		taskFailures.WithLabelValues("evaluate", StagePeerReport).Inc()
+		return fmt.Errorf("Error posting evaluation result %s to peer: %s", task.Key, err)
+	}
+	log.Printf("[INFO][evaluate] Model %s scored %f on %d test data blobs (%s)", task.Model, perfuplet.Perf, len(task.TestData), task.Key)
+	return nil
+}
+
+// reportEvaluation reports the status and perf of an evaluation to the peer
+func (w *Worker) reportEvaluation(task evaluate.Evaluateuplet, status string, perf float64, testPerf map[string]float64) (err error) {
+	reporter, ok := w.peer.(EvaluationReporter)
+	if !ok {
+		return fmt.Errorf("The peer can't record evaluations")
+	}
+	_, _, err = reporter.ReportEvaluation(task.Key, task.Model, status, perf, testPerf)
+	return err
+}
+
+// EvaluateWorkflow scores an existing model on the test data of an evaluation task: the algo
+// predicts on the un-targeted test data and the problem workflow computes the perf of the
+// predictions, as in the test step of LearnWorkflow. Each of its stages is traced as a child span
+// of parent.
+func (w *Worker) EvaluateWorkflow(task evaluate.Evaluateuplet, parent *tracing.Span) (perfuplet *Perfuplet, err error) {
+	log.Printf("[DEBUG][evaluate] Starting evaluation workflow for %s", task.Key)
+
+	timer := newStageTimer("evaluate", task.Key, parent)
+	defer func() { timer.Done(err) }()
+
+	// Setup directory structure (several evaluations of the same model may run side by side)
+	taskDataFolder := filepath.Join(w.dataFolder, fmt.Sprintf("evaluate-%s", uuid.NewV4()))
+	trainFolder := filepath.Join(taskDataFolder, w.trainFolder)
+	testFolder := filepath.Join(taskDataFolder, w.testFolder)
+	untargetedTestFolder := filepath.Join(taskDataFolder, w.untargetedTestFolder)
+	predFolder := filepath.Join(untargetedTestFolder, w.predFolder)
+	modelFolder := filepath.Join(taskDataFolder, w.modelFolder)
+	perfFolder := filepath.Join(taskDataFolder, w.perfFolder)
+	for _, path := range []string{taskDataFolder, trainFolder, testFolder, untargetedTestFolder, predFolder, modelFolder, perfFolder} {
+		if err = os.MkdirAll(path, os.ModeDir); err != nil {
+			return nil, fmt.Errorf("Error creating folder under %s: %s", path, err)
+		}
+	}
+	defer os.RemoveAll(taskDataFolder)
+
+	// The algo of the model is read from its metadata, unless given
+	algoID := task.Algo
+	if uuid.Equal(algoID, uuid.Nil) {
+		modelInfo, err := w.storage.GetModel(task.Model)
+		if err != nil {
+			return nil, fmt.Errorf("Error retrieving model %s metadata: %s", task.Model, err)
+		}
+		algoID = modelInfo.Algo
+	}
+
+	// Load the problem workflow and the algo
+	timer.Stage(StageImageLoad)
+	problemWorkflow, err := w.storage.GetProblemWorkflowBlob(task.Problem)
+	if err != nil {
+		return nil, fmt.Errorf("Error pulling problem workflow %s from storage: %s", task.Problem, err)
+	}
+	problemImageName := fmt.Sprintf("%s-%s", w.problemImagePrefix, task.Problem)
+	manifest, err := w.ProblemImageLoad(problemImageName, problemWorkflow)
+	problemWorkflow.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Error loading problem workflow image %s in Docker daemon: %s", task.Problem, err)
+	}
+	defer w.containerRuntime.ImageUnload(problemImageName)
+
+	algo, err := w.storage.GetAlgoBlob(algoID)
+	if err != nil {
+		return nil, fmt.Errorf("Error pulling algo %s from storage: %s", algoID, err)
+	}
+	algoImageName := fmt.Sprintf("%s-%s", w.algoImagePrefix, algoID)
+	err = w.ImageLoad(algoImageName, algo)
+	algo.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Error loading algo image %s in Docker daemon: %s", algoImageName, err)
+	}
+	defer w.containerRuntime.ImageUnload(algoImageName)
+
+	// Pull the model and the test data
+	timer.Stage(StageDataDownload)
+	model, err := w.storage.GetModelBlob(task.Model)
+	if err != nil {
+		return nil, fmt.Errorf("Error pulling model %s from storage: %s", task.Model, err)
+	}
+	err = w.UntargzInFolder(modelFolder, &countingReader{model, TransferDownload, TransferModel})
+	model.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Error un-tar-gz-ing model: %s", err)
+	}
+	if err = w.downloadData(task.TestData, testFolder); err != nil {
+		return nil, err
+	}
+
+	timer.Stage(StageDetarget)
+	if _, err = w.UntargetTestingVolume(manifest, problemImageName, testFolder, untargetedTestFolder); err != nil {
+		return nil, fmt.Errorf("Error preparing problem %s for model %s: %s", task.Problem, task.Model, err)
+	}
+
+	timer.Stage(StagePredict)
+	if _, err = w.Predict(manifest, algoImageName, untargetedTestFolder, predFolder, modelFolder); err != nil {
+		return nil, fmt.Errorf("Error in predict task: %s -- Body: %v", err, task)
+	}
+
+	timer.Stage(StagePerf)
+	if _, err = w.ComputePerf(manifest, problemImageName, trainFolder, testFolder, untargetedTestFolder, perfFolder); err != nil {
+		return nil, fmt.Errorf("Error computing perf for problem %s and model %s: %s", task.Problem, task.Model, err)
+	}
+	path := filepath.Join(perfFolder, "performance.json")
+	if perfuplet, err = readPerfuplet(path); err != nil {
+		return nil, fmt.Errorf("Error reading performance file %s: %s", path, err)
+	}
+	return perfuplet, nil
+}
+
+// downloadData pulls data blobs from storage into folder, as files named after their UUID
+func (w *Worker) downloadData(dataIDs []uuid.UUID, folder string) error {
+	for _, dataID := range dataIDs {
+		data, err := w.storage.GetDataBlob(dataID)
+		if err != nil {
+			return fmt.Errorf("Error pulling dataset %s from storage: %s", dataID, err)
+		}
+		path := filepath.Join(folder, dataID.String())
+		dataFile, err := os.Create(path)
+		if err != nil {
+			data.Close()
+			return fmt.Errorf("Error creating file %s: %s", path, err)
+		}
+		n, err := io.Copy(dataFile, data)
+		bytesTransferred.WithLabelValues(TransferDownload, TransferData).Add(float64(n))
+		dataFile.Close()
+		data.Close()
+		if err != nil {
+			return fmt.Errorf("Error copying data file %s (%d bytes written): %s", path, n, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package compute
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// JournalFolder is the subfolder of the worker's data folder task journals are kept in, along with
+// the workspace of the journaled tasks
+const JournalFolder = "journal"
+
+// Journal records the stages of a task that are completed and where their outputs are, so that
+// the next attempt of a failed task (on the same worker) resumes at the stage that failed. Outputs
+// are either local, in the workspace of the task (which is kept when it fails), or on storage.
+type Journal struct {
+	Task        string                  `json:"task"`
+	Key         string                  `json:"key"`
+	Fingerprint string                  `json:"fingerprint"`
+	Stages      map[string]JournalStage `json:"stages"`
+
+	path   string
+	folder string
+}
+
+// JournalStage is a completed stage of a journaled task
+type JournalStage struct {
+	DoneAt  time.Time       `json:"done_at"`
+	Outputs []JournalOutput `json:"outputs,omitempty"`
+}
+
+// JournalOutput is an output of a completed stage: a local file or folder, or a storage object
+// (as <kind>/<uuid>)
+type JournalOutput struct {
+	Local   string `json:"local,omitempty"`
+	Storage string `json:"storage,omitempty"`
+}
+
+// localOutputs lists local stage outputs
+func localOutputs(paths ...string) []JournalOutput {
+	outputs := make([]JournalOutput, 0, len(paths))
+	for _, path := range paths {
+		outputs = append(outputs, JournalOutput{Local: path})
+	}
+	return outputs
+}
+
+// SetJournalMaxAge enables task journaling: failed tasks keep their workspace, for their next
+// attempt to resume them, for up to maxAge (0 disables journaling)
+func (w *Worker) SetJournalMaxAge(maxAge time.Duration) {
+	w.journalMaxAge = maxAge
+}
+
+// openJournal returns the journal of a task, left by its previous attempt if any. The journals
+// left by another task under the same key, and those not updated for the journal max age (along
+// with their workspace), are discarded. It returns nil if journaling is disabled.
+func (w *Worker) openJournal(taskType, key string, task interface{}) (*Journal, error) {
+	if w.journalMaxAge <= 0 {
+		return nil, nil
+	}
+	folder := filepath.Join(w.dataFolder, JournalFolder)
+	if err := os.MkdirAll(folder, os.ModeDir); err != nil {
+		return nil, fmt.Errorf("Error creating journal folder %s: %s", folder, err)
+	}
+	w.pruneJournals(folder)
+
+	content, err := json.Marshal(task)
+	if err != nil {
+		return nil, fmt.Errorf("Error fingerprinting %s: %s", key, err)
+	}
+	name := fmt.Sprintf("%s-%s", taskType, url.PathEscape(key))
+	j := &Journal{
+		Task:        taskType,
+		Key:         key,
+		Fingerprint: fmt.Sprintf("%x", sha256.Sum256(content)),
+		Stages:      make(map[string]JournalStage),
+		path:        filepath.Join(folder, name+".json"),
+		folder:      filepath.Join(folder, name),
+	}
+
+	var previous Journal
+	if content, err := ioutil.ReadFile(j.path); err == nil && json.Unmarshal(content, &previous) == nil && previous.Fingerprint == j.Fingerprint {
+		if len(previous.Stages) > 0 {
+			j.Stages = previous.Stages
+			log.Printf("[INFO][journal] Resuming %s %s, %d stages were completed by a previous attempt", taskType, key, len(j.Stages))
+		}
+		return j, nil
+	}
+
+	// Let's start from a clean workspace
+	if err = os.RemoveAll(j.folder); err != nil {
+		return nil, fmt.Errorf("Error cleaning workspace %s up: %s", j.folder, err)
+	}
+	j.save()
+	return j, nil
+}
+
+// pruneJournals discards the journals (and workspaces) not updated for the journal max age: their
+// task was given up on, or is over. The journals of running tasks are kept, however long their
+// current stage takes.
+func (w *Worker) pruneJournals(folder string) {
+	paths, _ := filepath.Glob(filepath.Join(folder, "*.json"))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < w.journalMaxAge {
+			continue
+		}
+		var j Journal
+		if readJSON(path, &j) == nil && w.tasks.isRunning(j.Key) {
+			continue
+		}
+		log.Printf("[INFO][journal] Discarding stale journal %s", path)
+		os.RemoveAll(strings.TrimSuffix(path, ".json"))
+		os.Remove(path)
+	}
+}
+
+// workspace returns the workspace of a journaled task (defaultFolder if journaling is disabled)
+func (j *Journal) workspace(defaultFolder string) string {
+	if j == nil {
+		return defaultFolder
+	}
+	return j.folder
+}
+
+// done tells whether a previous attempt completed a stage, whose local outputs are still there
+func (j *Journal) done(stage string) bool {
+	if j == nil {
+		return false
+	}
+	completed, ok := j.Stages[stage]
+	if !ok {
+		return false
+	}
+	for _, output := range completed.Outputs {
+		if output.Local == "" {
+			continue
+		}
+		if _, err := os.Stat(output.Local); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// step runs a stage of a task, unless a previous attempt completed it, and records its outputs
+// once it's done
+func (j *Journal) step(timer *stageTimer, stage string, run func() error, outputs ...JournalOutput) error {
+	if j.done(stage) {
+		log.Printf("[INFO][journal] Skipping stage %s of %s, completed at %s", stage, j.Key, j.Stages[stage].DoneAt.Format(time.RFC3339))
+		timer.Skip(stage)
+		return nil
+	}
+	timer.Stage(stage)
+	if err := run(); err != nil {
+		return err
+	}
+	if j != nil {
+		j.Stages[stage] = JournalStage{DoneAt: time.Now().UTC(), Outputs: outputs}
+		j.save()
+	}
+	return nil
+}
+
+// save writes the journal (a journal that can't be written only costs its next attempt the stages
+// it didn't record)
+func (j *Journal) save() {
+	if err := writeJSON(j.path+".tmp", j); err != nil {
+		log.Printf("[WARNING][journal] %s", err)
+		return
+	}
+	if err := os.Rename(j.path+".tmp", j.path); err != nil {
+		log.Printf("[WARNING][journal] Error writing journal %s: %s", j.path, err)
+	}
+}
+
+// remove discards the journal and the workspace of a task that's over
+func (j *Journal) remove() {
+	if j == nil {
+		return
+	}
+	os.RemoveAll(j.folder)
+	os.Remove(j.path)
+}
+
+// resetFolder empties the folder a stage writes its outputs in, which its previous attempt may have
+// left half-written
+func resetFolder(folder string) error {
+	if err := os.RemoveAll(folder); err != nil {
+		return fmt.Errorf("Error cleaning folder %s up: %s", folder, err)
+	}
+	if err := os.MkdirAll(folder, os.ModeDir); err != nil {
+		return fmt.Errorf("Error creating folder under %s: %s", folder, err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package compute
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-compute/workflow"
+)
+
+// ProblemImageLoad loads a problem workflow image like ImageLoad, and returns the manifest read
+// from its blob on the fly (the v1 manifest if it has none)
+func (w *Worker) ProblemImageLoad(imageName string, blob io.Reader) (*workflow.Manifest, error) {
+	type readResult struct {
+		manifest *workflow.Manifest
+		err      error
+	}
+	scanned, scanner := io.Pipe()
+	result := make(chan readResult, 1)
+	go func() {
+		manifest, err := workflow.Read(scanned)
+		// Let the image load go on past the manifest
+		io.Copy(ioutil.Discard, scanned)
+		result <- readResult{manifest, err}
+	}()
+
+	teed := io.TeeReader(blob, scanner)
+	err := w.ImageLoad(imageName, teed)
+	// The manifest may be past what the container runtime read
+	io.Copy(ioutil.Discard, teed)
+	scanner.Close()
+	read := <-result
+	if err != nil {
+		return nil, err
+	}
+	if read.err != nil {
+		return nil, fmt.Errorf("Error reading the manifest of problem workflow %s: %s", imageName, read.err)
+	}
+	log.Printf("[DEBUG][workflow] Problem workflow %s follows the contract v%d", imageName, read.manifest.Version)
+	return read.manifest, nil
+}
+
+// problemManifest reads the manifest of a problem workflow from its blob, without loading its
+// image
+func (w *Worker) problemManifest(problem uuid.UUID) (*workflow.Manifest, error) {
+	blob, err := w.storage.GetProblemWorkflowBlob(problem)
+	if err != nil {
+		return nil, fmt.Errorf("Error pulling problem workflow %s from storage: %s", problem, err)
+	}
+	defer blob.Close()
+	manifest, err := workflow.Read(&countingReader{blob, TransferDownload, TransferImage})
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the manifest of problem workflow %s: %s", problem, err)
+	}
+	return manifest, nil
+}
+
+// runStep runs a step of a task as its manifest declares it, volumes being the worker folders the
+// step may mount (empty ones aren't mounted), and checks that the step wrote its expected outputs
+func (w *Worker) runStep(manifest *workflow.Manifest, name, image string, volumes map[string]string, remove bool) (containerID string, err error) {
+	step, err := manifest.Step(name)
+	if err != nil {
+		return "", err
+	}
+	mounts := make(map[string]string, len(step.Mounts))
+	for volume, path := range step.Mounts {
+		if folder := volumes[volume]; folder != "" {
+			mounts[folder] = path
+		}
+	}
+
+	containerID, err = w.containerRuntime.RunImageInUntrustedContainer(image, step.Args, mounts, remove)
+	if err != nil {
+		return containerID, err
+	}
+
+	for _, output := range step.Outputs {
+		volume, pattern := workflow.SplitOutput(output)
+		matches, _ := filepath.Glob(filepath.Join(volumes[volume], pattern))
+		if volumes[volume] == "" || len(matches) == 0 {
+			return containerID, fmt.Errorf("Step %s didn't write its expected output %s", name, output)
+		}
+	}
+	return containerID, nil
+}
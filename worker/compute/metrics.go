@@ -0,0 +1,310 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package compute
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// Workflow stages, used to time tasks and to classify their failures
+const (
+	StageDecode           = "decode"
+	StageCheck            = "check"
+	StagePeerAssign       = "peer_assign"
+	StageImageLoad        = "image_load"
+	StageDataDownload     = "data_download"
+	StageModelDownload    = "model_download"
+	StageDetarget         = "detarget"
+	StageCrossValidation  = "cross_validation"
+	StageTrain            = "train"
+	StagePredict          = "predict"
+	StagePerf             = "perf"
+	StageAggregate        = "aggregate"
+	StageModelUpload      = "model_upload"
+	StagePredictionUpload = "prediction_upload"
+	StagePeerReport       = "peer_report"
+)
+
+// Reasons tasks are handed back to the broker to be retried later (rather than failed)
+const (
+	DeferStartModel  = "start_model_missing"
+	DeferInputModels = "input_models_missing"
+)
+
+// Transfer directions and kinds of transferred content, used as label values for the bytes
+// transferred counter
+const (
+	TransferDownload = "download"
+	TransferUpload   = "upload"
+
+	TransferImage      = "image"
+	TransferData       = "data"
+	TransferModel      = "model"
+	TransferPrediction = "prediction"
+	TransferCheckpoint = "checkpoint"
+)
+
+// Checkpoint operations, used as label values for the checkpoints counter
+const (
+	CheckpointUpload       = "upload"
+	CheckpointUploadFailed = "upload_failed"
+	CheckpointRestore      = "restore"
+	CheckpointDelete       = "delete"
+)
+
+var (
+	stageDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "compute_worker",
+			Name:      "stage_duration_seconds",
+			Help:      "Duration of each workflow stage, by task type, stage and outcome.",
+			Buckets:   prometheus.ExponentialBuckets(0.5, 2, 14),
+		},
+		[]string{"task", "stage", "status"},
+	)
+	bytesTransferred = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "compute_worker",
+			Name:      "bytes_transferred_total",
+			Help:      "Bytes exchanged with storage, by direction and kind of content.",
+		},
+		[]string{"direction", "kind"},
+	)
+	tasksRunning = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "compute_worker",
+			Name:      "tasks_running",
+			Help:      "Number of tasks being processed, by topic.",
+		},
+		[]string{"topic"},
+	)
+	tasksParallelism = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "compute_worker",
+			Name:      "tasks_parallelism",
+			Help:      "Configured maximum number of tasks processed in parallel, by topic.",
+		},
+		[]string{"topic"},
+	)
+	taskFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "compute_worker",
+			Name:      "task_failures_total",
+			Help:      "Number of failed tasks, by task type and failure class (the stage that failed).",
+		},
+		[]string{"task", "class"},
+	)
+	taskDeferrals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "compute_worker",
+			Name:      "task_deferrals_total",
+			Help:      "Number of tasks handed back to the broker to be retried later, by task type and reason.",
+		},
+		[]string{"task", "reason"},
+	)
+	stagesSkipped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "compute_worker",
+			Name:      "stages_skipped_total",
+			Help:      "Number of workflow stages skipped because a previous attempt of the task completed them, by task type and stage.",
+		},
+		[]string{"task", "stage"},
+	)
+	servedModels = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "compute_worker",
+			Name:      "served_models",
+			Help:      "Number of models loaded for online predictions.",
+		},
+	)
+	servingRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "compute_worker",
+			Name:      "serving_requests_total",
+			Help:      "Number of online prediction requests, by outcome.",
+		},
+		[]string{"outcome"},
+	)
+	servingUnloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "compute_worker",
+			Name:      "serving_unloads_total",
+			Help:      "Number of served models unloaded, by reason.",
+		},
+		[]string{"reason"},
+	)
+	checkpointOps = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "compute_worker",
+			Name:      "checkpoints_total",
+			Help:      "Number of training checkpoints uploaded to (or restored from) storage, by operation.",
+		},
+		[]string{"operation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		stageDuration,
+		bytesTransferred,
+		tasksRunning,
+		tasksParallelism,
+		taskFailures,
+		taskDeferrals,
+		stagesSkipped,
+		servedModels,
+		servingRequests,
+		servingUnloads,
+		checkpointOps,
+	)
+}
+
+// stageTiming is the duration of a single workflow stage
+type stageTiming struct {
+	stage    string
+	duration time.Duration
+}
+
+// stageTimer times the successive stages of a task workflow. Starting a stage ends the previous
+// one, and the stage running when the workflow returns an error is the failure class. Each stage
+// is also traced as a child span of the task span.
+type stageTimer struct {
+	task    string
+	key     string
+	current string
+	start   time.Time
+	timings []stageTiming
+
+	span      *tracing.Span
+	stageSpan *tracing.Span
+}
+
+func newStageTimer(task, key string, span *tracing.Span) *stageTimer {
+	return &stageTimer{task: task, key: key, span: span}
+}
+
+// Stage ends the current stage (if any) and starts timing a new one
+func (t *stageTimer) Stage(stage string) {
+	t.end("ok", nil)
+	t.current = stage
+	t.start = time.Now()
+	t.stageSpan = t.span.Child(fmt.Sprintf("worker.%s.%s", t.task, stage))
+}
+
+// Skip ends the current stage (if any) and records a stage a previous attempt of the task
+// completed, which isn't ran again
+func (t *stageTimer) Skip(stage string) {
+	t.end("ok", nil)
+	stagesSkipped.WithLabelValues(t.task, stage).Inc()
+	t.timings = append(t.timings, stageTiming{stage: stage + "(skipped)"})
+}
+
+// Done ends the current stage, records the task failure if err isn't nil and logs a summary of
+// the stage timings
+func (t *stageTimer) Done(err error) {
+	failedStage := t.current
+	if err != nil {
+		t.end("failed", err)
+		taskFailures.WithLabelValues(t.task, failedStage).Inc()
+	} else {
+		t.end("ok", nil)
+	}
+
+	var summary []string
+	for _, timing := range t.timings {
+		summary = append(summary, fmt.Sprintf("%s=%s", timing.stage, timing.duration))
+	}
+	log.Printf("[INFO][%s] Stage timings for %s: %s", t.task, t.key, strings.Join(summary, " "))
+}
+
+func (t *stageTimer) end(status string, err error) {
+	if t.current == "" {
+		return
+	}
+	t.stageSpan.End(err)
+	duration := time.Since(t.start)
+	stageDuration.WithLabelValues(t.task, t.current, status).Observe(duration.Seconds())
+	t.timings = append(t.timings, stageTiming{stage: t.current, duration: duration})
+	t.current = ""
+}
+
+// countingReader counts the bytes read from storage through it
+type countingReader struct {
+	reader    io.Reader
+	direction string
+	kind      string
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	bytesTransferred.WithLabelValues(r.direction, r.kind).Add(float64(n))
+	return
+}
+
+// InstrumentHandler keeps track of the number of tasks being processed by a message handler
+func InstrumentHandler(topic string, parallelism int, handler func([]byte) error) func([]byte) error {
+	tasksParallelism.WithLabelValues(topic).Set(float64(parallelism))
+	return func(message []byte) error {
+		tasksRunning.WithLabelValues(topic).Inc()
+		defer tasksRunning.WithLabelValues(topic).Dec()
+		return handler(message)
+	}
+}
+
+// ServeAdmin serves the worker metrics and a liveness probe over HTTP
+func ServeAdmin(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+
+	log.Printf("[INFO] Admin server listening on %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.Printf("[ERROR] Admin server stopped: %s", err)
+	}
+}
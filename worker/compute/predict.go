@@ -0,0 +1,283 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package compute
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/envelope"
+	"github.com/MorpheoOrg/morpheo-compute/predict"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// PredictionReporter is implemented by the peers that record the results of prediction tasks.
+// Results are only logged by the worker otherwise.
+type PredictionReporter interface {
+	ReportPred(key string, status string, items []predict.Item) (string, []byte, error)
+}
+
+// HandlePred manages a prediction task: its model predicts on all its data blobs at once, and the
+// status of each of them is reported to the peer
+func (w *Worker) HandlePred(message []byte) (err error) {
+	log.Println("[DEBUG][pred] Starting prediction task")
+
+	// Unmarshal the pred-uplet (both enveloped and legacy messages are accepted)
+	msg, err := envelope.Decode(message, envelope.TypePred)
+	if err != nil {
+		taskFailures.WithLabelValues("pred", StageDecode).Inc()
+		return fmt.Errorf("Error decoding pred-uplet message: %s -- Body: %s", err, message)
+	}
+	var task predict.Preduplet
+	if err = msg.Unmarshal(&task); err != nil {
+		taskFailures.WithLabelValues("pred", StageDecode).Inc()
+		return fmt.Errorf("Error un-marshaling pred-uplet: %s -- Body: %s", err, message)
+	}
+	log.Printf("[DEBUG][pred] Received %s (schema version %d, submitted by %q, priority %q, %d data blobs)", task.Key, msg.SchemaVersion, msg.Submitter, msg.Priority, len(task.AllData()))
+
+	// Let's continue the trace started by the API
+	span := w.tracer.StartFromTraceparent("worker.HandlePred", msg.Traceparent)
+	span.SetAttribute("uplet.key", task.Key)
+	span.SetAttribute("worker.id", w.ID.String())
+	span.SetAttribute("message.priority", msg.Priority)
+	defer func() { span.End(err) }()
+
+	if err = task.Check(); err != nil {
+		taskFailures.WithLabelValues("pred", StageCheck).Inc()
+		return fmt.Errorf("Error in pred task: %s -- Body: %s", err, message)
+	}
+
+	// The model may still be trained: let the broker deliver the task again later
+	if err = w.checkStartModel(task.Model); err != nil {
+		taskDeferrals.WithLabelValues("pred", DeferInputModels).Inc()
+		return fmt.Errorf("Model %s of %s isn't on storage yet, requeuing it: %s", task.Model, task.Key, err)
+	}
+
+	items, err := w.PredWorkflow(task, span)
+	if err != nil {
+		// TODO: handle fatal and non-fatal errors differently and only report the items as failed if
+		// the error was fatal
+		items = make([]predict.Item, 0, len(task.AllData()))
+		for _, data := range task.AllData() {
+			items = append(items, predict.Item{Data: data, Status: predict.ItemFailed, Error: err.Error()})
+		}
+	}
+
+	reportSpan := span.Child("peer.ReportPred")
+	err2 := w.reportPred(task.Key, predict.Status(items), items)
+	reportSpan.End(err2)
+	switch {
+	case err != nil && err2 != nil:
+		return fmt.Errorf("Error in PredWorkflow: %s. Error reporting the pred-uplet as failed to the peer: %s", err, err2)
+	case err != nil:
+		return fmt.Errorf("Error in PredWorkflow: %s", err)
+	case err2 != nil:
+		taskFailures.WithLabelValues("pred", StagePeerReport).Inc()
+		return fmt.Errorf("Error posting pred result %s to peer: %s", task.Key, err2)
+	}
+	return nil
+}
+
+// reportPred reports the status of a prediction task and of its items to the peer, if it records
+// them, and logs them
+func (w *Worker) reportPred(key, status string, items []predict.Item) error {
+	for _, item := range items {
+		if item.Status == predict.ItemDone {
+			log.Printf("[INFO][pred] %s: prediction %s made on data %s", key, item.Prediction, item.Data)
+		} else {
+			log.Printf("[INFO][pred] %s: prediction on data %s failed: %s", key, item.Data, item.Error)
+		}
+	}
+	if reporter, ok := w.peer.(PredictionReporter); ok {
+		_, _, err := reporter.ReportPred(key, status, items)
+		return err
+	}
+	return nil
+}
+
+// PredWorkflow handles our prediction tasks: the model's algo container predicts on all the data
+// blobs of the task in a single run, then the predictions are posted to storage (one per data blob,
+// or one bundle). Data blobs that can't be pulled, and those the algo doesn't predict on, are
+// reported as failed items, the others as done. Each of its stages is traced as a child span of
+// parent.
+func (w *Worker) PredWorkflow(task predict.Preduplet, parent *tracing.Span) (items []predict.Item, err error) {
+	log.Printf("[DEBUG][pred] Starting prediction workflow for %s", task.Key)
+
+	timer := newStageTimer("pred", task.Key, parent)
+	defer func() { timer.Done(err) }()
+
+	// Setup directory structure (several prediction tasks may use the same model side by side)
+	taskDataFolder := filepath.Join(w.dataFolder, fmt.Sprintf("pred-%s", uuid.NewV4()))
+	testFolder := filepath.Join(taskDataFolder, w.testFolder)
+	predFolder := filepath.Join(testFolder, w.predFolder)
+	modelFolder := filepath.Join(taskDataFolder, w.modelFolder)
+	for _, path := range []string{taskDataFolder, testFolder, predFolder, modelFolder} {
+		if err = os.MkdirAll(path, os.ModeDir); err != nil {
+			return nil, fmt.Errorf("Error creating folder under %s: %s", path, err)
+		}
+	}
+	defer os.RemoveAll(taskDataFolder)
+
+	// Pull associated algo and load it into a container (the problem workflow only tells how to
+	// run it)
+	timer.Stage(StageImageLoad)
+	manifest, err := w.problemManifest(task.Problem)
+	if err != nil {
+		return nil, err
+	}
+	modelInfo, err := w.storage.GetModel(task.Model)
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving model %s metadata: %s", task.Model, err)
+	}
+	algo, err := w.storage.GetAlgoBlob(modelInfo.Algo)
+	if err != nil {
+		return nil, fmt.Errorf("Error pulling algo %s from storage: %s", modelInfo.Algo, err)
+	}
+	algoImageName := fmt.Sprintf("%s-%s", w.algoImagePrefix, modelInfo.Algo)
+	err = w.ImageLoad(algoImageName, algo)
+	algo.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Error loading algo image %s in Docker daemon: %s", algoImageName, err)
+	}
+	defer w.containerRuntime.ImageUnload(algoImageName)
+
+	// Pull the model and the data blobs (a data blob that can't be pulled only fails its item)
+	timer.Stage(StageDataDownload)
+	model, err := w.storage.GetModelBlob(task.Model)
+	if err != nil {
+		return nil, fmt.Errorf("Error pulling model %s from storage: %s", task.Model, err)
+	}
+	err = w.UntargzInFolder(modelFolder, &countingReader{model, TransferDownload, TransferModel})
+	model.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Error un-tar-gz-ing model: %s", err)
+	}
+	pulled := 0
+	for _, data := range task.AllData() {
+		item := predict.Item{Data: data, Status: predict.ItemDone}
+		if err := w.downloadData([]uuid.UUID{data}, testFolder); err != nil {
+			item.Status, item.Error = predict.ItemFailed, err.Error()
+		} else {
+			pulled++
+		}
+		items = append(items, item)
+	}
+	if pulled == 0 {
+		return nil, fmt.Errorf("None of the %d data blobs of %s could be pulled from storage", len(items), task.Key)
+	}
+
+	// Let's pass the prediction task to our execution backend, now that everything should be in place
+	timer.Stage(StagePredict)
+	if _, err = w.Predict(manifest, algoImageName, testFolder, predFolder, modelFolder); err != nil {
+		return nil, fmt.Errorf("Error in pred task: %s -- Body: %v", err, task)
+	}
+
+	// Let's send the predictions to storage
+	timer.Stage(StagePredictionUpload)
+	for i, item := range items {
+		if item.Status != predict.ItemDone {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(predFolder, item.Data.String())); err != nil {
+			items[i].Status, items[i].Error = predict.ItemFailed, fmt.Sprintf("Missing prediction file for data %s", item.Data)
+		}
+	}
+	if predict.Status(items) != common.TaskStatusDone {
+		return items, nil
+	}
+	if task.Bundle {
+		bundle := common.NewPrediction()
+		if err = w.postPredictionBundle(bundle, predFolder, filepath.Join(taskDataFolder, "pred.tar.gz")); err != nil {
+			return nil, err
+		}
+		for i := range items {
+			if items[i].Status == predict.ItemDone {
+				items[i].Prediction = bundle.ID
+			}
+		}
+		return items, nil
+	}
+	for i, item := range items {
+		if item.Status != predict.ItemDone {
+			continue
+		}
+		prediction := common.NewPrediction()
+		if err := w.postPredictionFile(prediction, filepath.Join(predFolder, item.Data.String())); err != nil {
+			items[i].Status, items[i].Error = predict.ItemFailed, err.Error()
+			continue
+		}
+		items[i].Prediction = prediction.ID
+	}
+	return items, nil
+}
+
+// postPredictionFile streams a prediction file to storage
+func (w *Worker) postPredictionFile(prediction *common.Prediction, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Error opening prediction file from path %s: %s", path, err)
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("Error retrieving file stat: %s", err)
+	}
+	if err = w.storage.PostPrediction(prediction, file, stat.Size()); err != nil {
+		return fmt.Errorf("Error streaming new prediction %s to storage: %s", prediction.ID, err)
+	}
+	bytesTransferred.WithLabelValues(TransferUpload, TransferPrediction).Add(float64(stat.Size()))
+	return nil
+}
+
+// postPredictionBundle tar-gzips the prediction folder into archivePath and streams it to storage
+func (w *Worker) postPredictionBundle(prediction *common.Prediction, predFolder, archivePath string) error {
+	archiveWriter, err := os.Create(archivePath)
+	if err != nil {
+		return fmt.Errorf("Error creating prediction bundle file %s: %s", archivePath, err)
+	}
+	err = w.TargzFolder(predFolder, archiveWriter)
+	archiveWriter.Close()
+	if err != nil {
+		return fmt.Errorf("Error tar-gzipping prediction bundle %s: %s", prediction.ID, err)
+	}
+	return w.postPredictionFile(prediction, archivePath)
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package compute
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MorpheoOrg/morpheo-compute/registry"
+)
+
+// WorkerHeartbeatPath is the compute API route workers post their heartbeats to (%s being the
+// worker ID)
+const WorkerHeartbeatPath = "/workers/%s/heartbeat"
+
+// Version is the version of the worker, reported in its heartbeats (set at link time, see the
+// Makefile)
+var Version = "dev"
+
+// HeartbeatConfig tells how often a worker sends heartbeats to the worker registry, and how long
+// it's considered alive after each of them
+type HeartbeatConfig struct {
+	Interval time.Duration
+	Lease    time.Duration
+}
+
+// HeartbeatSender delivers a heartbeat to the worker registry
+type HeartbeatSender func(heartbeat registry.Heartbeat) error
+
+// taskTracker keeps track of the tasks a worker is running and of the task types it consumes, for
+// its heartbeats
+type taskTracker struct {
+	lock         sync.Mutex
+	capabilities map[string]int
+	running      map[uint64]registry.Task
+	next         uint64
+}
+
+func newTaskTracker() *taskTracker {
+	return &taskTracker{
+		capabilities: make(map[string]int),
+		running:      make(map[uint64]registry.Task),
+	}
+}
+
+// setCapability records that the worker handles up to count tasks of a type at once
+func (t *taskTracker) setCapability(name string, count int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.capabilities[name] = count
+}
+
+// track wraps a message handler of topic so that the messages it handles are reported as running
+func (t *taskTracker) track(topic string, handler func([]byte) error) func([]byte) error {
+	return func(message []byte) error {
+		t.lock.Lock()
+		id := t.next
+		t.next++
+		t.running[id] = registry.NewTask(topic, message)
+		t.lock.Unlock()
+
+		defer func() {
+			t.lock.Lock()
+			delete(t.running, id)
+			t.lock.Unlock()
+		}()
+		return handler(message)
+	}
+}
+
+// isRunning tells whether a task is running
+func (t *taskTracker) isRunning(key string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, task := range t.running {
+		if task.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Heartbeat describes the worker and the tasks it is running, for it to be considered alive for
+// lease
+func (w *Worker) Heartbeat(lease time.Duration) registry.Heartbeat {
+	w.tasks.lock.Lock()
+	defer w.tasks.lock.Unlock()
+
+	heartbeat := registry.Heartbeat{
+		Worker:       w.ID.String(),
+		Version:      Version,
+		Capabilities: make(map[string]int),
+		Running:      []registry.Task{},
+		LeaseSeconds: int(lease / time.Second),
+	}
+	for name, count := range w.tasks.capabilities {
+		heartbeat.Capabilities[name] = count
+	}
+	for _, task := range w.tasks.running {
+		heartbeat.Running = append(heartbeat.Running, task)
+	}
+	return heartbeat
+}
+
+// SendHeartbeats sends a heartbeat every interval, forever. Failed heartbeats are only logged: the
+// worker keeps running its tasks, and is considered dead by the registry if its lease expires.
+func (w *Worker) SendHeartbeats(send HeartbeatSender, conf HeartbeatConfig) {
+	log.Printf("[INFO][registry] Sending heartbeats every %s (lease: %s) as worker %s", conf.Interval, conf.Lease, w.ID)
+	for {
+		if err := send(w.Heartbeat(conf.Lease)); err != nil {
+			log.Printf("[WARNING][registry] Error sending heartbeat: %s", err)
+		}
+		time.Sleep(conf.Interval)
+	}
+}
+
+// NewRegistryClient returns a HeartbeatSender posting heartbeats to the compute API at url. APIs
+// requiring mutual TLS are sent the client certificate of certFile and keyFile (if set), and their
+// certificate is verified against caFile (if set).
+func NewRegistryClient(url, certFile, keyFile, caFile string) (HeartbeatSender, error) {
+	tlsConfig := &tls.Config{}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading registry client key pair: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		caBundle, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading registry CA bundle %s: %s", caFile, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("No certificate found in registry CA bundle %s", caFile)
+		}
+	}
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+
+	return func(heartbeat registry.Heartbeat) error {
+		body, err := json.Marshal(heartbeat)
+		if err != nil {
+			return fmt.Errorf("Error marshaling heartbeat: %s", err)
+		}
+		endpoint := strings.TrimSuffix(url, "/") + fmt.Sprintf(WorkerHeartbeatPath, heartbeat.Worker)
+		resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("Error posting heartbeat to %s: %s", endpoint, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			message, _ := ioutil.ReadAll(resp.Body)
+			return fmt.Errorf("Unexpected status code (%s) posting heartbeat to %s: %s", resp.Status, endpoint, message)
+		}
+		return nil
+	}, nil
+}
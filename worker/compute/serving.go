@@ -0,0 +1,559 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package compute
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// Serving contract: the algo container of a served model is ran with ServeArgs, the model being
+// mounted in /data/model, and serves HTTP on the ServeSocket unix socket of the /data/serve folder
+// (containers are network-isolated). It answers GET /health (200 once ready), POST /predict and
+// POST /shutdown (the container exits).
+const (
+	ServeSocket = "serve.sock"
+)
+
+// ServeArgs are the arguments of the algo containers serving a model
+var ServeArgs = []string{"-V", "/data", "-T", "serve"}
+
+// Outcomes of online prediction requests, used as label values for the serving requests counter
+const (
+	ServingOK    = "ok"
+	ServingBusy  = "busy"
+	ServingError = "error"
+)
+
+// Reasons served models are unloaded, used as label values for the serving unloads counter
+const (
+	UnloadIdle      = "idle"
+	UnloadUnhealthy = "unhealthy"
+	UnloadEvicted   = "evicted"
+	UnloadStopped   = "stopped"
+)
+
+// ModelsRoute lists the served models, and serves their online predictions as
+// /models/{id}/predict (see ServeModels)
+const ModelsRoute = "/models"
+
+// ServingConfig configures a ModelServer
+type ServingConfig struct {
+	// Concurrency is the number of requests a served model handles at once (others are turned
+	// down)
+	Concurrency int
+	// MaxModels is the number of models loaded at once: loading another one unloads the least
+	// recently used idle model (requests are turned down if there's none)
+	MaxModels int
+	// IdleTimeout is the delay after which models that didn't serve any request are unloaded
+	IdleTimeout time.Duration
+	// StartTimeout is the delay serving containers have to get healthy
+	StartTimeout time.Duration
+	// RequestTimeout is the timeout of each request to a serving container
+	RequestTimeout time.Duration
+	// HealthInterval is the interval between two health checks of the served models
+	HealthInterval time.Duration
+}
+
+// ModelServer serves online predictions of trained models. Models are loaded on their first
+// request: their algo image is loaded through Worker.ImageLoad and a long-lived container is
+// started with the algo's serve entrypoint, requests being proxied to it. Served models are
+// health-checked and unloaded once idle, or to make room for another model.
+type ModelServer struct {
+	worker *Worker
+	conf   ServingConfig
+
+	lock   sync.Mutex
+	models map[string]*ServedModel
+}
+
+// ServedModel is a model loaded in a serving container
+type ServedModel struct {
+	ID       uuid.UUID `json:"model"`
+	Algo     uuid.UUID `json:"algo"`
+	LoadedAt time.Time `json:"loaded_at"`
+	LastUsed time.Time `json:"last_used"`
+	InFlight int       `json:"in_flight"`
+
+	image  string
+	folder string
+	client *http.Client
+	slots  chan struct{}
+	// ready is closed once the container is healthy, or once it failed to start (err is then set)
+	ready chan struct{}
+	err   error
+	// exited is closed once the container exits
+	exited chan struct{}
+}
+
+// NewModelServer creates a ModelServer running models on the worker's container runtime, and
+// starts its health checks
+func (w *Worker) NewModelServer(conf ServingConfig) *ModelServer {
+	s := &ModelServer{
+		worker: w,
+		conf:   conf,
+		models: make(map[string]*ServedModel),
+	}
+	go s.checkModels()
+	return s
+}
+
+// Predict proxies an online prediction request to the container serving a model, loading it first
+// if need be. The status and body of the container's response are returned, unless the request
+// couldn't be served. Requests past the concurrency limit of the model, or for a model that can't
+// be loaded since all the loaded ones are busy, are turned down with a 429 Too Many Requests status.
+func (s *ModelServer) Predict(model uuid.UUID, request []byte) (status int, response []byte, err error) {
+	m, err := s.get(model)
+	if err == errTooManyModels {
+		servingRequests.WithLabelValues(ServingBusy).Inc()
+		response, _ = json.Marshal(common.NewAPIError(fmt.Sprintf("Model %s can't be loaded: %d models are loaded and busy already", model, s.conf.MaxModels)))
+		return http.StatusTooManyRequests, response, nil
+	}
+	if err != nil {
+		servingRequests.WithLabelValues(ServingError).Inc()
+		return 0, nil, err
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		servingRequests.WithLabelValues(ServingBusy).Inc()
+		response, _ = json.Marshal(common.NewAPIError(fmt.Sprintf("Model %s is already serving %d requests", model, cap(m.slots))))
+		return http.StatusTooManyRequests, response, nil
+	}
+	s.use(m, 1)
+	defer func() {
+		s.use(m, -1)
+		<-m.slots
+	}()
+
+	resp, err := m.client.Post("http://serve/predict", "application/json", bytes.NewReader(request))
+	if err != nil {
+		servingRequests.WithLabelValues(ServingError).Inc()
+		return 0, nil, fmt.Errorf("Error proxying prediction request to the container serving model %s: %s", model, err)
+	}
+	defer resp.Body.Close()
+	response, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		servingRequests.WithLabelValues(ServingError).Inc()
+		return 0, nil, fmt.Errorf("Error reading the prediction of the container serving model %s: %s", model, err)
+	}
+	servingRequests.WithLabelValues(ServingOK).Inc()
+	return resp.StatusCode, response, nil
+}
+
+// Models lists the served models
+func (s *ModelServer) Models() []ServedModel {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	models := make([]ServedModel, 0, len(s.models))
+	for _, m := range s.models {
+		models = append(models, ServedModel{ID: m.ID, Algo: m.Algo, LoadedAt: m.LoadedAt, LastUsed: m.LastUsed, InFlight: m.InFlight})
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].LoadedAt.Before(models[j].LoadedAt) })
+	return models
+}
+
+// Stop unloads all the served models
+func (s *ModelServer) Stop() {
+	s.lock.Lock()
+	models := s.models
+	s.models = make(map[string]*ServedModel)
+	s.lock.Unlock()
+	for _, m := range models {
+		<-m.ready
+		if m.err == nil {
+			s.unload(m, UnloadStopped)
+		}
+	}
+}
+
+// errTooManyModels is returned by get when a model can't be loaded without unloading a busy one
+var errTooManyModels = errors.New("too many models loaded")
+
+// get returns a served model, loading it if it isn't yet (concurrent requests wait for the same
+// load), after unloading the least recently used idle model if MaxModels are loaded
+func (s *ModelServer) get(model uuid.UUID) (*ServedModel, error) {
+	s.lock.Lock()
+	m, ok := s.models[model.String()]
+	var evicted *ServedModel
+	if !ok {
+		if s.conf.MaxModels > 0 && len(s.models) >= s.conf.MaxModels {
+			if evicted = s.leastRecentlyUsed(); evicted == nil {
+				s.lock.Unlock()
+				return nil, errTooManyModels
+			}
+			delete(s.models, evicted.ID.String())
+		}
+		folder := filepath.Join(s.worker.dataFolder, fmt.Sprintf("serve-%s", model))
+		socket := filepath.Join(folder, "serve", ServeSocket)
+		m = &ServedModel{
+			ID:     model,
+			folder: folder,
+			client: &http.Client{
+				Timeout: s.conf.RequestTimeout,
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						var dialer net.Dialer
+						return dialer.DialContext(ctx, "unix", socket)
+					},
+				},
+			},
+			slots:  make(chan struct{}, s.conf.Concurrency),
+			ready:  make(chan struct{}),
+			exited: make(chan struct{}),
+		}
+		s.models[model.String()] = m
+	}
+	m.LastUsed = time.Now()
+	s.lock.Unlock()
+
+	if !ok {
+		// The evicted container is gone before the new one starts
+		if evicted != nil {
+			s.unload(evicted, UnloadEvicted)
+		}
+		go s.load(m)
+	}
+	<-m.ready
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m, nil
+}
+
+// leastRecentlyUsed returns the loaded model serving no request that was used the least recently,
+// if any. It's called with the lock held.
+func (s *ModelServer) leastRecentlyUsed() *ServedModel {
+	var lru *ServedModel
+	for _, m := range s.models {
+		select {
+		case <-m.ready:
+		default:
+			continue // Still loading
+		}
+		if m.err == nil && m.InFlight == 0 && (lru == nil || m.LastUsed.Before(lru.LastUsed)) {
+			lru = m
+		}
+	}
+	return lru
+}
+
+// use updates the number of requests being served by a model
+func (s *ModelServer) use(m *ServedModel, delta int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	m.InFlight += delta
+	m.LastUsed = time.Now()
+}
+
+// load pulls a model and its algo, and starts the container serving it. Models that fail to load
+// are forgotten, so that the next request tries again.
+func (s *ModelServer) load(m *ServedModel) {
+	defer close(m.ready)
+	if m.err = s.start(m); m.err != nil {
+		log.Printf("[ERROR][serve] Error loading model %s: %s", m.ID, m.err)
+		s.lock.Lock()
+		delete(s.models, m.ID.String())
+		s.lock.Unlock()
+		s.cleanUp(m)
+		return
+	}
+	s.lock.Lock()
+	m.LoadedAt = time.Now()
+	servedModels.Set(float64(len(s.models)))
+	s.lock.Unlock()
+	log.Printf("[INFO][serve] Model %s (algo %s) loaded and healthy", m.ID, m.Algo)
+}
+
+func (s *ModelServer) start(m *ServedModel) error {
+	w := s.worker
+	modelFolder := filepath.Join(m.folder, w.modelFolder)
+	serveFolder := filepath.Join(m.folder, "serve")
+	for _, path := range []string{m.folder, modelFolder, serveFolder} {
+		if err := os.MkdirAll(path, os.ModeDir); err != nil {
+			return fmt.Errorf("Error creating folder under %s: %s", path, err)
+		}
+	}
+
+	modelInfo, err := w.storage.GetModel(m.ID)
+	if err != nil {
+		return fmt.Errorf("Error retrieving model %s metadata: %s", m.ID, err)
+	}
+	m.Algo = modelInfo.Algo
+	algo, err := w.storage.GetAlgoBlob(m.Algo)
+	if err != nil {
+		return fmt.Errorf("Error pulling algo %s from storage: %s", m.Algo, err)
+	}
+	m.image = fmt.Sprintf("%s-%s", w.algoImagePrefix, m.Algo)
+	err = w.ImageLoad(m.image, algo)
+	algo.Close()
+	if err != nil {
+		return fmt.Errorf("Error loading algo image %s in Docker daemon: %s", m.image, err)
+	}
+
+	model, err := w.storage.GetModelBlob(m.ID)
+	if err != nil {
+		return fmt.Errorf("Error pulling model %s from storage: %s", m.ID, err)
+	}
+	err = w.UntargzInFolder(modelFolder, &countingReader{model, TransferDownload, TransferModel})
+	model.Close()
+	if err != nil {
+		return fmt.Errorf("Error un-tar-gz-ing model: %s", err)
+	}
+
+	// The serving container runs until it's shut down
+	go func() {
+		defer close(m.exited)
+		_, err := w.containerRuntime.RunImageInUntrustedContainer(m.image, ServeArgs, map[string]string{
+			modelFolder: "/data/model",
+			serveFolder: "/data/serve",
+		}, true)
+		if err != nil {
+			log.Printf("[ERROR][serve] Container serving model %s exited: %s", m.ID, err)
+			return
+		}
+		log.Printf("[INFO][serve] Container serving model %s exited", m.ID)
+	}()
+
+	deadline := time.Now().Add(s.conf.StartTimeout)
+	for {
+		if err = m.health(); err == nil {
+			return nil
+		}
+		select {
+		case <-m.exited:
+			return fmt.Errorf("Container serving model %s exited before getting healthy (%s)", m.ID, err)
+		case <-time.After(500 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			s.shutdown(m)
+			return fmt.Errorf("Container serving model %s isn't healthy after %s: %s", m.ID, s.conf.StartTimeout, err)
+		}
+	}
+}
+
+// health checks the health of the container serving a model
+func (m *ServedModel) health() error {
+	resp, err := m.client.Get("http://serve/health")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+// checkModels periodically unloads the served models that are idle or unhealthy
+func (s *ModelServer) checkModels() {
+	for range time.Tick(s.conf.HealthInterval) {
+		s.lock.Lock()
+		var models []*ServedModel
+		for _, m := range s.models {
+			models = append(models, m)
+		}
+		s.lock.Unlock()
+
+		for _, m := range models {
+			select {
+			case <-m.ready:
+			default:
+				continue // Still loading
+			}
+			if m.err != nil {
+				continue
+			}
+
+			reason := ""
+			s.lock.Lock()
+			if m.InFlight == 0 && time.Since(m.LastUsed) > s.conf.IdleTimeout {
+				reason = UnloadIdle
+			}
+			s.lock.Unlock()
+			if reason == "" {
+				if err := m.health(); err != nil {
+					log.Printf("[WARNING][serve] Container serving model %s is unhealthy: %s", m.ID, err)
+					reason = UnloadUnhealthy
+				}
+			}
+			if reason == "" {
+				continue
+			}
+
+			s.lock.Lock()
+			if s.models[m.ID.String()] != m || (reason == UnloadIdle && m.InFlight > 0) {
+				s.lock.Unlock()
+				continue
+			}
+			delete(s.models, m.ID.String())
+			servedModels.Set(float64(len(s.models)))
+			s.lock.Unlock()
+			s.unload(m, reason)
+		}
+	}
+}
+
+// unload shuts the container serving a model down and unloads its image
+func (s *ModelServer) unload(m *ServedModel, reason string) {
+	log.Printf("[INFO][serve] Unloading model %s (%s)", m.ID, reason)
+	servingUnloads.WithLabelValues(reason).Inc()
+	s.shutdown(m)
+	s.cleanUp(m)
+}
+
+// shutdown asks the container serving a model to exit, and waits for it to
+func (s *ModelServer) shutdown(m *ServedModel) {
+	if resp, err := m.client.Post("http://serve/shutdown", "application/json", nil); err == nil {
+		resp.Body.Close()
+	}
+	select {
+	case <-m.exited:
+	case <-time.After(s.conf.StartTimeout):
+		log.Printf("[WARNING][serve] Container serving model %s didn't exit after %s", m.ID, s.conf.StartTimeout)
+	}
+}
+
+func (s *ModelServer) cleanUp(m *ServedModel) {
+	if m.image != "" {
+		s.worker.containerRuntime.ImageUnload(m.image)
+	}
+	os.RemoveAll(m.folder)
+}
+
+// NewServingTLSConfig returns the TLS configuration of the model server: it serves the certificate
+// of certFile and keyFile, and requires clients (the compute API) to present a certificate issued
+// by the CA bundle of clientCAFile, if set. It returns nil if certFile is blank.
+func NewServingTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading model server key pair: %s", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		caBundle, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading model server client CA bundle %s: %s", clientCAFile, err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("No certificate found in model server client CA bundle %s", clientCAFile)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// ServeModels serves the online prediction routes of a ModelServer over HTTP, or HTTPS if
+// tlsConfig isn't nil (see NewServingTLSConfig)
+func ServeModels(address string, tlsConfig *tls.Config, server *ModelServer) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ModelsRoute, func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(w, http.StatusOK, server.Models())
+	})
+	mux.HandleFunc(ModelsRoute+"/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, ModelsRoute+"/"), "/predict")
+		model, err := uuid.FromString(id)
+		if err != nil || !strings.HasSuffix(r.URL.Path, "/predict") {
+			respondJSON(w, http.StatusNotFound, common.NewAPIError(fmt.Sprintf("Unknown route %s", r.URL.Path)))
+			return
+		}
+		if r.Method != http.MethodPost {
+			respondJSON(w, http.StatusMethodNotAllowed, common.NewAPIError("Online predictions are POSTed"))
+			return
+		}
+		request, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, common.NewAPIError(fmt.Sprintf("Error reading request body: %s", err)))
+			return
+		}
+		status, response, err := server.Predict(model, request)
+		if err != nil {
+			log.Printf("[ERROR][serve] %s", err)
+			respondJSON(w, http.StatusBadGateway, common.NewAPIError(err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(response)
+	})
+
+	var err error
+	if tlsConfig != nil {
+		log.Printf("[INFO] Model server listening on %s (TLS, client certificates required: %t)", address, tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert)
+		httpServer := &http.Server{Addr: address, Handler: mux, TLSConfig: tlsConfig}
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("[INFO] Model server listening on %s", address)
+		err = http.ListenAndServe(address, mux)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Model server stopped: %s", err)
+	}
+}
+
+// respondJSON writes v as the JSON response of an HTTP request
+func respondJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
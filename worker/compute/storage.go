@@ -0,0 +1,136 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package compute
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/client"
+)
+
+// ModelChecker is implemented by the storages telling a model that isn't there from an error
+// reaching them
+type ModelChecker interface {
+	ModelExists(id uuid.UUID) (bool, error)
+}
+
+// ModelDeleter is implemented by the storages models can be deleted from
+type ModelDeleter interface {
+	DeleteModel(id uuid.UUID) error
+}
+
+// StorageAPI is the Storage API client of the worker: on top of client.StorageAPI, it checks
+// whether models exist and deletes them, through the model routes of the Storage API
+type StorageAPI struct {
+	*client.StorageAPI
+
+	client *http.Client
+}
+
+// NewStorageAPI creates a StorageAPI
+func NewStorageAPI(hostname string, port int, user, password string) *StorageAPI {
+	return &StorageAPI{
+		StorageAPI: &client.StorageAPI{
+			Hostname: hostname,
+			Port:     port,
+			User:     user,
+			Password: password,
+		},
+		client: &http.Client{Timeout: time.Minute},
+	}
+}
+
+// ModelExists checks whether a model is on storage
+func (s *StorageAPI) ModelExists(id uuid.UUID) (bool, error) {
+	resp, err := s.do(http.MethodGet, id)
+	if err != nil {
+		return false, fmt.Errorf("Error checking model %s on storage: %s", id, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		body, _ := ioutil.ReadAll(resp.Body)
+		return false, fmt.Errorf("Error checking model %s on storage: %s -- Body: %s", id, resp.Status, body)
+	}
+}
+
+// DeleteModel deletes a model from storage (models that aren't there are deleted already)
+func (s *StorageAPI) DeleteModel(id uuid.UUID) error {
+	resp, err := s.do(http.MethodDelete, id)
+	if err != nil {
+		return fmt.Errorf("Error deleting model %s from storage: %s", id, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Error deleting model %s from storage: %s -- Body: %s", id, resp.Status, body)
+	}
+	return nil
+}
+
+func (s *StorageAPI) do(method string, id uuid.UUID) (*http.Response, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s:%d/model/%s", s.Hostname, s.Port, id), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error building storage request: %s", err)
+	}
+	if s.User != "" {
+		req.SetBasicAuth(s.User, s.Password)
+	}
+	return s.client.Do(req)
+}
+
+// modelExists checks whether a model is on storage. Storages that can't tell a missing model from
+// an error (see ModelChecker) are asked for the model blob, any error being reported as such.
+func (w *Worker) modelExists(id uuid.UUID) (bool, error) {
+	if checker, ok := w.storage.(ModelChecker); ok {
+		return checker.ModelExists(id)
+	}
+	blob, err := w.storage.GetModelBlob(id)
+	if err != nil {
+		return false, err
+	}
+	blob.Close()
+	return true, nil
+}
@@ -36,28 +36,23 @@
 package main
 
 import (
+	"fmt"
 	"log"
-	"os"
-	"time"
-
-	"github.com/satori/go.uuid"
 
 	"github.com/MorpheoOrg/morpheo-go-packages/client"
 	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+	"github.com/MorpheoOrg/morpheo-compute/worker/compute"
 )
 
 func main() {
-	conf := NewConsumerConfig()
+	conf := compute.NewConsumerConfig()
 
 	// Let's connect with Storage (or use our mock if no storage host was provided)
 	var storageBackend client.Storage
 	// if conf.StorageHost != "" {
-	storageBackend = &client.StorageAPI{
-		Hostname: conf.StorageHost,
-		Port:     conf.StoragePort,
-		User:     conf.StorageUser,
-		Password: conf.StoragePassword,
-	}
+	storageBackend = compute.NewStorageAPI(conf.StorageHost, conf.StoragePort, conf.StorageUser, conf.StoragePassword)
 	// } else {
 	// 	storageBackend = client.NewStorageAPIMock()
 	// }
@@ -80,45 +75,69 @@ func main() {
 		log.Panicf("[FATAL ERROR] Impossible to connect to Docker container backend: %s", err)
 	}
 
-	worker := &Worker{
-		ID: uuid.NewV4(),
+	// Let's set our tracer up
+	exporter, err := tracing.NewExporter(conf.TraceExporter, conf.TraceFile, conf.TraceEndpoint)
+	if err != nil {
+		log.Panicf("Error creating trace exporter: %s", err)
+	}
+
+	worker := compute.NewWorker(
 		// Root folder for train/test/predict data (should shared with the container runtime)
-		dataFolder: "/data",
+		"/data",
 		// Subfolder names
-		trainFolder:          "train",
-		testFolder:           "test",
-		predFolder:           "pred",
-		perfFolder:           "perf",
-		untargetedTestFolder: "untargeted_test",
-		modelFolder:          "model",
+		"train", "test", "untargeted_test", "pred", "perf", "model",
 		// Container runtime image name prefixes
-		problemImagePrefix: "problem",
-		algoImagePrefix:    "algo",
+		"problem", "algo",
 		// Dependency injection is done here :)
-		containerRuntime: containerRuntime,
-		storage:          storageBackend,
-		peer:             peer,
+		containerRuntime, storageBackend, peer,
+	)
+	worker.SetTracer(tracing.NewTracer("compute-worker", exporter))
+	worker.SetJournalMaxAge(conf.JournalMaxAge)
+	worker.SetStartModelWait(conf.StartModelWait)
+	worker.SetCheckpointInterval(conf.CheckpointInterval)
+
+	// Let's expose our metrics
+	if conf.AdminPort != 0 {
+		go compute.ServeAdmin(fmt.Sprintf("%s:%d", conf.AdminHost, conf.AdminPort))
+	}
+
+	// Let's serve our models online
+	var models *compute.ModelServer
+	if conf.ServingPort != 0 {
+		tlsConfig, err := compute.NewServingTLSConfig(conf.ServingCertFile, conf.ServingKeyFile, conf.ServingClientCAFile)
+		if err != nil {
+			log.Panicln(err)
+		}
+		models = worker.NewModelServer(conf.Serving)
+		go compute.ServeModels(fmt.Sprintf("%s:%d", conf.ServingHost, conf.ServingPort), tlsConfig, models)
 	}
 
 	// Let's hook with our consumer
-	consumer := common.NewNSQConsumer(
-		conf.NsqlookupdURLs,
-		conf.NsqdURL,
-		"compute",
-		5*time.Second,
-		log.New(os.Stdout, "[NSQ]", log.LstdFlags),
-	)
+	consumer, addHandlers, err := compute.NewConsumer(conf)
+	if err != nil {
+		log.Panicln(err)
+	}
 
 	// Wire our message handlers
-	consumer.AddHandler(common.TrainTopic, worker.HandleLearn, conf.LearnParallelism, conf.LearnTimeout)
-	consumer.AddHandler(common.PredictTopic, worker.HandlePred, conf.PredictParallelism, conf.PredictTimeout)
+	worker.RegisterHandlers(addHandlers, conf)
 
-	if err != nil {
-		log.Panicln(err)
+	// Let's tell the worker registry of the API we're alive, and what we're running
+	if conf.RegistryURL != "" {
+		sendHeartbeat, err := compute.NewRegistryClient(conf.RegistryURL, conf.RegistryCertFile, conf.RegistryKeyFile, conf.RegistryCAFile)
+		if err != nil {
+			log.Panicf("Error creating worker registry client: %s", err)
+		}
+		go worker.SendHeartbeats(sendHeartbeat, conf.Heartbeat)
 	}
+
 	// Let's connect to the for real and start pulling tasks
 	consumer.ConsumeUntilKilled()
 
+	// Let's not leave serving containers behind
+	if models != nil {
+		models.Stop()
+	}
+
 	log.Println("[INFO] Consumer has been gracefully stopped... Bye bye!")
 	return
 }
@@ -0,0 +1,265 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+// Package workflow defines the manifests problem workflows declare their contract with: the
+// arguments each step of a task is ran with, where the worker's folders are mounted in its
+// container, and the files it's expected to write.
+//
+// Problem workflows ship their manifest as a workflow.json file at the root of their blob (the
+// build context of their image). Problems without manifest, and the steps a manifest doesn't
+// declare, follow the v1 contract (see V1), which was the only one before manifests.
+package workflow
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ManifestFile is the file problem workflows declare their manifest in, at the root of their blob
+const ManifestFile = "workflow.json"
+
+// Version1 is the only contract version supported so far
+const Version1 = 1
+
+// Steps of the tasks ran by the workers. Detarget and perf are ran in the problem workflow
+// container, train and predict in the algo container.
+const (
+	StepDetarget = "detarget"
+	StepTrain    = "train"
+	StepPredict  = "predict"
+	StepPerf     = "perf"
+)
+
+// Volumes are the worker folders steps mount. Algo steps never see targets: their test volume is
+// the un-targeted test data (or the data to predict on). The checkpoint volume is where the train
+// step may save its progress, for an interrupted training to resume from there.
+const (
+	VolumeTrain          = "train"
+	VolumeTest           = "test"
+	VolumeUntargetedTest = "untargeted_test"
+	VolumeModel          = "model"
+	VolumePred           = "pred"
+	VolumePerf           = "perf"
+	VolumeParams         = "params"
+	VolumeCheckpoint     = "checkpoint"
+)
+
+// stepVolumes are the volumes each step may mount
+var stepVolumes = map[string][]string{
+	StepDetarget: {VolumeTest, VolumeUntargetedTest},
+	StepTrain:    {VolumeTrain, VolumeTest, VolumeModel, VolumeParams, VolumeCheckpoint},
+	StepPredict:  {VolumeTest, VolumePred, VolumeModel},
+	StepPerf:     {VolumeTest, VolumePerf, VolumeTrain, VolumeUntargetedTest},
+}
+
+// Manifest is the contract of a problem workflow
+type Manifest struct {
+	Version int             `json:"version"`
+	Steps   map[string]Step `json:"steps"`
+}
+
+// Step describes how a step is ran: its container arguments, the path each volume is mounted at
+// in its container, and the files it must write, as glob patterns relative to a volume (e.g.
+// "perf/performance.json"), each matching at least one file
+type Step struct {
+	Args    []string          `json:"args"`
+	Mounts  map[string]string `json:"mounts"`
+	Outputs []string          `json:"outputs,omitempty"`
+}
+
+// V1 returns the manifest of the v1 contract
+func V1() *Manifest {
+	return &Manifest{
+		Version: Version1,
+		Steps: map[string]Step{
+			StepDetarget: {
+				Args: []string{"-T", "detarget", "-i", "/hidden_data", "-s", "/submission_data"},
+				Mounts: map[string]string{
+					VolumeTest:           "/hidden_data/test",
+					VolumeUntargetedTest: "/submission_data/test",
+				},
+			},
+			StepTrain: {
+				Args: []string{"-V", "/data", "-T", "train"},
+				Mounts: map[string]string{
+					VolumeTrain:      "/data/train",
+					VolumeTest:       "/data/test",
+					VolumeModel:      "/data/model",
+					VolumeParams:     "/data/params",
+					VolumeCheckpoint: "/data/checkpoint",
+				},
+			},
+			StepPredict: {
+				Args: []string{"-V", "/data", "-T", "predict"},
+				Mounts: map[string]string{
+					VolumeTest:  "/data/test",
+					VolumePred:  "/data/test/pred",
+					VolumeModel: "/data/model",
+				},
+			},
+			StepPerf: {
+				Args: []string{"-T", "perf", "-i", "/hidden_data", "-s", "/submission_data"},
+				Mounts: map[string]string{
+					VolumeTest:           "/hidden_data/test",
+					VolumePerf:           "/hidden_data/perf",
+					VolumeTrain:          "/submission_data/train",
+					VolumeUntargetedTest: "/submission_data/test",
+				},
+				Outputs: []string{"perf/performance.json"},
+			},
+		},
+	}
+}
+
+// Parse decodes and validates a manifest, the steps it doesn't declare following the v1 contract
+func Parse(data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("Error un-marshaling manifest: %s", err)
+	}
+	if err := m.Check(); err != nil {
+		return nil, err
+	}
+	for name, step := range V1().Steps {
+		if _, ok := m.Steps[name]; !ok {
+			if m.Steps == nil {
+				m.Steps = make(map[string]Step)
+			}
+			m.Steps[name] = step
+		}
+	}
+	return &m, nil
+}
+
+// Check validates a manifest
+func (m *Manifest) Check() error {
+	if m.Version != Version1 {
+		return fmt.Errorf("unsupported contract version %d (supported: %d)", m.Version, Version1)
+	}
+	for name, step := range m.Steps {
+		volumes, ok := stepVolumes[name]
+		if !ok {
+			return fmt.Errorf("unknown step %s", name)
+		}
+		if len(step.Args) == 0 {
+			return fmt.Errorf("step %s has no args", name)
+		}
+		for volume, mountPath := range step.Mounts {
+			if !contains(volumes, volume) {
+				return fmt.Errorf("step %s can't mount volume %s (allowed: %s)", name, volume, strings.Join(volumes, ", "))
+			}
+			if !path.IsAbs(mountPath) {
+				return fmt.Errorf("step %s mounts volume %s at %q, which isn't an absolute path", name, volume, mountPath)
+			}
+		}
+		for _, output := range step.Outputs {
+			volume, pattern := SplitOutput(output)
+			if _, ok := step.Mounts[volume]; !ok || pattern == "" {
+				return fmt.Errorf("step %s output %q isn't a path in one of its mounted volumes", name, output)
+			}
+			if _, err := filepath.Match(pattern, ""); err != nil || strings.Contains(pattern, "..") {
+				return fmt.Errorf("step %s output %q isn't a valid pattern", name, output)
+			}
+		}
+	}
+	return nil
+}
+
+// Step returns the definition of a step
+func (m *Manifest) Step(name string) (Step, error) {
+	step, ok := m.Steps[name]
+	if !ok {
+		return Step{}, fmt.Errorf("step %s isn't defined by the contract v%d manifest", name, m.Version)
+	}
+	return step, nil
+}
+
+// SplitOutput splits an expected output into its volume and its pattern in the volume
+func SplitOutput(output string) (volume, pattern string) {
+	parts := strings.SplitN(output, "/", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// Read reads the manifest of a problem workflow from its tar-gzipped blob, returning the v1
+// manifest if it has none. Reading stops as soon as the manifest is found.
+func Read(blob io.Reader) (*Manifest, error) {
+	gzipReader, err := gzip.NewReader(blob)
+	if err != nil {
+		return nil, fmt.Errorf("Error un-gzipping problem workflow: %s", err)
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return V1(), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading problem workflow archive: %s", err)
+		}
+		if path.Clean(strings.TrimPrefix(header.Name, "./")) != ManifestFile {
+			continue
+		}
+		data, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", ManifestFile, err)
+		}
+		manifest, err := Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", ManifestFile, err)
+		}
+		return manifest, nil
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
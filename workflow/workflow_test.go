@@ -0,0 +1,103 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package workflow
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blob tar-gzips files like a problem workflow blob
+func blob(files map[string]string) *bytes.Buffer {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for name, content := range files {
+		tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})
+		tarWriter.Write([]byte(content))
+	}
+	tarWriter.Close()
+	gzipWriter.Close()
+	return &buf
+}
+
+func TestV1(t *testing.T) {
+	assert.Nil(t, V1().Check())
+}
+
+func TestParse(t *testing.T) {
+	m, err := Parse([]byte(`{"version": 1, "steps": {"train": {"args": ["train", "--data", "/in"], "mounts": {"train": "/in/train", "model": "/out"}, "outputs": ["model/*.bin"]}}}`))
+	assert.Nil(t, err)
+	train, err := m.Step(StepTrain)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"train", "--data", "/in"}, train.Args)
+	assert.Equal(t, "/out", train.Mounts[VolumeModel])
+	// Other steps follow the v1 contract
+	perf, err := m.Step(StepPerf)
+	assert.Nil(t, err)
+	assert.Equal(t, V1().Steps[StepPerf], perf)
+
+	for _, manifest := range []string{
+		`{"steps": {}}`,
+		`{"version": 2}`,
+		`{"version": 1, "steps": {"deploy": {"args": ["deploy"]}}}`,
+		`{"version": 1, "steps": {"train": {"args": []}}}`,
+		`{"version": 1, "steps": {"train": {"args": ["train"], "mounts": {"perf": "/perf"}}}}`,
+		`{"version": 1, "steps": {"train": {"args": ["train"], "mounts": {"model": "model"}}}}`,
+		`{"version": 1, "steps": {"train": {"args": ["train"], "mounts": {"model": "/model"}, "outputs": ["train/x"]}}}`,
+		`{"version": 1, "steps": {"train": {"args": ["train"], "mounts": {"model": "/model"}, "outputs": ["model/../x"]}}}`,
+	} {
+		_, err := Parse([]byte(manifest))
+		assert.NotNil(t, err, manifest)
+	}
+}
+
+func TestRead(t *testing.T) {
+	m, err := Read(blob(map[string]string{"Dockerfile": "FROM scratch"}))
+	assert.Nil(t, err)
+	assert.Equal(t, V1(), m)
+
+	m, err = Read(blob(map[string]string{"./workflow.json": `{"version": 1, "steps": {"detarget": {"args": ["detarget"]}}}`}))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"detarget"}, m.Steps[StepDetarget].Args)
+
+	_, err = Read(blob(map[string]string{"workflow.json": `{"version": 3}`}))
+	assert.NotNil(t, err)
+}